@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/gin-gonic/gin"
+)
+
+// bulkConcurrency bounds the Docker calls made by a bulk action
+const bulkConcurrency = 8
+
+// actionRequest is the body accepted by the stop/start/restart/delete
+// endpoints. Exactly one way of selecting containers must be used.
+type actionRequest struct {
+	ContainerID  string   `json:"container_id"`
+	ContainerIDs []string `json:"container_ids"`
+	Label        string   `json:"label"`
+
+	// TimeoutSeconds is how long stop and restart wait before killing;
+	// nil uses the container's own stop timeout, -1 waits indefinitely
+	TimeoutSeconds *int `json:"timeout_seconds"`
+	// Force removes running containers; nil keeps the historical default
+	// of forcing
+	Force         *bool `json:"force"`
+	RemoveVolumes bool  `json:"remove_volumes"`
+	// Quarantine makes delete stop and rename containers for later
+	// removal instead; nil follows CONTAINERSCOPE_QUARANTINE
+	Quarantine *bool `json:"quarantine"`
+}
+
+// stopOptions returns the options for ContainerStop and ContainerRestart
+func (req actionRequest) stopOptions() container.StopOptions {
+	return container.StopOptions{Timeout: req.TimeoutSeconds}
+}
+
+// removeOptions returns the options for ContainerRemove
+func (req actionRequest) removeOptions() container.RemoveOptions {
+	force := req.Force == nil || *req.Force
+	return container.RemoveOptions{Force: force, RemoveVolumes: req.RemoveVolumes}
+}
+
+// actionResult reports the outcome of an action on one container
+type actionResult struct {
+	ContainerID string `json:"container_id"`
+	Success     bool   `json:"success"`
+	Warning     string `json:"warning,omitempty"`
+	Error       string `json:"error,omitempty"`
+	Code        string `json:"code,omitempty"`
+}
+
+// actionWarning is returned by an action that had nothing to do, such as
+// starting a running container. It is reported as a success with a warning.
+type actionWarning string
+
+func (w actionWarning) Error() string { return string(w) }
+
+// containerActionFunc performs an action on a single container
+type containerActionFunc func(ctx context.Context, containerID string, req actionRequest) error
+
+// resolveTargets returns the container IDs a bulk request selects
+func resolveTargets(ctx context.Context, req actionRequest) ([]string, error) {
+	if req.Label == "" {
+		return req.ContainerIDs, nil
+	}
+	if runtimeName == runtimeContainerd {
+		return containerdLabelTargets(ctx, req.Label)
+	}
+	list, err := docker(ctx).ContainerList(ctx, container.ListOptions{
+		All:     true,
+		Filters: scopeFilters(ctx, filters.NewArgs(filters.Arg("label", req.Label))),
+	})
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(list))
+	for _, cont := range list {
+		if inQuarantine(cont) {
+			continue
+		}
+		ids = append(ids, cont.ID)
+	}
+	return ids, nil
+}
+
+// containerRunning reports whether a container is running; callers fall
+// back to the real action on error so it reports the failure
+func containerRunning(ctx context.Context, containerID string) (bool, error) {
+	inspection, err := docker(ctx).ContainerInspect(ctx, containerID)
+	if err != nil {
+		return false, err
+	}
+	return inspection.State.Running, nil
+}
+
+// runBulk applies action to every target concurrently, preserving order
+func runBulk(ctx context.Context, targets []string, req actionRequest, action containerActionFunc) []actionResult {
+	results := make([]actionResult, len(targets))
+	sem := make(chan struct{}, bulkConcurrency)
+	var wg sync.WaitGroup
+	for i, id := range targets {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, id string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			results[i] = actionResult{ContainerID: id, Success: true}
+			err := checkScope(ctx, id)
+			if err == nil {
+				err = action(ctx, id, req)
+			}
+			var warning actionWarning
+			if errors.As(err, &warning) {
+				results[i].Warning = string(warning)
+			} else if err != nil {
+				_, code := dockerStatus(err, codeContainerNotFound)
+				results[i] = actionResult{ContainerID: id, Error: err.Error(), Code: code}
+			}
+		}(i, id)
+	}
+	wg.Wait()
+	return results
+}
+
+// runContainerAction binds an actionRequest and applies action to the
+// selected containers. A single container_id keeps the original response
+// shape; container_ids or label return per-container results.
+func runContainerAction(c *gin.Context, done, errMsg string, action containerActionFunc) {
+	var req actionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		badRequest(c, "Invalid request")
+		return
+	}
+
+	selectors := 0
+	for _, set := range []bool{req.ContainerID != "", len(req.ContainerIDs) > 0, req.Label != ""} {
+		if set {
+			selectors++
+		}
+	}
+	if selectors != 1 {
+		badRequest(c, "Specify exactly one of container_id, container_ids or label")
+		return
+	}
+	if req.TimeoutSeconds != nil && *req.TimeoutSeconds < -1 {
+		badRequest(c, "timeout_seconds must be -1 or greater")
+		return
+	}
+
+	for _, ref := range req.ContainerIDs {
+		if err := checkContainerRef(ref); err != nil {
+			badRequest(c, err.Error())
+			return
+		}
+	}
+
+	ctx := hostContext(c)
+	if req.ContainerID != "" {
+		containerID := req.ContainerID
+		if runtimeName != runtimeContainerd {
+			cont, err := resolveContainer(ctx, containerID)
+			if err != nil {
+				dockerError(c, errMsg, err)
+				return
+			}
+			containerID = cont.ID
+		}
+		var warning actionWarning
+		if err := action(ctx, containerID, req); errors.As(err, &warning) {
+			respond(c, http.StatusOK, gin.H{"message": fmt.Sprintf("Container %s successfully", done), "warning": string(warning)})
+			return
+		} else if err != nil {
+			dockerError(c, errMsg, err)
+			return
+		}
+		respondMessage(c, fmt.Sprintf("Container %s successfully", done))
+		return
+	}
+
+	if runtimeName == runtimeContainerd {
+		ctx = withContainerdNamespace(ctx, c)
+	}
+	targets, err := resolveTargets(ctx, req)
+	if err != nil {
+		dockerError(c, "Error listing containers", err)
+		return
+	}
+
+	results := runBulk(ctx, targets, req, action)
+	failed := 0
+	for _, result := range results {
+		if !result.Success {
+			failed++
+		}
+	}
+	respond(c, http.StatusOK, gin.H{
+		"results":   results,
+		"succeeded": len(results) - failed,
+		"failed":    failed,
+	})
+}
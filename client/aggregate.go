@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/gin-gonic/gin"
+)
+
+// errLogLimit stops merging once the byte limit is reached
+var errLogLimit = errors.New("log byte limit reached")
+
+// aggregateDefaultLines is how much history each container contributes
+// when the request does not say
+const aggregateDefaultLines = "100"
+
+// logEntry is one line of a container's output with the time Docker
+// recorded for it
+type logEntry struct {
+	name string
+	time time.Time
+	line string
+}
+
+// parseLogEntry splits a line read with timestamps into its time and
+// text. A line without a timestamp is kept whole with the zero time.
+func parseLogEntry(name, raw string) logEntry {
+	ts, line, _ := strings.Cut(raw, " ")
+	t, err := time.Parse(time.RFC3339Nano, ts)
+	if err != nil {
+		return logEntry{name: name, line: raw}
+	}
+	return logEntry{name: name, time: t, line: line}
+}
+
+// logSource is one container's output being merged
+type logSource struct {
+	name    string
+	out     io.ReadCloser
+	scanner *bufio.Scanner
+	next    logEntry
+	done    bool
+}
+
+// advance reads the source's next line
+func (s *logSource) advance() {
+	if s.done = !s.scanner.Scan(); !s.done {
+		s.next = parseLogEntry(s.name, s.scanner.Text())
+	}
+}
+
+// openLogSources opens the logs of every container with options, which
+// must ask for timestamps. Containers whose logs cannot be read are left
+// out.
+func openLogSources(ctx context.Context, names map[string]string, options container.LogsOptions) []*logSource {
+	var sources []*logSource
+	for id, name := range names {
+		out, err := openLogs(ctx, id, options)
+		if err != nil {
+			logger.Debug("opening logs to aggregate", "container", name, "error", err)
+			continue
+		}
+		scanner := bufio.NewScanner(out)
+		scanner.Buffer(make([]byte, 64*1024), maxLogLine)
+		sources = append(sources, &logSource{name: name, out: out, scanner: scanner})
+	}
+	return sources
+}
+
+// mergeLogs calls fn with the lines of all sources in time order. Each
+// source is already in order, so only the next line of each is held.
+func mergeLogs(sources []*logSource, fn func(logEntry) error) error {
+	for _, s := range sources {
+		s.advance()
+	}
+	for {
+		var first *logSource
+		for _, s := range sources {
+			if !s.done && (first == nil || s.next.time.Before(first.next.time)) {
+				first = s
+			}
+		}
+		if first == nil {
+			return nil
+		}
+		if err := fn(first.next); err != nil {
+			return err
+		}
+		first.advance()
+	}
+}
+
+// fanInLogs calls fn with the lines of all sources as they arrive, until
+// every source ends or ctx is done
+func fanInLogs(ctx context.Context, sources []*logSource, fn func(logEntry) error) error {
+	lines := make(chan logEntry)
+	var wg sync.WaitGroup
+	for _, s := range sources {
+		wg.Add(1)
+		go func(s *logSource) {
+			defer wg.Done()
+			for s.advance(); !s.done; s.advance() {
+				select {
+				case lines <- s.next:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}(s)
+	}
+	go func() {
+		wg.Wait()
+		close(lines)
+	}()
+	for {
+		select {
+		case entry, ok := <-lines:
+			if !ok {
+				return nil
+			}
+			if err := fn(entry); err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// closeLogSources closes every source's log stream
+func closeLogSources(sources []*logSource) {
+	for _, s := range sources {
+		s.out.Close()
+	}
+}
+
+// aggregateLogs merges the logs of the containers matching the list
+// filters, or a compose project, into one plain text stream interleaved
+// by time, each line prefixed with its container's name. With
+// follow=true the merged history is followed by new lines as they are
+// written.
+func aggregateLogs(c *gin.Context) {
+	ctx := hostContext(c)
+	args, err := containerFilters(c)
+	if err != nil {
+		badRequest(c, err.Error())
+		return
+	}
+	if project := c.Query("project"); project != "" {
+		args.Add("label", composeProjectLabel+"="+project)
+	}
+	if args.Len() == 0 {
+		badRequest(c, "Select containers with label, project, name, image or status")
+		return
+	}
+	q, err := parseLogQuery(c)
+	if err != nil {
+		badRequest(c, err.Error())
+		return
+	}
+	options := q.options
+	if c.Query("lines") == "" && options.Since == "" {
+		options.Tail = aggregateDefaultLines
+	}
+	showTimestamps := options.Timestamps
+	options.Timestamps = true
+
+	list, err := docker(ctx).ContainerList(ctx, container.ListOptions{All: true, Filters: args})
+	if err != nil {
+		dockerError(c, "Error listing containers", err)
+		return
+	}
+	if len(list) == 0 {
+		respondError(c, http.StatusNotFound, codeContainerNotFound, "No containers match the filters")
+		return
+	}
+	names := make(map[string]string, len(list))
+	width := 0
+	for _, cont := range list {
+		name := cont.ID[:10]
+		if len(cont.Names) > 0 {
+			name = strings.TrimPrefix(cont.Names[0], "/")
+		}
+		names[cont.ID] = name
+		if len(name) > width {
+			width = len(name)
+		}
+	}
+
+	// History is merged by time up to now; following then picks up from
+	// the same instant so no line appears twice
+	start := time.Now()
+	now := fmt.Sprintf("%d.%09d", start.Unix(), start.Nanosecond())
+	history := options
+	if options.Follow {
+		history.Follow, history.Until = false, now
+	}
+	sources := openLogSources(ctx, names, history)
+	defer closeLogSources(sources)
+
+	c.Header("Content-Type", "text/plain; charset=utf-8")
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Status(http.StatusOK)
+	w := bufio.NewWriter(c.Writer)
+	defer w.Flush()
+
+	var written int64
+	write := func(entry logEntry) error {
+		if q.grep != nil && !q.grep.MatchString(stripANSI(entry.line)) {
+			return nil
+		}
+		line := q.render(entry.line)
+		if showTimestamps {
+			line = entry.time.Format(time.RFC3339Nano) + " " + line
+		}
+		out := fmt.Sprintf("%-*s | %s\n", width, entry.name, line)
+		if written += int64(len(out)); written > q.limit {
+			w.WriteString(truncatedNotice(q.limit))
+			return errLogLimit
+		}
+		_, err := w.WriteString(out)
+		return err
+	}
+
+	err = mergeLogs(sources, write)
+	if err == nil && options.Follow {
+		live := options
+		live.Since, live.Tail = now, "all"
+		followed := openLogSources(ctx, names, live)
+		defer closeLogSources(followed)
+		if err = w.Flush(); err == nil {
+			c.Writer.Flush()
+			err = fanInLogs(ctx, followed, func(entry logEntry) error {
+				if err := write(entry); err != nil {
+					return err
+				}
+				if err := w.Flush(); err != nil {
+					return err
+				}
+				c.Writer.Flush()
+				return nil
+			})
+		}
+	}
+	if err != nil && !errors.Is(err, errLogLimit) {
+		c.Error(err)
+	}
+}
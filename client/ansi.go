@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ansiSequence matches terminal escape sequences: CSI sequences such as
+// colours and cursor movement, OSC sequences such as window titles, and
+// two-character escapes
+var ansiSequence = regexp.MustCompile(`\x1b(?:\[[0-?]*[ -/]*[@-~]|\][^\x07\x1b]*(?:\x07|\x1b\\)|[@-Z\\-_])`)
+
+// stripANSI removes escape sequences from s
+func stripANSI(s string) string {
+	if !strings.Contains(s, "\x1b") {
+		return s
+	}
+	return ansiSequence.ReplaceAllString(s, "")
+}
+
+// ansiColors names the eight standard terminal colours in SGR order
+var ansiColors = [8]string{"black", "red", "green", "yellow", "blue", "magenta", "cyan", "white"}
+
+// ansiPaletteColor names a 256-colour palette entry; only the first 16,
+// which terminals show as the standard and bright colours, have classes
+func ansiPaletteColor(n int) string {
+	switch {
+	case n >= 0 && n < 8:
+		return ansiColors[n]
+	case n >= 8 && n < 16:
+		return "bright-" + ansiColors[n-8]
+	}
+	return ""
+}
+
+// ansiStyle is the text style set by the SGR sequences seen so far
+type ansiStyle struct {
+	fg, bg                  string
+	bold, italic, underline bool
+}
+
+// classes returns the CSS classes for the style, such as
+// "ansi-bold ansi-fg-red", or "" for plain text
+func (s ansiStyle) classes() string {
+	var classes []string
+	for _, flag := range []struct {
+		on   bool
+		name string
+	}{{s.bold, "ansi-bold"}, {s.italic, "ansi-italic"}, {s.underline, "ansi-underline"}} {
+		if flag.on {
+			classes = append(classes, flag.name)
+		}
+	}
+	if s.fg != "" {
+		classes = append(classes, "ansi-fg-"+s.fg)
+	}
+	if s.bg != "" {
+		classes = append(classes, "ansi-bg-"+s.bg)
+	}
+	return strings.Join(classes, " ")
+}
+
+// apply updates the style with the parameters of one SGR sequence, the
+// part between "\x1b[" and "m"
+func (s *ansiStyle) apply(params string) {
+	codes := strings.Split(params, ";")
+	for i := 0; i < len(codes); i++ {
+		// An empty parameter, as in "\x1b[m", means 0
+		n, _ := strconv.Atoi(codes[i])
+		switch {
+		case n == 0:
+			*s = ansiStyle{}
+		case n == 1:
+			s.bold = true
+		case n == 3:
+			s.italic = true
+		case n == 4:
+			s.underline = true
+		case n == 22:
+			s.bold = false
+		case n == 23:
+			s.italic = false
+		case n == 24:
+			s.underline = false
+		case n >= 30 && n <= 37:
+			s.fg = ansiColors[n-30]
+		case n == 39:
+			s.fg = ""
+		case n >= 40 && n <= 47:
+			s.bg = ansiColors[n-40]
+		case n == 49:
+			s.bg = ""
+		case n >= 90 && n <= 97:
+			s.fg = "bright-" + ansiColors[n-90]
+		case n >= 100 && n <= 107:
+			s.bg = "bright-" + ansiColors[n-100]
+		case n == 38 || n == 48:
+			// 38;5;n picks from the 256-colour palette and 38;2;r;g;b is
+			// a true colour, which has no class
+			color := ""
+			if i+2 < len(codes) && codes[i+1] == "5" {
+				p, _ := strconv.Atoi(codes[i+2])
+				color = ansiPaletteColor(p)
+				i += 2
+			} else if i+4 < len(codes) && codes[i+1] == "2" {
+				i += 4
+			}
+			if n == 38 {
+				s.fg = color
+			} else {
+				s.bg = color
+			}
+		}
+	}
+}
+
+// ansiToHTML escapes s for HTML and turns its colour and text style
+// sequences into spans with ansi-* classes. Other escape sequences are
+// dropped. Each line is converted on its own, starting unstyled.
+func ansiToHTML(s string) string {
+	if !strings.Contains(s, "\x1b") {
+		return html.EscapeString(s)
+	}
+	var b strings.Builder
+	var style ansiStyle
+	open := false
+	last := 0
+	for _, m := range ansiSequence.FindAllStringIndex(s, -1) {
+		b.WriteString(html.EscapeString(s[last:m[0]]))
+		last = m[1]
+		seq := s[m[0]:m[1]]
+		if !strings.HasPrefix(seq, "\x1b[") || !strings.HasSuffix(seq, "m") {
+			continue
+		}
+		style.apply(seq[2 : len(seq)-1])
+		if open {
+			b.WriteString("</span>")
+			open = false
+		}
+		if classes := style.classes(); classes != "" {
+			fmt.Fprintf(&b, `<span class="%s">`, classes)
+			open = true
+		}
+	}
+	b.WriteString(html.EscapeString(s[last:]))
+	if open {
+		b.WriteString("</span>")
+	}
+	return b.String()
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// adminToken unlocks the administrative endpoints under /debug; they are
+// disabled when it is unset
+var adminToken = os.Getenv("CONTAINERSCOPE_ADMIN_TOKEN")
+
+// bearerToken returns the token from the Authorization header, or ""
+func bearerToken(c *gin.Context) string {
+	scheme, token, ok := strings.Cut(c.GetHeader("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+// tokenMatches compares tokens in constant time
+func tokenMatches(got, want string) bool {
+	return subtle.ConstantTimeCompare([]byte(got), []byte(want)) == 1
+}
+
+// requireAdmin rejects requests that do not carry the admin token or
+// come from a signed-in user with the admin role
+func requireAdmin() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if p, found, _ := identify(c); found && p.Role == roleAdmin {
+			c.Next()
+			return
+		}
+		if adminToken == "" {
+			respondError(c, http.StatusForbidden, codeForbidden, "Set CONTAINERSCOPE_ADMIN_TOKEN to enable admin endpoints")
+			return
+		}
+		token := bearerToken(c)
+		if token == "" {
+			c.Header("WWW-Authenticate", `Bearer realm="containerscope"`)
+			respondError(c, http.StatusUnauthorized, codeUnauthorized, "Admin token required")
+			return
+		}
+		if !tokenMatches(token, adminToken) {
+			respondError(c, http.StatusForbidden, codeForbidden, "Invalid admin token")
+			return
+		}
+		c.Next()
+	}
+}
+
+// Roles, from least to most privileged: viewers may only read, operators
+// may use the whole API, and admins may also use /debug and packet capture
+const (
+	roleViewer   = "viewer"
+	roleOperator = "operator"
+	roleAdmin    = "admin"
+)
+
+// roleRank orders the roles so the most privileged of several wins
+var roleRank = map[string]int{roleViewer: 1, roleOperator: 2, roleAdmin: 3}
+
+// principal is who a request comes from: a token, or a user signed in
+// through an identity provider
+type principal struct {
+	Name     string   `json:"name"`
+	Role     string   `json:"role"`
+	Provider string   `json:"provider"`
+	Labels   []string `json:"labels,omitempty"`
+}
+
+// principalKey is the context key holding the request's principal
+type principalKey struct{}
+
+// apiToken is a token from CONTAINERSCOPE_TOKENS_FILE. Labels, as key or
+// key=value selectors that must all match, limit it to the containers
+// carrying them; a token without labels may use the whole API. Role
+// defaults to operator.
+type apiToken struct {
+	Name   string   `json:"name"`
+	Token  string   `json:"token"`
+	Role   string   `json:"role"`
+	Labels []string `json:"labels"`
+}
+
+// apiTokens are the tokens accepted on /api/v1
+var apiTokens []apiToken
+
+// loadTokens reads the JSON array of tokens in CONTAINERSCOPE_TOKENS_FILE
+func loadTokens() error {
+	path := os.Getenv("CONTAINERSCOPE_TOKENS_FILE")
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &apiTokens); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	for i := range apiTokens {
+		token := &apiTokens[i]
+		if token.Name == "" || token.Token == "" {
+			return fmt.Errorf("%s: token %d needs a name and a token", path, i+1)
+		}
+		if token.Role == "" {
+			token.Role = roleOperator
+		}
+		if roleRank[token.Role] == 0 {
+			return fmt.Errorf("%s: token %s: unknown role %q, expected viewer, operator or admin", path, token.Name, token.Role)
+		}
+		for _, label := range token.Labels {
+			if label == "" || strings.HasPrefix(label, "=") {
+				return fmt.Errorf("%s: token %s: invalid label %q, expected key or key=value", path, token.Name, label)
+			}
+		}
+	}
+	logger.Info("API tokens loaded", "tokens", len(apiTokens))
+	return nil
+}
+
+// findToken returns the configured token matching got. Every token is
+// compared so the time taken does not reveal which one matched.
+func findToken(got string) (apiToken, bool) {
+	var found apiToken
+	ok := false
+	for _, token := range apiTokens {
+		if tokenMatches(got, token.Token) {
+			found, ok = token, true
+		}
+	}
+	return found, ok
+}
+
+// parseRoleMap reads the environment variable name as semicolon separated
+// group=role pairs. A group may itself contain = and commas, as LDAP DNs
+// do, so the role follows the last =.
+func parseRoleMap(name string) (map[string]string, error) {
+	roles := map[string]string{}
+	for _, entry := range strings.Split(os.Getenv(name), ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		i := strings.LastIndex(entry, "=")
+		if i <= 0 || roleRank[entry[i+1:]] == 0 {
+			return nil, fmt.Errorf("%s: expected group=viewer, operator or admin, got %q", name, entry)
+		}
+		roles[entry[:i]] = entry[i+1:]
+	}
+	return roles, nil
+}
+
+// mapRole returns the most privileged role any of groups maps to, or def
+// when none do
+func mapRole(roles map[string]string, groups []string, def string) string {
+	role := def
+	for _, group := range groups {
+		if mapped, ok := roles[group]; ok && roleRank[mapped] > roleRank[role] {
+			role = mapped
+		}
+	}
+	return role
+}
+
+// authRequired reports whether /api/v1 needs credentials: once tokens,
+// an identity provider or a directory are configured. Otherwise the API is
+// open, as it was before any of them existed.
+func authRequired() bool {
+	return len(apiTokens) > 0 || oidcEnabled() || ldapEnabled()
+}
+
+// identify finds the principal behind the request's bearer token or
+// session cookie. found is false when neither was sent, and valid false
+// when what was sent is not recognised.
+func identify(c *gin.Context) (p principal, found, valid bool) {
+	got := bearerToken(c)
+	if got == "" {
+		got, _ = c.Cookie(sessionCookie)
+	}
+	if got == "" {
+		return p, false, false
+	}
+	if adminToken != "" && tokenMatches(got, adminToken) {
+		return principal{Name: "admin", Role: roleAdmin, Provider: "admin-token"}, true, true
+	}
+	if token, ok := findToken(got); ok {
+		return principal{Name: token.Name, Role: token.Role, Provider: "token", Labels: token.Labels}, true, true
+	}
+	if session, ok := lookupSession(got); ok {
+		return session.principal(), true, true
+	}
+	return p, true, false
+}
+
+// readOnlyPosts are POST endpoints that only read, taking a body because
+// their input does not fit in a query string
+var readOnlyPosts = map[string]bool{
+	"POST /api/v1/containers/inspect": true,
+}
+
+// readOnlyRequest reports whether a request cannot change state
+func readOnlyRequest(c *gin.Context) bool {
+	switch c.Request.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	return readOnlyPosts[c.Request.Method+" "+c.FullPath()]
+}
+
+// roleAllows reports whether role may make a request, given whether it is
+// read-only
+func roleAllows(role string, readOnly bool) bool {
+	return roleRank[role] >= roleRank[roleOperator] || readOnly
+}
+
+// authenticate requires a token from CONTAINERSCOPE_TOKENS_FILE, the admin
+// token or a session from signing in, once any of them are configured.
+// Viewers may only read. A label-scoped principal is confined to the
+// container endpoints, and carries its scope in the request context so
+// lists and actions only reach matching containers.
+func authenticate() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !authRequired() {
+			c.Next()
+			return
+		}
+		p, found, valid := identify(c)
+		if !found {
+			c.Header("WWW-Authenticate", `Bearer realm="containerscope"`)
+			respondError(c, http.StatusUnauthorized, codeUnauthorized, "API token or sign-in required")
+			return
+		}
+		if !valid {
+			respondError(c, http.StatusForbidden, codeForbidden, "Invalid API token or expired session")
+			return
+		}
+		if !roleAllows(p.Role, readOnlyRequest(c)) {
+			respondError(c, http.StatusForbidden, codeForbidden, fmt.Sprintf("%s has the %s role, which may only read", p.Name, p.Role))
+			return
+		}
+		ctx := context.WithValue(c.Request.Context(), principalKey{}, p)
+		if len(p.Labels) > 0 {
+			if runtimeName != runtimeDocker || !scopedRoute(c.Request.Method+" "+c.FullPath()) {
+				respondError(c, http.StatusForbidden, codeForbidden, fmt.Sprintf("%s is limited to containers labelled %s", p.Name, strings.Join(p.Labels, ",")))
+				return
+			}
+			ctx = context.WithValue(ctx, tokenScopeKey{}, p.Labels)
+		}
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+	}
+}
+
+// whoami describes the caller, or an anonymous operator when the API is
+// open
+func whoami(c *gin.Context) {
+	p, ok := c.Request.Context().Value(principalKey{}).(principal)
+	if !ok {
+		p = principal{Name: "anonymous", Role: roleOperator, Provider: "none"}
+	}
+	respond(c, http.StatusOK, p)
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/gin-gonic/gin"
+)
+
+// autohealLabel opts a container into being restarted when unhealthy
+const autohealLabel = "containerscope.autoheal"
+
+// autohealPolicyBucket holds API-configured autoheal policies
+const autohealPolicyBucket = "autoheal_policies"
+
+// A container is restarted at once the first time it turns unhealthy and
+// after autohealBackoff, doubling, on later attempts. Once it has been
+// restarted autohealMaxRestarts times within autohealWindow the agent gives
+// up until it turns healthy again.
+var (
+	autohealBackoff     = envDuration("CONTAINERSCOPE_AUTOHEAL_BACKOFF", 10*time.Second)
+	autohealMaxRestarts = int(envInt("CONTAINERSCOPE_AUTOHEAL_MAX_RESTARTS", 5))
+	autohealWindow      = envDuration("CONTAINERSCOPE_AUTOHEAL_WINDOW", time.Hour)
+)
+
+// maxHealActions is how many recent actions GET /autoheal returns
+const maxHealActions = 100
+
+// Autoheal action results
+const (
+	healRestarted = "restarted"
+	healFailed    = "failed"
+	healGaveUp    = "gave_up"
+)
+
+// healAction records one thing autoheal did to a container
+type healAction struct {
+	Time        time.Time `json:"time"`
+	Host        string    `json:"host"`
+	ContainerID string    `json:"container_id"`
+	Container   string    `json:"container"`
+	Result      string    `json:"result"`
+	Attempt     int       `json:"attempt"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// healState tracks a container's recent restarts, keyed by host and ID
+type healState struct {
+	restarts []time.Time
+	healing  bool
+	gaveUp   bool
+}
+
+// autoheal is the state shared by every host's autoheal loop
+var autoheal struct {
+	sync.Mutex
+	states  map[string]*healState
+	actions []healAction
+}
+
+// startAutoheal restarts opted-in containers that turn unhealthy, on every
+// host, until ctx is done
+func startAutoheal(ctx context.Context) {
+	autoheal.Lock()
+	autoheal.states = map[string]*healState{}
+	autoheal.Unlock()
+	for name, host := range dockerHosts {
+		go watchHealth(ctx, host, eventBuses[name])
+	}
+}
+
+// watchHealth follows one host's health events. After a resync, containers
+// that are already unhealthy are healed too.
+func watchHealth(ctx context.Context, host *dockerHost, bus *eventBus) {
+	evs := bus.subscribeUntil(ctx)
+	for ev := range evs {
+		if ev.Resync {
+			go healUnhealthy(ctx, host)
+			continue
+		}
+		if ev.Type != events.ContainerEventType {
+			continue
+		}
+		key := host.Name + "/" + ev.Actor.ID
+		if ev.Action == events.ActionDestroy {
+			autoheal.Lock()
+			delete(autoheal.states, key)
+			autoheal.Unlock()
+			continue
+		}
+		switch status, _ := strings.CutPrefix(string(ev.Action), string(events.ActionHealthStatus)+": "); status {
+		case types.Unhealthy:
+			beginHeal(ctx, host, ev.Actor.ID)
+		case types.Healthy:
+			autoheal.Lock()
+			if state, ok := autoheal.states[key]; ok {
+				state.gaveUp = false
+			}
+			autoheal.Unlock()
+		}
+	}
+}
+
+// healUnhealthy starts healing every unhealthy container on host
+func healUnhealthy(ctx context.Context, host *dockerHost) {
+	listCtx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+	list, err := host.Client().ContainerList(listCtx, container.ListOptions{
+		Filters: filters.NewArgs(filters.Arg("health", types.Unhealthy)),
+	})
+	if err != nil {
+		logger.Warn("listing unhealthy containers", "host", host.Name, "error", err)
+		return
+	}
+	for _, cont := range list {
+		beginHeal(ctx, host, cont.ID)
+	}
+}
+
+// beginHeal starts healing a container unless that is already under way
+func beginHeal(ctx context.Context, host *dockerHost, containerID string) {
+	key := host.Name + "/" + containerID
+	autoheal.Lock()
+	state, ok := autoheal.states[key]
+	if !ok {
+		state = &healState{}
+		autoheal.states[key] = state
+	}
+	if state.healing || state.gaveUp {
+		autoheal.Unlock()
+		return
+	}
+	state.healing = true
+	autoheal.Unlock()
+
+	go func() {
+		healContainer(ctx, host, containerID, state)
+		autoheal.Lock()
+		state.healing = false
+		autoheal.Unlock()
+	}()
+}
+
+// healContainer waits out the backoff and restarts the container if it is
+// still running, unhealthy and opted in, and ctx is not done by then
+func healContainer(ctx context.Context, host *dockerHost, containerID string, state *healState) {
+	autoheal.Lock()
+	cutoff := time.Now().Add(-autohealWindow)
+	for len(state.restarts) > 0 && state.restarts[0].Before(cutoff) {
+		state.restarts = state.restarts[1:]
+	}
+	attempt := len(state.restarts) + 1
+	autoheal.Unlock()
+
+	inspection, ok := healCandidate(host, containerID)
+	if !ok {
+		return
+	}
+	action := healAction{Host: host.Name, ContainerID: containerID, Container: strings.TrimPrefix(inspection.Name, "/"), Attempt: attempt}
+
+	if attempt > autohealMaxRestarts {
+		autoheal.Lock()
+		state.gaveUp = true
+		autoheal.Unlock()
+		action.Result = healGaveUp
+		recordHealAction(action)
+		return
+	}
+	if attempt > 1 {
+		delay := autohealBackoff << (attempt - 2)
+		if delay > autohealWindow || delay <= 0 {
+			delay = autohealWindow
+		}
+		if !pause(ctx, delay) {
+			return
+		}
+		// It may have recovered or been stopped in the meantime
+		if _, ok := healCandidate(host, containerID); !ok {
+			return
+		}
+	}
+	if ctx.Err() != nil {
+		return
+	}
+
+	restartCtx, cancel := context.WithTimeout(withHost(context.Background(), host), longRequestTimeout)
+	err := restartAction(restartCtx, containerID, actionRequest{})
+	cancel()
+	action.Result = healRestarted
+	if err != nil {
+		action.Result, action.Error = healFailed, err.Error()
+	}
+	autoheal.Lock()
+	state.restarts = append(state.restarts, time.Now())
+	autoheal.Unlock()
+	recordHealAction(action)
+}
+
+// healCandidate inspects a container and reports whether autoheal should
+// restart it
+func healCandidate(host *dockerHost, containerID string) (types.ContainerJSON, bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	inspection, err := host.Client().ContainerInspect(ctx, containerID)
+	if err != nil || inspection.State == nil || !inspection.State.Running {
+		return inspection, false
+	}
+	if inspection.State.Health == nil || inspection.State.Health.Status != types.Unhealthy {
+		return inspection, false
+	}
+	var labels map[string]string
+	if inspection.Config != nil {
+		labels = inspection.Config.Labels
+	}
+	return inspection, policyEnabled(autohealPolicyBucket, strings.TrimPrefix(inspection.Name, "/"), labels, autohealLabel)
+}
+
+// recordHealAction logs an action, counts it and keeps it for GET /autoheal
+func recordHealAction(action healAction) {
+	action.Time = time.Now()
+	switch action.Result {
+	case healRestarted:
+		logger.Warn("autoheal restarted unhealthy container", "host", action.Host, "container", action.Container, "attempt", action.Attempt)
+	case healFailed:
+		logger.Error("autoheal restart failed", "host", action.Host, "container", action.Container, "attempt", action.Attempt, "error", action.Error)
+	case healGaveUp:
+		logger.Error("autoheal giving up on container", "host", action.Host, "container", action.Container, "restarts", autohealMaxRestarts, "window", autohealWindow.String())
+	}
+	autohealActions.WithLabelValues(action.Host, action.Result).Inc()
+	notifyWebhooks(webhookEvent{
+		Event:   "autoheal." + action.Result,
+		Time:    action.Time,
+		Host:    action.Host,
+		ID:      action.ContainerID,
+		Name:    action.Container,
+		Health:  "unhealthy",
+		Message: healMessage(action),
+	})
+
+	autoheal.Lock()
+	autoheal.actions = append(autoheal.actions, action)
+	if len(autoheal.actions) > maxHealActions {
+		autoheal.actions = autoheal.actions[1:]
+	}
+	autoheal.Unlock()
+}
+
+// healMessage describes an action for webhooks
+func healMessage(action healAction) string {
+	switch action.Result {
+	case healRestarted:
+		return fmt.Sprintf("Restarted unhealthy container (attempt %d)", action.Attempt)
+	case healFailed:
+		return fmt.Sprintf("Restarting unhealthy container failed (attempt %d): %s", action.Attempt, action.Error)
+	}
+	return fmt.Sprintf("Gave up after %d restarts within %s", autohealMaxRestarts, autohealWindow)
+}
+
+// autohealStatus reports the autoheal settings, policies and recent
+// actions, newest first
+func autohealStatus(c *gin.Context) {
+	policies, err := loadPolicies(autohealPolicyBucket)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, codeInternal, err.Error())
+		return
+	}
+	policyList := []containerPolicy{}
+	for _, policy := range policies {
+		policyList = append(policyList, policy)
+	}
+
+	autoheal.Lock()
+	actions := make([]healAction, len(autoheal.actions))
+	for i, action := range autoheal.actions {
+		actions[len(actions)-1-i] = action
+	}
+	autoheal.Unlock()
+	respond(c, http.StatusOK, gin.H{
+		"label":           autohealLabel,
+		"backoff_seconds": autohealBackoff.Seconds(),
+		"max_restarts":    autohealMaxRestarts,
+		"window_seconds":  autohealWindow.Seconds(),
+		"policies":        policyList,
+		"recent_actions":  actions,
+	})
+}
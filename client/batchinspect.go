@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/docker/docker/api/types"
+	"github.com/gin-gonic/gin"
+)
+
+// maxBatchInspect bounds the containers one batch inspect may ask for
+const maxBatchInspect = 100
+
+// batchInspectRequest is the body of POST /containers/inspect
+type batchInspectRequest struct {
+	ContainerIDs []string `json:"container_ids"`
+	Size         bool     `json:"size"`
+}
+
+// inspectResult is one container's inspect output, or why it failed
+type inspectResult struct {
+	ContainerID string               `json:"container_id"`
+	Inspect     *types.ContainerJSON `json:"inspect,omitempty"`
+	Error       string               `json:"error,omitempty"`
+	Code        string               `json:"code,omitempty"`
+}
+
+// batchInspect inspects several containers concurrently and returns the
+// results in the order asked for, each redacted as inspectContainer's.
+// A container that cannot be inspected fails on its own.
+func batchInspect(c *gin.Context) {
+	var req batchInspectRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		badRequest(c, "Invalid request")
+		return
+	}
+	if len(req.ContainerIDs) == 0 {
+		badRequest(c, "container_ids is required")
+		return
+	}
+	if len(req.ContainerIDs) > maxBatchInspect {
+		badRequest(c, fmt.Sprintf("At most %d containers can be inspected at once", maxBatchInspect))
+		return
+	}
+	for _, ref := range req.ContainerIDs {
+		if err := checkContainerRef(ref); err != nil {
+			badRequest(c, err.Error())
+			return
+		}
+	}
+	reveal, ok := wantsReveal(c)
+	if !ok {
+		return
+	}
+
+	ctx := hostContext(c)
+	role := callerRole(c)
+	results := make([]inspectResult, len(req.ContainerIDs))
+	sem := make(chan struct{}, bulkConcurrency)
+	var wg sync.WaitGroup
+	for i, ref := range req.ContainerIDs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, ref string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			results[i] = inspectResult{ContainerID: ref}
+			cont, err := resolveContainer(ctx, ref)
+			if err != nil {
+				_, results[i].Code = dockerStatus(err, codeContainerNotFound)
+				results[i].Error = err.Error()
+				return
+			}
+			inspection, _, err := docker(ctx).ContainerInspectWithRaw(ctx, cont.ID, req.Size)
+			if err != nil {
+				_, results[i].Code = dockerStatus(err, codeContainerNotFound)
+				results[i].Error = err.Error()
+				return
+			}
+			if !reveal {
+				redactInspection(&inspection, role)
+			}
+			results[i].Inspect = &inspection
+		}(i, ref)
+	}
+	wg.Wait()
+
+	failed := 0
+	for _, result := range results {
+		if result.Inspect == nil {
+			failed++
+		}
+	}
+	respond(c, http.StatusOK, gin.H{"results": results, "failed": failed})
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/docker/go-connections/nat"
+	"github.com/gin-gonic/gin"
+)
+
+// blueGreenLabel marks the candidate of a blue-green swap with the ID of
+// the container it is replacing, so a leftover one can be told apart
+const blueGreenLabel = "containerscope.bluegreen"
+
+// maxCheckOutput bounds the output of a check command kept for the reply
+const maxCheckOutput = 4096
+
+// blueGreenRequest is the body of POST /containers/:container_id/bluegreen
+type blueGreenRequest struct {
+	Image string `json:"image" binding:"required"`
+	Pull  *bool  `json:"pull"`
+	// Check is a command run in the candidate once it is healthy; the swap
+	// goes ahead only if it exits 0
+	Check []string `json:"check"`
+	// HealthTimeoutSeconds is how long to wait for the candidate and the
+	// final container to be healthy, and for the check to finish
+	HealthTimeoutSeconds int `json:"health_timeout_seconds"`
+}
+
+// checkResult is the outcome of a check command
+type checkResult struct {
+	ExitCode int    `json:"exit_code"`
+	Output   string `json:"output"`
+}
+
+// cappedBuffer keeps the first maxCheckOutput bytes written to it and
+// discards the rest, so a chatty check cannot fill memory
+type cappedBuffer struct {
+	bytes.Buffer
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if room := maxCheckOutput - b.Len(); room > 0 {
+		b.Buffer.Write(p[:min(room, len(p))])
+	}
+	return len(p), nil
+}
+
+// runCheck runs cmd in a container and returns its exit code and output
+func runCheck(ctx context.Context, containerID string, cmd []string) (checkResult, error) {
+	exec, err := docker(ctx).ContainerExecCreate(ctx, containerID, types.ExecConfig{Cmd: cmd, AttachStdout: true, AttachStderr: true})
+	if err != nil {
+		return checkResult{}, err
+	}
+	attach, err := docker(ctx).ContainerExecAttach(ctx, exec.ID, types.ExecStartCheck{})
+	if err != nil {
+		return checkResult{}, err
+	}
+	defer attach.Close()
+	var out cappedBuffer
+	if _, err := stdcopy.StdCopy(&out, &out, attach.Reader); err != nil {
+		return checkResult{}, err
+	}
+	inspection, err := docker(ctx).ContainerExecInspect(ctx, exec.ID)
+	if err != nil {
+		return checkResult{}, err
+	}
+	return checkResult{ExitCode: inspection.ExitCode, Output: out.String()}, nil
+}
+
+// candidateConfig adapts a replacement's configuration to run next to the
+// old container: its published ports move to ports the daemon picks, fixed
+// addresses are dropped and it is not restarted by the daemon
+func candidateConfig(config container.Config, hostConfig container.HostConfig, oldID string) (container.Config, container.HostConfig) {
+	labels := make(map[string]string, len(config.Labels)+1)
+	for key, value := range config.Labels {
+		labels[key] = value
+	}
+	labels[blueGreenLabel] = oldID
+	config.Labels = labels
+
+	bindings := nat.PortMap{}
+	for port, published := range hostConfig.PortBindings {
+		moved := make([]nat.PortBinding, 0, len(published))
+		for _, b := range published {
+			moved = append(moved, nat.PortBinding{HostIP: b.HostIP})
+		}
+		bindings[port] = moved
+	}
+	hostConfig.PortBindings = bindings
+	hostConfig.RestartPolicy = container.RestartPolicy{}
+	hostConfig.AutoRemove = false
+	return config, hostConfig
+}
+
+// candidateEndpoint copies endpoint settings without a fixed address, which
+// only one of the two containers could hold
+func candidateEndpoint(endpoint *network.EndpointSettings) *network.EndpointSettings {
+	if endpoint == nil {
+		return nil
+	}
+	copied := *endpoint
+	copied.IPAMConfig = nil
+	return &copied
+}
+
+// createAndStart creates a container, connects its extra networks and
+// starts it. A container that was created is removed again on failure.
+func createAndStart(ctx context.Context, name string, config *container.Config, hostConfig *container.HostConfig,
+	primary *network.NetworkingConfig, extra map[string]*network.EndpointSettings) (string, error) {
+	created, err := docker(ctx).ContainerCreate(ctx, config, hostConfig, primary, nil, name)
+	if err != nil {
+		return "", fmt.Errorf("creating container: %w", err)
+	}
+	for networkName, endpoint := range extra {
+		if err := docker(ctx).NetworkConnect(ctx, networkName, created.ID, endpoint); err != nil {
+			_ = docker(ctx).ContainerRemove(ctx, created.ID, container.RemoveOptions{Force: true})
+			return "", fmt.Errorf("connecting network %s: %w", networkName, err)
+		}
+	}
+	if err := docker(ctx).ContainerStart(ctx, created.ID, container.StartOptions{}); err != nil {
+		_ = docker(ctx).ContainerRemove(ctx, created.ID, container.RemoveOptions{Force: true})
+		return "", fmt.Errorf("starting container: %w", err)
+	}
+	return created.ID, nil
+}
+
+// blueGreenSwap replaces a running container with one created from a new
+// image without betting on the image blindly. A candidate is started next
+// to the old container, with its published ports on temporary host ports,
+// and must become healthy and pass the optional check command. Only then
+// is the old container stopped and a container with the original name
+// and ports created in its place; if that one fails too, the old
+// container is put back. The candidate is removed either way.
+func blueGreenSwap(c *gin.Context) {
+	var req blueGreenRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		badRequest(c, "image is required")
+		return
+	}
+	if req.HealthTimeoutSeconds < 0 {
+		badRequest(c, "health_timeout_seconds must not be negative")
+		return
+	}
+	healthTimeout := defaultHealthTimeout
+	if req.HealthTimeoutSeconds > 0 {
+		healthTimeout = time.Duration(req.HealthTimeoutSeconds) * time.Second
+	}
+
+	ctx := hostContext(c)
+	if req.Pull == nil || *req.Pull {
+		if err := pullImage(ctx, req.Image); err != nil {
+			dockerError(c, "Error pulling image", err)
+			return
+		}
+	}
+
+	recreateMu.Lock()
+	defer recreateMu.Unlock()
+
+	old, err := docker(ctx).ContainerInspect(ctx, c.Param("container_id"))
+	if err != nil {
+		dockerError(c, "Error inspecting container", err)
+		return
+	}
+	if !old.State.Running {
+		respondError(c, http.StatusConflict, codeConflict, "Container is not running; recreate it instead")
+		return
+	}
+	if mode := old.HostConfig.NetworkMode; mode.IsHost() || mode.IsContainer() {
+		respondError(c, http.StatusConflict, codeConflict, "Containers sharing another network namespace cannot run side by side; recreate it instead")
+		return
+	}
+	name := strings.TrimPrefix(old.Name, "/")
+	config, hostConfig := replacementConfig(ctx, old, req.Image)
+	primary, extra := recreateNetworks(old)
+	if err := checkPortConflicts(ctx, &hostConfig, old.ID); err != nil {
+		dockerError(c, "Error swapping container", err)
+		return
+	}
+
+	// Start the candidate next to the old container
+	candConfig, candHostConfig := candidateConfig(config, hostConfig, old.ID)
+	var candPrimary *network.NetworkingConfig
+	if primary != nil {
+		candPrimary = &network.NetworkingConfig{EndpointsConfig: map[string]*network.EndpointSettings{}}
+		for networkName, endpoint := range primary.EndpointsConfig {
+			candPrimary.EndpointsConfig[networkName] = candidateEndpoint(endpoint)
+		}
+	}
+	candExtra := map[string]*network.EndpointSettings{}
+	for networkName, endpoint := range extra {
+		candExtra[networkName] = candidateEndpoint(endpoint)
+	}
+	candName := fmt.Sprintf("%s-green-%d", name, time.Now().Unix())
+	candID, err := createAndStart(ctx, candName, &candConfig, &candHostConfig, candPrimary, candExtra)
+	if err != nil {
+		dockerError(c, "Error starting candidate", err)
+		return
+	}
+	defer func() {
+		if err := docker(ctx).ContainerRemove(ctx, candID, container.RemoveOptions{Force: true}); err != nil {
+			logger.Warn("could not remove blue-green candidate", "container", candName, "error", err)
+		}
+	}()
+
+	health, err := waitHealthy(ctx, candID, healthTimeout)
+	if err != nil {
+		respondError(c, http.StatusUnprocessableEntity, codeUnhealthy, "Candidate failed: "+err.Error())
+		return
+	}
+	candidate := gin.H{"id": candID, "name": candName, "health": health}
+	if inspection, err := docker(ctx).ContainerInspect(ctx, candID); err == nil && inspection.NetworkSettings != nil {
+		candidate["ports"] = inspection.NetworkSettings.Ports
+	}
+	var check *checkResult
+	if len(req.Check) > 0 {
+		checkCtx, cancel := context.WithTimeout(ctx, healthTimeout)
+		result, err := runCheck(checkCtx, candID, req.Check)
+		cancel()
+		if err != nil {
+			dockerError(c, "Error running check", err)
+			return
+		}
+		if result.ExitCode != 0 {
+			respondError(c, http.StatusUnprocessableEntity, codeUnhealthy,
+				fmt.Sprintf("Check exited with code %d: %s", result.ExitCode, strings.TrimSpace(result.Output)))
+			return
+		}
+		check = &result
+	}
+
+	// Swap: the old container makes way for one with its name and ports
+	backupName := fmt.Sprintf("%s-old-%d", name, time.Now().Unix())
+	if err := docker(ctx).ContainerRename(ctx, old.ID, backupName); err != nil {
+		dockerError(c, "Error renaming old container", err)
+		return
+	}
+	restore := func(newID string) {
+		if newID != "" {
+			_ = docker(ctx).ContainerRemove(ctx, newID, container.RemoveOptions{Force: true})
+		}
+		_ = docker(ctx).ContainerRename(ctx, old.ID, name)
+		_ = docker(ctx).ContainerStart(ctx, old.ID, container.StartOptions{})
+	}
+	if err := docker(ctx).ContainerStop(ctx, old.ID, container.StopOptions{}); err != nil {
+		restore("")
+		dockerError(c, "Error stopping old container", err)
+		return
+	}
+	newID, err := createAndStart(ctx, name, &config, &hostConfig, primary, extra)
+	if err != nil {
+		restore("")
+		dockerError(c, "Error swapping container", err)
+		return
+	}
+	if health, err = waitHealthy(ctx, newID, healthTimeout); err != nil {
+		restore(newID)
+		respondError(c, http.StatusUnprocessableEntity, codeUnhealthy, "New container failed, old container restored: "+err.Error())
+		return
+	}
+	if err := docker(ctx).ContainerRemove(ctx, old.ID, container.RemoveOptions{}); err != nil {
+		logger.Warn("could not remove replaced container", "container", backupName, "error", err)
+	}
+
+	logger.Info("blue-green swap", "container", name, "image", req.Image, "host", hostFrom(ctx).Name)
+	respond(c, http.StatusOK, gin.H{
+		"message":   "Container swapped successfully",
+		"id":        newID,
+		"image":     req.Image,
+		"health":    health,
+		"candidate": candidate,
+		"check":     check,
+	})
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/gin-gonic/gin"
+)
+
+// buildRequest is the JSON form of a build: a single Dockerfile with no
+// other context files
+type buildRequest struct {
+	Dockerfile string            `json:"dockerfile"`
+	Tags       []string          `json:"tags"`
+	BuildArgs  map[string]string `json:"build_args"`
+	Pull       bool              `json:"pull"`
+	NoCache    bool              `json:"no_cache"`
+}
+
+// dockerfileContext wraps a Dockerfile in the tar build context Docker expects
+func dockerfileContext(dockerfile string) (io.Reader, error) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	header := &tar.Header{Name: "Dockerfile", Mode: 0o644, Size: int64(len(dockerfile)), ModTime: time.Now()}
+	if err := tw.WriteHeader(header); err != nil {
+		return nil, err
+	}
+	if _, err := tw.Write([]byte(dockerfile)); err != nil {
+		return nil, err
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	return &buf, nil
+}
+
+// buildImage builds and tags an image, streaming Docker's build output back
+// as newline-delimited JSON. The build context is either a JSON body with a
+// Dockerfile string, or a tar archive (raw body or multipart "file") with
+// options in the query string.
+func buildImage(c *gin.Context) {
+	ctx := hostContext(c)
+	var (
+		buildContext io.Reader
+		req          buildRequest
+	)
+
+	if c.ContentType() == "application/json" {
+		if err := c.ShouldBindJSON(&req); err != nil || req.Dockerfile == "" {
+			badRequest(c, "dockerfile is required")
+			return
+		}
+		var err error
+		if buildContext, err = dockerfileContext(req.Dockerfile); err != nil {
+			respondError(c, http.StatusInternalServerError, codeInternal, err.Error())
+			return
+		}
+		req.Dockerfile = "Dockerfile"
+	} else {
+		archive, err := uploadedArchive(c)
+		if err != nil {
+			badRequest(c, "Expected a JSON body, a tar archive, or a multipart file field")
+			return
+		}
+		defer archive.Close()
+		buildContext = archive
+
+		req.Dockerfile = c.DefaultQuery("dockerfile", "Dockerfile")
+		req.Tags = c.QueryArray("tag")
+		req.Pull = c.Query("pull") == "true"
+		req.NoCache = c.Query("no_cache") == "true"
+		req.BuildArgs = map[string]string{}
+		for _, arg := range c.QueryArray("build_arg") {
+			key, value, _ := strings.Cut(arg, "=")
+			req.BuildArgs[key] = value
+		}
+	}
+
+	if len(req.Tags) == 0 {
+		badRequest(c, "At least one tag is required")
+		return
+	}
+
+	buildArgs := map[string]*string{}
+	for key, value := range req.BuildArgs {
+		value := value
+		buildArgs[key] = &value
+	}
+
+	resp, err := docker(ctx).ImageBuild(ctx, buildContext, types.ImageBuildOptions{
+		Tags:        req.Tags,
+		Dockerfile:  req.Dockerfile,
+		BuildArgs:   buildArgs,
+		PullParent:  req.Pull,
+		NoCache:     req.NoCache,
+		Remove:      true,
+		ForceRemove: true,
+		AuthConfigs: buildAuthConfigs(),
+	})
+	if err != nil {
+		dockerError(c, "Error building image", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	streamResponse(c, "application/x-ndjson", resp.Body)
+}
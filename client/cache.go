@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+)
+
+// cacheDebounce collects bursts of events, such as a compose project
+// starting, into a single refresh
+const cacheDebounce = 200 * time.Millisecond
+
+// listCacheEnabled turns the cache off with CONTAINERSCOPE_LIST_CACHE=false
+var listCacheEnabled = os.Getenv("CONTAINERSCOPE_LIST_CACHE") != "false"
+
+// listCache keeps a host's container and image lists in memory, refreshed
+// whenever Docker reports a container or image event. Readers fall back
+// to the daemon while it is stale or the event stream is down.
+type listCache struct {
+	mu         sync.RWMutex
+	current    bool
+	containers []types.Container
+	images     []types.ImageSummary
+	imageTags  map[string]string
+}
+
+// listCaches holds a cache per host name; it is filled before the server
+// starts and only read afterwards
+var listCaches = map[string]*listCache{}
+
+// startListCache fills and then maintains a cache for every host from its
+// event bus
+func startListCache() {
+	if !listCacheEnabled {
+		return
+	}
+	for name, host := range dockerHosts {
+		cache := &listCache{}
+		listCaches[name] = cache
+		go cache.watch(host, eventBuses[name])
+	}
+}
+
+// watch refreshes the lists after each burst of container or image
+// events, and whenever the bus says events may have been missed
+func (lc *listCache) watch(host *dockerHost, bus *eventBus) {
+	evs, _ := bus.subscribe()
+	var debounce <-chan time.Time
+	for {
+		select {
+		case ev := <-evs:
+			if !ev.Resync && ev.Type != events.ContainerEventType && ev.Type != events.ImageEventType {
+				continue
+			}
+			lc.setCurrent(false)
+			if debounce == nil {
+				debounce = time.After(cacheDebounce)
+			}
+		case <-debounce:
+			debounce = nil
+			ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+			if err := lc.refresh(ctx, host); err != nil {
+				logger.Debug("refreshing list cache", "host", host.Name, "error", err)
+			}
+			cancel()
+		}
+	}
+}
+
+// refresh reloads both lists from the daemon
+func (lc *listCache) refresh(ctx context.Context, host *dockerHost) error {
+	cli := host.Client()
+	containers, err := cli.ContainerList(ctx, container.ListOptions{All: true})
+	if err != nil {
+		return err
+	}
+	images, err := cli.ImageList(ctx, types.ImageListOptions{})
+	if err != nil {
+		return err
+	}
+	lc.mu.Lock()
+	lc.containers, lc.images, lc.imageTags, lc.current = containers, images, imageTags(images), true
+	lc.mu.Unlock()
+	return nil
+}
+
+func (lc *listCache) setCurrent(current bool) {
+	lc.mu.Lock()
+	lc.current = current
+	lc.mu.Unlock()
+}
+
+// cacheFor returns the cache of the host carried by ctx
+func cacheFor(ctx context.Context) *listCache {
+	return listCaches[hostFrom(ctx).Name]
+}
+
+// cachedContainers returns a copy of the host's containers matching args,
+// and false when the cache is not current or cannot apply the filters
+func cachedContainers(ctx context.Context, args filters.Args) ([]types.Container, bool) {
+	lc := cacheFor(ctx)
+	if lc == nil {
+		return nil, false
+	}
+	for _, key := range args.Keys() {
+		if !cachedFilters[key] {
+			return nil, false
+		}
+	}
+	lc.mu.RLock()
+	defer lc.mu.RUnlock()
+	if !lc.current {
+		return nil, false
+	}
+	matched := []types.Container{}
+	for _, cont := range lc.containers {
+		if args.ExactMatch("status", cont.State) && args.MatchKVList("label", cont.Labels) && matchesName(args, cont.Names) {
+			matched = append(matched, cont)
+		}
+	}
+	return matched, true
+}
+
+// cachedFilters are the container filters the cache applies itself, with
+// the daemon's semantics; others such as ancestor go to the daemon
+var cachedFilters = map[string]bool{"status": true, "name": true, "label": true}
+
+// matchesName applies the name filter, a regular expression the daemon
+// matches against each of a container's names
+func matchesName(args filters.Args, names []string) bool {
+	if !args.Contains("name") {
+		return true
+	}
+	for _, name := range names {
+		if args.Match("name", name) {
+			return true
+		}
+	}
+	return false
+}
+
+// cachedImages returns a copy of the host's images, and false when the
+// cache is not current
+func cachedImages(ctx context.Context) ([]types.ImageSummary, bool) {
+	lc := cacheFor(ctx)
+	if lc == nil {
+		return nil, false
+	}
+	lc.mu.RLock()
+	defer lc.mu.RUnlock()
+	if !lc.current {
+		return nil, false
+	}
+	return append([]types.ImageSummary(nil), lc.images...), true
+}
+
+// cachedImageTags returns the host's image ID to first tag map, shared
+// and not to be modified, and false when the cache is not current
+func cachedImageTags(ctx context.Context) (map[string]string, bool) {
+	lc := cacheFor(ctx)
+	if lc == nil {
+		return nil, false
+	}
+	lc.mu.RLock()
+	defer lc.mu.RUnlock()
+	if !lc.current {
+		return nil, false
+	}
+	return lc.imageTags, true
+}
+
+// imageTags maps image IDs to their first tag, or "" when untagged
+func imageTags(images []types.ImageSummary) map[string]string {
+	tags := make(map[string]string, len(images))
+	for _, image := range images {
+		tags[image.ID] = firstTag(image)
+	}
+	return tags
+}
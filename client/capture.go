@@ -0,0 +1,208 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/strslice"
+	"github.com/docker/docker/errdefs"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/gin-gonic/gin"
+)
+
+// captureImage is the image of the helper containers that run tcpdump in
+// a container's network namespace; it must have tcpdump on its PATH
+var captureImage = envOr("CONTAINERSCOPE_CAPTURE_IMAGE", "nicolaka/netshoot:latest")
+
+// Bounds on a capture: how long it may run and how many packets it may
+// keep, so a capture cannot fill the helper's disk
+const (
+	defaultCaptureSeconds = 10
+	maxCaptureSeconds     = 300
+	maxCapturePackets     = 100000
+)
+
+// captureFile is where the helper writes the capture
+const captureFile = "/tmp/capture.pcap"
+
+// captureRequest is the optional body of POST /containers/:container_id/capture
+type captureRequest struct {
+	// DurationSeconds is how long to capture; 10 when unset
+	DurationSeconds int `json:"duration_seconds"`
+	// Packets stops the capture early once this many have been captured
+	Packets int `json:"packets"`
+	// Interface to capture on; all of the container's when unset
+	Interface string `json:"interface"`
+	// Filter is a pcap filter expression, such as "tcp port 5432"
+	Filter string `json:"filter"`
+	// Snaplen is how many bytes of each packet to keep; tcpdump's default
+	// when unset
+	Snaplen int `json:"snaplen"`
+}
+
+// command returns the tcpdump command line for the request
+func (r captureRequest) command() []string {
+	iface := r.Interface
+	if iface == "" {
+		iface = "any"
+	}
+	packets := r.Packets
+	if packets == 0 {
+		packets = maxCapturePackets
+	}
+	cmd := []string{"tcpdump", "-i", iface, "-n", "-U", "-w", captureFile, "-c", strconv.Itoa(packets)}
+	if r.Snaplen > 0 {
+		cmd = append(cmd, "-s", strconv.Itoa(r.Snaplen))
+	}
+	if r.Filter != "" {
+		cmd = append(cmd, r.Filter)
+	}
+	return cmd
+}
+
+// captureOutput returns the end of what the capture container printed
+func captureOutput(ctx context.Context, containerID string) string {
+	logs, err := docker(ctx).ContainerLogs(ctx, containerID, container.LogsOptions{ShowStdout: true, ShowStderr: true, Tail: "20"})
+	if err != nil {
+		return err.Error()
+	}
+	defer logs.Close()
+	var out cappedBuffer
+	_, _ = stdcopy.StdCopy(&out, &out, logs)
+	return strings.TrimSpace(out.String())
+}
+
+// captureContainer captures the traffic of a running container for a
+// number of seconds, or until enough packets have been seen, and returns
+// it as a pcap file. tcpdump runs in a helper container that joins the
+// container's network namespace with the capabilities capturing needs, so
+// neither the container nor the host needs tcpdump. Admin only, since a
+// capture can hold anything sent over the container's connections.
+func captureContainer(c *gin.Context) {
+	var req captureRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			badRequest(c, "Invalid request")
+			return
+		}
+	}
+	switch {
+	case req.DurationSeconds < 0 || req.DurationSeconds > maxCaptureSeconds:
+		badRequest(c, fmt.Sprintf("duration_seconds must be between 1 and %d", maxCaptureSeconds))
+		return
+	case req.Packets < 0 || req.Packets > maxCapturePackets:
+		badRequest(c, fmt.Sprintf("packets must be between 1 and %d", maxCapturePackets))
+		return
+	case req.Snaplen < 0:
+		badRequest(c, "snaplen must not be negative")
+		return
+	case strings.HasPrefix(req.Interface, "-") || strings.ContainsAny(req.Interface, " \t\r\n"):
+		badRequest(c, "Invalid interface")
+		return
+	case strings.HasPrefix(strings.TrimSpace(req.Filter), "-"):
+		badRequest(c, "Invalid filter")
+		return
+	}
+	duration := defaultCaptureSeconds * time.Second
+	if req.DurationSeconds > 0 {
+		duration = time.Duration(req.DurationSeconds) * time.Second
+	}
+
+	ctx := hostContext(c)
+	inspection, err := docker(ctx).ContainerInspect(ctx, c.Param("container_id"))
+	if err != nil {
+		dockerError(c, "Error inspecting container", err)
+		return
+	}
+	if !inspection.State.Running {
+		respondError(c, http.StatusConflict, codeConflict, "Container is not running")
+		return
+	}
+	if _, _, err := docker(ctx).ImageInspectWithRaw(ctx, captureImage); errdefs.IsNotFound(err) {
+		if err := pullImage(ctx, captureImage); err != nil {
+			dockerError(c, "Error pulling capture image "+captureImage, err)
+			return
+		}
+	} else if err != nil {
+		dockerError(c, "Error inspecting capture image", err)
+		return
+	}
+
+	created, err := docker(ctx).ContainerCreate(ctx,
+		&container.Config{
+			Image:      captureImage,
+			Entrypoint: strslice.StrSlice{},
+			Cmd:        req.command(),
+			Labels:     map[string]string{helperLabel: "capture"},
+		},
+		&container.HostConfig{
+			NetworkMode: container.NetworkMode("container:" + inspection.ID),
+			CapAdd:      strslice.StrSlice{"NET_ADMIN", "NET_RAW"},
+		},
+		nil, nil, "")
+	if err != nil {
+		dockerError(c, "Error creating capture container", err)
+		return
+	}
+	defer removeHelper(context.WithoutCancel(ctx), created.ID)
+	if err := docker(ctx).ContainerStart(ctx, created.ID, container.StartOptions{}); err != nil {
+		dockerError(c, "Error starting capture", err)
+		return
+	}
+
+	// tcpdump exits by itself once it has the packets asked for; otherwise
+	// it is stopped when the time is up, which makes it close the file
+	waitCtx, cancel := context.WithTimeout(ctx, duration)
+	statusCh, errCh := docker(ctx).ContainerWait(waitCtx, created.ID, container.WaitConditionNotRunning)
+	select {
+	case <-statusCh:
+	case <-errCh:
+	}
+	cancel()
+	if ctx.Err() != nil {
+		dockerError(c, "Error capturing", ctx.Err())
+		return
+	}
+	stopTimeout := 5
+	if err := docker(ctx).ContainerStop(ctx, created.ID, container.StopOptions{Timeout: &stopTimeout}); err != nil {
+		dockerError(c, "Error stopping capture", err)
+		return
+	}
+	state, err := docker(ctx).ContainerInspect(ctx, created.ID)
+	if err != nil {
+		dockerError(c, "Error inspecting capture container", err)
+		return
+	}
+	// tcpdump exits 0 when it reaches the packet count or is stopped, and
+	// 137 if it had to be killed; anything else means it could not capture,
+	// usually for a bad filter or interface, and its output says why
+	if code := state.State.ExitCode; code != 0 && code != 137 && code != 143 {
+		badRequest(c, fmt.Sprintf("tcpdump exited with code %d: %s", code, captureOutput(ctx, created.ID)))
+		return
+	}
+
+	reader, _, err := docker(ctx).CopyFromContainer(ctx, created.ID, captureFile)
+	if err != nil {
+		dockerError(c, "Error reading capture", err)
+		return
+	}
+	defer reader.Close()
+	tr := tar.NewReader(reader)
+	header, err := tr.Next()
+	if err != nil {
+		dockerError(c, "Error reading capture", err)
+		return
+	}
+
+	name := strings.TrimPrefix(inspection.Name, "/")
+	logger.Info("captured container traffic", "container", name, "bytes", header.Size, "host", hostFrom(ctx).Name)
+	filename := fmt.Sprintf("capture_%s_%s.pcap", name, time.Now().UTC().Format("20060102T150405Z"))
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%s", filename))
+	c.DataFromReader(http.StatusOK, header.Size, "application/vnd.tcpdump.pcap", tr, nil)
+}
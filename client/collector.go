@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"golang.org/x/sync/errgroup"
+)
+
+// statsInterval is how often the collector samples every running
+// container's stats
+var statsInterval = envDuration("CONTAINERSCOPE_STATS_INTERVAL", 15*time.Second)
+
+// statsSample is one stats reading of a running container, with its
+// traffic per network interface and its block I/O
+type statsSample struct {
+	Host      string
+	Container types.Container
+	Stats     types.StatsJSON
+	Network   []interfaceTraffic
+	BlockIO   blockIO
+}
+
+// interfaceTraffic is one network interface's counters since the container
+// started, and its rates since the collector's previous sample. The rates
+// are nil on the first sample and after a restart resets the counters.
+type interfaceTraffic struct {
+	Interface string   `json:"interface"`
+	RxBytes   uint64   `json:"rx_bytes"`
+	TxBytes   uint64   `json:"tx_bytes"`
+	RxPackets uint64   `json:"rx_packets"`
+	TxPackets uint64   `json:"tx_packets"`
+	RxErrors  uint64   `json:"rx_errors"`
+	TxErrors  uint64   `json:"tx_errors"`
+	RxDropped uint64   `json:"rx_dropped"`
+	TxDropped uint64   `json:"tx_dropped"`
+	RxRate    *float64 `json:"rx_bytes_per_second"`
+	TxRate    *float64 `json:"tx_bytes_per_second"`
+}
+
+// networkTraffic lists the interfaces in stats by name, with rates
+// against previous when it is an earlier sample of the same container
+func networkTraffic(stats types.StatsJSON, previous *types.StatsJSON) []interfaceTraffic {
+	var elapsed float64
+	if previous != nil {
+		elapsed = stats.Read.Sub(previous.Read).Seconds()
+	}
+	list := make([]interfaceTraffic, 0, len(stats.Networks))
+	for name, n := range stats.Networks {
+		traffic := interfaceTraffic{
+			Interface: name,
+			RxBytes:   n.RxBytes,
+			TxBytes:   n.TxBytes,
+			RxPackets: n.RxPackets,
+			TxPackets: n.TxPackets,
+			RxErrors:  n.RxErrors,
+			TxErrors:  n.TxErrors,
+			RxDropped: n.RxDropped,
+			TxDropped: n.TxDropped,
+		}
+		if elapsed > 0 {
+			if p, ok := previous.Networks[name]; ok && n.RxBytes >= p.RxBytes && n.TxBytes >= p.TxBytes {
+				rx := float64(n.RxBytes-p.RxBytes) / elapsed
+				tx := float64(n.TxBytes-p.TxBytes) / elapsed
+				traffic.RxRate, traffic.TxRate = &rx, &tx
+			}
+		}
+		list = append(list, traffic)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Interface < list[j].Interface })
+	return list
+}
+
+// blockIO is the bytes a container has read from and written to block
+// devices since it started, and the rates since the collector's previous
+// sample, nil like interfaceTraffic's
+type blockIO struct {
+	ReadBytes  uint64   `json:"read_bytes"`
+	WriteBytes uint64   `json:"write_bytes"`
+	ReadRate   *float64 `json:"read_bytes_per_second"`
+	WriteRate  *float64 `json:"write_bytes_per_second"`
+}
+
+// blockTraffic sums stats' block I/O over devices, with rates against
+// previous like networkTraffic. cgroup v1 reports the ops as Read and
+// Write, v2 as read and write.
+func blockTraffic(stats types.StatsJSON, previous *types.StatsJSON) blockIO {
+	read, write := blockBytes(stats)
+	traffic := blockIO{ReadBytes: read, WriteBytes: write}
+	if previous == nil {
+		return traffic
+	}
+	elapsed := stats.Read.Sub(previous.Read).Seconds()
+	lastRead, lastWrite := blockBytes(*previous)
+	if elapsed > 0 && read >= lastRead && write >= lastWrite {
+		readRate := float64(read-lastRead) / elapsed
+		writeRate := float64(write-lastWrite) / elapsed
+		traffic.ReadRate, traffic.WriteRate = &readRate, &writeRate
+	}
+	return traffic
+}
+
+func blockBytes(stats types.StatsJSON) (read, write uint64) {
+	for _, entry := range stats.BlkioStats.IoServiceBytesRecursive {
+		switch strings.ToLower(entry.Op) {
+		case "read":
+			read += entry.Value
+		case "write":
+			write += entry.Value
+		}
+	}
+	return read, write
+}
+
+// networkRates sums the interfaces' rates, or returns nil when any is
+// unknown
+func networkRates(network []interfaceTraffic) (rx, tx *float64) {
+	var rxSum, txSum float64
+	for _, traffic := range network {
+		if traffic.RxRate == nil {
+			return nil, nil
+		}
+		rxSum += *traffic.RxRate
+		txSum += *traffic.TxRate
+	}
+	return &rxSum, &txSum
+}
+
+// Name is the container's name without the leading slash
+func (s statsSample) Name() string {
+	if len(s.Container.Names) == 0 {
+		return s.Container.ID[:12]
+	}
+	return strings.TrimPrefix(s.Container.Names[0], "/")
+}
+
+// statsCollector keeps the latest sample of each running container on a
+// host, for consumers that would otherwise each poll the daemon
+type statsCollector struct {
+	host *dockerHost
+
+	mu      sync.RWMutex
+	samples map[string]statsSample
+}
+
+// statsCollectors holds a collector per host once started
+var statsCollectors = map[string]*statsCollector{}
+
+// statsListeners are called with each host's samples after every round.
+// The exporters add theirs while this replica leads, as the collectors run.
+var (
+	statsListenersMu sync.RWMutex
+	statsListeners   = map[*statsListener]struct{}{}
+)
+
+// statsListener wraps a listener so it can be removed again
+type statsListener struct {
+	fn func(host string, samples []statsSample)
+}
+
+// addStatsListener calls fn after every round until ctx is done
+func addStatsListener(ctx context.Context, fn func(host string, samples []statsSample)) {
+	l := &statsListener{fn: fn}
+	statsListenersMu.Lock()
+	statsListeners[l] = struct{}{}
+	statsListenersMu.Unlock()
+	go func() {
+		<-ctx.Done()
+		statsListenersMu.Lock()
+		delete(statsListeners, l)
+		statsListenersMu.Unlock()
+	}()
+}
+
+// startStatsCollector samples every host's containers in the background,
+// for network rates and the stats exporters
+func startStatsCollector() {
+	for name, host := range dockerHosts {
+		sc := &statsCollector{host: host, samples: map[string]statsSample{}}
+		statsCollectors[name] = sc
+		go sc.run()
+	}
+}
+
+func (sc *statsCollector) run() {
+	for {
+		start := time.Now()
+		sc.collect()
+		time.Sleep(max(statsInterval-time.Since(start), time.Second))
+	}
+}
+
+// collect samples every running container once, a few at a time since
+// each sample takes the daemon about a second
+func (sc *statsCollector) collect() {
+	ctx, cancel := context.WithTimeout(withHost(context.Background(), sc.host), statsInterval)
+	defer cancel()
+	containers, err := docker(ctx).ContainerList(ctx, container.ListOptions{})
+	if err != nil {
+		logger.Debug("listing containers for stats", "host", sc.host.Name, "error", err)
+		return
+	}
+
+	sc.mu.RLock()
+	previous := sc.samples
+	sc.mu.RUnlock()
+
+	var mu sync.Mutex
+	samples := map[string]statsSample{}
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(8)
+	for _, cont := range containers {
+		cont := cont
+		g.Go(func() error {
+			stats, err := sampleStats(gctx, cont.ID)
+			if err != nil {
+				logger.Debug("sampling container stats", "host", sc.host.Name, "container", cont.ID, "error", err)
+				return nil
+			}
+			var last *types.StatsJSON
+			if p, ok := previous[cont.ID]; ok {
+				last = &p.Stats
+			}
+			mu.Lock()
+			samples[cont.ID] = statsSample{Host: sc.host.Name, Container: cont, Stats: stats, Network: networkTraffic(stats, last), BlockIO: blockTraffic(stats, last)}
+			mu.Unlock()
+			return nil
+		})
+	}
+	g.Wait()
+
+	sc.mu.Lock()
+	sc.samples = samples
+	sc.mu.Unlock()
+	statsListenersMu.RLock()
+	var listeners []*statsListener
+	for l := range statsListeners {
+		listeners = append(listeners, l)
+	}
+	statsListenersMu.RUnlock()
+	list := sc.latest()
+	for _, l := range listeners {
+		l.fn(sc.host.Name, list)
+	}
+}
+
+// latest returns the last round's samples, by container name
+func (sc *statsCollector) latest() []statsSample {
+	sc.mu.RLock()
+	defer sc.mu.RUnlock()
+	list := make([]statsSample, 0, len(sc.samples))
+	for _, sample := range sc.samples {
+		list = append(list, sample)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name() < list[j].Name() })
+	return list
+}
+
+// sample returns the last round's sample of a container
+func (sc *statsCollector) sample(containerID string) (statsSample, bool) {
+	sc.mu.RLock()
+	defer sc.mu.RUnlock()
+	sample, ok := sc.samples[containerID]
+	return sample, ok
+}
+
+// collectedSample returns the collector's latest sample of a container on
+// the host ctx carries
+func collectedSample(ctx context.Context, containerID string) (statsSample, bool) {
+	sc, ok := statsCollectors[hostFrom(ctx).Name]
+	if !ok {
+		return statsSample{}, false
+	}
+	return sc.sample(containerID)
+}
+
+// sampleStats reads one stats sample, which includes the previous CPU
+// reading so usage can be computed
+func sampleStats(ctx context.Context, containerID string) (types.StatsJSON, error) {
+	var stats types.StatsJSON
+	resp, err := docker(ctx).ContainerStats(ctx, containerID, false)
+	if err != nil {
+		return stats, err
+	}
+	defer resp.Body.Close()
+	err = json.NewDecoder(resp.Body).Decode(&stats)
+	return stats, err
+}
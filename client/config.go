@@ -0,0 +1,45 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"time"
+)
+
+// envOr returns the environment variable name, or def when it is unset
+func envOr(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
+// envDuration parses the environment variable name as a duration such as
+// "30s" or "1h", returning def when it is unset or invalid
+func envDuration(name string, def time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		logger.Warn("invalid duration, using default", "variable", name, "value", v, "default", def.String())
+		return def
+	}
+	return d
+}
+
+// envInt parses the environment variable name as an integer, returning def
+// when it is unset or invalid
+func envInt(name string, def int64) int64 {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		logger.Warn("invalid integer, using default", "variable", name, "value", v, "default", def)
+		return def
+	}
+	return n
+}
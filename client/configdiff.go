@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/gin-gonic/gin"
+)
+
+// configChange is one setting that differs between two containers. A or B
+// is null when only the other container has the setting.
+type configChange struct {
+	Key string      `json:"key"`
+	A   interface{} `json:"a"`
+	B   interface{} `json:"b"`
+}
+
+// mountConfig is what a container mounts at one destination
+type mountConfig struct {
+	Type   string `json:"type"`
+	Source string `json:"source,omitempty"`
+	Name   string `json:"name,omitempty"`
+	RW     bool   `json:"rw"`
+}
+
+// diffValues compares two sets of settings by key, in key order
+func diffValues(a, b map[string]interface{}) []configChange {
+	keys := make([]string, 0, len(a)+len(b))
+	for key := range a {
+		keys = append(keys, key)
+	}
+	for key := range b {
+		if _, ok := a[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	changes := []configChange{}
+	for _, key := range keys {
+		if !reflect.DeepEqual(a[key], b[key]) {
+			changes = append(changes, configChange{Key: key, A: a[key], B: b[key]})
+		}
+	}
+	return changes
+}
+
+// stringValues turns variables or labels into diffable settings, keeping
+// the keys keep accepts
+func stringValues(values map[string]string, keep func(key string) bool) map[string]interface{} {
+	out := map[string]interface{}{}
+	for key, value := range values {
+		if keep(key) {
+			out[key] = value
+		}
+	}
+	return out
+}
+
+// redactChanges masks the values of changes the rules for role mask
+func redactChanges(changes []configChange, field, role string) []configChange {
+	for i, change := range changes {
+		if fieldRedaction(field, change.Key, role) != redactMask {
+			continue
+		}
+		if change.A != nil {
+			changes[i].A = maskedValue
+		}
+		if change.B != nil {
+			changes[i].B = maskedValue
+		}
+	}
+	return changes
+}
+
+// envValues maps NAME=value variables by name
+func envValues(env []string) map[string]string {
+	values := make(map[string]string, len(env))
+	for _, e := range env {
+		name, value, _ := strings.Cut(e, "=")
+		values[name] = value
+	}
+	return values
+}
+
+// commandValues is a container's entrypoint and command, redacted for
+// role unless reveal
+func commandValues(config *container.Config, role string, reveal bool) map[string]interface{} {
+	command := container.Config{Entrypoint: config.Entrypoint, Cmd: config.Cmd}
+	if !reveal {
+		redactConfig(&command, role)
+	}
+	values := map[string]interface{}{}
+	if len(command.Entrypoint) > 0 {
+		values["entrypoint"] = []string(command.Entrypoint)
+	}
+	if len(command.Cmd) > 0 {
+		values["cmd"] = []string(command.Cmd)
+	}
+	return values
+}
+
+// mountValues maps a container's mounts by destination
+func mountValues(inspection types.ContainerJSON) map[string]interface{} {
+	values := map[string]interface{}{}
+	for _, m := range inspection.Mounts {
+		values[m.Destination] = mountConfig{Type: string(m.Type), Source: m.Source, Name: m.Name, RW: m.RW}
+	}
+	return values
+}
+
+// limitValues is a container's resource limits, leaving out those not set
+func limitValues(hostConfig *container.HostConfig) map[string]interface{} {
+	values := map[string]interface{}{}
+	if hostConfig == nil {
+		return values
+	}
+	r := hostConfig.Resources
+	set := func(key string, value int64) {
+		if value != 0 {
+			values[key] = value
+		}
+	}
+	set("memory", r.Memory)
+	set("memory_reservation", r.MemoryReservation)
+	set("memory_swap", r.MemorySwap)
+	set("nano_cpus", r.NanoCPUs)
+	set("cpu_shares", r.CPUShares)
+	set("cpu_quota", r.CPUQuota)
+	set("cpu_period", r.CPUPeriod)
+	set("blkio_weight", int64(r.BlkioWeight))
+	if r.PidsLimit != nil {
+		set("pids_limit", *r.PidsLimit)
+	}
+	if r.CpusetCpus != "" {
+		values["cpuset_cpus"] = r.CpusetCpus
+	}
+	for _, u := range r.Ulimits {
+		values["ulimit_"+u.Name] = fmt.Sprintf("%d:%d", u.Soft, u.Hard)
+	}
+	if hostConfig.ShmSize != 0 {
+		values["shm_size"] = hostConfig.ShmSize
+	}
+	return values
+}
+
+// otherValues is the rest of what commonly makes two containers behave
+// differently: restart policy, published ports, networks and user
+func otherValues(inspection types.ContainerJSON) map[string]interface{} {
+	values := map[string]interface{}{}
+	if inspection.HostConfig != nil {
+		values["restart_policy"] = string(inspection.HostConfig.RestartPolicy.Name)
+		values["network_mode"] = string(inspection.HostConfig.NetworkMode)
+		for port, bindings := range inspection.HostConfig.PortBindings {
+			published := make([]string, 0, len(bindings))
+			for _, b := range bindings {
+				published = append(published, strings.TrimPrefix(b.HostIP+":"+b.HostPort, ":"))
+			}
+			values["port "+string(port)] = strings.Join(published, ",")
+		}
+	}
+	if inspection.Config != nil && inspection.Config.User != "" {
+		values["user"] = inspection.Config.User
+	}
+	if inspection.NetworkSettings != nil {
+		for name := range inspection.NetworkSettings.Networks {
+			values["network "+name] = true
+		}
+	}
+	return values
+}
+
+// inspectRef resolves and inspects a container for the diff
+func inspectRef(ctx context.Context, ref string) (types.ContainerJSON, error) {
+	cont, err := resolveContainer(ctx, ref)
+	if err != nil {
+		return types.ContainerJSON{}, err
+	}
+	return docker(ctx).ContainerInspect(ctx, cont.ID)
+}
+
+// diffContainers compares the configuration of containers a and b, by
+// section, listing only the settings that differ. b may be on another
+// host, named by ?b_host=; both default to the selected host. Environment
+// variables, labels and commands are redacted as in inspect unless an
+// admin asks for ?reveal=true.
+func diffContainers(c *gin.Context) {
+	refA, refB := c.Query("a"), c.Query("b")
+	if refA == "" || refB == "" {
+		badRequest(c, "a and b are required")
+		return
+	}
+	ctxA := hostContext(c)
+	ctxB := ctxA
+	if name := c.Query("b_host"); name != "" {
+		host, ok := dockerHosts[name]
+		if !ok {
+			respondError(c, http.StatusNotFound, codeHostNotFound, fmt.Sprintf("Host %s is not configured", name))
+			return
+		}
+		ctxB = withHost(c.Request.Context(), host)
+	}
+	reveal, ok := wantsReveal(c)
+	if !ok {
+		return
+	}
+
+	a, err := inspectRef(ctxA, refA)
+	if err != nil {
+		dockerError(c, "Error inspecting container "+refA, err)
+		return
+	}
+	b, err := inspectRef(ctxB, refB)
+	if err != nil {
+		dockerError(c, "Error inspecting container "+refB, err)
+		return
+	}
+	if a.Config == nil || b.Config == nil {
+		respondError(c, http.StatusInternalServerError, codeInternal, "Container has no configuration")
+		return
+	}
+
+	// Masked values are compared as they are and masked afterwards, so a
+	// masked setting that differs is still reported
+	role := callerRole(c)
+	section := func(field string, valuesA, valuesB map[string]string) []configChange {
+		keep := func(key string) bool {
+			return reveal || fieldRedaction(field, key, role) != redactStrip
+		}
+		changes := diffValues(stringValues(valuesA, keep), stringValues(valuesB, keep))
+		if reveal {
+			return changes
+		}
+		return redactChanges(changes, field, role)
+	}
+	differences := map[string][]configChange{
+		"image": diffValues(
+			map[string]interface{}{"image": a.Config.Image, "image_id": a.Image},
+			map[string]interface{}{"image": b.Config.Image, "image_id": b.Image},
+		),
+		"command": diffValues(commandValues(a.Config, role, reveal), commandValues(b.Config, role, reveal)),
+		"env":     section(redactEnv, envValues(a.Config.Env), envValues(b.Config.Env)),
+		"labels":  section(redactLabels, a.Config.Labels, b.Config.Labels),
+		"mounts":  diffValues(mountValues(a), mountValues(b)),
+		"limits":  diffValues(limitValues(a.HostConfig), limitValues(b.HostConfig)),
+		"other":   diffValues(otherValues(a), otherValues(b)),
+	}
+	identical := true
+	for _, changes := range differences {
+		if len(changes) > 0 {
+			identical = false
+		}
+	}
+	respond(c, http.StatusOK, gin.H{
+		"a":           gin.H{"id": a.ID, "name": strings.TrimPrefix(a.Name, "/"), "host": hostFrom(ctxA).Name},
+		"b":           gin.H{"id": b.ID, "name": strings.TrimPrefix(b.Name, "/"), "host": hostFrom(ctxB).Name},
+		"identical":   identical,
+		"differences": differences,
+	})
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	timetypes "github.com/docker/docker/api/types/time"
+	"github.com/docker/docker/errdefs"
+	"github.com/gin-gonic/gin"
+)
+
+// confirmationHeader carries the token from a preview endpoint; it may
+// also be sent as confirmation_token in the request body
+const confirmationHeader = "X-Confirmation-Token"
+
+// requireConfirmation makes container delete and prune take a token from
+// their preview endpoint; CONTAINERSCOPE_REQUIRE_CONFIRMATION=false turns
+// that off for automation that cannot do two steps
+var requireConfirmation = os.Getenv("CONTAINERSCOPE_REQUIRE_CONFIRMATION") != "false"
+
+// confirmationTTL is how long a preview's token stays valid
+var confirmationTTL = envDuration("CONTAINERSCOPE_CONFIRMATION_TTL", 2*time.Minute)
+
+// anonymousVolumePattern matches the generated names of anonymous volumes,
+// the only ones remove_volumes deletes
+var anonymousVolumePattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// confirmationBucket holds the issued tokens, keyed by their hash, so a
+// token from one replica is accepted by the others
+const confirmationBucket = "confirmations"
+
+// pendingConfirmation is an issued token: the caller and the exact
+// operation it allows, once, until it expires
+type pendingConfirmation struct {
+	Client  string    `json:"client"`
+	Digest  string    `json:"digest"`
+	Expires time.Time `json:"expires"`
+}
+
+// previewVolume is a mount of a container about to be destroyed
+type previewVolume struct {
+	Name        string `json:"name,omitempty"`
+	Type        string `json:"type"`
+	Source      string `json:"source,omitempty"`
+	Destination string `json:"destination"`
+	// Removed is true for anonymous volumes deleted with remove_volumes;
+	// named volumes and bind mounts are always kept
+	Removed bool `json:"removed"`
+}
+
+// previewContainer is a container that would be destroyed
+type previewContainer struct {
+	ID      string          `json:"id"`
+	FullID  string          `json:"full_id"`
+	Name    string          `json:"name"`
+	Image   string          `json:"image"`
+	State   string          `json:"state"`
+	Running bool            `json:"running"`
+	Volumes []previewVolume `json:"volumes"`
+}
+
+// destructivePreview is what a preview endpoint returns
+type destructivePreview struct {
+	Action         string             `json:"action"`
+	Token          string             `json:"token"`
+	ExpiresAt      time.Time          `json:"expires_at"`
+	Containers     []previewContainer `json:"containers"`
+	VolumesRemoved int                `json:"volumes_removed"`
+	// Quarantine is true when a delete keeps the containers for
+	// CONTAINERSCOPE_QUARANTINE_RETENTION before removing them
+	Quarantine bool `json:"quarantine,omitempty"`
+}
+
+// operationDigest identifies an operation by its action, options and the
+// full IDs of the containers it destroys
+func operationDigest(action string, options string, ids []string) string {
+	sorted := append([]string(nil), ids...)
+	sort.Strings(sorted)
+	sum := sha256.Sum256([]byte(action + "\n" + options + "\n" + strings.Join(sorted, "\n")))
+	return hex.EncodeToString(sum[:])
+}
+
+// issueConfirmation stores a token for the caller's operation, and
+// forgets the expired ones
+func issueConfirmation(c *gin.Context, digest string) (string, time.Time, error) {
+	token := newWebhookSecret()
+	now := time.Now()
+	expires := now.Add(confirmationTTL)
+	var expired []string
+	err := storeEach(confirmationBucket, func(key string, value []byte) error {
+		var pending pendingConfirmation
+		if json.Unmarshal(value, &pending) != nil || now.After(pending.Expires) {
+			expired = append(expired, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", expires, err
+	}
+	for _, key := range expired {
+		storeDelete(confirmationBucket, key)
+	}
+	// Tokens are hashed like session tokens, so the store does not hold them
+	err = storePut(confirmationBucket, sessionKey(token), pendingConfirmation{Client: clientKey(c), Digest: digest, Expires: expires})
+	return token, expires, err
+}
+
+// confirmed consumes the request's token if it allows the operation, and
+// otherwise replies 428, or 409 when the containers changed since the
+// preview
+func confirmed(c *gin.Context, token, digest string) bool {
+	if !requireConfirmation {
+		return true
+	}
+	if token == "" {
+		respondError(c, http.StatusPreconditionRequired, codeConfirmationRequired, "This operation needs a confirmation token from its preview endpoint")
+		return false
+	}
+	var pending pendingConfirmation
+	ok, err := storeTake(confirmationBucket, sessionKey(token), &pending)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, codeInternal, "Error reading confirmation token: "+err.Error())
+		return false
+	}
+	if !ok || time.Now().After(pending.Expires) || pending.Client != clientKey(c) {
+		respondError(c, http.StatusPreconditionRequired, codeConfirmationRequired, "Confirmation token is invalid or has expired; request a new preview")
+		return false
+	}
+	if pending.Digest != digest {
+		respondError(c, http.StatusConflict, codeConflict, "The containers affected have changed since the preview; request a new preview")
+		return false
+	}
+	return true
+}
+
+// confirmationToken reads the token from the header or the request body's
+// confirmation_token field, leaving the body for the handler
+func confirmationToken(c *gin.Context) string {
+	if token := c.GetHeader(confirmationHeader); token != "" {
+		return token
+	}
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		return ""
+	}
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+	var req struct {
+		ConfirmationToken string `json:"confirmation_token"`
+	}
+	json.Unmarshal(body, &req)
+	return req.ConfirmationToken
+}
+
+// describeContainers builds the preview of the containers to destroy
+func describeContainers(list []types.Container, removeVolumes bool) ([]previewContainer, int) {
+	previews := []previewContainer{}
+	removed := 0
+	for _, cont := range list {
+		preview := previewContainer{
+			ID:      cont.ID[:10],
+			FullID:  cont.ID,
+			Name:    strings.TrimPrefix(cont.Names[0], "/"),
+			Image:   cont.Image,
+			State:   cont.State,
+			Running: cont.State == "running",
+			Volumes: []previewVolume{},
+		}
+		for _, mount := range cont.Mounts {
+			volume := previewVolume{
+				Name:        mount.Name,
+				Type:        string(mount.Type),
+				Source:      mount.Source,
+				Destination: mount.Destination,
+				Removed:     removeVolumes && mount.Type == "volume" && anonymousVolumePattern.MatchString(mount.Name),
+			}
+			if volume.Removed {
+				removed++
+			}
+			preview.Volumes = append(preview.Volumes, volume)
+		}
+		previews = append(previews, preview)
+	}
+	sort.Slice(previews, func(i, j int) bool { return previews[i].Name < previews[j].Name })
+	return previews, removed
+}
+
+// deleteTargets resolves the containers a delete request selects
+func deleteTargets(ctx context.Context, req actionRequest) ([]types.Container, error) {
+	refs := req.ContainerIDs
+	if req.ContainerID != "" {
+		refs = []string{req.ContainerID}
+	}
+	list := []types.Container{}
+	if req.Label != "" {
+		all, err := docker(ctx).ContainerList(ctx, container.ListOptions{
+			All:     true,
+			Filters: scopeFilters(ctx, filters.NewArgs(filters.Arg("label", req.Label))),
+		})
+		if err != nil {
+			return nil, err
+		}
+		// The delete itself skips quarantined containers, as resolveTargets does
+		for _, cont := range all {
+			if !inQuarantine(cont) {
+				list = append(list, cont)
+			}
+		}
+		return list, nil
+	}
+	for _, ref := range refs {
+		cont, err := resolveContainer(ctx, ref)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, cont)
+	}
+	return list, nil
+}
+
+// deleteDigest identifies a delete of list with req's options
+func deleteDigest(req actionRequest, list []types.Container) string {
+	options, _ := json.Marshal(struct {
+		container.RemoveOptions
+		Quarantine bool
+	}{req.removeOptions(), req.quarantines()})
+	ids := make([]string, len(list))
+	for i, cont := range list {
+		ids[i] = cont.ID
+	}
+	return operationDigest("delete", string(options), ids)
+}
+
+// previewDelete shows what DELETE /containers/delete would remove for the
+// same container_id, container_ids or label, force and remove_volumes,
+// with the token that allows it
+func previewDelete(c *gin.Context) {
+	req := actionRequest{ContainerID: c.Query("container_id"), Label: c.Query("label"), RemoveVolumes: c.Query("remove_volumes") == "true"}
+	if v := c.Query("quarantine"); v != "" {
+		quarantine := v == "true"
+		req.Quarantine = &quarantine
+	}
+	for _, v := range c.QueryArray("container_ids") {
+		req.ContainerIDs = append(req.ContainerIDs, strings.Split(v, ",")...)
+	}
+	if v := c.Query("force"); v != "" {
+		force := v == "true"
+		req.Force = &force
+	}
+	selectors := 0
+	for _, set := range []bool{req.ContainerID != "", len(req.ContainerIDs) > 0, req.Label != ""} {
+		if set {
+			selectors++
+		}
+	}
+	if selectors != 1 {
+		badRequest(c, "Specify exactly one of container_id, container_ids or label")
+		return
+	}
+
+	ctx := hostContext(c)
+	list, err := deleteTargets(ctx, req)
+	if err != nil {
+		dockerError(c, "Error finding containers", err)
+		return
+	}
+	preview := destructivePreview{Action: "delete"}
+	preview.Quarantine = req.quarantines()
+	preview.Containers, preview.VolumesRemoved = describeContainers(list, req.RemoveVolumes)
+	if preview.Token, preview.ExpiresAt, err = issueConfirmation(c, deleteDigest(req, list)); err != nil {
+		respondError(c, http.StatusInternalServerError, codeInternal, "Error storing confirmation token: "+err.Error())
+		return
+	}
+	respond(c, http.StatusOK, preview)
+}
+
+// confirmDelete checks a delete request's token against the containers it
+// selects now
+func confirmDelete(c *gin.Context) bool {
+	if !requireConfirmation {
+		return true
+	}
+	token := confirmationToken(c)
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		badRequest(c, "Error reading request body")
+		return false
+	}
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+	var req actionRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		badRequest(c, "Invalid request")
+		return false
+	}
+	list, err := deleteTargets(hostContext(c), req)
+	if err != nil {
+		dockerError(c, "Error finding containers", err)
+		return false
+	}
+	return confirmed(c, token, deleteDigest(req, list))
+}
+
+// pruneRequest is the body of POST /containers/prune; its preview takes
+// the same fields as query parameters
+type pruneRequest struct {
+	Until         string   `json:"until" form:"until"`
+	Labels        []string `json:"labels" form:"labels"`
+	ExcludeLabels []string `json:"exclude_labels" form:"exclude_labels"`
+}
+
+// pruneCandidates lists the stopped containers a prune removes: those not
+// running, paused or restarting that match the label filters and were
+// created before until, leaving out quarantined containers
+func pruneCandidates(ctx context.Context, req pruneRequest) ([]types.Container, error) {
+	var cutoff time.Time
+	if req.Until != "" {
+		ts, err := timetypes.GetTimestamp(req.Until, time.Now())
+		if err != nil {
+			return nil, errdefs.InvalidParameter(fmt.Errorf("until must be an RFC3339 time, a Unix timestamp or a duration such as 24h"))
+		}
+		cutoff = logTimeBound(ts)
+	}
+	args := filters.NewArgs()
+	for _, label := range req.Labels {
+		args.Add("label", label)
+	}
+	// The size is what removing the container reclaims
+	list, err := docker(ctx).ContainerList(ctx, container.ListOptions{All: true, Size: true, Filters: args})
+	if err != nil {
+		return nil, err
+	}
+	excluded := filters.NewArgs()
+	for _, label := range req.ExcludeLabels {
+		excluded.Add("label", label)
+	}
+	candidates := []types.Container{}
+	for _, cont := range list {
+		switch {
+		case cont.State == "running" || cont.State == "paused" || cont.State == "restarting":
+		case inQuarantine(cont):
+		case len(req.ExcludeLabels) > 0 && excluded.MatchKVList("label", cont.Labels):
+		case !cutoff.IsZero() && !time.Unix(cont.Created, 0).Before(cutoff):
+		default:
+			candidates = append(candidates, cont)
+		}
+	}
+	return candidates, nil
+}
+
+// pruneDigest identifies a prune of list with req's filters
+func pruneDigest(req pruneRequest, list []types.Container) string {
+	options, _ := json.Marshal(req)
+	ids := make([]string, len(list))
+	for i, cont := range list {
+		ids[i] = cont.ID
+	}
+	return operationDigest("prune", string(options), ids)
+}
+
+// previewPrune shows the stopped containers POST /containers/prune would
+// remove for the same until, labels and exclude_labels, with the token
+// that allows it
+func previewPrune(c *gin.Context) {
+	var req pruneRequest
+	if err := c.ShouldBindQuery(&req); err != nil {
+		badRequest(c, "Invalid request")
+		return
+	}
+	list, err := pruneCandidates(hostContext(c), req)
+	if err != nil {
+		dockerError(c, "Error listing containers", err)
+		return
+	}
+	preview := destructivePreview{Action: "prune"}
+	preview.Containers, _ = describeContainers(list, false)
+	if preview.Token, preview.ExpiresAt, err = issueConfirmation(c, pruneDigest(req, list)); err != nil {
+		respondError(c, http.StatusInternalServerError, codeInternal, "Error storing confirmation token: "+err.Error())
+		return
+	}
+	respond(c, http.StatusOK, preview)
+}
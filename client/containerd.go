@@ -0,0 +1,565 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	_ "github.com/containerd/cgroups/v3/cgroup1/stats"
+	_ "github.com/containerd/cgroups/v3/cgroup2/stats"
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/cio"
+	cerrdefs "github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/typeurl/v2"
+	"github.com/docker/docker/errdefs"
+	"github.com/gin-gonic/gin"
+)
+
+// Labels nerdctl and the kubelet put on the containers they create
+const (
+	nerdctlNameLabel     = "nerdctl/name"
+	nerdctlStateDirLabel = "nerdctl/state-dir"
+	nerdctlLogURILabel   = "nerdctl/log-uri"
+	kubePodLabel         = "io.kubernetes.pod.name"
+	kubeContainerLabel   = "io.kubernetes.container.name"
+)
+
+// defaultStopTimeout is how long stop waits after SIGTERM before SIGKILL
+// when the request does not say
+const defaultStopTimeout = 10 * time.Second
+
+var (
+	containerdMu     sync.Mutex
+	containerdClient *containerd.Client
+)
+
+// containerdConn connects to containerd on first use, and again on later
+// calls until a connection succeeds, so the agent can start before
+// containerd does. CONTAINERD_ADDRESS selects the socket; k3s uses
+// /run/k3s/containerd/containerd.sock.
+func containerdConn() (*containerd.Client, error) {
+	containerdMu.Lock()
+	defer containerdMu.Unlock()
+	if containerdClient == nil {
+		address := envOr("CONTAINERD_ADDRESS", "/run/containerd/containerd.sock")
+		client, err := containerd.New(address)
+		if err != nil {
+			return nil, err
+		}
+		containerdClient = client
+	}
+	return containerdClient, nil
+}
+
+// containerdNamespaces returns the namespaces a request covers: the
+// namespace query parameter, CONTAINERD_NAMESPACE, or every namespace
+func containerdNamespaces(ctx context.Context, c *gin.Context, client *containerd.Client) ([]string, error) {
+	return namespacesOrAll(ctx, client, c.DefaultQuery("namespace", os.Getenv("CONTAINERD_NAMESPACE")))
+}
+
+// namespacesOrAll returns ns, or every namespace when ns is ""
+func namespacesOrAll(ctx context.Context, client *containerd.Client, ns string) ([]string, error) {
+	if ns != "" {
+		return []string{ns}, nil
+	}
+	return client.NamespaceService().List(ctx)
+}
+
+// containerdNamespaceKey carries the namespace a request covers to work
+// done for it without the request, such as selecting containers by label
+type containerdNamespaceKey struct{}
+
+// withContainerdNamespace returns ctx carrying the namespace c covers, ""
+// for every namespace
+func withContainerdNamespace(ctx context.Context, c *gin.Context) context.Context {
+	return context.WithValue(ctx, containerdNamespaceKey{}, c.DefaultQuery("namespace", os.Getenv("CONTAINERD_NAMESPACE")))
+}
+
+// containerdNotFound makes containerd's not found errors look like
+// Docker's so dockerError reports them as 404s
+func containerdNotFound(err error) error {
+	if cerrdefs.IsNotFound(err) {
+		return errdefs.NotFound(err)
+	}
+	return err
+}
+
+// findContainerdContainer looks a container up by ID across the namespaces
+// the request covers, returning a context scoped to its namespace
+func findContainerdContainer(ctx context.Context, c *gin.Context, id string) (context.Context, containerd.Container, error) {
+	client, err := containerdConn()
+	if err != nil {
+		return nil, nil, err
+	}
+	nss, err := containerdNamespaces(ctx, c, client)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, ns := range nss {
+		nsCtx := namespaces.WithNamespace(ctx, ns)
+		cont, err := client.LoadContainer(nsCtx, id)
+		if err == nil {
+			return nsCtx, cont, nil
+		}
+		if !cerrdefs.IsNotFound(err) {
+			return nil, nil, err
+		}
+	}
+	return nil, nil, errdefs.NotFound(fmt.Errorf("no such container: %s", id))
+}
+
+// containerdName picks a human readable name from the labels nerdctl or
+// the kubelet set, falling back to the ID
+func containerdName(id string, labels map[string]string) string {
+	if name := labels[nerdctlNameLabel]; name != "" {
+		return name
+	}
+	if pod := labels[kubePodLabel]; pod != "" {
+		return pod + "/" + labels[kubeContainerLabel]
+	}
+	return id
+}
+
+// containerdState reports the task status, or "created" for a container
+// without a task
+func containerdState(ctx context.Context, cont containerd.Container) string {
+	task, err := cont.Task(ctx, nil)
+	if err != nil {
+		return "created"
+	}
+	status, err := task.Status(ctx)
+	if err != nil {
+		return "unknown"
+	}
+	return string(status.Status)
+}
+
+// containerdListContainers lists containers in every namespace the request
+// covers, with the same core fields as the Docker listing
+func containerdListContainers(c *gin.Context) {
+	ctx := c.Request.Context()
+	client, err := containerdConn()
+	if err != nil {
+		dockerError(c, "Error connecting to containerd", err)
+		return
+	}
+	nss, err := containerdNamespaces(ctx, c, client)
+	if err != nil {
+		dockerError(c, "Error listing namespaces", err)
+		return
+	}
+
+	rows := []map[string]interface{}{}
+	for _, ns := range nss {
+		nsCtx := namespaces.WithNamespace(ctx, ns)
+		containers, err := client.Containers(nsCtx)
+		if err != nil {
+			dockerError(c, "Error listing containers", err)
+			return
+		}
+		for _, cont := range containers {
+			info, err := cont.Info(nsCtx, containerd.WithoutRefreshedMetadata)
+			if err != nil {
+				continue
+			}
+			state := containerdState(nsCtx, cont)
+			if c.Query("all") != "true" && state != string(containerd.Running) {
+				continue
+			}
+			rows = append(rows, map[string]interface{}{
+				"id":        info.ID,
+				"name":      containerdName(info.ID, info.Labels),
+				"image":     info.Image,
+				"state":     state,
+				"namespace": ns,
+				"runtime":   info.Runtime.Name,
+				"labels":    info.Labels,
+				"created":   info.CreatedAt.Unix(),
+			})
+		}
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i]["name"].(string) < rows[j]["name"].(string) })
+
+	respond(c, http.StatusOK, rows)
+}
+
+// containerdInspectContainer returns the container record, its OCI spec
+// and the task's state
+func containerdInspectContainer(c *gin.Context) {
+	ctx, cont, err := findContainerdContainer(c.Request.Context(), c, c.Param("container_id"))
+	if err != nil {
+		dockerError(c, "Error inspecting container", err)
+		return
+	}
+	info, err := cont.Info(ctx)
+	if err != nil {
+		dockerError(c, "Error inspecting container", containerdNotFound(err))
+		return
+	}
+	spec, err := cont.Spec(ctx)
+	if err != nil {
+		dockerError(c, "Error reading container spec", err)
+		return
+	}
+	namespace, _ := namespaces.Namespace(ctx)
+
+	result := gin.H{
+		"id":        info.ID,
+		"name":      containerdName(info.ID, info.Labels),
+		"namespace": namespace,
+		"image":     info.Image,
+		"labels":    info.Labels,
+		"runtime":   info.Runtime.Name,
+		"snapshot":  info.SnapshotKey,
+		"created":   info.CreatedAt,
+		"updated":   info.UpdatedAt,
+		"spec":      spec,
+		"state":     containerdState(ctx, cont),
+	}
+	if task, err := cont.Task(ctx, nil); err == nil {
+		result["pid"] = task.Pid()
+		if status, err := task.Status(ctx); err == nil && status.Status == containerd.Stopped {
+			result["exit_code"] = status.ExitStatus
+			result["exited_at"] = status.ExitTime
+		}
+	}
+
+	respond(c, http.StatusOK, result)
+}
+
+// containerdContainerLogs reads the json-file log nerdctl keeps for each
+// container. Containers started by other clients have no log the agent can
+// find.
+func containerdContainerLogs(c *gin.Context) {
+	ctx, cont, err := findContainerdContainer(c.Request.Context(), c, c.Param("container_id"))
+	if err != nil {
+		dockerError(c, "Error retrieving container logs", err)
+		return
+	}
+	labels, err := cont.Labels(ctx)
+	if err != nil {
+		dockerError(c, "Error retrieving container logs", containerdNotFound(err))
+		return
+	}
+	stateDir := labels[nerdctlStateDirLabel]
+	if stateDir == "" {
+		respondError(c, http.StatusNotImplemented, codeNotSupported, "Logs are only available for containers created by nerdctl")
+		return
+	}
+
+	file, err := os.Open(filepath.Join(stateDir, cont.ID()+"-json.log"))
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, codeInternal, fmt.Sprintf("Error opening log file: %v", err))
+		return
+	}
+	defer file.Close()
+
+	q, err := parseLogQuery(c)
+	if err != nil {
+		badRequest(c, err.Error())
+		return
+	}
+	since, until := logTimeBound(q.options.Since), logTimeBound(q.options.Until)
+	lines, _ := strconv.Atoi(q.options.Tail)
+
+	var logLines []string
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry struct {
+			Log  string    `json:"log"`
+			Time time.Time `json:"time"`
+		}
+		if json.Unmarshal(scanner.Bytes(), &entry) != nil {
+			continue
+		}
+		if !since.IsZero() && entry.Time.Before(since) || !until.IsZero() && entry.Time.After(until) {
+			continue
+		}
+		line := strings.TrimRight(entry.Log, "\n")
+		if q.options.Timestamps {
+			line = entry.Time.Format(time.RFC3339Nano) + " " + line
+		}
+		if q.grep != nil && !q.grep.MatchString(stripANSI(line)) {
+			continue
+		}
+		logLines = append(logLines, q.render(line))
+		if lines > 0 && len(logLines) > lines {
+			logLines = logLines[1:]
+		}
+	}
+
+	respond(c, http.StatusOK, formatLogs(strings.Join(logLines, "\n")))
+}
+
+// containerdContainerStats returns the task's cgroup metrics, decoded from
+// the cgroup v1 or v2 message containerd reports
+func containerdContainerStats(c *gin.Context) {
+	ctx, cont, err := findContainerdContainer(c.Request.Context(), c, c.Param("container_id"))
+	if err != nil {
+		dockerError(c, "Error retrieving container stats", err)
+		return
+	}
+	task, err := cont.Task(ctx, nil)
+	if err != nil {
+		badRequest(c, "Container is not running")
+		return
+	}
+	metric, err := task.Metrics(ctx)
+	if err != nil {
+		dockerError(c, "Error retrieving container stats", err)
+		return
+	}
+	data, err := typeurl.UnmarshalAny(metric.Data)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, codeInternal, fmt.Sprintf("Error decoding metrics: %v", err))
+		return
+	}
+
+	respond(c, http.StatusOK, gin.H{"timestamp": metric.Timestamp.AsTime(), "metrics": data})
+}
+
+// containerdStop sends SIGTERM, waits for the task to exit, kills it if it
+// outlives the timeout, and deletes the task so the container can be
+// started again
+func containerdStop(ctx context.Context, cont containerd.Container, req actionRequest) error {
+	task, err := cont.Task(ctx, nil)
+	if cerrdefs.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	status, err := task.Status(ctx)
+	if err != nil {
+		return err
+	}
+	if status.Status == containerd.Running || status.Status == containerd.Paused {
+		exited, err := task.Wait(ctx)
+		if err != nil {
+			return err
+		}
+		if err := task.Kill(ctx, syscall.SIGTERM); err != nil && !cerrdefs.IsNotFound(err) {
+			return err
+		}
+		timeout := defaultStopTimeout
+		if req.TimeoutSeconds != nil {
+			timeout = time.Duration(*req.TimeoutSeconds) * time.Second
+		}
+		var expired <-chan time.Time
+		if timeout >= 0 {
+			expired = time.After(timeout)
+		}
+		select {
+		case <-exited:
+		case <-expired:
+			if err := task.Kill(ctx, syscall.SIGKILL); err != nil && !cerrdefs.IsNotFound(err) {
+				return err
+			}
+			<-exited
+		}
+	}
+	_, err = task.Delete(ctx)
+	return err
+}
+
+// containerdStart starts a new task for the container, sending output to
+// nerdctl's logger when the container has one
+func containerdStart(ctx context.Context, cont containerd.Container) error {
+	if task, err := cont.Task(ctx, nil); err == nil {
+		status, err := task.Status(ctx)
+		if err != nil {
+			return err
+		}
+		if status.Status == containerd.Running {
+			return nil
+		}
+		if _, err := task.Delete(ctx); err != nil {
+			return err
+		}
+	}
+
+	creator := cio.NullIO
+	labels, err := cont.Labels(ctx)
+	if err != nil {
+		return err
+	}
+	if uri, err := url.Parse(labels[nerdctlLogURILabel]); err == nil && uri.Scheme != "" {
+		creator = cio.LogURI(uri)
+	}
+
+	task, err := cont.NewTask(ctx, creator)
+	if err != nil {
+		return err
+	}
+	return task.Start(ctx)
+}
+
+// containerdAction adapts a containerd operation to the bulk action runner
+func containerdAction(c *gin.Context, action func(ctx context.Context, cont containerd.Container, req actionRequest) error) containerActionFunc {
+	return func(ctx context.Context, containerID string, req actionRequest) error {
+		nsCtx, cont, err := findContainerdContainer(ctx, c, containerID)
+		if err != nil {
+			return err
+		}
+		return containerdNotFound(action(nsCtx, cont, req))
+	}
+}
+
+// containerdLabelTargets returns the IDs of containers carrying label,
+// given as key or key=value, in the namespace ctx carries from its request,
+// or else CONTAINERD_NAMESPACE or every namespace
+func containerdLabelTargets(ctx context.Context, label string) ([]string, error) {
+	client, err := containerdConn()
+	if err != nil {
+		return nil, err
+	}
+	ns, ok := ctx.Value(containerdNamespaceKey{}).(string)
+	if !ok {
+		ns = os.Getenv("CONTAINERD_NAMESPACE")
+	}
+	nss, err := namespacesOrAll(ctx, client, ns)
+	if err != nil {
+		return nil, err
+	}
+
+	filter := fmt.Sprintf("labels.%q", label)
+	if key, value, ok := strings.Cut(label, "="); ok {
+		filter = fmt.Sprintf("labels.%q==%q", key, value)
+	}
+	ids := []string{}
+	for _, ns := range nss {
+		containers, err := client.Containers(namespaces.WithNamespace(ctx, ns), filter)
+		if err != nil {
+			return nil, err
+		}
+		for _, cont := range containers {
+			ids = append(ids, cont.ID())
+		}
+	}
+	return ids, nil
+}
+
+func containerdStartContainer(c *gin.Context) {
+	runContainerAction(c, "started", "Error starting container", containerdAction(c, func(ctx context.Context, cont containerd.Container, _ actionRequest) error {
+		return containerdStart(ctx, cont)
+	}))
+}
+
+func containerdStopContainer(c *gin.Context) {
+	runContainerAction(c, "stopped", "Error stopping container", containerdAction(c, containerdStop))
+}
+
+func containerdRestartContainer(c *gin.Context) {
+	runContainerAction(c, "restarted", "Error restarting container", containerdAction(c, func(ctx context.Context, cont containerd.Container, req actionRequest) error {
+		if err := containerdStop(ctx, cont, req); err != nil {
+			return err
+		}
+		return containerdStart(ctx, cont)
+	}))
+}
+
+// errContainerRunning is returned when deleting a running container
+// without force
+var errContainerRunning = errors.New("container is running; stop it first or set force")
+
+func containerdDeleteContainer(c *gin.Context) {
+	runContainerAction(c, "deleted", "Error deleting container", containerdAction(c, func(ctx context.Context, cont containerd.Container, req actionRequest) error {
+		if state := containerdState(ctx, cont); state == string(containerd.Running) && req.Force != nil && !*req.Force {
+			return errContainerRunning
+		}
+		zero := 0
+		if err := containerdStop(ctx, cont, actionRequest{TimeoutSeconds: &zero}); err != nil {
+			return err
+		}
+		return cont.Delete(ctx, containerd.WithSnapshotCleanup)
+	}))
+}
+
+// containerdListImages lists images in every namespace the request covers
+func containerdListImages(c *gin.Context) {
+	ctx := c.Request.Context()
+	client, err := containerdConn()
+	if err != nil {
+		dockerError(c, "Error connecting to containerd", err)
+		return
+	}
+	nss, err := containerdNamespaces(ctx, c, client)
+	if err != nil {
+		dockerError(c, "Error listing namespaces", err)
+		return
+	}
+
+	rows := []map[string]interface{}{}
+	for _, ns := range nss {
+		nsCtx := namespaces.WithNamespace(ctx, ns)
+		images, err := client.ImageService().List(nsCtx)
+		if err != nil {
+			dockerError(c, "Error listing images", err)
+			return
+		}
+		for _, image := range images {
+			size, _ := image.Size(nsCtx, client.ContentStore(), platforms.Default())
+			rows = append(rows, map[string]interface{}{
+				"name":      image.Name,
+				"digest":    image.Target.Digest.String(),
+				"size":      size,
+				"namespace": ns,
+				"labels":    image.Labels,
+				"created":   image.CreatedAt.Unix(),
+			})
+		}
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i]["name"].(string) < rows[j]["name"].(string) })
+
+	respond(c, http.StatusOK, rows)
+}
+
+// containerdListNamespaces lists containerd namespaces; Kubernetes uses
+// k8s.io and nerdctl uses default
+func containerdListNamespaces(c *gin.Context) {
+	client, err := containerdConn()
+	if err != nil {
+		dockerError(c, "Error connecting to containerd", err)
+		return
+	}
+	nss, err := client.NamespaceService().List(c.Request.Context())
+	if err != nil {
+		dockerError(c, "Error listing namespaces", err)
+		return
+	}
+	sort.Strings(nss)
+
+	respond(c, http.StatusOK, nss)
+}
+
+// containerdVersion returns the containerd version
+func containerdVersion(c *gin.Context) {
+	client, err := containerdConn()
+	if err != nil {
+		dockerError(c, "Error connecting to containerd", err)
+		return
+	}
+	version, err := client.Version(c.Request.Context())
+	if err != nil {
+		dockerError(c, "Error retrieving version", err)
+		return
+	}
+
+	respond(c, http.StatusOK, gin.H{"runtime": runtimeContainerd, "server": version})
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/errdefs"
+	"github.com/gin-gonic/gin"
+)
+
+// containerRefPattern matches what can name a container: a full or
+// prefixed hex ID, or a name as Docker allows them
+var containerRefPattern = regexp.MustCompile(`^/?[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// maxContainerRef bounds a container reference; Docker names are far
+// shorter in practice
+const maxContainerRef = 255
+
+// resolvedContainerKey is the gin context key holding the container a
+// :container_id parameter resolved to
+const resolvedContainerKey = "resolved_container"
+
+// checkContainerRef rejects references that cannot name a container, such
+// as paths or values with spaces
+func checkContainerRef(ref string) error {
+	if ref == "" || len(ref) > maxContainerRef || !containerRefPattern.MatchString(ref) {
+		return errdefs.InvalidParameter(fmt.Errorf("%q is not a valid container ID or name", ref))
+	}
+	return nil
+}
+
+// resolveContainer finds the container ref names, in the daemon's order:
+// an exact ID, then an exact name, then a unique ID prefix. Errors carry
+// errdefs kinds, so dockerError reports 400 for an invalid or ambiguous
+// reference and 404 for no match.
+func resolveContainer(ctx context.Context, ref string) (types.Container, error) {
+	if err := checkContainerRef(ref); err != nil {
+		return types.Container{}, err
+	}
+	list, ok := cachedContainers(ctx, filters.NewArgs())
+	if !ok {
+		var err error
+		if list, err = docker(ctx).ContainerList(ctx, container.ListOptions{All: true}); err != nil {
+			return types.Container{}, err
+		}
+	}
+
+	name := "/" + strings.TrimPrefix(ref, "/")
+	var prefixed []types.Container
+	for _, cont := range list {
+		// Containers outside the token's scope do not exist for it
+		if !inScope(ctx, cont.Labels) {
+			continue
+		}
+		if cont.ID == ref {
+			return cont, nil
+		}
+		if contains(cont.Names, name) {
+			return cont, nil
+		}
+		if strings.HasPrefix(cont.ID, ref) {
+			prefixed = append(prefixed, cont)
+		}
+	}
+	switch len(prefixed) {
+	case 0:
+		return types.Container{}, errdefs.NotFound(fmt.Errorf("no such container: %s", ref))
+	case 1:
+		return prefixed[0], nil
+	}
+	return types.Container{}, errdefs.InvalidParameter(fmt.Errorf("container ID prefix %s matches %d containers; use more of the ID or the name", ref, len(prefixed)))
+}
+
+// resolveContainerParam replaces a :container_id parameter with the full
+// ID of the container it names, so every handler sees the same container
+// whether it was given a name, a short ID or a full one
+func resolveContainerParam() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ref := c.Param("container_id")
+		if ref == "" {
+			c.Next()
+			return
+		}
+		cont, err := resolveContainer(hostContext(c), ref)
+		if err != nil {
+			dockerError(c, "Error finding container", err)
+			return
+		}
+		for i := range c.Params {
+			if c.Params[i].Key == "container_id" {
+				c.Params[i].Value = cont.ID
+			}
+		}
+		c.Set(resolvedContainerKey, cont)
+		c.Next()
+	}
+}
+
+// containerName returns the name of the container the request's
+// :container_id resolved to, or the parameter itself
+func containerName(c *gin.Context) string {
+	if v, ok := c.Get(resolvedContainerKey); ok {
+		if cont := v.(types.Container); len(cont.Names) > 0 {
+			return strings.TrimPrefix(cont.Names[0], "/")
+		}
+	}
+	return c.Param("container_id")
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/errdefs"
+	"github.com/gin-gonic/gin"
+)
+
+// detailConcurrency bounds the inspect calls made for ?detail=true
+const detailConcurrency = 8
+
+// containerDetails builds the extra fields returned by ?detail=true. Most
+// come from the list entry; restart count, exit code, OOM kill, memory
+// limit, health, start time and attached GPUs need an inspect. Block I/O
+// comes from the stats collector and is null until it has sampled the
+// container.
+func containerDetails(ctx context.Context, cont types.Container) (map[string]interface{}, error) {
+	inspection, err := docker(ctx).ContainerInspect(ctx, cont.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	mounts := []map[string]interface{}{}
+	for _, m := range cont.Mounts {
+		mounts = append(mounts, map[string]interface{}{
+			"type":        m.Type,
+			"name":        m.Name,
+			"source":      m.Source,
+			"destination": m.Destination,
+			"rw":          m.RW,
+		})
+	}
+
+	networks := map[string]string{}
+	if cont.NetworkSettings != nil {
+		for name, endpoint := range cont.NetworkSettings.Networks {
+			networks[name] = endpoint.IPAddress
+		}
+	}
+
+	health := types.NoHealthcheck
+	if inspection.State.Health != nil {
+		health = inspection.State.Health.Status
+	}
+
+	var memoryLimit int64
+	if inspection.HostConfig != nil {
+		memoryLimit = inspection.HostConfig.Memory
+	}
+
+	var blockUsage interface{}
+	if sample, ok := collectedSample(ctx, cont.ID); ok && cont.State == "running" {
+		blockUsage = sample.BlockIO
+	}
+
+	uptime := ""
+	startedAt, err := time.Parse(time.RFC3339Nano, inspection.State.StartedAt)
+	if err == nil && inspection.State.Running {
+		uptime = time.Since(startedAt).Round(time.Second).String()
+	}
+
+	return map[string]interface{}{
+		"full_id":       cont.ID,
+		"created":       time.Unix(cont.Created, 0).Format("2006-01-02 15:04:05"),
+		"started_at":    inspection.State.StartedAt,
+		"uptime":        uptime,
+		"state":         cont.State,
+		"status":        cont.Status,
+		"restart_count": inspection.RestartCount,
+		"exit_code":     inspection.State.ExitCode,
+		"oom_killed":    inspection.State.OOMKilled,
+		"oom_kills":     oomCount(hostFrom(ctx).Name, cont.ID),
+		"memory_limit":  memoryLimit,
+		"health":        health,
+		"labels":        cont.Labels,
+		"mounts":        mounts,
+		"networks":      networks,
+		"command":       cont.Command,
+		"block_io":      blockUsage,
+		"gpus":          containerGPUs(inspection),
+	}, nil
+}
+
+// addContainerDetails merges containerDetails into each row concurrently.
+// rows[i] must describe containers[i]. Containers removed since they were
+// listed are dropped from the result.
+func addContainerDetails(ctx context.Context, containers []types.Container, rows []map[string]interface{}) ([]map[string]interface{}, error) {
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+		gone     = make([]bool, len(rows))
+		sem      = make(chan struct{}, detailConcurrency)
+	)
+	for i := range containers {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			details, err := containerDetails(ctx, containers[i])
+			if errdefs.IsNotFound(err) {
+				gone[i] = true
+				return
+			}
+			if err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+				return
+			}
+			for k, v := range details {
+				rows[i][k] = v
+			}
+		}(i)
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	kept := rows[:0]
+	for i, row := range rows {
+		if !gone[i] {
+			kept = append(kept, row)
+		}
+	}
+	return kept, nil
+}
+
+// healthFromStatus extracts the health check state from a list entry's
+// status text, e.g. "Up 2 hours (healthy)", avoiding an inspect per row
+func healthFromStatus(status string) string {
+	switch {
+	case strings.HasSuffix(status, "(healthy)"):
+		return types.Healthy
+	case strings.HasSuffix(status, "(unhealthy)"):
+		return types.Unhealthy
+	case strings.HasSuffix(status, "(health: starting)"):
+		return types.Starting
+	}
+	return types.NoHealthcheck
+}
+
+func containerHealth(c *gin.Context) {
+	ctx := hostContext(c)
+	containerID := c.Param("container_id")
+	inspection, err := docker(ctx).ContainerInspect(ctx, containerID)
+	if err != nil {
+		dockerError(c, "Error inspecting container", err)
+		return
+	}
+
+	health := inspection.State.Health
+	if health == nil {
+		respond(c, http.StatusOK, gin.H{"status": types.NoHealthcheck, "failing_streak": 0, "log": []interface{}{}})
+		return
+	}
+
+	entries := []map[string]interface{}{}
+	for _, result := range health.Log {
+		entries = append(entries, map[string]interface{}{
+			"start":     result.Start,
+			"end":       result.End,
+			"exit_code": result.ExitCode,
+			"output":    strings.TrimSpace(result.Output),
+		})
+	}
+
+	respond(c, http.StatusOK, gin.H{
+		"status":         health.Status,
+		"failing_streak": health.FailingStreak,
+		"log":            entries,
+	})
+}
+
+// defaultPsArgs gives %CPU, %MEM and RSS columns, unlike Docker's -ef default
+const defaultPsArgs = "aux"
+
+// topColumns maps the ps column titles we normalize onto output keys
+var topColumns = map[string]string{
+	"PID":     "pid",
+	"USER":    "user",
+	"UID":     "user",
+	"%CPU":    "cpu_percent",
+	"C":       "cpu_percent",
+	"%MEM":    "mem_percent",
+	"RSS":     "rss_kb",
+	"CMD":     "command",
+	"COMMAND": "command",
+}
+
+func containerTop(c *gin.Context) {
+	ctx := hostContext(c)
+	containerID := c.Param("container_id")
+	psArgs := strings.Fields(c.DefaultQuery("ps_args", defaultPsArgs))
+
+	top, err := docker(ctx).ContainerTop(ctx, containerID, psArgs)
+	if err != nil {
+		dockerError(c, "Error listing container processes", err)
+		return
+	}
+
+	processes := []map[string]interface{}{}
+	for _, row := range top.Processes {
+		process := map[string]interface{}{}
+		fields := map[string]string{}
+		for i, title := range top.Titles {
+			if i >= len(row) {
+				break
+			}
+			fields[title] = row[i]
+			if key, ok := topColumns[title]; ok {
+				process[key] = row[i]
+			}
+		}
+		process["fields"] = fields
+		processes = append(processes, process)
+	}
+
+	respond(c, http.StatusOK, gin.H{"titles": top.Titles, "processes": processes})
+}
+
+// exportContainer streams the container's filesystem as a tar archive
+func exportContainer(c *gin.Context) {
+	ctx := hostContext(c)
+	containerID := c.Param("container_id")
+	reader, err := docker(ctx).ContainerExport(ctx, containerID)
+	if err != nil {
+		dockerError(c, "Error exporting container", err)
+		return
+	}
+	defer reader.Close()
+
+	filename := fmt.Sprintf("container_export_%s_%s.tar", containerName(c), time.Now().Format("20060102_150405"))
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%s", filename))
+	c.DataFromReader(http.StatusOK, -1, "application/x-tar", reader, nil)
+}
+
+// pruneContainers removes stopped containers, optionally limited to those
+// created before until and matching label filters. Quarantined containers
+// are left for the reaper, so they can still be restored.
+func pruneContainers(c *gin.Context) {
+	ctx := hostContext(c)
+	token := confirmationToken(c)
+	var req pruneRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		badRequest(c, "Invalid request")
+		return
+	}
+	list, err := pruneCandidates(ctx, req)
+	if err != nil {
+		dockerError(c, "Error listing containers", err)
+		return
+	}
+	if requireConfirmation && !confirmed(c, token, pruneDigest(req, list)) {
+		return
+	}
+
+	report := removePruneCandidates(ctx, list)
+	deleted := report.ContainersDeleted
+	if deleted == nil {
+		deleted = []string{}
+	}
+	respond(c, http.StatusOK, gin.H{
+		"containers_deleted": deleted,
+		"space_reclaimed":    report.SpaceReclaimed,
+	})
+}
+
+// removePruneCandidates removes the containers pruneCandidates listed one
+// by one, as the daemon's own prune would remove quarantined containers
+// too. Like that prune it skips a container it cannot remove, such as one
+// started since it was listed.
+func removePruneCandidates(ctx context.Context, list []types.Container) types.ContainersPruneReport {
+	var report types.ContainersPruneReport
+	for _, cont := range list {
+		if err := docker(ctx).ContainerRemove(ctx, cont.ID, container.RemoveOptions{}); err != nil {
+			logger.Warn("pruning container", "host", hostFrom(ctx).Name, "container", cont.ID, "error", err)
+			continue
+		}
+		report.ContainersDeleted = append(report.ContainersDeleted, cont.ID)
+		report.SpaceReclaimed += uint64(cont.SizeRw)
+	}
+	return report
+}
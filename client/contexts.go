@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// defaultContextName is the Docker CLI's implicit context, which stands
+// for DOCKER_HOST or the local socket and has no entry in the store
+const defaultContextName = "default"
+
+// dockerContext is a Docker CLI context's Docker endpoint
+type dockerContext struct {
+	Name          string
+	Description   string
+	Endpoint      string
+	TLS           bool
+	SkipTLSVerify bool
+	certDir       string
+}
+
+// contextMeta is the meta.json the Docker CLI writes for each context
+type contextMeta struct {
+	Name     string `json:"Name"`
+	Metadata struct {
+		Description string `json:"Description"`
+	} `json:"Metadata"`
+	Endpoints map[string]struct {
+		Host          string `json:"Host"`
+		SkipTLSVerify bool   `json:"SkipTLSVerify"`
+	} `json:"Endpoints"`
+}
+
+// dockerConfigDir is where the Docker CLI keeps its configuration and
+// contexts: DOCKER_CONFIG, or ~/.docker
+func dockerConfigDir() string {
+	if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+		return dir
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ".docker"
+	}
+	return filepath.Join(home, ".docker")
+}
+
+// readDockerContexts reads the contexts in the Docker CLI's store, which
+// keeps each in a directory named after the SHA-256 of its name, with its
+// TLS material in a matching directory. A missing store has no contexts.
+func readDockerContexts() ([]dockerContext, error) {
+	root := filepath.Join(dockerConfigDir(), "contexts")
+	entries, err := os.ReadDir(filepath.Join(root, "meta"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return []dockerContext{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	contexts := []dockerContext{}
+	for _, entry := range entries {
+		data, err := os.ReadFile(filepath.Join(root, "meta", entry.Name(), "meta.json"))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		var meta contextMeta
+		if err := json.Unmarshal(data, &meta); err != nil {
+			return nil, fmt.Errorf("context %s: %w", entry.Name(), err)
+		}
+		endpoint, ok := meta.Endpoints["docker"]
+		if !ok {
+			continue
+		}
+		dc := dockerContext{
+			Name:          meta.Name,
+			Description:   meta.Metadata.Description,
+			Endpoint:      endpoint.Host,
+			SkipTLSVerify: endpoint.SkipTLSVerify,
+			certDir:       filepath.Join(root, "tls", entry.Name(), "docker"),
+		}
+		if _, err := os.Stat(filepath.Join(dc.certDir, "ca.pem")); err == nil {
+			dc.TLS = true
+		}
+		contexts = append(contexts, dc)
+	}
+	sort.Slice(contexts, func(i, j int) bool { return contexts[i].Name < contexts[j].Name })
+	return contexts, nil
+}
+
+// findDockerContext reads one context from the store
+func findDockerContext(name string) (dockerContext, error) {
+	contexts, err := readDockerContexts()
+	if err != nil {
+		return dockerContext{}, err
+	}
+	for _, dc := range contexts {
+		if dc.Name == name {
+			return dc, nil
+		}
+	}
+	return dockerContext{}, fmt.Errorf("docker context %q not found in %s", name, filepath.Join(dockerConfigDir(), "contexts"))
+}
+
+// currentDockerContext is the context the Docker CLI would use:
+// DOCKER_CONTEXT, or the currentContext of its config.json
+func currentDockerContext() string {
+	if name := os.Getenv("DOCKER_CONTEXT"); name != "" {
+		return name
+	}
+	var config struct {
+		CurrentContext string `json:"currentContext"`
+	}
+	if data, err := os.ReadFile(filepath.Join(dockerConfigDir(), "config.json")); err == nil {
+		_ = json.Unmarshal(data, &config)
+	}
+	if config.CurrentContext == "" {
+		return defaultContextName
+	}
+	return config.CurrentContext
+}
+
+// agentDockerContext is the context the default host is configured from:
+// CONTAINERSCOPE_DOCKER_CONTEXT, or DOCKER_CONTEXT as the Docker CLI uses
+// it. It is "" for the implicit default context.
+func agentDockerContext() string {
+	name := envOr("CONTAINERSCOPE_DOCKER_CONTEXT", os.Getenv("DOCKER_CONTEXT"))
+	if name == defaultContextName {
+		return ""
+	}
+	return name
+}
+
+// contextHost creates a host that reaches the daemon of a context
+func contextHost(name string, dc dockerContext) (*dockerHost, error) {
+	if dc.SkipTLSVerify {
+		return nil, fmt.Errorf("docker context %s skips TLS verification, which is not supported", dc.Name)
+	}
+	host := &dockerHost{Name: name, Endpoint: dc.Endpoint, Context: dc.Name}
+	if dc.TLS {
+		host.TLS = true
+		host.certDir = dc.certDir
+	}
+	if err := host.connect(); err != nil {
+		return nil, err
+	}
+	return host, nil
+}
+
+// loadContextHosts adds a host named after each context listed in
+// CONTAINERSCOPE_CONTEXT_HOSTS, or every context for *, unless a host by
+// that name is configured already
+func loadContextHosts() error {
+	setting := strings.TrimSpace(os.Getenv("CONTAINERSCOPE_CONTEXT_HOSTS"))
+	if setting == "" {
+		return nil
+	}
+	contexts, err := readDockerContexts()
+	if err != nil {
+		return err
+	}
+	wanted := map[string]bool{}
+	for _, name := range strings.Split(setting, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			wanted[name] = true
+		}
+	}
+	for _, dc := range contexts {
+		if setting != "*" && !wanted[dc.Name] {
+			continue
+		}
+		delete(wanted, dc.Name)
+		if _, exists := dockerHosts[dc.Name]; exists {
+			continue
+		}
+		host, err := contextHost(dc.Name, dc)
+		if err != nil {
+			return fmt.Errorf("host %s: %w", dc.Name, err)
+		}
+		dockerHosts[dc.Name] = host
+	}
+	delete(wanted, "*")
+	for name := range wanted {
+		return fmt.Errorf("docker context %q not found", name)
+	}
+	return nil
+}
+
+// listDockerContexts lists the Docker CLI's contexts with the hosts
+// configured from each, and which one the CLI itself would use
+func listDockerContexts(c *gin.Context) {
+	contexts, err := readDockerContexts()
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, codeInternal, "Error reading docker contexts: "+err.Error())
+		return
+	}
+	current := currentDockerContext()
+	rows := make([]gin.H, 0, len(contexts))
+	for _, dc := range contexts {
+		hosts := []string{}
+		for name, host := range dockerHosts {
+			if host.Context == dc.Name {
+				hosts = append(hosts, name)
+			}
+		}
+		sort.Strings(hosts)
+		rows = append(rows, gin.H{
+			"name":            dc.Name,
+			"description":     dc.Description,
+			"endpoint":        dc.Endpoint,
+			"tls":             dc.TLS,
+			"skip_tls_verify": dc.SkipTLSVerify,
+			"current":         dc.Name == current,
+			"hosts":           hosts,
+		})
+	}
+	respond(c, http.StatusOK, gin.H{
+		"store":    filepath.Join(dockerConfigDir(), "contexts"),
+		"current":  current,
+		"contexts": rows,
+	})
+}
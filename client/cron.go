@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSchedule is a parsed five-field cron expression: minute, hour, day
+// of month, month and day of week. Each field is a bit set of the values
+// it allows.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	// domAny and dowAny record a * in the day fields; when both are
+	// restricted, cron runs on days matching either
+	domAny, dowAny bool
+}
+
+// cronMacros are the shorthands cron accepts for common schedules
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+var (
+	cronMonths = []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}
+	cronDays   = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+)
+
+// parseCron parses an expression such as "0 19 * * mon-fri" or "@daily"
+func parseCron(expr string) (cronSchedule, error) {
+	expr = strings.TrimSpace(expr)
+	if macro, ok := cronMacros[strings.ToLower(expr)]; ok {
+		expr = macro
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return cronSchedule{}, fmt.Errorf("cron expression %q must have 5 fields: minute hour day-of-month month day-of-week", expr)
+	}
+	var s cronSchedule
+	var err error
+	if s.minute, err = parseCronField(fields[0], 0, 59, nil); err != nil {
+		return s, fmt.Errorf("minute: %v", err)
+	}
+	if s.hour, err = parseCronField(fields[1], 0, 23, nil); err != nil {
+		return s, fmt.Errorf("hour: %v", err)
+	}
+	if s.dom, err = parseCronField(fields[2], 1, 31, nil); err != nil {
+		return s, fmt.Errorf("day of month: %v", err)
+	}
+	if s.month, err = parseCronField(fields[3], 1, 12, cronMonths); err != nil {
+		return s, fmt.Errorf("month: %v", err)
+	}
+	// Sunday is both 0 and 7
+	if s.dow, err = parseCronField(fields[4], 0, 7, cronDays); err != nil {
+		return s, fmt.Errorf("day of week: %v", err)
+	}
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	s.domAny, s.dowAny = fields[2] == "*", fields[4] == "*"
+	return s, nil
+}
+
+// parseCronField parses a comma-separated list of *, values and ranges,
+// each optionally with a /step. names, when given, are accepted for the
+// values starting at min, as in jan or mon.
+func parseCronField(field string, min, max int, names []string) (uint64, error) {
+	value := func(v string) (int, error) {
+		for i, name := range names {
+			if strings.EqualFold(v, name) {
+				return min + i, nil
+			}
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < min || n > max {
+			return 0, fmt.Errorf("%q is not between %d and %d", v, min, max)
+		}
+		return n, nil
+	}
+
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rng, stepText, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			n, err := strconv.Atoi(stepText)
+			if err != nil || n < 1 {
+				return 0, fmt.Errorf("invalid step %q", stepText)
+			}
+			step = n
+		}
+		lo, hi := min, max
+		switch from, to, isRange := strings.Cut(rng, "-"); {
+		case rng == "*":
+		case isRange:
+			var err error
+			if lo, err = value(from); err != nil {
+				return 0, err
+			}
+			if hi, err = value(to); err != nil {
+				return 0, err
+			}
+			if lo > hi {
+				return 0, fmt.Errorf("range %q runs backwards", rng)
+			}
+		default:
+			n, err := value(rng)
+			if err != nil {
+				return 0, err
+			}
+			// 5/15 means from 5 to the end in steps of 15
+			lo, hi = n, n
+			if hasStep {
+				hi = max
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+// matches reports whether the schedule fires in the minute of t
+func (s cronSchedule) matches(t time.Time) bool {
+	if s.minute&(1<<uint(t.Minute())) == 0 || s.hour&(1<<uint(t.Hour())) == 0 || s.month&(1<<uint(t.Month())) == 0 {
+		return false
+	}
+	return s.matchesDay(t)
+}
+
+// next returns the first minute after t in which the schedule fires, or
+// the zero time when there is none within five years, as for 30 February
+func (s cronSchedule) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	end := t.AddDate(5, 0, 0)
+	for t.Before(end) {
+		switch {
+		case s.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !s.matchesDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case s.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case s.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// matchesDay applies the day of month and day of week fields to t
+func (s cronSchedule) matchesDay(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domAny || s.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"expvar"
+	"net/http/pprof"
+	"runtime"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func init() {
+	// Runtime figures alongside expvar's memstats and cmdline
+	expvar.Publish("goroutines", expvar.Func(func() interface{} { return runtime.NumGoroutine() }))
+	expvar.Publish("uptime_seconds", expvar.Func(func() interface{} { return int64(time.Since(agentStartedAt).Seconds()) }))
+	expvar.Publish("version", expvar.Func(func() interface{} { return map[string]string{"version": version, "commit": commit} }))
+}
+
+// pprofHandler serves net/http/pprof under /debug/pprof/, dispatching on
+// the profile name the way pprof's own mux registration does
+func pprofHandler(c *gin.Context) {
+	switch c.Param("profile") {
+	case "/cmdline":
+		pprof.Cmdline(c.Writer, c.Request)
+	case "/profile":
+		pprof.Profile(c.Writer, c.Request)
+	case "/symbol":
+		pprof.Symbol(c.Writer, c.Request)
+	case "/trace":
+		pprof.Trace(c.Writer, c.Request)
+	default:
+		// Index serves named profiles such as goroutine and heap too
+		pprof.Index(c.Writer, c.Request)
+	}
+}
+
+// debugVars serves expvar's JSON runtime stats
+func debugVars(c *gin.Context) {
+	expvar.Handler().ServeHTTP(c.Writer, c.Request)
+}
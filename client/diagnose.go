@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/gin-gonic/gin"
+)
+
+// Bounds on a diagnose request: how many checks it may run and how many
+// seconds each may take
+const (
+	maxDiagnoseChecks      = 20
+	defaultDiagnoseTimeout = 5
+	maxDiagnoseTimeout     = 30
+)
+
+// diagnosePingCount is how many echo requests a ping check sends
+const diagnosePingCount = "3"
+
+// diagnoseHelperMargin is how long a diagnose helper outlives its checks
+// before exiting on its own, should removing it fail
+const diagnoseHelperMargin = time.Minute
+
+// diagnoseRequest is the body of POST /containers/:container_id/diagnose
+type diagnoseRequest struct {
+	// DNS lists names to resolve
+	DNS []string `json:"dns"`
+	// TCP lists host:port addresses to connect to
+	TCP []string `json:"tcp"`
+	// Ping lists hosts to ping
+	Ping []string `json:"ping"`
+	// TimeoutSeconds bounds each check; 5 when unset
+	TimeoutSeconds int `json:"timeout_seconds"`
+	// Exec runs the checks in the container itself rather than in a helper
+	// container sharing its network. The container then needs nslookup, nc
+	// and ping.
+	Exec bool `json:"exec"`
+}
+
+// diagnoseCheck is one check to run and the command that runs it
+type diagnoseCheck struct {
+	kind, target string
+	cmd          []string
+}
+
+// diagnoseResult is the outcome of one check
+type diagnoseResult struct {
+	Check      string `json:"check"`
+	Target     string `json:"target"`
+	Success    bool   `json:"success"`
+	DurationMs int64  `json:"duration_ms"`
+	// Addresses are what a DNS name resolved to
+	Addresses []string `json:"addresses,omitempty"`
+	// Transmitted, Received and RTTAvgMs summarise a ping
+	Transmitted int     `json:"transmitted,omitempty"`
+	Received    int     `json:"received,omitempty"`
+	RTTAvgMs    float64 `json:"rtt_avg_ms,omitempty"`
+	// Output is what the command printed, kept when the check fails
+	Output string `json:"output,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+var (
+	pingCountsRe = regexp.MustCompile(`(\d+) packets transmitted, (\d+) (?:packets )?received`)
+	pingRTTRe    = regexp.MustCompile(`= [\d.]+/([\d.]+)/`)
+)
+
+// validDiagnoseHost rejects what could be taken for an option or is not a
+// host name or address at all; commands are run without a shell
+func validDiagnoseHost(host string) bool {
+	return host != "" && !strings.HasPrefix(host, "-") && !strings.ContainsAny(host, " \t\r\n/")
+}
+
+// diagnoseChecks turns a request into the commands to run
+func diagnoseChecks(req diagnoseRequest, timeout int) ([]diagnoseCheck, error) {
+	wait := strconv.Itoa(timeout)
+	checks := []diagnoseCheck{}
+	for _, name := range req.DNS {
+		if !validDiagnoseHost(name) {
+			return nil, fmt.Errorf("invalid dns name %q", name)
+		}
+		checks = append(checks, diagnoseCheck{"dns", name, []string{"nslookup", name}})
+	}
+	for _, address := range req.TCP {
+		host, port, err := net.SplitHostPort(address)
+		if n, perr := strconv.Atoi(port); err != nil || perr != nil || n < 1 || n > 65535 || !validDiagnoseHost(host) {
+			return nil, fmt.Errorf("invalid tcp address %q, expected host:port", address)
+		}
+		checks = append(checks, diagnoseCheck{"tcp", address, []string{"nc", "-z", "-w", wait, host, port}})
+	}
+	for _, host := range req.Ping {
+		if !validDiagnoseHost(host) {
+			return nil, fmt.Errorf("invalid ping host %q", host)
+		}
+		checks = append(checks, diagnoseCheck{"ping", host, []string{"ping", "-c", diagnosePingCount, "-w", wait, host}})
+	}
+	return checks, nil
+}
+
+// diagnoseHelper starts a container in the network namespace of another,
+// so checks see its interfaces, routes, /etc/hosts and resolver, and
+// returns its ID. It exits on its own after lifetime in case it is not
+// removed.
+func diagnoseHelper(ctx context.Context, containerID string, lifetime time.Duration) (string, error) {
+	if err := ensureHelperImage(ctx); err != nil {
+		return "", err
+	}
+	created, err := docker(ctx).ContainerCreate(ctx,
+		&container.Config{
+			Image:  helperImage,
+			Cmd:    []string{"sleep", strconv.Itoa(int(lifetime.Seconds()))},
+			Labels: map[string]string{helperLabel: "diagnose"},
+		},
+		&container.HostConfig{NetworkMode: container.NetworkMode("container:" + containerID)},
+		nil, nil, "")
+	if err != nil {
+		return "", err
+	}
+	if err := docker(ctx).ContainerStart(ctx, created.ID, container.StartOptions{}); err != nil {
+		removeHelper(context.WithoutCancel(ctx), created.ID)
+		return "", err
+	}
+	return created.ID, nil
+}
+
+// runDiagnoseCheck runs a check in a container and reads its output
+func runDiagnoseCheck(ctx context.Context, containerID string, check diagnoseCheck, timeout time.Duration) diagnoseResult {
+	result := diagnoseResult{Check: check.kind, Target: check.target}
+	// The commands stop themselves after timeout; the margin covers exec
+	ctx, cancel := context.WithTimeout(ctx, timeout+5*time.Second)
+	defer cancel()
+	start := time.Now()
+	out, err := runCheck(ctx, containerID, check.cmd)
+	result.DurationMs = time.Since(start).Milliseconds()
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		result.Error = fmt.Sprintf("timed out after %s", timeout)
+		return result
+	case err != nil:
+		result.Error = err.Error()
+		return result
+	}
+
+	result.Success = out.ExitCode == 0
+	switch check.kind {
+	case "dns":
+		// The resolver's own address comes before the answer's Name line
+		answer := false
+		for _, line := range strings.Split(out.Output, "\n") {
+			if strings.HasPrefix(line, "Name:") {
+				answer = true
+			} else if _, address, ok := strings.Cut(line, "Address:"); ok && answer {
+				result.Addresses = append(result.Addresses, strings.TrimSpace(address))
+			}
+		}
+		result.Success = result.Success && len(result.Addresses) > 0
+	case "ping":
+		if m := pingCountsRe.FindStringSubmatch(out.Output); m != nil {
+			result.Transmitted, _ = strconv.Atoi(m[1])
+			result.Received, _ = strconv.Atoi(m[2])
+		}
+		if m := pingRTTRe.FindStringSubmatch(out.Output); m != nil {
+			result.RTTAvgMs, _ = strconv.ParseFloat(m[1], 64)
+		}
+		result.Success = result.Success && result.Received > 0
+	}
+	if !result.Success {
+		result.Output = strings.TrimSpace(out.Output)
+		switch {
+		case out.ExitCode == 126 || out.ExitCode == 127:
+			result.Error = fmt.Sprintf("%s is not available in the container", check.cmd[0])
+		case out.ExitCode != 0:
+			result.Error = fmt.Sprintf("%s exited with code %d", check.cmd[0], out.ExitCode)
+		default:
+			result.Error = "no answer"
+		}
+	}
+	return result
+}
+
+// diagnoseContainer runs connectivity checks from inside a running
+// container's network: resolving DNS names, connecting to TCP addresses
+// and pinging hosts. They run in a helper container that joins the
+// container's network namespace, so the container needs no tools of its
+// own, or with exec in the container itself. Checks run concurrently and
+// a failing check does not fail the request.
+func diagnoseContainer(c *gin.Context) {
+	var req diagnoseRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		badRequest(c, "Invalid request")
+		return
+	}
+	if req.TimeoutSeconds < 0 || req.TimeoutSeconds > maxDiagnoseTimeout {
+		badRequest(c, fmt.Sprintf("timeout_seconds must be between 1 and %d", maxDiagnoseTimeout))
+		return
+	}
+	timeoutSeconds := defaultDiagnoseTimeout
+	if req.TimeoutSeconds > 0 {
+		timeoutSeconds = req.TimeoutSeconds
+	}
+	checks, err := diagnoseChecks(req, timeoutSeconds)
+	if err != nil {
+		badRequest(c, err.Error())
+		return
+	}
+	if len(checks) == 0 {
+		badRequest(c, "Specify at least one dns, tcp or ping check")
+		return
+	}
+	if len(checks) > maxDiagnoseChecks {
+		badRequest(c, fmt.Sprintf("At most %d checks may be run at once", maxDiagnoseChecks))
+		return
+	}
+	timeout := time.Duration(timeoutSeconds) * time.Second
+
+	ctx := hostContext(c)
+	inspection, err := docker(ctx).ContainerInspect(ctx, c.Param("container_id"))
+	if err != nil {
+		dockerError(c, "Error inspecting container", err)
+		return
+	}
+	if !inspection.State.Running {
+		respondError(c, http.StatusConflict, codeConflict, "Container is not running")
+		return
+	}
+	target, via := inspection.ID, "exec"
+	if !req.Exec {
+		helper, err := diagnoseHelper(ctx, inspection.ID, timeout+diagnoseHelperMargin)
+		if err != nil {
+			dockerError(c, "Error starting helper container", err)
+			return
+		}
+		defer removeHelper(context.WithoutCancel(ctx), helper)
+		target, via = helper, "helper"
+	}
+
+	results := make([]diagnoseResult, len(checks))
+	var wg sync.WaitGroup
+	for i, check := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = runDiagnoseCheck(ctx, target, check, timeout)
+		}()
+	}
+	wg.Wait()
+
+	passed := 0
+	for _, result := range results {
+		if result.Success {
+			passed++
+		}
+	}
+	respond(c, http.StatusOK, gin.H{
+		"container": strings.TrimPrefix(inspection.Name, "/"),
+		"via":       via,
+		"results":   results,
+		"passed":    passed,
+		"failed":    len(results) - passed,
+	})
+}
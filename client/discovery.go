@@ -0,0 +1,613 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// mdnsService is the DNS-SD service type agents advertise on the LAN
+const mdnsService = "_containerscope._tcp.local."
+
+// mdnsGroup is the multicast address mDNS queries and answers go to
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// discoveryTTL is how long a registration outlives its agent in Consul
+// and etcd, and discoveryRefresh how often a live agent renews it
+const (
+	discoveryTTL     = 30 * time.Second
+	discoveryRefresh = 10 * time.Second
+)
+
+// discoveredHost is what an agent advertises: the host name it wants on
+// the hub, the Docker endpoint the hub should use, and its node labels
+type discoveredHost struct {
+	Name     string            `json:"name"`
+	Endpoint string            `json:"endpoint"`
+	Labels   map[string]string `json:"labels,omitempty"`
+	Source   string            `json:"source,omitempty"`
+}
+
+// discoverySources are the registries hosts can be found in and
+// advertised to
+var discoverySources = map[string]bool{"mdns": true, "consul": true, "etcd": true}
+
+// parseDiscoverySources reads a comma separated list of sources
+func parseDiscoverySources(env string) ([]string, error) {
+	sources := splitList(os.Getenv(env))
+	for _, source := range sources {
+		if !discoverySources[source] {
+			return nil, fmt.Errorf("%s: unknown source %q, expected mdns, consul or etcd", env, source)
+		}
+	}
+	return sources, nil
+}
+
+// formatNodeLabels writes labels the way parseNodeLabels reads them
+func formatNodeLabels(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for key, value := range labels {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// discoveryClient is used for the Consul and etcd HTTP APIs
+var discoveryClient = &http.Client{Timeout: 10 * time.Second}
+
+// jsonRequest sends a JSON request to Consul or etcd and decodes the
+// JSON answer into out, when given
+func jsonRequest(ctx context.Context, method, target string, header http.Header, body, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, reader)
+	if err != nil {
+		return err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := discoveryClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s %s: %s: %s", method, target, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// discoverHosts asks each source for the hosts advertised in it, and
+// returns the errors of the sources that could not be asked by name. A
+// host advertised in several sources is taken from the first listed.
+func discoverHosts(ctx context.Context, sources []string) ([]discoveredHost, map[string]string) {
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		results = make([][]discoveredHost, len(sources))
+		errs    = map[string]string{}
+	)
+	for i, source := range sources {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var hosts []discoveredHost
+			var err error
+			switch source {
+			case "mdns":
+				hosts, err = browseMDNS(ctx, envDuration("CONTAINERSCOPE_DISCOVERY_WAIT", 2*time.Second))
+			case "consul":
+				hosts, err = consulHosts(ctx)
+			case "etcd":
+				hosts, err = etcdHosts(ctx)
+			}
+			if err != nil {
+				mu.Lock()
+				errs[source] = err.Error()
+				mu.Unlock()
+				return
+			}
+			for j := range hosts {
+				hosts[j].Source = source
+			}
+			results[i] = hosts
+		}()
+	}
+	wg.Wait()
+
+	found := []discoveredHost{}
+	seen := map[string]bool{}
+	for _, hosts := range results {
+		for _, host := range hosts {
+			if !seen[host.Name] {
+				seen[host.Name] = true
+				found = append(found, host)
+			}
+		}
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].Name < found[j].Name })
+	return found, errs
+}
+
+// loadDiscoveredHosts adds a host for each agent advertised in the
+// sources listed in CONTAINERSCOPE_DISCOVERY, unless a host by that name
+// is configured already. A source that cannot be reached is logged and
+// skipped, so the agent still starts with the hosts it has.
+func loadDiscoveredHosts(tlsDir string) error {
+	sources, err := parseDiscoverySources("CONTAINERSCOPE_DISCOVERY")
+	if err != nil || len(sources) == 0 {
+		return err
+	}
+	found, errs := discoverHosts(context.Background(), sources)
+	for source, err := range errs {
+		logger.Warn("discovering hosts", "source", source, "error", err)
+	}
+	for _, d := range found {
+		if _, exists := dockerHosts[d.Name]; exists {
+			continue
+		}
+		var host *dockerHost
+		if d.Endpoint == tunnelEndpoint {
+			host, err = newTunnelHost(d.Name)
+		} else {
+			host, err = newDockerHost(d.Name, d.Endpoint, filepath.Join(tlsDir, d.Name))
+		}
+		if err != nil {
+			logger.Warn("skipping discovered host", "host", d.Name, "source", d.Source, "error", err)
+			continue
+		}
+		host.Labels = d.Labels
+		host.Discovered = d.Source
+		dockerHosts[d.Name] = host
+		logger.Info("discovered host", "host", d.Name, "endpoint", d.Endpoint, "source", d.Source)
+	}
+	return nil
+}
+
+// listDiscoveredHosts asks the discovery sources again and reports what
+// they advertise now, and which of those hosts are configured. Hosts that
+// appeared since the agent started are added when it restarts.
+func listDiscoveredHosts(c *gin.Context) {
+	sources, err := parseDiscoverySources("CONTAINERSCOPE_DISCOVERY")
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, codeInternal, err.Error())
+		return
+	}
+	found, errs := discoverHosts(c.Request.Context(), sources)
+	rows := make([]gin.H, 0, len(found))
+	for _, d := range found {
+		host, configured := dockerHosts[d.Name]
+		rows = append(rows, gin.H{
+			"name":       d.Name,
+			"endpoint":   d.Endpoint,
+			"labels":     d.Labels,
+			"source":     d.Source,
+			"configured": configured,
+			"discovered": configured && host.Discovered != "",
+		})
+	}
+	respond(c, http.StatusOK, gin.H{"sources": sources, "hosts": rows, "errors": errs})
+}
+
+// advertisedHost is how this agent describes its default daemon to hubs:
+// CONTAINERSCOPE_ADVERTISE_NAME, by default the tunnel name or hostname,
+// and CONTAINERSCOPE_ADVERTISE_ENDPOINT, which defaults to tunnel: when
+// the agent tunnels to a hub
+func advertisedHost() (discoveredHost, error) {
+	name := envOr("CONTAINERSCOPE_ADVERTISE_NAME", os.Getenv("CONTAINERSCOPE_TUNNEL_NAME"))
+	if name == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return discoveredHost{}, fmt.Errorf("CONTAINERSCOPE_ADVERTISE_NAME: %w", err)
+		}
+		name = hostname
+	}
+	endpoint := os.Getenv("CONTAINERSCOPE_ADVERTISE_ENDPOINT")
+	if endpoint == "" && os.Getenv("CONTAINERSCOPE_TUNNEL_URL") != "" {
+		endpoint = tunnelEndpoint
+	}
+	if endpoint == "" {
+		return discoveredHost{}, fmt.Errorf("CONTAINERSCOPE_ADVERTISE_ENDPOINT is required, such as tcp://10.0.0.5:2376")
+	}
+	return discoveredHost{Name: name, Endpoint: endpoint, Labels: dockerHosts[defaultHostName].Labels}, nil
+}
+
+// startAdvertising announces this agent's default daemon in the sources
+// listed in CONTAINERSCOPE_ADVERTISE, so hubs discover it, and keeps the
+// registrations alive while the agent runs
+func startAdvertising() {
+	sources, err := parseDiscoverySources("CONTAINERSCOPE_ADVERTISE")
+	if err != nil {
+		logger.Error("advertising disabled", "error", err)
+		return
+	}
+	if len(sources) == 0 {
+		return
+	}
+	self, err := advertisedHost()
+	if err != nil {
+		logger.Error("advertising disabled", "error", err)
+		return
+	}
+	logger.Info("advertising host", "name", self.Name, "endpoint", self.Endpoint, "sources", sources)
+	for _, source := range sources {
+		switch source {
+		case "mdns":
+			go respondMDNS(self)
+		case "consul":
+			go keepRegistered("consul", func(ctx context.Context) error { return registerConsul(ctx, self) })
+		case "etcd":
+			go keepRegistered("etcd", (&etcdRegistration{self: self}).renew)
+		}
+	}
+}
+
+// keepRegistered renews a registration every discoveryRefresh, logging
+// when it starts and stops failing
+func keepRegistered(source string, renew func(ctx context.Context) error) {
+	failing := false
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), discoveryRefresh)
+		err := renew(ctx)
+		cancel()
+		switch {
+		case err != nil && !failing:
+			logger.Warn("advertising host failed", "source", source, "error", err)
+		case err == nil && failing:
+			logger.Info("advertising host again", "source", source)
+		}
+		failing = err != nil
+		time.Sleep(discoveryRefresh)
+	}
+}
+
+// mdnsInstance is the DNS-SD instance name a host is advertised under
+func mdnsInstance(name string) string {
+	return strings.ReplaceAll(name, ".", "-") + "." + mdnsService
+}
+
+// mdnsAnswer builds the response announcing host: a PTR from the service
+// type to its instance, and a TXT record with its endpoint and labels
+func mdnsAnswer(self discoveredHost) ([]byte, error) {
+	service, err := dnsmessage.NewName(mdnsService)
+	if err != nil {
+		return nil, err
+	}
+	instance, err := dnsmessage.NewName(mdnsInstance(self.Name))
+	if err != nil {
+		return nil, err
+	}
+	txt := []string{"name=" + self.Name, "endpoint=" + self.Endpoint}
+	if len(self.Labels) > 0 {
+		txt = append(txt, "labels="+formatNodeLabels(self.Labels))
+	}
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{Response: true, Authoritative: true})
+	b.EnableCompression()
+	if err := b.StartAnswers(); err != nil {
+		return nil, err
+	}
+	ttl := uint32(discoveryTTL.Seconds())
+	if err := b.PTRResource(dnsmessage.ResourceHeader{Name: service, Class: dnsmessage.ClassINET, TTL: ttl}, dnsmessage.PTRResource{PTR: instance}); err != nil {
+		return nil, err
+	}
+	if err := b.TXTResource(dnsmessage.ResourceHeader{Name: instance, Class: dnsmessage.ClassINET, TTL: ttl}, dnsmessage.TXTResource{TXT: txt}); err != nil {
+		return nil, err
+	}
+	return b.Finish()
+}
+
+// mdnsQuestion reports whether a message asks for the service type, and
+// whether it wants the answer sent back to the asker rather than to the
+// group
+func mdnsQuestion(msg []byte) (asked, unicast bool) {
+	var p dnsmessage.Parser
+	header, err := p.Start(msg)
+	if err != nil || header.Response {
+		return false, false
+	}
+	for {
+		q, err := p.Question()
+		if err != nil {
+			return asked, unicast
+		}
+		if (q.Type == dnsmessage.TypePTR || q.Type == dnsmessage.TypeALL) && strings.EqualFold(q.Name.String(), mdnsService) {
+			asked = true
+			unicast = unicast || q.Class&(1<<15) != 0
+		}
+	}
+}
+
+// respondMDNS answers mDNS queries for the service type on the LAN with
+// this host, after announcing it once. Queries from a port other than
+// 5353 come from simple resolvers, such as hubs browsing, and are answered
+// directly.
+func respondMDNS(self discoveredHost) {
+	answer, err := mdnsAnswer(self)
+	if err != nil {
+		logger.Error("advertising over mDNS", "error", err)
+		return
+	}
+	conn, err := net.ListenMulticastUDP("udp4", nil, mdnsGroup)
+	if err != nil {
+		logger.Error("advertising over mDNS", "error", err)
+		return
+	}
+	defer conn.Close()
+	conn.WriteToUDP(answer, mdnsGroup)
+
+	buf := make([]byte, 9000)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			logger.Error("advertising over mDNS", "error", err)
+			return
+		}
+		asked, unicast := mdnsQuestion(buf[:n])
+		if !asked {
+			continue
+		}
+		to := mdnsGroup
+		if unicast || from.Port != mdnsGroup.Port {
+			to = from
+		}
+		conn.WriteToUDP(answer, to)
+	}
+}
+
+// browseMDNS asks the LAN for the service type and collects the hosts
+// that answer within wait
+func browseMDNS(ctx context.Context, wait time.Duration) ([]discoveredHost, error) {
+	name, err := dnsmessage.NewName(mdnsService)
+	if err != nil {
+		return nil, err
+	}
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{})
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := b.Question(dnsmessage.Question{Name: name, Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET}); err != nil {
+		return nil, err
+	}
+	query, err := b.Finish()
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if _, err := conn.WriteToUDP(query, mdnsGroup); err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(wait)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetReadDeadline(deadline)
+
+	byName := map[string]discoveredHost{}
+	buf := make([]byte, 9000)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			// The read deadline ends the wait for answers
+			break
+		}
+		for _, host := range mdnsHosts(buf[:n]) {
+			byName[host.Name] = host
+		}
+	}
+	hosts := make([]discoveredHost, 0, len(byName))
+	for _, host := range byName {
+		hosts = append(hosts, host)
+	}
+	return hosts, nil
+}
+
+// mdnsHosts reads the hosts from the TXT records of the service type's
+// instances in an mDNS response
+func mdnsHosts(msg []byte) []discoveredHost {
+	var p dnsmessage.Parser
+	header, err := p.Start(msg)
+	if err != nil || !header.Response {
+		return nil
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return nil
+	}
+	var hosts []discoveredHost
+	read := func(next func() (dnsmessage.ResourceHeader, error), skip func() error) {
+		for {
+			h, err := next()
+			if err != nil {
+				return
+			}
+			if h.Type != dnsmessage.TypeTXT || !strings.HasSuffix(strings.ToLower(h.Name.String()), "."+mdnsService) {
+				if skip() != nil {
+					return
+				}
+				continue
+			}
+			txt, err := p.TXTResource()
+			if err != nil {
+				return
+			}
+			host := discoveredHost{}
+			for _, entry := range txt.TXT {
+				key, value, _ := strings.Cut(entry, "=")
+				switch key {
+				case "name":
+					host.Name = value
+				case "endpoint":
+					host.Endpoint = value
+				case "labels":
+					host.Labels, _ = parseNodeLabels(value)
+				}
+			}
+			if host.Name != "" && host.Endpoint != "" {
+				hosts = append(hosts, host)
+			}
+		}
+	}
+	read(p.AnswerHeader, p.SkipAnswer)
+	if p.SkipAllAuthorities() == nil {
+		read(p.AdditionalHeader, p.SkipAdditional)
+	}
+	return hosts
+}
+
+// consulService is the service name agents register in Consul
+const consulService = "containerscope"
+
+// consulRequest calls the Consul HTTP API at CONTAINERSCOPE_CONSUL_URL
+// with CONTAINERSCOPE_CONSUL_TOKEN
+func consulRequest(ctx context.Context, method, path string, body, out interface{}) error {
+	base := strings.TrimSuffix(envOr("CONTAINERSCOPE_CONSUL_URL", "http://127.0.0.1:8500"), "/")
+	header := http.Header{}
+	if token := os.Getenv("CONTAINERSCOPE_CONSUL_TOKEN"); token != "" {
+		header.Set("X-Consul-Token", token)
+	}
+	return jsonRequest(ctx, method, base+path, header, body, out)
+}
+
+// consulServiceID is the Consul service ID of a host
+func consulServiceID(name string) string {
+	return consulService + "-" + name
+}
+
+// registerConsul registers this host with the local Consul agent with a
+// TTL check and passes the check, which is all a renewal needs to do.
+// Consul removes the service once the check has failed for a while.
+func registerConsul(ctx context.Context, self discoveredHost) error {
+	id := consulServiceID(self.Name)
+	err := consulRequest(ctx, http.MethodPut, "/v1/agent/check/pass/service:"+id, nil, nil)
+	if err == nil {
+		return nil
+	}
+	meta := map[string]string{"name": self.Name, "endpoint": self.Endpoint}
+	if len(self.Labels) > 0 {
+		meta["labels"] = formatNodeLabels(self.Labels)
+	}
+	registration := map[string]interface{}{
+		"ID":   id,
+		"Name": consulService,
+		"Meta": meta,
+		"Check": map[string]string{
+			"CheckID":                        "service:" + id,
+			"TTL":                            discoveryTTL.String(),
+			"DeregisterCriticalServiceAfter": "10m",
+		},
+	}
+	if err := consulRequest(ctx, http.MethodPut, "/v1/agent/service/register", registration, nil); err != nil {
+		return err
+	}
+	return consulRequest(ctx, http.MethodPut, "/v1/agent/check/pass/service:"+id, nil, nil)
+}
+
+// consulHosts lists the hosts registered in Consul whose checks pass
+func consulHosts(ctx context.Context) ([]discoveredHost, error) {
+	var entries []struct {
+		Service struct {
+			Meta map[string]string `json:"Meta"`
+		} `json:"Service"`
+	}
+	if err := consulRequest(ctx, http.MethodGet, "/v1/health/service/"+consulService+"?passing=true", nil, &entries); err != nil {
+		return nil, err
+	}
+	hosts := []discoveredHost{}
+	for _, entry := range entries {
+		meta := entry.Service.Meta
+		if meta["name"] == "" || meta["endpoint"] == "" {
+			continue
+		}
+		labels, _ := parseNodeLabels(meta["labels"])
+		hosts = append(hosts, discoveredHost{Name: meta["name"], Endpoint: meta["endpoint"], Labels: labels})
+	}
+	return hosts, nil
+}
+
+// etcdPrefix is the key prefix hosts are registered under in etcd
+func etcdPrefix() string {
+	return envOr("CONTAINERSCOPE_ETCD_PREFIX", "/containerscope/hosts/")
+}
+
+// etcdRegistration is this host's key in etcd, attached to a lease that
+// expires unless renewed
+type etcdRegistration struct {
+	self  discoveredHost
+	lease string
+}
+
+// renew keeps the lease alive, or writes the key again under a new lease
+// when the old one has expired, as it does while etcd is unreachable
+func (r *etcdRegistration) renew(ctx context.Context) error {
+	if r.lease != "" && etcdKeepAlive(ctx, r.lease) == nil {
+		return nil
+	}
+	lease, err := etcdGrant(ctx, discoveryTTL)
+	if err != nil {
+		return err
+	}
+	value, err := json.Marshal(r.self)
+	if err != nil {
+		return err
+	}
+	put := map[string]string{"key": etcdBytes(etcdPrefix() + r.self.Name), "value": etcdBytes(string(value)), "lease": lease}
+	if err := etcdRequest(ctx, "/v3/kv/put", put, nil); err != nil {
+		return err
+	}
+	r.lease = lease
+	return nil
+}
+
+// etcdHosts lists the hosts registered under the etcd prefix
+func etcdHosts(ctx context.Context) ([]discoveredHost, error) {
+	prefix := etcdPrefix()
+	var result etcdRange
+	request := map[string]string{"key": etcdBytes(prefix), "range_end": etcdBytes(etcdRangeEnd(prefix))}
+	if err := etcdRequest(ctx, "/v3/kv/range", request, &result); err != nil {
+		return nil, err
+	}
+	hosts := []discoveredHost{}
+	for _, kv := range result.KVs {
+		data, err := base64.StdEncoding.DecodeString(kv.Value)
+		if err != nil {
+			continue
+		}
+		var host discoveredHost
+		if json.Unmarshal(data, &host) != nil || host.Name == "" || host.Endpoint == "" {
+			continue
+		}
+		hosts = append(hosts, host)
+	}
+	return hosts, nil
+}
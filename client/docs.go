@@ -0,0 +1,146 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"io/fs"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// openAPISpec is the description of every agent endpoint. main checks it
+// against the registered routes at startup, so a route cannot be added
+// without documenting it.
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+// swaggerUIFiles are the swagger-ui-dist 5.18.2 assets, Apache 2.0
+// licensed, embedded so the docs work without reaching a CDN
+//
+//go:embed swagger-ui
+var swaggerUIFiles embed.FS
+
+// swaggerUIPage renders the spec with Swagger UI
+const swaggerUIPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+  <meta charset="utf-8">
+  <title>ContainerScope API</title>
+  <link rel="stylesheet" href="/docs/assets/swagger-ui.css">
+</head>
+<body>
+  <div id="swagger-ui"></div>
+  <script src="/docs/assets/swagger-ui-bundle.js"></script>
+  <script>
+    window.ui = SwaggerUIBundle({ url: "/openapi.json", dom_id: "#swagger-ui" });
+  </script>
+</body>
+</html>
+`
+
+// undocumentedRoutes are served outside the API and left out of the spec
+var undocumentedRoutes = map[string]bool{
+	"/":                      true,
+	"/assets/*filepath":      true,
+	"/docs":                  true,
+	"/docs/assets/*filepath": true,
+	"/openapi.json":          true,
+}
+
+// routeParam matches a path parameter as gin (:id, *path) or OpenAPI
+// ({id}) writes it
+var routeParam = regexp.MustCompile(`:[^/]+|\*[^/]+|\{[^/}]+\}`)
+
+// missingFromSpec lists the registered routes openapi.json does not
+// describe, as "METHOD /path". Parameters are compared by position only,
+// since the spec may name them differently from the route.
+func missingFromSpec(routes gin.RoutesInfo) ([]string, error) {
+	var spec struct {
+		Servers []struct {
+			URL string `json:"url"`
+		} `json:"servers"`
+		Paths map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.Unmarshal(openAPISpec, &spec); err != nil {
+		return nil, err
+	}
+	base := ""
+	if len(spec.Servers) > 0 {
+		base = spec.Servers[0].URL
+	}
+	documented := map[string]bool{}
+	for path, item := range spec.Paths {
+		prefix := base
+		if servers, ok := item["servers"]; ok {
+			var override []struct {
+				URL string `json:"url"`
+			}
+			if err := json.Unmarshal(servers, &override); err != nil {
+				return nil, err
+			}
+			if len(override) > 0 {
+				prefix = override[0].URL
+			}
+		}
+		full := routeParam.ReplaceAllString(prefix+path, "{}")
+		if prefix == "/" {
+			full = routeParam.ReplaceAllString(path, "{}")
+		}
+		for method := range item {
+			documented[method+" "+full] = true
+		}
+	}
+
+	var missing []string
+	for _, route := range routes {
+		if route.Method == http.MethodHead || undocumentedRoutes[route.Path] {
+			continue
+		}
+		key := strings.ToLower(route.Method) + " " + routeParam.ReplaceAllString(route.Path, "{}")
+		if documented[key] {
+			continue
+		}
+		// A catch-all route is documented by the paths under it
+		if wildcard := strings.Index(route.Path, "*"); wildcard >= 0 {
+			prefix := strings.ToLower(route.Method) + " " + routeParam.ReplaceAllString(route.Path[:wildcard], "{}")
+			if documentedUnder(documented, prefix) {
+				continue
+			}
+		}
+		missing = append(missing, route.Method+" "+route.Path)
+	}
+	sort.Strings(missing)
+	return missing, nil
+}
+
+// documentedUnder reports whether a documented path starts with prefix
+func documentedUnder(documented map[string]bool, prefix string) bool {
+	for key := range documented {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// swaggerUIAssets serves the embedded Swagger UI scripts and styles
+func swaggerUIAssets() http.FileSystem {
+	sub, err := fs.Sub(swaggerUIFiles, "swagger-ui")
+	if err != nil {
+		panic(err)
+	}
+	return http.FS(sub)
+}
+
+func openAPIJSON(c *gin.Context) {
+	c.Data(http.StatusOK, "application/json", openAPISpec)
+}
+
+func swaggerUI(c *gin.Context) {
+	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(swaggerUIPage))
+}
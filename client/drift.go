@@ -0,0 +1,354 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/gin-gonic/gin"
+	"gopkg.in/yaml.v3"
+)
+
+// declaredProject is the part of a stack's normalized compose definition,
+// as docker compose config prints it, that drift is checked against
+type declaredProject struct {
+	Services map[string]declaredService `yaml:"services"`
+	Volumes  map[string]struct {
+		Name string `yaml:"name"`
+	} `yaml:"volumes"`
+}
+
+// declaredService is a service of a declaredProject. Environment values
+// are nil for variables taken from the agent's own environment when unset.
+type declaredService struct {
+	Image       string             `yaml:"image"`
+	Entrypoint  []string           `yaml:"entrypoint"`
+	Command     []string           `yaml:"command"`
+	Environment map[string]*string `yaml:"environment"`
+	Labels      map[string]string  `yaml:"labels"`
+	Volumes     []struct {
+		Type     string `yaml:"type"`
+		Source   string `yaml:"source"`
+		Target   string `yaml:"target"`
+		ReadOnly bool   `yaml:"read_only"`
+	} `yaml:"volumes"`
+}
+
+// driftChange is a setting where a container differs from its declared
+// service. Declared is null for a setting added by hand and Actual for
+// one the container lacks.
+type driftChange struct {
+	Key      string      `json:"key"`
+	Declared interface{} `json:"declared"`
+	Actual   interface{} `json:"actual"`
+}
+
+// containerDrift is how one container of a stack differs from its service
+type containerDrift struct {
+	ID      string                   `json:"id"`
+	Name    string                   `json:"name"`
+	Service string                   `json:"service"`
+	Drifted bool                     `json:"drifted"`
+	Drift   map[string][]driftChange `json:"drift"`
+}
+
+// loadDeclaredProject has docker compose normalize a stack's stored file,
+// resolving variables, env files, paths and volume names
+func loadDeclaredProject(ctx context.Context, name string) (*declaredProject, error) {
+	ctx, cancel := context.WithTimeout(ctx, composeTimeout)
+	defer cancel()
+
+	out, err := composeCommand(ctx, name, "config").Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return nil, fmt.Errorf("docker compose config failed: %v\n%s", err, exitErr.Stderr)
+		}
+		return nil, fmt.Errorf("docker compose config failed: %w", err)
+	}
+	var project declaredProject
+	if err := yaml.Unmarshal(out, &project); err != nil {
+		return nil, fmt.Errorf("reading docker compose config: %w", err)
+	}
+	return &project, nil
+}
+
+// declaredValues pairs the declared settings with the container's: its
+// full value for every declared key, plus the keys it sets beyond its
+// image's defaults, in extra, that the service does not declare
+func declaredValues(declared, full, extra map[string]string, keep func(key string) bool) (map[string]interface{}, map[string]interface{}) {
+	wanted, actual := map[string]interface{}{}, map[string]interface{}{}
+	for key, value := range declared {
+		if !keep(key) {
+			continue
+		}
+		wanted[key] = value
+		if v, ok := full[key]; ok {
+			actual[key] = v
+		}
+	}
+	for key, value := range extra {
+		if _, ok := declared[key]; !ok && keep(key) {
+			actual[key] = value
+		}
+	}
+	return wanted, actual
+}
+
+// withoutComposeLabels drops the labels compose adds itself
+func withoutComposeLabels(labels map[string]string) map[string]string {
+	out := map[string]string{}
+	for key, value := range labels {
+		if !strings.HasPrefix(key, composeLabelPrefix) {
+			out[key] = value
+		}
+	}
+	return out
+}
+
+// driftChanges turns a diff of declared against actual settings into drift
+func driftChanges(changes []configChange) []driftChange {
+	drift := make([]driftChange, 0, len(changes))
+	for _, change := range changes {
+		drift = append(drift, driftChange{Key: change.Key, Declared: change.A, Actual: change.B})
+	}
+	return drift
+}
+
+// serviceDrift compares a container with the service that declares it.
+// Environment variables, labels and commands are redacted for role as in
+// inspect unless reveal.
+func serviceDrift(ctx context.Context, project *declaredProject, service declaredService, inspection types.ContainerJSON, role string, reveal bool) map[string][]driftChange {
+	// Settings the container only inherits from its image were not set by
+	// hand, so only what remains after stripping them counts as added
+	inherited := *inspection.Config
+	var imageVolumes map[string]struct{}
+	if image, _, err := docker(ctx).ImageInspectWithRaw(ctx, inspection.Image); err == nil && image.Config != nil {
+		stripImageDefaults(&inherited, image.Config)
+		imageVolumes = image.Config.Volumes
+	}
+
+	wantedImage := map[string]interface{}{}
+	actualImage := map[string]interface{}{"image": inspection.Config.Image}
+	if service.Image != "" {
+		wantedImage["image"] = service.Image
+		// The tag now pointing at another image means the service was
+		// pulled but not redeployed, or the container was recreated by hand
+		if image, _, err := docker(ctx).ImageInspectWithRaw(ctx, service.Image); err == nil {
+			wantedImage["image_id"] = image.ID
+			actualImage["image_id"] = inspection.Image
+		}
+	}
+
+	keepFor := func(field string) func(string) bool {
+		return func(key string) bool {
+			return reveal || fieldRedaction(field, key, role) != redactStrip
+		}
+	}
+	redacted := func(changes []configChange, field string) []configChange {
+		if reveal {
+			return changes
+		}
+		return redactChanges(changes, field, role)
+	}
+
+	declaredEnv := map[string]string{}
+	for key, value := range service.Environment {
+		if value != nil {
+			declaredEnv[key] = *value
+		}
+	}
+	wantedEnv, actualEnv := declaredValues(declaredEnv, envValues(inspection.Config.Env), envValues(inherited.Env), keepFor(redactEnv))
+	wantedLabels, actualLabels := declaredValues(withoutComposeLabels(service.Labels),
+		withoutComposeLabels(inspection.Config.Labels), withoutComposeLabels(inherited.Labels), keepFor(redactLabels))
+
+	wantedCommand := container.Config{Entrypoint: service.Entrypoint, Cmd: service.Command}
+	actualCommand := container.Config{Entrypoint: inherited.Entrypoint, Cmd: inherited.Cmd}
+	if service.Entrypoint != nil {
+		actualCommand.Entrypoint = inspection.Config.Entrypoint
+	}
+	if service.Command != nil {
+		actualCommand.Cmd = inspection.Config.Cmd
+	}
+
+	wantedMounts, actualMounts := map[string]interface{}{}, map[string]interface{}{}
+	for _, v := range service.Volumes {
+		switch v.Type {
+		case string(mount.TypeBind):
+			wantedMounts[v.Target] = mountConfig{Type: v.Type, Source: v.Source, RW: !v.ReadOnly}
+		case string(mount.TypeVolume):
+			name := v.Source
+			if declared, ok := project.Volumes[v.Source]; ok && declared.Name != "" {
+				name = declared.Name
+			}
+			wantedMounts[v.Target] = mountConfig{Type: v.Type, Name: name, RW: !v.ReadOnly}
+		}
+	}
+	for _, m := range inspection.Mounts {
+		switch m.Type {
+		case mount.TypeBind:
+			actualMounts[m.Destination] = mountConfig{Type: string(m.Type), Source: m.Source, RW: m.RW}
+		case mount.TypeVolume:
+			name := m.Name
+			if isAnonymousVolume(name) {
+				// Anonymous volumes the image declares are not drift
+				if _, declared := wantedMounts[m.Destination]; !declared {
+					if _, ok := imageVolumes[m.Destination]; ok {
+						continue
+					}
+				}
+				name = ""
+			}
+			actualMounts[m.Destination] = mountConfig{Type: string(m.Type), Name: name, RW: m.RW}
+		}
+	}
+
+	return map[string][]driftChange{
+		"image":   driftChanges(diffValues(wantedImage, actualImage)),
+		"command": driftChanges(diffValues(commandValues(&wantedCommand, role, reveal), commandValues(&actualCommand, role, reveal))),
+		"env":     driftChanges(redacted(diffValues(wantedEnv, actualEnv), redactEnv)),
+		"labels":  driftChanges(redacted(diffValues(wantedLabels, actualLabels), redactLabels)),
+		"mounts":  driftChanges(diffValues(wantedMounts, actualMounts)),
+	}
+}
+
+// stackDrift checks the containers of a stack against its declared
+// project. With only set, just that container is checked.
+func stackDrift(ctx context.Context, name string, project *declaredProject, only, role string, reveal bool) (gin.H, error) {
+	containers, err := docker(ctx).ContainerList(ctx, container.ListOptions{
+		All:     true,
+		Filters: scopeFilters(ctx, filters.NewArgs(filters.Arg("label", composeProjectLabel+"="+name))),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	results := []containerDrift{}
+	orphans := []string{}
+	seen := map[string]bool{}
+	drifted := false
+	for _, cont := range containers {
+		serviceName := cont.Labels[composeServiceLabel]
+		seen[serviceName] = true
+		if only != "" && cont.ID != only {
+			continue
+		}
+		service, ok := project.Services[serviceName]
+		if !ok {
+			orphans = append(orphans, strings.TrimPrefix(cont.Names[0], "/"))
+			continue
+		}
+		inspection, err := docker(ctx).ContainerInspect(ctx, cont.ID)
+		if err != nil {
+			return nil, err
+		}
+		result := containerDrift{
+			ID:      cont.ID,
+			Name:    strings.TrimPrefix(cont.Names[0], "/"),
+			Service: serviceName,
+			Drift:   serviceDrift(ctx, project, service, inspection, role, reveal),
+		}
+		for _, changes := range result.Drift {
+			if len(changes) > 0 {
+				result.Drifted = true
+			}
+		}
+		drifted = drifted || result.Drifted
+		results = append(results, result)
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Name < results[j].Name })
+
+	missing := []string{}
+	for serviceName := range project.Services {
+		if !seen[serviceName] {
+			missing = append(missing, serviceName)
+		}
+	}
+	sort.Strings(missing)
+	sort.Strings(orphans)
+	return gin.H{"stack": name, "drifted": drifted, "containers": results, "missing_services": missing, "orphans": orphans}, nil
+}
+
+// stackExists reports whether a stack was deployed through the agent on
+// ctx's host
+func stackExists(ctx context.Context, name string) bool {
+	if !stackName.MatchString(name) {
+		return false
+	}
+	_, err := os.Stat(filepath.Join(stackDir(ctx, name), stackComposeFile))
+	return err == nil
+}
+
+// getStackDrift reports how a stack's containers differ from its stored
+// compose file: edited environment, labels or command, another image, or
+// mounts added, removed or changed. Services without a container are
+// listed as missing, containers of removed services as orphans.
+func getStackDrift(c *gin.Context) {
+	ctx := hostContext(c)
+	name := c.Param("stack")
+	if !stackExists(ctx, name) {
+		respondError(c, http.StatusNotFound, codeStackNotFound, fmt.Sprintf("Stack %s not found", name))
+		return
+	}
+	reveal, ok := wantsReveal(c)
+	if !ok {
+		return
+	}
+	project, err := loadDeclaredProject(ctx, name)
+	if err != nil {
+		c.Error(err)
+		respondError(c, http.StatusUnprocessableEntity, codeComposeError, err.Error())
+		return
+	}
+	report, err := stackDrift(ctx, name, project, "", callerRole(c), reveal)
+	if err != nil {
+		dockerError(c, "Error checking drift", err)
+		return
+	}
+	respond(c, http.StatusOK, report)
+}
+
+// getContainerDrift reports how a container differs from its service in
+// the stack it was deployed with
+func getContainerDrift(c *gin.Context) {
+	ctx := hostContext(c)
+	containerID := c.Param("container_id")
+	v, _ := c.Get(resolvedContainerKey)
+	cont, _ := v.(types.Container)
+	name := cont.Labels[composeProjectLabel]
+	if !stackExists(ctx, name) {
+		respondError(c, http.StatusNotFound, codeStackNotFound, fmt.Sprintf("Container %s is not part of a stack deployed through the agent", containerName(c)))
+		return
+	}
+	reveal, ok := wantsReveal(c)
+	if !ok {
+		return
+	}
+	project, err := loadDeclaredProject(ctx, name)
+	if err != nil {
+		c.Error(err)
+		respondError(c, http.StatusUnprocessableEntity, codeComposeError, err.Error())
+		return
+	}
+	report, err := stackDrift(ctx, name, project, containerID, callerRole(c), reveal)
+	if err != nil {
+		dockerError(c, "Error checking drift", err)
+		return
+	}
+	results := report["containers"].([]containerDrift)
+	if len(results) == 0 {
+		respondError(c, http.StatusNotFound, codeStackNotFound, fmt.Sprintf("Stack %s no longer declares service %s", name, cont.Labels[composeServiceLabel]))
+		return
+	}
+	respond(c, http.StatusOK, gin.H{"stack": name, "container": results[0]})
+}
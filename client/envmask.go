@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// secretEnvPatterns mark environment variables whose values the default
+// redaction rule masks: a variable is secret when its name contains one of
+// them, ignoring case. CONTAINERSCOPE_SECRET_ENV_PATTERNS replaces the
+// defaults.
+var secretEnvPatterns = splitList(envOr("CONTAINERSCOPE_SECRET_ENV_PATTERNS", "PASSWORD,TOKEN,SECRET,KEY"))
+
+// maskedValue replaces a redacted value
+const maskedValue = "********"
+
+// envVar is one variable of a container's environment
+type envVar struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Masked bool   `json:"masked"`
+}
+
+// wantsReveal reads ?reveal=true, which turns redaction off and only admins
+// may send: the admin token, or a signed-in user with the admin role. It
+// responds with 403 to anyone else and returns ok false.
+func wantsReveal(c *gin.Context) (reveal, ok bool) {
+	if c.Query("reveal") != "true" {
+		return false, true
+	}
+	if p, found, _ := identify(c); found && p.Role == roleAdmin {
+		return true, true
+	}
+	respondError(c, http.StatusForbidden, codeForbidden, "Only admins may reveal redacted values")
+	return false, false
+}
+
+// containerEnv lists a container's environment variables, masked or left
+// out as the redaction rules say for the caller's role unless an admin
+// asks for ?reveal=true
+func containerEnv(c *gin.Context) {
+	ctx := hostContext(c)
+	containerID := c.Param("container_id")
+	reveal, ok := wantsReveal(c)
+	if !ok {
+		return
+	}
+	inspection, err := docker(ctx).ContainerInspect(ctx, containerID)
+	if err != nil {
+		dockerError(c, "Error inspecting container", err)
+		return
+	}
+
+	role := callerRole(c)
+	vars := []envVar{}
+	if inspection.Config != nil {
+		for _, e := range inspection.Config.Env {
+			name, value, _ := strings.Cut(e, "=")
+			v := envVar{Name: name, Value: value}
+			if !reveal {
+				switch fieldRedaction(redactEnv, name, role) {
+				case redactStrip:
+					continue
+				case redactMask:
+					v.Value, v.Masked = maskedValue, true
+				}
+			}
+			vars = append(vars, v)
+		}
+	}
+	respond(c, http.StatusOK, gin.H{
+		"container": containerID,
+		"name":      containerName(c),
+		"revealed":  reveal,
+		"env":       vars,
+	})
+}
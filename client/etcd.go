@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// etcdStoreTimeout bounds each store operation against etcd
+const etcdStoreTimeout = 10 * time.Second
+
+// etcdPageSize is how many keys a range over a bucket reads at a time
+const etcdPageSize = 500
+
+// etcdKV is a key and value as the JSON gateway returns them, base64
+// encoded
+type etcdKV struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// etcdRange is the JSON gateway's answer to a range request
+type etcdRange struct {
+	KVs  []etcdKV `json:"kvs"`
+	More bool     `json:"more"`
+}
+
+// etcdRequest calls the JSON gateway of etcd's v3 API at
+// CONTAINERSCOPE_ETCD_URL, a comma separated list of cluster members
+// tried in turn while they cannot be reached
+func etcdRequest(ctx context.Context, path string, body, out interface{}) error {
+	var err error
+	for _, base := range splitList(envOr("CONTAINERSCOPE_ETCD_URL", "http://127.0.0.1:2379")) {
+		err = jsonRequest(ctx, http.MethodPost, strings.TrimSuffix(base, "/")+path, nil, body, out)
+		var unreachable *url.Error
+		if !errors.As(err, &unreachable) {
+			return err
+		}
+	}
+	return err
+}
+
+// etcdBytes encodes a key or value for the JSON gateway
+func etcdBytes(s string) string {
+	return base64.StdEncoding.EncodeToString([]byte(s))
+}
+
+// etcdRangeEnd is the end of the range of keys starting with prefix: the
+// prefix with its last byte incremented
+func etcdRangeEnd(prefix string) string {
+	if prefix == "" {
+		return "\x00"
+	}
+	end := []byte(prefix)
+	end[len(end)-1]++
+	return string(end)
+}
+
+// etcdGrant creates a lease that expires after ttl unless kept alive
+func etcdGrant(ctx context.Context, ttl time.Duration) (string, error) {
+	var grant struct {
+		ID string `json:"ID"`
+	}
+	if err := etcdRequest(ctx, "/v3/lease/grant", map[string]int64{"TTL": int64(ttl.Seconds())}, &grant); err != nil {
+		return "", err
+	}
+	return grant.ID, nil
+}
+
+// errLeaseExpired is the error renewing a lease that has expired
+var errLeaseExpired = errors.New("lease has expired")
+
+// etcdKeepAlive renews a lease, failing when it has already expired
+func etcdKeepAlive(ctx context.Context, lease string) error {
+	var alive struct {
+		Result struct {
+			TTL string `json:"TTL"`
+		} `json:"result"`
+	}
+	if err := etcdRequest(ctx, "/v3/lease/keepalive", map[string]string{"ID": lease}, &alive); err != nil {
+		return err
+	}
+	if alive.Result.TTL == "" || alive.Result.TTL == "0" {
+		return fmt.Errorf("lease %s: %w", lease, errLeaseExpired)
+	}
+	return nil
+}
+
+// etcdCreate puts value under key, bound to lease unless it is "", if no
+// key by that name exists, reporting whether it did
+func etcdCreate(ctx context.Context, key, value, lease string) (bool, error) {
+	put := map[string]string{"key": etcdBytes(key), "value": etcdBytes(value)}
+	if lease != "" {
+		put["lease"] = lease
+	}
+	var txn struct {
+		Succeeded bool `json:"succeeded"`
+	}
+	err := etcdRequest(ctx, "/v3/kv/txn", map[string]interface{}{
+		"compare": []map[string]string{{"key": etcdBytes(key), "result": "EQUAL", "target": "CREATE", "create_revision": "0"}},
+		"success": []map[string]interface{}{{"request_put": put}},
+	}, &txn)
+	return txn.Succeeded, err
+}
+
+// etcdPrefixRoot is where replicas sharing etcd keep their state:
+// CONTAINERSCOPE_ETCD_STORE_PREFIX, by default /containerscope/
+func etcdPrefixRoot() string {
+	return envOr("CONTAINERSCOPE_ETCD_STORE_PREFIX", "/containerscope/")
+}
+
+// etcdStore keeps each bucket under its own prefix in etcd, so replicas
+// of the agent share their state
+type etcdStore struct {
+	prefix string
+}
+
+// openEtcdStore checks that etcd answers before the agent relies on it
+func openEtcdStore() (etcdStore, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), etcdStoreTimeout)
+	defer cancel()
+	if err := etcdRequest(ctx, "/v3/maintenance/status", map[string]string{}, nil); err != nil {
+		return etcdStore{}, fmt.Errorf("etcd: %w", err)
+	}
+	return etcdStore{prefix: etcdPrefixRoot() + "store/"}, nil
+}
+
+// bucket is the prefix of a bucket's keys
+func (s etcdStore) bucket(name string) string {
+	return s.prefix + name + "/"
+}
+
+func (s etcdStore) put(bucket, key string, data []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), etcdStoreTimeout)
+	defer cancel()
+	return etcdRequest(ctx, "/v3/kv/put", map[string]string{"key": etcdBytes(s.bucket(bucket) + key), "value": etcdBytes(string(data))}, nil)
+}
+
+func (s etcdStore) get(bucket, key string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), etcdStoreTimeout)
+	defer cancel()
+	var result etcdRange
+	if err := etcdRequest(ctx, "/v3/kv/range", map[string]string{"key": etcdBytes(s.bucket(bucket) + key)}, &result); err != nil {
+		return nil, err
+	}
+	if len(result.KVs) == 0 {
+		return nil, nil
+	}
+	return base64.StdEncoding.DecodeString(result.KVs[0].Value)
+}
+
+func (s etcdStore) delete(bucket, key string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), etcdStoreTimeout)
+	defer cancel()
+	return etcdRequest(ctx, "/v3/kv/deleterange", map[string]string{"key": etcdBytes(s.bucket(bucket) + key)}, nil)
+}
+
+func (s etcdStore) create(bucket, key string, data []byte) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), etcdStoreTimeout)
+	defer cancel()
+	return etcdCreate(ctx, s.bucket(bucket)+key, string(data), "")
+}
+
+func (s etcdStore) take(bucket, key string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), etcdStoreTimeout)
+	defer cancel()
+	var result struct {
+		PrevKVs []etcdKV `json:"prev_kvs"`
+	}
+	if err := etcdRequest(ctx, "/v3/kv/deleterange", map[string]interface{}{"key": etcdBytes(s.bucket(bucket) + key), "prev_kv": true}, &result); err != nil {
+		return nil, err
+	}
+	if len(result.PrevKVs) == 0 {
+		return nil, nil
+	}
+	return base64.StdEncoding.DecodeString(result.PrevKVs[0].Value)
+}
+
+func (s etcdStore) deleteIf(bucket, key string, data []byte) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), etcdStoreTimeout)
+	defer cancel()
+	full := etcdBytes(s.bucket(bucket) + key)
+	var txn struct {
+		Succeeded bool `json:"succeeded"`
+	}
+	err := etcdRequest(ctx, "/v3/kv/txn", map[string]interface{}{
+		"compare": []map[string]string{{"key": full, "result": "EQUAL", "target": "VALUE", "value": etcdBytes(string(data))}},
+		"success": []map[string]interface{}{{"request_delete_range": map[string]string{"key": full}}},
+	}, &txn)
+	return txn.Succeeded, err
+}
+
+// eachRange reads the range a page at a time, so a large bucket such as
+// the event history is not loaded at once
+func (s etcdStore) eachRange(bucket, from, to string, fn func(key string, value []byte) error) error {
+	prefix := s.bucket(bucket)
+	start, end := prefix+from, etcdRangeEnd(prefix)
+	if to != "" {
+		end = prefix + to
+	}
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), etcdStoreTimeout)
+		var page etcdRange
+		err := etcdRequest(ctx, "/v3/kv/range", map[string]interface{}{
+			"key":       etcdBytes(start),
+			"range_end": etcdBytes(end),
+			"limit":     etcdPageSize,
+		}, &page)
+		cancel()
+		if err != nil {
+			return err
+		}
+		for _, kv := range page.KVs {
+			key, err := base64.StdEncoding.DecodeString(kv.Key)
+			if err != nil {
+				return err
+			}
+			value, err := base64.StdEncoding.DecodeString(kv.Value)
+			if err != nil {
+				return err
+			}
+			if err := fn(strings.TrimPrefix(string(key), prefix), value); err != nil {
+				return err
+			}
+			// The next page starts just after this key
+			start = string(key) + "\x00"
+		}
+		if !page.More || len(page.KVs) == 0 {
+			return nil
+		}
+	}
+}
+
+func (s etcdStore) deleteBefore(bucket, key string) (int, error) {
+	if key == "" {
+		return 0, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), etcdStoreTimeout)
+	defer cancel()
+	prefix := s.bucket(bucket)
+	var result struct {
+		Deleted string `json:"deleted"`
+	}
+	if err := etcdRequest(ctx, "/v3/kv/deleterange", map[string]string{"key": etcdBytes(prefix), "range_end": etcdBytes(prefix + key)}, &result); err != nil {
+		return 0, err
+	}
+	n, _ := strconv.Atoi(result.Deleted)
+	return n, nil
+}
+
+// etcdLeaderKey is the etcd key holding the leading replica's ID
+func etcdLeaderKey() string {
+	return etcdPrefixRoot() + "leader"
+}
+
+// campaign takes the leader key under a new lease if no replica holds
+// it; the lease is the term
+func (s etcdStore) campaign(ctx context.Context, id string) (string, error) {
+	lease, err := etcdGrant(ctx, leaderTTL)
+	if err != nil {
+		return "", err
+	}
+	created, err := etcdCreate(ctx, etcdLeaderKey(), id, lease)
+	if err == nil && created {
+		return lease, nil
+	}
+	// The lease is not needed; it expires on its own if this fails too
+	etcdRequest(ctx, "/v3/lease/revoke", map[string]string{"ID": lease}, nil)
+	return "", err
+}
+
+func (s etcdStore) renew(ctx context.Context, term string) error {
+	err := etcdKeepAlive(ctx, term)
+	if errors.Is(err, errLeaseExpired) {
+		return fmt.Errorf("%w: %w", errTermLapsed, err)
+	}
+	return err
+}
+
+func (s etcdStore) leader(ctx context.Context) (string, error) {
+	var result etcdRange
+	if err := etcdRequest(ctx, "/v3/kv/range", map[string]string{"key": etcdBytes(etcdLeaderKey())}, &result); err != nil || len(result.KVs) == 0 {
+		return "", err
+	}
+	id, err := base64.StdEncoding.DecodeString(result.KVs[0].Value)
+	return string(id), err
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+)
+
+// eventBufferSize is how many events a slow subscriber may fall behind
+// before it misses some and is told to resync
+const eventBufferSize = 256
+
+// hostEvent is a Docker event, or a resync notice when the stream was
+// (re)established and events may have been missed
+type hostEvent struct {
+	events.Message
+	Resync bool
+}
+
+// eventBus follows one host's Docker event stream and fans it out, so
+// every feature that reacts to events shares a single subscription
+type eventBus struct {
+	host *dockerHost
+	mu   sync.Mutex
+	subs map[*eventSub]struct{}
+}
+
+// eventSub is one subscriber's queue
+type eventSub struct {
+	ch     chan hostEvent
+	missed bool
+}
+
+// eventBuses holds a bus per host name; it is filled before the server
+// starts and only read afterwards
+var eventBuses = map[string]*eventBus{}
+
+// startEventBuses starts following the events of every host
+func startEventBuses() {
+	for name, host := range dockerHosts {
+		bus := &eventBus{host: host, subs: map[*eventSub]struct{}{}}
+		eventBuses[name] = bus
+		go bus.run()
+	}
+}
+
+// subscribe returns a channel of the host's events, starting with a
+// resync notice, and a function that ends the subscription
+func (b *eventBus) subscribe() (<-chan hostEvent, func()) {
+	sub := &eventSub{ch: make(chan hostEvent, eventBufferSize)}
+	sub.ch <- hostEvent{Resync: true}
+	b.mu.Lock()
+	b.subs[sub] = struct{}{}
+	b.mu.Unlock()
+	return sub.ch, func() {
+		b.mu.Lock()
+		delete(b.subs, sub)
+		b.mu.Unlock()
+	}
+}
+
+// subscribeUntil returns a channel of the host's events like subscribe,
+// which closes once ctx is done
+func (b *eventBus) subscribeUntil(ctx context.Context) <-chan hostEvent {
+	sub := &eventSub{ch: make(chan hostEvent, eventBufferSize)}
+	sub.ch <- hostEvent{Resync: true}
+	b.mu.Lock()
+	b.subs[sub] = struct{}{}
+	b.mu.Unlock()
+	go func() {
+		<-ctx.Done()
+		// publish sends under the lock, so nothing is sent once removed
+		b.mu.Lock()
+		delete(b.subs, sub)
+		b.mu.Unlock()
+		close(sub.ch)
+	}()
+	return sub.ch
+}
+
+// publish hands ev to every subscriber without blocking. A subscriber
+// whose queue is full misses it, and gets a resync notice once it has
+// caught up.
+func (b *eventBus) publish(ev hostEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for sub := range b.subs {
+		if sub.missed {
+			select {
+			case sub.ch <- hostEvent{Resync: true}:
+				sub.missed = false
+			default:
+				continue
+			}
+		}
+		select {
+		case sub.ch <- ev:
+		default:
+			sub.missed = true
+		}
+	}
+}
+
+// run follows the event stream, resubscribing with backoff when it
+// breaks, and tells subscribers to resync after every reconnection
+func (b *eventBus) run() {
+	backoff := time.Second
+	for {
+		ctx, cancel := context.WithCancel(context.Background())
+		connected := time.Now()
+		msgs, errs := b.host.Client().Events(ctx, types.EventsOptions{})
+		b.publish(hostEvent{Resync: true})
+		err := b.forward(msgs, errs)
+		cancel()
+		logger.Debug("docker event stream ended", "host", b.host.Name, "error", err)
+
+		if time.Since(connected) > time.Minute {
+			backoff = time.Second
+		}
+		time.Sleep(backoff)
+		if backoff < 30*time.Second {
+			backoff *= 2
+		}
+	}
+}
+
+// forward publishes events until the stream fails
+func (b *eventBus) forward(msgs <-chan events.Message, errs <-chan error) error {
+	for {
+		select {
+		case msg := <-msgs:
+			b.publish(hostEvent{Message: msg})
+		case err := <-errs:
+			return err
+		}
+	}
+}
+
+// eventBusFor returns the bus of the host carried by ctx, or nil when
+// events are not followed, as with the containerd runtime
+func eventBusFor(ctx context.Context) *eventBus {
+	return eventBuses[hostFrom(ctx).Name]
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/gin-gonic/gin"
+)
+
+// containerPath reads and cleans the ?path= parameter, which must be absolute
+func containerPath(c *gin.Context) (string, bool) {
+	p := c.Query("path")
+	if !strings.HasPrefix(p, "/") {
+		badRequest(c, "path must be an absolute path inside the container")
+		return "", false
+	}
+	return path.Clean(p), true
+}
+
+// fileEntry describes one file in a container directory listing
+func fileEntry(name string, size int64, mode int64, modTime time.Time, isDir bool, linkTarget string) map[string]interface{} {
+	return map[string]interface{}{
+		"name":        name,
+		"size":        size,
+		"mode":        fmt.Sprintf("%o", mode&0o7777),
+		"modified":    modTime,
+		"is_dir":      isDir,
+		"link_target": linkTarget,
+	}
+}
+
+// archiveEntries lists the direct children of the directory a
+// CopyFromContainer archive holds
+func archiveEntries(r io.Reader) ([]interface{}, error) {
+	entries := []interface{}{}
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// Entries are rooted at the directory's own name: skip the root
+		// itself and anything below its direct children
+		_, rel, found := strings.Cut(strings.TrimSuffix(header.Name, "/"), "/")
+		if !found || rel == "" || strings.Contains(rel, "/") {
+			continue
+		}
+		entries = append(entries, fileEntry(rel, header.Size, header.Mode, header.ModTime,
+			header.Typeflag == tar.TypeDir, header.Linkname))
+	}
+}
+
+// listContainerFiles lists the direct children of a directory. Docker has no
+// listing API, so this walks the headers of the tar CopyFromContainer
+// returns; large trees are still transferred in full by the daemon.
+func listContainerFiles(c *gin.Context) {
+	ctx := hostContext(c)
+	containerID := c.Param("container_id")
+	dir, ok := containerPath(c)
+	if !ok {
+		return
+	}
+
+	stat, err := docker(ctx).ContainerStatPath(ctx, containerID, dir)
+	if err != nil {
+		dockerError(c, "Error reading container path", err)
+		return
+	}
+	if !stat.Mode.IsDir() {
+		respond(c, http.StatusOK, gin.H{
+			"path":    dir,
+			"entries": []interface{}{fileEntry(stat.Name, stat.Size, int64(stat.Mode.Perm()), stat.Mtime, false, stat.LinkTarget)},
+		})
+		return
+	}
+
+	reader, _, err := docker(ctx).CopyFromContainer(ctx, containerID, dir)
+	if err != nil {
+		dockerError(c, "Error reading container path", err)
+		return
+	}
+	defer reader.Close()
+
+	entries, err := archiveEntries(reader)
+	if err != nil {
+		dockerError(c, "Error reading container archive", err)
+		return
+	}
+	respond(c, http.StatusOK, gin.H{"path": dir, "entries": entries})
+}
+
+// downloadContainerFiles streams a file or directory as a tar archive
+func downloadContainerFiles(c *gin.Context) {
+	ctx := hostContext(c)
+	containerID := c.Param("container_id")
+	src, ok := containerPath(c)
+	if !ok {
+		return
+	}
+
+	reader, stat, err := docker(ctx).CopyFromContainer(ctx, containerID, src)
+	if err != nil {
+		dockerError(c, "Error copying from container", err)
+		return
+	}
+	defer reader.Close()
+
+	filename := fmt.Sprintf("%s_%s.tar", containerName(c), stat.Name)
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%s", filename))
+	c.DataFromReader(http.StatusOK, -1, "application/x-tar", reader, nil)
+}
+
+// copyUploads copies uploaded files into a directory in a container,
+// packing them into the tar stream CopyToContainer expects
+func copyUploads(ctx context.Context, containerID, dst string, files []*multipart.FileHeader) error {
+	pr, pw := io.Pipe()
+	go func() {
+		tw := tar.NewWriter(pw)
+		for _, fh := range files {
+			f, err := fh.Open()
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			header := &tar.Header{Name: path.Base(fh.Filename), Mode: 0o644, Size: fh.Size}
+			if err := tw.WriteHeader(header); err != nil {
+				f.Close()
+				pw.CloseWithError(err)
+				return
+			}
+			_, err = io.Copy(tw, f)
+			f.Close()
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+		pw.CloseWithError(tw.Close())
+	}()
+
+	err := docker(ctx).CopyToContainer(ctx, containerID, dst, pr, types.CopyToContainerOptions{})
+	pr.Close()
+	return err
+}
+
+// uploadContainerFiles copies multipart "file" uploads into a directory
+// in the container
+func uploadContainerFiles(c *gin.Context) {
+	ctx := hostContext(c)
+	containerID := c.Param("container_id")
+	dst, ok := containerPath(c)
+	if !ok {
+		return
+	}
+
+	form, err := c.MultipartForm()
+	if err != nil {
+		badRequest(c, "Expected a multipart form with one or more file fields")
+		return
+	}
+	files := form.File["file"]
+	if len(files) == 0 {
+		badRequest(c, "No files uploaded")
+		return
+	}
+
+	if err := copyUploads(ctx, containerID, dst, files); err != nil {
+		dockerError(c, "Error copying to container", err)
+		return
+	}
+
+	names := []string{}
+	for _, fh := range files {
+		names = append(names, path.Join(dst, path.Base(fh.Filename)))
+	}
+	respond(c, http.StatusOK, gin.H{"message": "Files uploaded successfully", "files": names})
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/gin-gonic/gin"
+)
+
+// hostEnv is the variable holding a per-host setting: base itself for the
+// default host, and base_<NAME> for the others, the name upper-cased with
+// anything but letters and digits turned into underscores
+func hostEnv(base, name string) string {
+	if name == defaultHostName {
+		return base
+	}
+	return base + "_" + strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// nodeLabelsEnv is the variable holding a host's labels:
+// CONTAINERSCOPE_NODE_LABELS for the default host, and
+// CONTAINERSCOPE_NODE_LABELS_<NAME> for the others
+func nodeLabelsEnv(name string) string {
+	return hostEnv("CONTAINERSCOPE_NODE_LABELS", name)
+}
+
+// parseNodeLabels reads comma separated key=value pairs
+func parseNodeLabels(setting string) (map[string]string, error) {
+	labels := map[string]string{}
+	for _, pair := range strings.Split(setting, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(pair, "=")
+		if key = strings.TrimSpace(key); !ok || key == "" {
+			return nil, fmt.Errorf("invalid label %q, expected key=value", pair)
+		}
+		labels[key] = strings.TrimSpace(value)
+	}
+	return labels, nil
+}
+
+// loadNodeLabels gives each configured host the labels set for it, such
+// as env=prod,dc=eu-west, which the host endpoints filter and group by
+func loadNodeLabels() error {
+	for name, host := range dockerHosts {
+		env := nodeLabelsEnv(name)
+		labels, err := parseNodeLabels(os.Getenv(env))
+		if err != nil {
+			return fmt.Errorf("%s: %w", env, err)
+		}
+		if len(labels) > 0 {
+			host.Labels = labels
+		}
+	}
+	return nil
+}
+
+// nodeSelector is the node_label query parameters, each key or
+// key=value, all of which a host's labels must match
+type nodeSelector []string
+
+// parseNodeSelector reads the request's node_label parameters
+func parseNodeSelector(c *gin.Context) (nodeSelector, error) {
+	selector := nodeSelector(c.QueryArray("node_label"))
+	for _, label := range selector {
+		if label == "" || strings.HasPrefix(label, "=") {
+			return nil, fmt.Errorf("invalid node_label %q, expected key or key=value", label)
+		}
+	}
+	return selector, nil
+}
+
+// matches reports whether labels satisfy every term of the selector
+func (s nodeSelector) matches(labels map[string]string) bool {
+	for _, term := range s {
+		key, value, hasValue := strings.Cut(term, "=")
+		actual, ok := labels[key]
+		if !ok || hasValue && actual != value {
+			return false
+		}
+	}
+	return true
+}
+
+// selectedHosts returns the hosts the request's node_label parameters
+// select, by name
+func selectedHosts(c *gin.Context) ([]*dockerHost, error) {
+	selector, err := parseNodeSelector(c)
+	if err != nil {
+		return nil, err
+	}
+	hosts := []*dockerHost{}
+	for _, host := range dockerHosts {
+		if selector.matches(host.Labels) {
+			hosts = append(hosts, host)
+		}
+	}
+	sort.Slice(hosts, func(i, j int) bool { return hosts[i].Name < hosts[j].Name })
+	return hosts, nil
+}
+
+// forEachHost calls fn for every host concurrently with a context carrying
+// the host, and returns the error of each host that failed by name, so one
+// unreachable host does not fail a request covering many
+func forEachHost(ctx context.Context, hosts []*dockerHost, fn func(ctx context.Context, host *dockerHost) error) map[string]string {
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs = map[string]string{}
+	)
+	for _, host := range hosts {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := fn(withHost(ctx, host), host); err != nil {
+				mu.Lock()
+				errs[host.Name] = err.Error()
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return errs
+}
+
+// hostGroup is the hosts sharing one value of the group_by label, and
+// what was gathered from them
+type hostGroup struct {
+	value string
+	hosts []string
+	rows  []map[string]interface{}
+}
+
+// groupByLabel splits rows, each naming its host, by the value the host
+// has for the label key. Hosts without the label form the group with the
+// empty value, which comes last.
+func groupByLabel(key string, hosts []*dockerHost, rows []map[string]interface{}) []*hostGroup {
+	byValue := map[string]*hostGroup{}
+	hostValue := map[string]string{}
+	for _, host := range hosts {
+		value := host.Labels[key]
+		hostValue[host.Name] = value
+		group, ok := byValue[value]
+		if !ok {
+			group = &hostGroup{value: value, hosts: []string{}, rows: []map[string]interface{}{}}
+			byValue[value] = group
+		}
+		group.hosts = append(group.hosts, host.Name)
+	}
+	for _, row := range rows {
+		group := byValue[hostValue[row["host"].(string)]]
+		group.rows = append(group.rows, row)
+	}
+	groups := make([]*hostGroup, 0, len(byValue))
+	for _, group := range byValue {
+		groups = append(groups, group)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		if (groups[i].value == "") != (groups[j].value == "") {
+			return groups[j].value == ""
+		}
+		return groups[i].value < groups[j].value
+	})
+	return groups
+}
+
+// fleetContainers lists the containers of every host the node_label
+// parameters select, taking the container list's status, name, image and
+// label filters. ?group_by=<label> groups them by that node label. Hosts
+// that cannot be reached are listed under errors.
+func fleetContainers(c *gin.Context) {
+	hosts, err := selectedHosts(c)
+	if err != nil {
+		badRequest(c, err.Error())
+		return
+	}
+	listFilters, err := containerFilters(c)
+	if err != nil {
+		badRequest(c, err.Error())
+		return
+	}
+
+	var mu sync.Mutex
+	rows := []map[string]interface{}{}
+	errs := forEachHost(c.Request.Context(), hosts, func(ctx context.Context, host *dockerHost) error {
+		containers, err := docker(ctx).ContainerList(ctx, container.ListOptions{All: true, Filters: listFilters})
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		for _, cont := range containers {
+			rows = append(rows, map[string]interface{}{
+				"host":    host.Name,
+				"name":    strings.TrimPrefix(cont.Names[0], "/"),
+				"id":      cont.ID[:10],
+				"full_id": cont.ID,
+				"image":   cont.Image,
+				"state":   cont.State,
+				"status":  cont.Status,
+				"running": cont.State == "running",
+				"health":  healthFromStatus(cont.Status),
+				"project": cont.Labels[composeProjectLabel],
+				"service": cont.Labels[composeServiceLabel],
+			})
+		}
+		return nil
+	})
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i]["host"] != rows[j]["host"] {
+			return rows[i]["host"].(string) < rows[j]["host"].(string)
+		}
+		return rows[i]["name"].(string) < rows[j]["name"].(string)
+	})
+
+	if key := c.Query("group_by"); key != "" {
+		groups := []gin.H{}
+		for _, group := range groupByLabel(key, hosts, rows) {
+			groups = append(groups, gin.H{"value": group.value, "hosts": group.hosts, "containers": group.rows, "count": len(group.rows)})
+		}
+		respond(c, http.StatusOK, gin.H{"group_by": key, "groups": groups, "errors": errs})
+		return
+	}
+	respond(c, http.StatusOK, gin.H{"containers": rows, "count": len(rows), "errors": errs})
+}
+
+// hostStatsTotals are the figures fleetStats adds up over a group
+var hostStatsTotals = []string{"containers", "running", "paused", "stopped", "images", "cpus", "memory_total", "cpu_percent", "memory_usage"}
+
+// fleetStats reports each selected host's container counts and capacity
+// from the daemon, with CPU and memory use summed over the stats
+// collector's latest samples of its containers. ?group_by=<label> adds
+// the figures up per value of that node label.
+func fleetStats(c *gin.Context) {
+	hosts, err := selectedHosts(c)
+	if err != nil {
+		badRequest(c, err.Error())
+		return
+	}
+
+	rows := make([]map[string]interface{}, len(hosts))
+	index := map[string]int{}
+	for i, host := range hosts {
+		index[host.Name] = i
+	}
+	errs := forEachHost(c.Request.Context(), hosts, func(ctx context.Context, host *dockerHost) error {
+		info, err := docker(ctx).Info(ctx)
+		if err != nil {
+			return err
+		}
+		var cpuPercent, memoryUsage float64
+		if sc, ok := statsCollectors[host.Name]; ok {
+			for _, sample := range sc.latest() {
+				usage := computeUsage(sample.Stats)
+				cpuPercent += usage.CPUPercent
+				memoryUsage += usage.MemoryUsage
+			}
+		}
+		rows[index[host.Name]] = map[string]interface{}{
+			"host":           host.Name,
+			"labels":         host.Labels,
+			"server_version": info.ServerVersion,
+			"containers":     info.Containers,
+			"running":        info.ContainersRunning,
+			"paused":         info.ContainersPaused,
+			"stopped":        info.ContainersStopped,
+			"images":         info.Images,
+			"cpus":           info.NCPU,
+			"memory_total":   info.MemTotal,
+			"cpu_percent":    cpuPercent,
+			"memory_usage":   memoryUsage,
+		}
+		return nil
+	})
+	reached := []map[string]interface{}{}
+	for _, row := range rows {
+		if row != nil {
+			reached = append(reached, row)
+		}
+	}
+
+	if key := c.Query("group_by"); key != "" {
+		groups := []gin.H{}
+		for _, group := range groupByLabel(key, hosts, reached) {
+			totals := map[string]float64{}
+			for _, name := range hostStatsTotals {
+				totals[name] = 0
+			}
+			for _, row := range group.rows {
+				for _, name := range hostStatsTotals {
+					totals[name] += statsFigure(row[name])
+				}
+			}
+			groups = append(groups, gin.H{"value": group.value, "hosts": group.hosts, "totals": totals})
+		}
+		respond(c, http.StatusOK, gin.H{"group_by": key, "groups": groups, "errors": errs})
+		return
+	}
+	respond(c, http.StatusOK, gin.H{"hosts": reached, "errors": errs})
+}
+
+// statsFigure converts one of the numbers in a fleetStats row for adding
+func statsFigure(v interface{}) float64 {
+	switch n := v.(type) {
+	case int:
+		return float64(n)
+	case int64:
+		return float64(n)
+	case float64:
+		return n
+	}
+	return 0
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+)
+
+// forwardLabel opts a container into log forwarding when no
+// CONTAINERSCOPE_LOG_FORWARD_LABEL selector is configured
+const forwardLabel = "containerscope.logs.forward"
+
+// Forwarded lines are sent in batches of up to forwardBatchSize, at least
+// every forwardFlushInterval. A batch that keeps failing is dropped after
+// forwardMaxAttempts so one bad batch cannot stall forwarding.
+const (
+	forwardBatchSize     = 500
+	forwardFlushInterval = time.Second
+	forwardMaxAttempts   = 8
+)
+
+// forwardRecord is one log line on its way to the sink
+type forwardRecord struct {
+	Host        string    `json:"host"`
+	ContainerID string    `json:"container_id"`
+	Container   string    `json:"container"`
+	Image       string    `json:"image"`
+	Time        time.Time `json:"@timestamp"`
+	Line        string    `json:"message"`
+}
+
+// logSink sends a batch of records to a log store
+type logSink interface {
+	send(ctx context.Context, records []forwardRecord) error
+}
+
+// forwarder is the state of the log forwarding subsystem. Followers put
+// lines on the queue and a single shipper sends them in batches; when the
+// sink falls behind the queue fills up and new lines are dropped.
+var forwarder struct {
+	sink     logSink
+	selector string
+	queue    chan forwardRecord
+
+	mu        sync.Mutex
+	following map[string]bool
+	// last is the time of the last line read from each container, so a
+	// follower that restarts picks up where the previous one stopped
+	last map[string]time.Time
+}
+
+// startLogForwarding follows the logs of selected containers on every
+// host and ships them to the sink named by CONTAINERSCOPE_LOG_FORWARD,
+// until ctx is done; forwarding is off when it is unset. A replica that
+// leads again resumes each container where it stopped.
+func startLogForwarding(ctx context.Context) {
+	kind := envOr("CONTAINERSCOPE_LOG_FORWARD", "")
+	if kind == "" {
+		return
+	}
+	if forwarder.sink == nil {
+		sink, err := newLogSink(kind, envOr("CONTAINERSCOPE_LOG_FORWARD_URL", ""))
+		if err != nil {
+			logger.Error("log forwarding disabled", "error", err)
+			return
+		}
+		forwarder.sink = sink
+		forwarder.selector = envOr("CONTAINERSCOPE_LOG_FORWARD_LABEL", forwardLabel+"=true")
+		forwarder.queue = make(chan forwardRecord, envInt("CONTAINERSCOPE_LOG_FORWARD_BUFFER", 10000))
+		forwarder.following = map[string]bool{}
+		forwarder.last = map[string]time.Time{}
+	}
+	logger.Info("log forwarding enabled", "sink", kind, "selector", forwarder.selector)
+
+	go shipLogs(ctx)
+	for name, host := range dockerHosts {
+		go watchForwardedContainers(ctx, host, eventBuses[name])
+	}
+}
+
+// newLogSink builds the sink for a CONTAINERSCOPE_LOG_FORWARD value
+func newLogSink(kind, endpoint string) (logSink, error) {
+	if endpoint == "" {
+		return nil, fmt.Errorf("CONTAINERSCOPE_LOG_FORWARD_URL is required")
+	}
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	switch kind {
+	case "loki":
+		return &lokiSink{url: strings.TrimSuffix(endpoint, "/") + "/loki/api/v1/push", client: httpClient}, nil
+	case "elasticsearch":
+		return &elasticSink{
+			url:    strings.TrimSuffix(endpoint, "/") + "/_bulk",
+			index:  envOr("CONTAINERSCOPE_LOG_FORWARD_INDEX", "containerscope-logs"),
+			client: httpClient,
+		}, nil
+	case "syslog":
+		u, err := url.Parse(endpoint)
+		if err != nil || (u.Scheme != "udp" && u.Scheme != "tcp") || u.Host == "" {
+			return nil, fmt.Errorf("syslog endpoint must look like udp://host:514 or tcp://host:514")
+		}
+		return &syslogSink{network: u.Scheme, addr: u.Host}, nil
+	}
+	return nil, fmt.Errorf("unknown log sink %q, expected loki, elasticsearch or syslog", kind)
+}
+
+// watchForwardedContainers starts a follower for every selected running
+// container on host, checking again whenever a container starts and
+// after every event stream reconnection
+func watchForwardedContainers(ctx context.Context, host *dockerHost, bus *eventBus) {
+	evs := bus.subscribeUntil(ctx)
+	for ev := range evs {
+		if !ev.Resync && (ev.Type != events.ContainerEventType || ev.Action != events.ActionStart) {
+			continue
+		}
+		listCtx, cancel := context.WithTimeout(withHost(ctx, host), requestTimeout)
+		list, err := host.Client().ContainerList(listCtx, container.ListOptions{
+			Filters: filters.NewArgs(filters.Arg("label", forwarder.selector), filters.Arg("status", "running")),
+		})
+		cancel()
+		if err != nil {
+			logger.Debug("listing containers to forward", "host", host.Name, "error", err)
+			continue
+		}
+		for _, cont := range list {
+			name := cont.ID[:10]
+			if len(cont.Names) > 0 {
+				name = strings.TrimPrefix(cont.Names[0], "/")
+			}
+			record := forwardRecord{Host: host.Name, ContainerID: cont.ID, Container: name, Image: cont.Image}
+			if startFollowing(record) {
+				go followForwarded(ctx, host, record)
+			}
+		}
+	}
+}
+
+// startFollowing claims a container for a new follower, and false when
+// one is already running
+func startFollowing(record forwardRecord) bool {
+	key := record.Host + "/" + record.ContainerID
+	forwarder.mu.Lock()
+	defer forwarder.mu.Unlock()
+	if forwarder.following[key] {
+		return false
+	}
+	forwarder.following[key] = true
+	return true
+}
+
+// followForwarded queues a container's new log lines until its log
+// stream ends, which happens when the container stops or ctx is done
+func followForwarded(ctx context.Context, host *dockerHost, record forwardRecord) {
+	key := record.Host + "/" + record.ContainerID
+	defer func() {
+		forwarder.mu.Lock()
+		delete(forwarder.following, key)
+		forwarder.mu.Unlock()
+	}()
+
+	forwarder.mu.Lock()
+	since, ok := forwarder.last[key]
+	forwarder.mu.Unlock()
+	if ok {
+		// Docker includes lines written at exactly the since time
+		since = since.Add(time.Nanosecond)
+	} else {
+		since = agentStartedAt
+	}
+
+	out, err := openLogs(withHost(ctx, host), record.ContainerID, container.LogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+		Follow:     true,
+		Timestamps: true,
+		Since:      fmt.Sprintf("%d.%09d", since.Unix(), since.Nanosecond()),
+	})
+	if err != nil {
+		logger.Debug("following logs to forward", "container", record.Container, "error", err)
+		return
+	}
+	defer out.Close()
+
+	_, err = scanLogs(out, math.MaxInt64, nil, func(_ int, line string) error {
+		entry := parseLogEntry(record.Container, line)
+		if entry.time.IsZero() {
+			entry.time = time.Now()
+		} else {
+			forwarder.mu.Lock()
+			forwarder.last[key] = entry.time
+			forwarder.mu.Unlock()
+		}
+
+		r := record
+		r.Time, r.Line = entry.time, entry.line
+		select {
+		case forwarder.queue <- r:
+			forwardQueued.Inc()
+		default:
+			forwardDropped.Inc()
+		}
+		return nil
+	})
+	if err != nil {
+		logger.Debug("forwarded log stream ended", "container", record.Container, "error", err)
+	}
+}
+
+// shipLogs sends queued records to the sink in batches until ctx is done,
+// leaving what is still queued to the next time this replica leads
+func shipLogs(ctx context.Context) {
+	ticker := time.NewTicker(forwardFlushInterval)
+	defer ticker.Stop()
+	batch := make([]forwardRecord, 0, forwardBatchSize)
+	for {
+		select {
+		case r := <-forwarder.queue:
+			forwardQueued.Set(float64(len(forwarder.queue)))
+			if batch = append(batch, r); len(batch) < forwardBatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		case <-ctx.Done():
+			if len(batch) > 0 {
+				shipBatch(batch)
+			}
+			return
+		}
+		shipBatch(batch)
+		batch = batch[:0]
+	}
+}
+
+// shipBatch sends one batch, retrying with backoff while the queue keeps
+// buffering new lines
+func shipBatch(batch []forwardRecord) {
+	backoff := time.Second
+	for attempt := 1; ; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+		err := forwarder.sink.send(ctx, batch)
+		cancel()
+		if err == nil {
+			forwardSent.Add(float64(len(batch)))
+			return
+		}
+		if attempt == forwardMaxAttempts {
+			logger.Warn("dropping forwarded log lines", "lines", len(batch), "error", err)
+			forwardDropped.Add(float64(len(batch)))
+			return
+		}
+		logger.Debug("forwarding log lines failed, retrying", "attempt", attempt, "error", err)
+		time.Sleep(backoff)
+		if backoff < 30*time.Second {
+			backoff *= 2
+		}
+	}
+}
+
+// postBatch sends a request body to an HTTP log store
+func postBatch(ctx context.Context, client *http.Client, url, contentType string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s answered %s: %s", url, resp.Status, bytes.TrimSpace(msg))
+	}
+	return resp, nil
+}
+
+// lokiSink pushes to Loki's push API, one stream per container
+type lokiSink struct {
+	url    string
+	client *http.Client
+}
+
+func (s *lokiSink) send(ctx context.Context, records []forwardRecord) error {
+	type stream struct {
+		Stream map[string]string `json:"stream"`
+		Values [][2]string       `json:"values"`
+	}
+	streams := map[string]*stream{}
+	var order []string
+	for _, r := range records {
+		key := r.Host + "/" + r.ContainerID
+		st, ok := streams[key]
+		if !ok {
+			st = &stream{Stream: map[string]string{
+				"job":       "containerscope",
+				"host":      r.Host,
+				"container": r.Container,
+				"image":     r.Image,
+			}}
+			streams[key] = st
+			order = append(order, key)
+		}
+		st.Values = append(st.Values, [2]string{strconv.FormatInt(r.Time.UnixNano(), 10), r.Line})
+	}
+	push := struct {
+		Streams []*stream `json:"streams"`
+	}{}
+	for _, key := range order {
+		push.Streams = append(push.Streams, streams[key])
+	}
+	body, err := json.Marshal(push)
+	if err != nil {
+		return err
+	}
+	resp, err := postBatch(ctx, s.client, s.url, "application/json", body)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// elasticSink indexes records with the Elasticsearch bulk API
+type elasticSink struct {
+	url    string
+	index  string
+	client *http.Client
+}
+
+func (s *elasticSink) send(ctx context.Context, records []forwardRecord) error {
+	var body bytes.Buffer
+	action, _ := json.Marshal(map[string]interface{}{"create": map[string]string{"_index": s.index}})
+	enc := json.NewEncoder(&body)
+	for _, r := range records {
+		body.Write(action)
+		body.WriteByte('\n')
+		if err := enc.Encode(r); err != nil {
+			return err
+		}
+	}
+	resp, err := postBatch(ctx, s.client, s.url, "application/x-ndjson", body.Bytes())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// The bulk API answers 200 even when single documents were rejected
+	var result struct {
+		Errors bool `json:"errors"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return err
+	}
+	if result.Errors {
+		return fmt.Errorf("elasticsearch rejected some documents")
+	}
+	return nil
+}
+
+// syslogSink sends RFC 5424 messages over UDP or newline-framed TCP,
+// reconnecting after a failed write
+type syslogSink struct {
+	network string
+	addr    string
+	conn    net.Conn
+}
+
+// syslogPriority is facility user, severity informational
+const syslogPriority = 1*8 + 6
+
+func (s *syslogSink) send(ctx context.Context, records []forwardRecord) error {
+	if s.conn == nil {
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, s.network, s.addr)
+		if err != nil {
+			return err
+		}
+		s.conn = conn
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		s.conn.SetWriteDeadline(deadline)
+	}
+	for _, r := range records {
+		app := r.Container
+		if len(app) > 48 {
+			app = app[:48]
+		}
+		msg := fmt.Sprintf("<%d>1 %s %s %s - - - %s\n", syslogPriority, r.Time.UTC().Format(time.RFC3339Nano), hostname, app, r.Line)
+		if _, err := io.WriteString(s.conn, msg); err != nil {
+			s.conn.Close()
+			s.conn = nil
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/gin-gonic/gin"
+)
+
+// nvidiaSMI is the NVML command line tool the agent reads GPU usage from.
+// It reports on the machine the agent runs on, so GPU usage is only
+// matched to containers of a local daemon.
+var nvidiaSMI = envOr("CONTAINERSCOPE_NVIDIA_SMI", "nvidia-smi")
+
+// errNoGPUs is returned when the node has no NVIDIA driver to ask
+var errNoGPUs = errors.New("nvidia-smi not found; this node has no NVIDIA driver, or the agent cannot see it")
+
+// gpuDevice is one GPU and the containers using it
+type gpuDevice struct {
+	Index              int        `json:"index"`
+	UUID               string     `json:"uuid"`
+	Name               string     `json:"name"`
+	UtilizationPercent *float64   `json:"utilization_percent"`
+	MemoryUsed         uint64     `json:"memory_used"`
+	MemoryTotal        uint64     `json:"memory_total"`
+	TemperatureC       *float64   `json:"temperature_c"`
+	Containers         []gpuUsage `json:"containers"`
+}
+
+// gpuUsage is what one container's processes use of one GPU. Utilization
+// is the share of the GPU's streaming multiprocessors, and is null when
+// the driver does not report it per process.
+type gpuUsage struct {
+	ID                 string   `json:"id,omitempty"`
+	Name               string   `json:"name,omitempty"`
+	GPU                string   `json:"gpu,omitempty"`
+	MemoryUsed         uint64   `json:"memory_used"`
+	UtilizationPercent *float64 `json:"utilization_percent"`
+	PIDs               []int    `json:"pids"`
+}
+
+// gpuProcess is a process running on a GPU
+type gpuProcess struct {
+	PID         int
+	GPU         string
+	MemoryUsed  uint64
+	SMPercent   *float64
+	ContainerID string
+}
+
+// runNvidiaSMI runs nvidia-smi with args and returns its output
+func runNvidiaSMI(ctx context.Context, args ...string) ([]byte, error) {
+	out, err := exec.CommandContext(ctx, nvidiaSMI, args...).Output()
+	if errors.Is(err, exec.ErrNotFound) || errors.Is(err, os.ErrNotExist) {
+		return nil, errNoGPUs
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return nil, fmt.Errorf("nvidia-smi: %s", strings.TrimSpace(string(exitErr.Stderr)))
+	}
+	return out, err
+}
+
+// readCSV parses nvidia-smi's --format=csv,noheader,nounits output
+func readCSV(out []byte) ([][]string, error) {
+	r := csv.NewReader(bytes.NewReader(out))
+	r.TrimLeadingSpace = true
+	r.FieldsPerRecord = -1
+	return r.ReadAll()
+}
+
+// smiNumber parses a number from nvidia-smi, which prints [N/A] or - for
+// values a GPU does not report
+func smiNumber(s string) *float64 {
+	v, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil {
+		return nil
+	}
+	return &v
+}
+
+// mebibytes converts nvidia-smi's MiB to bytes
+func mebibytes(s string) uint64 {
+	if v := smiNumber(s); v != nil {
+		return uint64(*v * 1024 * 1024)
+	}
+	return 0
+}
+
+// readGPUs lists the node's GPUs
+func readGPUs(ctx context.Context) ([]gpuDevice, error) {
+	out, err := runNvidiaSMI(ctx, "--query-gpu=index,uuid,name,utilization.gpu,memory.used,memory.total,temperature.gpu", "--format=csv,noheader,nounits")
+	if err != nil {
+		return nil, err
+	}
+	rows, err := readCSV(out)
+	if err != nil {
+		return nil, fmt.Errorf("reading nvidia-smi output: %w", err)
+	}
+	devices := []gpuDevice{}
+	for _, row := range rows {
+		if len(row) < 7 {
+			continue
+		}
+		index, _ := strconv.Atoi(row[0])
+		devices = append(devices, gpuDevice{
+			Index:              index,
+			UUID:               row[1],
+			Name:               row[2],
+			UtilizationPercent: smiNumber(row[3]),
+			MemoryUsed:         mebibytes(row[4]),
+			MemoryTotal:        mebibytes(row[5]),
+			TemperatureC:       smiNumber(row[6]),
+			Containers:         []gpuUsage{},
+		})
+	}
+	return devices, nil
+}
+
+// readGPUProcesses lists the processes using GPUs with their memory and,
+// from nvidia-smi pmon, their share of the GPU. devices maps pmon's GPU
+// indexes to UUIDs.
+func readGPUProcesses(ctx context.Context, devices []gpuDevice) ([]gpuProcess, error) {
+	out, err := runNvidiaSMI(ctx, "--query-compute-apps=pid,gpu_uuid,used_memory", "--format=csv,noheader,nounits")
+	if err != nil {
+		return nil, err
+	}
+	rows, err := readCSV(out)
+	if err != nil {
+		return nil, fmt.Errorf("reading nvidia-smi output: %w", err)
+	}
+	uuids := map[int]string{}
+	for _, d := range devices {
+		uuids[d.Index] = d.UUID
+	}
+	// pmon samples for a second; GPUs without per-process accounting
+	// leave utilization unknown
+	sm := map[string]*float64{}
+	if pmon, err := runNvidiaSMI(ctx, "pmon", "-c", "1", "-s", "u"); err == nil {
+		sm = parsePmon(pmon, uuids)
+	}
+
+	var procs []gpuProcess
+	for _, row := range rows {
+		if len(row) < 3 {
+			continue
+		}
+		pid, err := strconv.Atoi(row[0])
+		if err != nil {
+			continue
+		}
+		procs = append(procs, gpuProcess{
+			PID:         pid,
+			GPU:         row[1],
+			MemoryUsed:  mebibytes(row[2]),
+			SMPercent:   sm[row[1]+"/"+row[0]],
+			ContainerID: processContainer(pid),
+		})
+	}
+	return procs, nil
+}
+
+// parsePmon reads nvidia-smi pmon's table of "gpu pid type sm mem ..."
+// into SM utilization keyed by GPU UUID and PID
+func parsePmon(out []byte, uuids map[int]string) map[string]*float64 {
+	sm := map[string]*float64{}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		index, err := strconv.Atoi(fields[0])
+		if err != nil {
+			continue
+		}
+		sm[uuids[index]+"/"+fields[1]] = smiNumber(fields[3])
+	}
+	return sm
+}
+
+// cgroupContainerID matches the container ID in a process's cgroup path,
+// as in /docker/<id> or /system.slice/docker-<id>.scope
+var cgroupContainerID = regexp.MustCompile(`[0-9a-f]{64}`)
+
+// processContainer returns the ID of the container a host process runs
+// in, or "" for processes outside containers
+func processContainer(pid int) string {
+	data, err := os.ReadFile(filepath.Join(hostProc, strconv.Itoa(pid), "cgroup"))
+	if err != nil {
+		return ""
+	}
+	ids := cgroupContainerID.FindAllString(string(data), -1)
+	if len(ids) == 0 {
+		return ""
+	}
+	return ids[len(ids)-1]
+}
+
+// containerGPUUsage sums procs per container and GPU. Processes outside
+// containers are left out.
+func containerGPUUsage(procs []gpuProcess) map[string][]gpuUsage {
+	type key struct{ id, gpu string }
+	sums := map[key]*gpuUsage{}
+	for _, p := range procs {
+		if p.ContainerID == "" {
+			continue
+		}
+		k := key{p.ContainerID, p.GPU}
+		u, ok := sums[k]
+		if !ok {
+			u = &gpuUsage{ID: p.ContainerID, GPU: p.GPU, PIDs: []int{}}
+			sums[k] = u
+		}
+		u.MemoryUsed += p.MemoryUsed
+		u.PIDs = append(u.PIDs, p.PID)
+		if p.SMPercent != nil {
+			total := *p.SMPercent
+			if u.UtilizationPercent != nil {
+				total += *u.UtilizationPercent
+			}
+			u.UtilizationPercent = &total
+		}
+	}
+	usage := map[string][]gpuUsage{}
+	for _, u := range sums {
+		sort.Ints(u.PIDs)
+		usage[u.ID] = append(usage[u.ID], *u)
+	}
+	for _, list := range usage {
+		sort.Slice(list, func(i, j int) bool { return list[i].GPU < list[j].GPU })
+	}
+	return usage
+}
+
+// gpuAttachment is how a container was given GPUs: a --gpus device
+// request, the nvidia runtime with NVIDIA_VISIBLE_DEVICES, or /dev/nvidiaN
+// devices. Devices holds indexes or UUIDs, or "all".
+type gpuAttachment struct {
+	Source  string   `json:"source"`
+	Devices []string `json:"devices,omitempty"`
+	Count   int      `json:"count,omitempty"`
+}
+
+// nvidiaDevicePath matches the per-GPU device nodes
+var nvidiaDevicePath = regexp.MustCompile(`^/dev/nvidia([0-9]+)$`)
+
+// containerGPUs reports the GPUs a container's configuration attaches, or
+// nil when it has none
+func containerGPUs(inspection types.ContainerJSON) *gpuAttachment {
+	hc := inspection.HostConfig
+	if hc == nil {
+		return nil
+	}
+	for _, req := range hc.DeviceRequests {
+		if !isGPURequest(req) {
+			continue
+		}
+		switch {
+		case len(req.DeviceIDs) > 0:
+			return &gpuAttachment{Source: "device_request", Devices: req.DeviceIDs}
+		case req.Count < 0:
+			return &gpuAttachment{Source: "device_request", Devices: []string{"all"}}
+		default:
+			return &gpuAttachment{Source: "device_request", Count: req.Count}
+		}
+	}
+	if hc.Runtime == "nvidia" && inspection.Config != nil {
+		for _, env := range inspection.Config.Env {
+			value, ok := strings.CutPrefix(env, "NVIDIA_VISIBLE_DEVICES=")
+			if ok && value != "" && value != "none" && value != "void" {
+				return &gpuAttachment{Source: "runtime", Devices: splitList(value)}
+			}
+		}
+	}
+	var devices []string
+	for _, d := range hc.Devices {
+		if m := nvidiaDevicePath.FindStringSubmatch(d.PathOnHost); m != nil {
+			devices = append(devices, m[1])
+		}
+	}
+	if len(devices) > 0 {
+		return &gpuAttachment{Source: "device", Devices: devices}
+	}
+	return nil
+}
+
+// isGPURequest reports whether a device request is for NVIDIA GPUs, as
+// --gpus makes them
+func isGPURequest(req container.DeviceRequest) bool {
+	if req.Driver == "nvidia" {
+		return true
+	}
+	for _, caps := range req.Capabilities {
+		if contains(caps, "gpu") {
+			return true
+		}
+	}
+	return false
+}
+
+// nodeGPUs lists the node's GPUs with the memory and utilization of each
+// container using them
+func nodeGPUs(c *gin.Context) {
+	ctx := hostContext(c)
+	devices, err := readGPUs(ctx)
+	if err == nil {
+		var procs []gpuProcess
+		if procs, err = readGPUProcesses(ctx, devices); err == nil {
+			names := containerNamesByID(ctx)
+			usage := containerGPUUsage(procs)
+			for i := range devices {
+				for id, list := range usage {
+					for _, u := range list {
+						if u.GPU == devices[i].UUID {
+							u.Name, u.GPU = names[id], ""
+							devices[i].Containers = append(devices[i].Containers, u)
+						}
+					}
+				}
+				sort.Slice(devices[i].Containers, func(a, b int) bool {
+					return devices[i].Containers[a].MemoryUsed > devices[i].Containers[b].MemoryUsed
+				})
+			}
+		}
+	}
+	if errors.Is(err, errNoGPUs) {
+		respondError(c, http.StatusNotImplemented, codeNotSupported, err.Error())
+		return
+	}
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, codeInternal, err.Error())
+		return
+	}
+	respond(c, http.StatusOK, gin.H{"node": hostname, "gpus": devices})
+}
+
+// containerNamesByID maps the IDs of the host's containers to their names
+func containerNamesByID(ctx context.Context) map[string]string {
+	list, ok := cachedContainers(ctx, filters.NewArgs())
+	if !ok {
+		var err error
+		if list, err = docker(ctx).ContainerList(ctx, container.ListOptions{All: true}); err != nil {
+			return map[string]string{}
+		}
+	}
+	names := map[string]string{}
+	for _, cont := range list {
+		if len(cont.Names) > 0 {
+			names[cont.ID] = strings.TrimPrefix(cont.Names[0], "/")
+		}
+	}
+	return names
+}
+
+// containerGPU reports the GPUs a container is configured with and what
+// its processes use of each. A container without GPUs on a node without
+// the driver gets an empty answer rather than an error.
+func containerGPU(c *gin.Context) {
+	ctx := hostContext(c)
+	containerID := c.Param("container_id")
+	inspection, err := docker(ctx).ContainerInspect(ctx, containerID)
+	if err != nil {
+		dockerError(c, "Error inspecting container", err)
+		return
+	}
+	attached := containerGPUs(inspection)
+
+	usage := []gpuUsage{}
+	if inspection.State.Running {
+		devices, err := readGPUs(ctx)
+		var procs []gpuProcess
+		if err == nil {
+			procs, err = readGPUProcesses(ctx, devices)
+		}
+		switch {
+		case errors.Is(err, errNoGPUs) && attached == nil:
+		case errors.Is(err, errNoGPUs):
+			respondError(c, http.StatusNotImplemented, codeNotSupported, err.Error())
+			return
+		case err != nil:
+			respondError(c, http.StatusInternalServerError, codeInternal, err.Error())
+			return
+		default:
+			if list := containerGPUUsage(procs)[containerID]; list != nil {
+				usage = list
+			}
+		}
+	}
+	for i := range usage {
+		usage[i].ID = ""
+	}
+	respond(c, http.StatusOK, gin.H{
+		"container": containerID,
+		"name":      containerName(c),
+		"attached":  attached,
+		"usage":     usage,
+	})
+}
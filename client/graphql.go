@@ -0,0 +1,411 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/gin-gonic/gin"
+	"github.com/graphql-go/graphql"
+)
+
+// gqlContainer is a container list entry; inspect, image and stats are
+// fetched only when a query asks for fields that need them
+type gqlContainer struct {
+	summary types.Container
+	images  *gqlImageCache
+
+	inspectOnce sync.Once
+	inspection  types.ContainerJSON
+	inspectErr  error
+}
+
+func (gc *gqlContainer) inspect(ctx context.Context) (types.ContainerJSON, error) {
+	gc.inspectOnce.Do(func() {
+		gc.inspection, gc.inspectErr = docker(ctx).ContainerInspect(ctx, gc.summary.ID)
+	})
+	return gc.inspection, gc.inspectErr
+}
+
+// gqlImageCache inspects each image once per query, however many
+// containers use it. The lock only guards the map, so resolvers wait on
+// one another only when they need the same image.
+type gqlImageCache struct {
+	mu     sync.Mutex
+	images map[string]*gqlImage
+}
+
+// gqlImage is an image inspected at most once
+type gqlImage struct {
+	once       sync.Once
+	inspection types.ImageInspect
+	err        error
+}
+
+func (cache *gqlImageCache) get(ctx context.Context, id string) (*types.ImageInspect, error) {
+	cache.mu.Lock()
+	image, ok := cache.images[id]
+	if !ok {
+		image = &gqlImage{}
+		cache.images[id] = image
+	}
+	cache.mu.Unlock()
+	image.once.Do(func() {
+		image.inspection, _, image.err = docker(ctx).ImageInspectWithRaw(ctx, id)
+	})
+	if image.err != nil {
+		return nil, image.err
+	}
+	return &image.inspection, nil
+}
+
+// gqlStats is a container's resource usage computed from one stats sample
+type gqlStats struct {
+	CPUPercent    float64  `json:"cpuPercent"`
+	MemoryUsage   float64  `json:"memoryUsage"`
+	MemoryLimit   float64  `json:"memoryLimit"`
+	MemoryPercent float64  `json:"memoryPercent"`
+	NetworkRx     float64  `json:"networkRx"`
+	NetworkTx     float64  `json:"networkTx"`
+	NetworkRxRate *float64 `json:"networkRxRate"`
+	NetworkTxRate *float64 `json:"networkTxRate"`
+	Pids          int      `json:"pids"`
+}
+
+// containerUsage samples stats once, with the previous CPU reading Docker
+// includes when not in one-shot mode, so CPU usage can be computed
+func containerUsage(ctx context.Context, containerID string) (*gqlStats, error) {
+	stats, err := sampleStats(ctx, containerID)
+	if err != nil {
+		return nil, err
+	}
+	usage := computeUsage(stats)
+	if sample, ok := collectedSample(ctx, containerID); ok {
+		usage.NetworkRxRate, usage.NetworkTxRate = networkRates(sample.Network)
+	}
+	return usage, nil
+}
+
+// computeUsage derives CPU and memory percentages and network totals from
+// a stats sample
+func computeUsage(stats types.StatsJSON) *gqlStats {
+	usage := &gqlStats{Pids: int(stats.PidsStats.Current)}
+	cpuDelta := float64(stats.CPUStats.CPUUsage.TotalUsage) - float64(stats.PreCPUStats.CPUUsage.TotalUsage)
+	systemDelta := float64(stats.CPUStats.SystemUsage) - float64(stats.PreCPUStats.SystemUsage)
+	if cpuDelta > 0 && systemDelta > 0 {
+		usage.CPUPercent = cpuDelta / systemDelta * float64(max(stats.CPUStats.OnlineCPUs, 1)) * 100
+	}
+	used := stats.MemoryStats.Usage - min(stats.MemoryStats.Stats["inactive_file"], stats.MemoryStats.Usage)
+	usage.MemoryUsage = float64(used)
+	usage.MemoryLimit = float64(stats.MemoryStats.Limit)
+	if stats.MemoryStats.Limit > 0 {
+		usage.MemoryPercent = float64(used) / float64(stats.MemoryStats.Limit) * 100
+	}
+	for _, network := range stats.Networks {
+		usage.NetworkRx += float64(network.RxBytes)
+		usage.NetworkTx += float64(network.TxBytes)
+	}
+	return usage
+}
+
+// gqlLabel is one key/value label, since GraphQL has no map type
+type gqlLabel struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+func gqlLabels(labels map[string]string) []gqlLabel {
+	list := make([]gqlLabel, 0, len(labels))
+	for k, v := range labels {
+		list = append(list, gqlLabel{Key: k, Value: v})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Key < list[j].Key })
+	return list
+}
+
+// containerField resolves a field from the container list entry
+func containerField(fn func(cont types.Container) interface{}) graphql.FieldResolveFn {
+	return func(p graphql.ResolveParams) (interface{}, error) {
+		return fn(p.Source.(*gqlContainer).summary), nil
+	}
+}
+
+// inspectField resolves a field that needs the container inspected
+func inspectField(fn func(inspection types.ContainerJSON) interface{}) graphql.FieldResolveFn {
+	return func(p graphql.ResolveParams) (interface{}, error) {
+		inspection, err := p.Source.(*gqlContainer).inspect(p.Context)
+		if err != nil {
+			return nil, err
+		}
+		return fn(inspection), nil
+	}
+}
+
+var gqlLabelType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "Label",
+	Fields: graphql.Fields{
+		"key":   &graphql.Field{Type: graphql.String},
+		"value": &graphql.Field{Type: graphql.String},
+	},
+})
+
+var gqlImageType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "Image",
+	Fields: graphql.Fields{
+		"id": &graphql.Field{Type: graphql.String, Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			return p.Source.(*types.ImageInspect).ID, nil
+		}},
+		"tags": &graphql.Field{Type: graphql.NewList(graphql.String), Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			return p.Source.(*types.ImageInspect).RepoTags, nil
+		}},
+		"created": &graphql.Field{Type: graphql.String, Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			return p.Source.(*types.ImageInspect).Created, nil
+		}},
+		"size": &graphql.Field{Type: graphql.Float, Description: "Size in bytes", Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			return float64(p.Source.(*types.ImageInspect).Size), nil
+		}},
+		"architecture": &graphql.Field{Type: graphql.String, Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			return p.Source.(*types.ImageInspect).Architecture, nil
+		}},
+		"os": &graphql.Field{Type: graphql.String, Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			return p.Source.(*types.ImageInspect).Os, nil
+		}},
+	},
+})
+
+var gqlStatsType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "Stats",
+	Fields: graphql.Fields{
+		"cpuPercent":    &graphql.Field{Type: graphql.Float},
+		"memoryUsage":   &graphql.Field{Type: graphql.Float, Description: "Bytes, excluding page cache"},
+		"memoryLimit":   &graphql.Field{Type: graphql.Float},
+		"memoryPercent": &graphql.Field{Type: graphql.Float},
+		"networkRx":     &graphql.Field{Type: graphql.Float, Description: "Bytes received on all interfaces"},
+		"networkTx":     &graphql.Field{Type: graphql.Float},
+		"networkRxRate": &graphql.Field{Type: graphql.Float, Description: "Bytes per second received on all interfaces, between the collector's last two samples"},
+		"networkTxRate": &graphql.Field{Type: graphql.Float},
+		"pids":          &graphql.Field{Type: graphql.Int},
+	},
+})
+
+var gqlContainerType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "Container",
+	Fields: graphql.Fields{
+		"id":     &graphql.Field{Type: graphql.String, Resolve: containerField(func(cont types.Container) interface{} { return cont.ID[:10] })},
+		"fullId": &graphql.Field{Type: graphql.String, Resolve: containerField(func(cont types.Container) interface{} { return cont.ID })},
+		"name": &graphql.Field{Type: graphql.String, Resolve: containerField(func(cont types.Container) interface{} {
+			return strings.TrimPrefix(cont.Names[0], "/")
+		})},
+		"image":   &graphql.Field{Type: graphql.String, Resolve: containerField(func(cont types.Container) interface{} { return cont.Image })},
+		"state":   &graphql.Field{Type: graphql.String, Resolve: containerField(func(cont types.Container) interface{} { return cont.State })},
+		"status":  &graphql.Field{Type: graphql.String, Resolve: containerField(func(cont types.Container) interface{} { return cont.Status })},
+		"running": &graphql.Field{Type: graphql.Boolean, Resolve: containerField(func(cont types.Container) interface{} { return cont.State == "running" })},
+		"health":  &graphql.Field{Type: graphql.String, Resolve: containerField(func(cont types.Container) interface{} { return healthFromStatus(cont.Status) })},
+		"ports":   &graphql.Field{Type: graphql.NewList(graphql.String), Resolve: containerField(func(cont types.Container) interface{} { return formatPorts(cont) })},
+		"project": &graphql.Field{Type: graphql.String, Resolve: containerField(func(cont types.Container) interface{} { return cont.Labels[composeProjectLabel] })},
+		"service": &graphql.Field{Type: graphql.String, Resolve: containerField(func(cont types.Container) interface{} { return cont.Labels[composeServiceLabel] })},
+		"labels":  &graphql.Field{Type: graphql.NewList(gqlLabelType), Resolve: containerField(func(cont types.Container) interface{} { return gqlLabels(cont.Labels) })},
+		"created": &graphql.Field{Type: graphql.String, Resolve: containerField(func(cont types.Container) interface{} {
+			return time.Unix(cont.Created, 0).UTC().Format(time.RFC3339)
+		})},
+		"startedAt":    &graphql.Field{Type: graphql.String, Resolve: inspectField(func(i types.ContainerJSON) interface{} { return i.State.StartedAt })},
+		"restartCount": &graphql.Field{Type: graphql.Int, Resolve: inspectField(func(i types.ContainerJSON) interface{} { return i.RestartCount })},
+		"exitCode":     &graphql.Field{Type: graphql.Int, Resolve: inspectField(func(i types.ContainerJSON) interface{} { return i.State.ExitCode })},
+		"imageInfo": &graphql.Field{
+			Type:        gqlImageType,
+			Description: "The image the container was created from",
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				gc := p.Source.(*gqlContainer)
+				return gc.images.get(p.Context, gc.summary.ImageID)
+			},
+		},
+		"stats": &graphql.Field{
+			Type:        gqlStatsType,
+			Description: "Current resource usage; null for stopped containers. Sampled concurrently for every container in the query.",
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				gc := p.Source.(*gqlContainer)
+				if gc.summary.State != "running" {
+					return nil, nil
+				}
+				type result struct {
+					stats *gqlStats
+					err   error
+				}
+				done := make(chan result, 1)
+				go func() {
+					stats, err := containerUsage(p.Context, gc.summary.ID)
+					done <- result{stats, err}
+				}()
+				// Returning a thunk lets the executor start every
+				// container's sample before waiting on any of them
+				return func() (interface{}, error) {
+					r := <-done
+					return r.stats, r.err
+				}, nil
+			},
+		},
+	},
+})
+
+var gqlHostType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "Host",
+	Fields: graphql.Fields{
+		"name":     &graphql.Field{Type: graphql.String},
+		"endpoint": &graphql.Field{Type: graphql.String},
+		"tls":      &graphql.Field{Type: graphql.Boolean},
+		"default": &graphql.Field{Type: graphql.Boolean, Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			return p.Source.(*dockerHost).Name == defaultHostName, nil
+		}},
+	},
+})
+
+// listGQLContainers lists containers matching the query arguments
+func listGQLContainers(p graphql.ResolveParams) ([]*gqlContainer, error) {
+	args := filters.NewArgs()
+	if all, _ := p.Args["all"].(bool); !all {
+		args.Add("status", "running")
+	}
+	if id, ok := p.Args["id"].(string); ok {
+		args.Add("id", id)
+	}
+	if name, ok := p.Args["name"].(string); ok {
+		args.Add("name", name)
+	}
+	if project, ok := p.Args["project"].(string); ok {
+		args.Add("label", composeProjectLabel+"="+project)
+	}
+	if labels, ok := p.Args["label"].([]interface{}); ok {
+		for _, label := range labels {
+			args.Add("label", label.(string))
+		}
+	}
+
+	summaries, err := docker(p.Context).ContainerList(p.Context, container.ListOptions{All: true, Filters: args})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(summaries, func(i, j int) bool { return summaries[i].Names[0] < summaries[j].Names[0] })
+
+	images := &gqlImageCache{images: map[string]*gqlImage{}}
+	containers := make([]*gqlContainer, len(summaries))
+	for i, summary := range summaries {
+		containers[i] = &gqlContainer{summary: summary, images: images}
+	}
+	return containers, nil
+}
+
+var gqlSchema = func() graphql.Schema {
+	query := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Query",
+		Fields: graphql.Fields{
+			"containers": &graphql.Field{
+				Type: graphql.NewList(gqlContainerType),
+				Args: graphql.FieldConfigArgument{
+					"all":     &graphql.ArgumentConfig{Type: graphql.Boolean, Description: "Include stopped containers"},
+					"name":    &graphql.ArgumentConfig{Type: graphql.String},
+					"project": &graphql.ArgumentConfig{Type: graphql.String},
+					"label":   &graphql.ArgumentConfig{Type: graphql.NewList(graphql.String), Description: "key or key=value"},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return listGQLContainers(p)
+				},
+			},
+			"container": &graphql.Field{
+				Type: gqlContainerType,
+				Args: graphql.FieldConfigArgument{
+					"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String), Description: "ID or ID prefix"},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					p.Args["all"] = true
+					containers, err := listGQLContainers(p)
+					if err != nil || len(containers) == 0 {
+						return nil, err
+					}
+					return containers[0], nil
+				},
+			},
+			"images": &graphql.Field{
+				Type: graphql.NewList(gqlImageType),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					summaries, err := docker(p.Context).ImageList(p.Context, types.ImageListOptions{})
+					if err != nil {
+						return nil, err
+					}
+					cache := &gqlImageCache{images: map[string]*gqlImage{}}
+					images := make([]*types.ImageInspect, 0, len(summaries))
+					for _, summary := range summaries {
+						image, err := cache.get(p.Context, summary.ID)
+						if err != nil {
+							return nil, err
+						}
+						images = append(images, image)
+					}
+					return images, nil
+				},
+			},
+			"hosts": &graphql.Field{
+				Type: graphql.NewList(gqlHostType),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					hosts := make([]*dockerHost, 0, len(dockerHosts))
+					for _, host := range dockerHosts {
+						hosts = append(hosts, host)
+					}
+					sort.Slice(hosts, func(i, j int) bool { return hosts[i].Name < hosts[j].Name })
+					return hosts, nil
+				},
+			},
+		},
+	})
+	schema, err := graphql.NewSchema(graphql.SchemaConfig{Query: query})
+	if err != nil {
+		panic(err)
+	}
+	return schema
+}()
+
+// graphqlQuery runs a GraphQL query against the selected host. The
+// response uses GraphQL's own data/errors shape rather than the API
+// envelope, so standard GraphQL clients work unchanged.
+func graphqlQuery(c *gin.Context) {
+	var req struct {
+		Query         string                 `json:"query" form:"query"`
+		OperationName string                 `json:"operationName" form:"operationName"`
+		Variables     map[string]interface{} `json:"variables"`
+	}
+	if c.Request.Method == http.MethodGet {
+		req.Query = c.Query("query")
+		req.OperationName = c.Query("operationName")
+		if variables := c.Query("variables"); variables != "" {
+			if err := json.Unmarshal([]byte(variables), &req.Variables); err != nil {
+				badRequest(c, "variables must be a JSON object")
+				return
+			}
+		}
+	} else if err := c.ShouldBindJSON(&req); err != nil {
+		badRequest(c, "Invalid request")
+		return
+	}
+	if req.Query == "" {
+		badRequest(c, "query is required")
+		return
+	}
+
+	result := graphql.Do(graphql.Params{
+		Schema:         gqlSchema,
+		RequestString:  req.Query,
+		VariableValues: req.Variables,
+		OperationName:  req.OperationName,
+		Context:        hostContext(c),
+	})
+	for _, err := range result.Errors {
+		c.Error(err)
+	}
+	c.JSON(http.StatusOK, result)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// leaderTTL is how long leadership outlives a replica that stopped
+// renewing it, and leaderRenew how often the leader renews it and the
+// others try to take it over. A renewal that takes longer than
+// leaderRenewTimeout fails, and the leader retries it every leaderRetry
+// until the term could lapse before the next attempt finished.
+const (
+	leaderTTL          = 15 * time.Second
+	leaderRenew        = 5 * time.Second
+	leaderRenewTimeout = 3 * time.Second
+	leaderRetry        = time.Second
+)
+
+// errTermLapsed is the error renewing a term another replica may now hold
+var errTermLapsed = errors.New("leadership has lapsed")
+
+// leading is true on the replica that runs the background jobs which
+// must run once: always, unless several replicas share the store
+var leading atomic.Bool
+
+// replicaID names this replica among those sharing a store:
+// CONTAINERSCOPE_REPLICA_ID, or the hostname
+func replicaID() string {
+	if id := os.Getenv("CONTAINERSCOPE_REPLICA_ID"); id != "" {
+		return id
+	}
+	hostname, _ := os.Hostname()
+	return hostname
+}
+
+// leaderElection is how replicas sharing a store pick the one that leads
+type leaderElection interface {
+	// campaign makes id the leader for a term that lapses leaderTTL after
+	// its last renewal, if no replica leads, returning the term, or ""
+	// when another replica leads
+	campaign(ctx context.Context, id string) (string, error)
+	// renew extends a term, failing once it has lapsed
+	renew(ctx context.Context, term string) error
+	// leader returns the leading replica's ID, which is "" while none leads
+	leader(ctx context.Context) (string, error)
+}
+
+// runAsLeader starts jobs on the replica that leads, with a context that
+// is cancelled when it stops leading. With a store of its own the agent
+// leads straight away and for good; replicas sharing etcd or Redis elect
+// one, and the others wait to take over until its term lapses.
+func runAsLeader(jobs func(ctx context.Context)) {
+	if !storeShared {
+		leading.Store(true)
+		jobs(context.Background())
+		return
+	}
+	go lead(jobs)
+}
+
+// lead campaigns until this replica leads, starts the jobs and keeps its
+// term alive, retrying a failed renewal while the term may still hold.
+// The jobs cannot be fenced off from the store, so once the term could
+// lapse before another renewal succeeds the leader steps down: it cancels
+// the jobs' context, so they start nothing new, and campaigns again.
+// Another replica only takes over once the term has lapsed.
+func lead(jobs func(ctx context.Context)) {
+	id := replicaID()
+	for {
+		term, renewed := campaign(id)
+		leading.Store(true)
+		logger.Info("leading replicas", "replica", id)
+		ctx, stepDown := context.WithCancel(context.Background())
+		jobs(ctx)
+
+		wait := leaderRenew
+		for {
+			time.Sleep(wait)
+			attempt := time.Now()
+			renewCtx, cancel := context.WithTimeout(context.Background(), leaderRenewTimeout)
+			err := election.renew(renewCtx, term)
+			cancel()
+			if err == nil {
+				renewed, wait = attempt, leaderRenew
+				continue
+			}
+			// A lapsed term cannot be renewed; otherwise retry while a
+			// retry could still finish before the term lapses
+			if errors.Is(err, errTermLapsed) || time.Since(renewed)+leaderRetry+leaderRenewTimeout >= leaderTTL {
+				logger.Error("could not renew leadership, stepping down", "replica", id, "error", err)
+				break
+			}
+			logger.Warn("renewing leadership", "replica", id, "error", err)
+			wait = leaderRetry
+		}
+		stepDown()
+		leading.Store(false)
+	}
+}
+
+// campaign tries to take leadership until it succeeds, returning the term
+// and when it started, as the term lapses leaderTTL after that at the
+// earliest
+func campaign(id string) (string, time.Time) {
+	for {
+		started := time.Now()
+		ctx, cancel := context.WithTimeout(context.Background(), leaderRenew)
+		term, err := election.campaign(ctx, id)
+		cancel()
+		if err != nil {
+			logger.Warn("electing leader", "error", err)
+		}
+		if term != "" {
+			return term, started
+		}
+		time.Sleep(leaderRenew)
+	}
+}
+
+// pause waits for d, returning false if ctx is done first
+func pause(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// clusterStatus reports the store this replica uses, and which replica
+// leads and so runs the scheduler, autoheal, automatic updates, webhooks,
+// log forwarding, event history and stats export
+func clusterStatus(c *gin.Context) {
+	id := replicaID()
+	status := gin.H{"replica": id, "store": storeKind, "shared": storeShared, "leading": leading.Load(), "leader": id}
+	if storeShared {
+		leader, err := election.leader(c.Request.Context())
+		if err != nil {
+			respondError(c, http.StatusBadGateway, codeUpstreamError, "Error reading the leader from "+storeKind+": "+err.Error())
+			return
+		}
+		status["leader"] = leader
+	}
+	respond(c, http.StatusOK, status)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// scriptedElection grants the first campaign and answers renewals in
+// turn from its script, then keeps failing them as lapsed
+type scriptedElection struct {
+	mu        sync.Mutex
+	campaigns int
+	renewals  []error
+}
+
+func (e *scriptedElection) campaign(ctx context.Context, id string) (string, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.campaigns++; e.campaigns > 1 {
+		return "", nil
+	}
+	return "term", nil
+}
+
+func (e *scriptedElection) renew(ctx context.Context, term string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.renewals) == 0 {
+		return errTermLapsed
+	}
+	err := e.renewals[0]
+	e.renewals = e.renewals[1:]
+	return err
+}
+
+func (e *scriptedElection) leader(ctx context.Context) (string, error) {
+	return "", nil
+}
+
+// TestLeadStepsDown checks that the leader rides out a failed renewal and
+// cancels its jobs, without exiting, once its term has lapsed
+func TestLeadStepsDown(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits out lease renewals")
+	}
+	election = &scriptedElection{renewals: []error{errors.New("connection refused"), nil}}
+	started := make(chan context.Context, 1)
+	go lead(func(ctx context.Context) { started <- ctx })
+
+	var jobs context.Context
+	select {
+	case jobs = <-started:
+	case <-time.After(leaderRenew):
+		t.Fatal("the only replica did not start leading")
+	}
+	if !leading.Load() {
+		t.Fatal("leading is false while the jobs run")
+	}
+
+	// The renewal after leaderRenew fails and the retry a second later
+	// succeeds, so the jobs keep running past both
+	time.Sleep(leaderRenew + leaderRetry + leaderRenew/2)
+	if jobs.Err() != nil {
+		t.Fatal("a renewal that was retried in time stopped the jobs")
+	}
+
+	// The next renewal finds the term lapsed
+	select {
+	case <-jobs.Done():
+	case <-time.After(leaderRenew):
+		t.Fatal("the jobs kept running after the term lapsed")
+	}
+	time.Sleep(10 * time.Millisecond)
+	if leading.Load() {
+		t.Fatal("leading is still true after stepping down")
+	}
+}
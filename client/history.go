@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/docker/docker/api/types/events"
+	"github.com/gin-gonic/gin"
+)
+
+// eventHistoryBucket holds container events keyed by time, so a range of
+// keys is a range of time
+const eventHistoryBucket = "event_history"
+
+// eventRetention is how long events are kept; older ones are pruned hourly
+var eventRetention = envDuration("CONTAINERSCOPE_EVENT_RETENTION", 30*24*time.Hour)
+
+const (
+	defaultHistoryLimit = 100
+	maxHistoryLimit     = 1000
+)
+
+// historyActions are the container events worth keeping: lifecycle
+// changes and the reasons behind them
+var historyActions = map[events.Action]bool{
+	events.ActionCreate:  true,
+	events.ActionStart:   true,
+	events.ActionRestart: true,
+	events.ActionStop:    true,
+	events.ActionKill:    true,
+	events.ActionDie:     true,
+	events.ActionOOM:     true,
+	events.ActionDestroy: true,
+	events.ActionPause:   true,
+	events.ActionUnPause: true,
+}
+
+// historyEvent is one stored container event
+type historyEvent struct {
+	Time        time.Time `json:"time"`
+	Host        string    `json:"host"`
+	Action      string    `json:"action"`
+	ContainerID string    `json:"container_id"`
+	Container   string    `json:"container"`
+	Image       string    `json:"image,omitempty"`
+	ExitCode    string    `json:"exit_code,omitempty"`
+	Signal      string    `json:"signal,omitempty"`
+	Health      string    `json:"health,omitempty"`
+}
+
+// historySeq tells apart events stored in the same nanosecond
+var historySeq atomic.Uint32
+
+// historyKey orders events by time; the sequence number keeps keys unique
+func historyKey(t time.Time, seq uint32) string {
+	return fmt.Sprintf("%019d-%06d", t.UnixNano(), seq%1000000)
+}
+
+// startEventHistory records every host's container events and prunes
+// those older than CONTAINERSCOPE_EVENT_RETENTION, until ctx is done
+func startEventHistory(ctx context.Context) {
+	for name, host := range dockerHosts {
+		go recordEvents(ctx, host.Name, eventBuses[name])
+	}
+	go func() {
+		for {
+			cutoff := historyKey(time.Now().Add(-eventRetention), 0)
+			if n, err := storeDeleteBefore(eventHistoryBucket, cutoff); err != nil {
+				logger.Warn("pruning event history", "error", err)
+			} else if n > 0 {
+				logger.Debug("pruned event history", "events", n)
+			}
+			if !pause(ctx, time.Hour) {
+				return
+			}
+		}
+	}()
+}
+
+// recordEvents stores the container events of one host's bus
+func recordEvents(ctx context.Context, host string, bus *eventBus) {
+	evs := bus.subscribeUntil(ctx)
+	for ev := range evs {
+		event, ok := toHistoryEvent(host, ev)
+		if !ok {
+			continue
+		}
+		if err := storePut(eventHistoryBucket, historyKey(event.Time, historySeq.Add(1)), event); err != nil {
+			logger.Warn("recording event", "host", host, "action", event.Action, "error", err)
+		}
+	}
+}
+
+// toHistoryEvent converts a Docker event, and false for events that are
+// not kept
+func toHistoryEvent(host string, ev hostEvent) (historyEvent, bool) {
+	if ev.Resync || ev.Type != events.ContainerEventType {
+		return historyEvent{}, false
+	}
+	event := historyEvent{
+		Time:        time.Unix(0, ev.TimeNano),
+		Host:        host,
+		Action:      string(ev.Action),
+		ContainerID: ev.Actor.ID,
+		Container:   ev.Actor.Attributes["name"],
+		Image:       ev.Actor.Attributes["image"],
+		ExitCode:    ev.Actor.Attributes["exitCode"],
+		Signal:      ev.Actor.Attributes["signal"],
+	}
+	if ev.TimeNano == 0 {
+		event.Time = time.Unix(ev.Time, 0)
+	}
+	// Health events carry the status in the action, as in
+	// "health_status: unhealthy"
+	if status, ok := strings.CutPrefix(event.Action, string(events.ActionHealthStatus)+": "); ok {
+		event.Action, event.Health = string(events.ActionHealthStatus), status
+		return event, true
+	}
+	return event, historyActions[ev.Action]
+}
+
+// eventHistory returns stored events of the selected host, newest first.
+// container matches an ID prefix or a name, type an action such as die or
+// oom, and from and to bound the time like the logs since and until.
+func eventHistory(c *gin.Context) {
+	ctx := hostContext(c)
+	host := hostFrom(ctx).Name
+
+	now := time.Now()
+	from, err := logTime(c, "from", now)
+	if err != nil {
+		badRequest(c, err.Error())
+		return
+	}
+	to, err := logTime(c, "to", now)
+	if err != nil {
+		badRequest(c, err.Error())
+		return
+	}
+	limit := defaultHistoryLimit
+	if v := c.Query("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 || limit > maxHistoryLimit {
+			badRequest(c, fmt.Sprintf("limit must be between 1 and %d", maxHistoryLimit))
+			return
+		}
+	}
+	actions := map[string]bool{}
+	for _, v := range c.QueryArray("type") {
+		for _, action := range strings.Split(v, ",") {
+			actions[action] = true
+		}
+	}
+	cont := strings.TrimPrefix(c.Query("container"), "/")
+
+	fromKey, toKey := "", ""
+	if from != "" {
+		fromKey = historyKey(logTimeBound(from), 0)
+	}
+	if to != "" {
+		// The bound is inclusive
+		toKey = historyKey(logTimeBound(to).Add(time.Nanosecond), 0)
+	}
+
+	// Keys are in time order, so the newest matches are the last ones seen
+	matched := []historyEvent{}
+	err = storeEachRange(eventHistoryBucket, fromKey, toKey, func(_ string, value []byte) error {
+		var event historyEvent
+		if err := json.Unmarshal(value, &event); err != nil {
+			return nil
+		}
+		if event.Host != host || len(actions) > 0 && !actions[event.Action] {
+			return nil
+		}
+		if cont != "" && event.Container != cont && !strings.HasPrefix(event.ContainerID, cont) {
+			return nil
+		}
+		if matched = append(matched, event); len(matched) > limit {
+			matched = matched[1:]
+		}
+		return nil
+	})
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, codeInternal, "Error reading event history")
+		return
+	}
+	for i, j := 0, len(matched)-1; i < j; i, j = i+1, j-1 {
+		matched[i], matched[j] = matched[j], matched[i]
+	}
+	respond(c, http.StatusOK, matched)
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/docker/docker/client"
+	"github.com/gin-gonic/gin"
+)
+
+// defaultHostName is the host requests target when they do not pick one:
+// the daemon from DOCKER_HOST, or the local socket
+const defaultHostName = "local"
+
+// dockerHost is one Docker daemon the agent manages
+type dockerHost struct {
+	Name     string `json:"name"`
+	Endpoint string `json:"endpoint"`
+	TLS      bool   `json:"tls"`
+	// Context is the Docker CLI context the host was configured from
+	Context string `json:"context,omitempty"`
+	// Discovered is the source the host was discovered in, if it was
+	Discovered string `json:"discovered,omitempty"`
+	// Labels describe the host, such as env=prod, for selecting and
+	// grouping hosts
+	Labels  map[string]string `json:"labels,omitempty"`
+	certDir string
+	fromEnv bool
+
+	// mu guards the client, which the watchdog replaces, and its health
+	mu     sync.RWMutex
+	client *client.Client
+	health hostHealth
+}
+
+// dockerHosts holds every configured daemon by name, including the default
+var dockerHosts = map[string]*dockerHost{}
+
+// loadHosts registers the default daemon and those listed in
+// CONTAINERSCOPE_HOSTS as comma separated name=endpoint pairs. TCP
+// endpoints use TLS when CONTAINERSCOPE_TLS_DIR/<name> holds ca.pem,
+// cert.pem and key.pem; ssh:// endpoints go through the ssh client,
+// context:<name> takes the endpoint and TLS material of a Docker context,
+// and tunnel: waits for the host's agent to dial in.
+// The default daemon comes from a context too when one is selected and
+// DOCKER_HOST is unset, and CONTAINERSCOPE_CONTEXT_HOSTS adds hosts for
+// contexts by name. Hosts advertised in the CONTAINERSCOPE_DISCOVERY
+// sources come next, and each host then gets the labels set for it.
+func loadHosts() error {
+	endpoint := os.Getenv("DOCKER_HOST")
+	if endpoint == "" {
+		endpoint = client.DefaultDockerHost
+	}
+	host := &dockerHost{
+		Name:     defaultHostName,
+		Endpoint: endpoint,
+		TLS:      os.Getenv("DOCKER_TLS_VERIFY") != "",
+		certDir:  os.Getenv("DOCKER_CERT_PATH"),
+		fromEnv:  true,
+	}
+	// A context stands in for DOCKER_HOST, as it does for the Docker CLI
+	if name := agentDockerContext(); name != "" && os.Getenv("DOCKER_HOST") == "" {
+		dc, err := findDockerContext(name)
+		if err != nil {
+			return err
+		}
+		if host, err = contextHost(defaultHostName, dc); err != nil {
+			return err
+		}
+	} else if err := host.connect(); err != nil {
+		return fmt.Errorf("DOCKER_HOST: %w", err)
+	}
+	dockerHosts[defaultHostName] = host
+
+	tlsDir := envOr("CONTAINERSCOPE_TLS_DIR", filepath.Join(dataDir(), "tls"))
+	for _, entry := range strings.Split(os.Getenv("CONTAINERSCOPE_HOSTS"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, endpoint, ok := strings.Cut(entry, "=")
+		if !ok || name == "" || endpoint == "" {
+			return fmt.Errorf("CONTAINERSCOPE_HOSTS: expected name=endpoint, got %q", entry)
+		}
+		var host *dockerHost
+		var err error
+		if contextName, ok := strings.CutPrefix(endpoint, "context:"); ok {
+			var dc dockerContext
+			if dc, err = findDockerContext(contextName); err == nil {
+				host, err = contextHost(name, dc)
+			}
+		} else if endpoint == tunnelEndpoint {
+			host, err = newTunnelHost(name)
+		} else {
+			host, err = newDockerHost(name, endpoint, filepath.Join(tlsDir, name))
+		}
+		if err != nil {
+			return fmt.Errorf("CONTAINERSCOPE_HOSTS: host %s: %w", name, err)
+		}
+		dockerHosts[name] = host
+	}
+	if err := loadContextHosts(); err != nil {
+		return fmt.Errorf("CONTAINERSCOPE_CONTEXT_HOSTS: %w", err)
+	}
+	if err := loadDiscoveredHosts(tlsDir); err != nil {
+		return err
+	}
+	return loadNodeLabels()
+}
+
+// newDockerHost creates a client for endpoint, using the certificates in
+// certDir when they exist
+func newDockerHost(name, endpoint, certDir string) (*dockerHost, error) {
+	host := &dockerHost{Name: name, Endpoint: endpoint}
+	if !strings.HasPrefix(endpoint, "ssh://") {
+		if _, err := os.Stat(filepath.Join(certDir, "ca.pem")); err == nil {
+			host.TLS = true
+			host.certDir = certDir
+		}
+	}
+	if err := host.connect(); err != nil {
+		return nil, err
+	}
+	return host, nil
+}
+
+// connect builds a new client for the host and swaps it in for the old
+// one. Creating a client does not dial the daemon, so this only fails on
+// bad configuration.
+func (h *dockerHost) connect() error {
+	var opts []client.Opt
+	switch {
+	// The Docker client cannot dial ssh:// on its own
+	case strings.HasPrefix(h.Endpoint, "ssh://"):
+		sshOpts, err := sshClientOpts(h.Endpoint)
+		if err != nil {
+			return err
+		}
+		opts = sshOpts
+	case h.Endpoint == tunnelEndpoint:
+		opts = tunnelClientOpts(h.Name)
+	case h.fromEnv:
+		opts = []client.Opt{client.FromEnv, client.WithAPIVersionNegotiation()}
+	default:
+		opts = []client.Opt{client.WithHost(h.Endpoint), client.WithAPIVersionNegotiation()}
+		if h.TLS {
+			opts = append(opts, client.WithTLSClientConfig(
+				filepath.Join(h.certDir, "ca.pem"),
+				filepath.Join(h.certDir, "cert.pem"),
+				filepath.Join(h.certDir, "key.pem"),
+			))
+		}
+	}
+	cli, err := client.NewClientWithOpts(opts...)
+	if err != nil {
+		return err
+	}
+	// Wrap the transport only once the client exists, so it still finds
+	// the underlying *http.Transport for TLS and hijacked connections
+	hc := cli.HTTPClient()
+	hc.Transport = &dockerTransport{host: h.Name, next: hc.Transport}
+	if err := client.WithHTTPClient(hc)(cli); err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	old := h.client
+	h.client = cli
+	h.mu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+// Client returns the host's current Docker client
+func (h *dockerHost) Client() *client.Client {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.client
+}
+
+// hostKey is the gin context key the selected host is stored under
+const hostKey = "docker_host"
+
+// dockerHostKey is the context.Context key the selected host is stored under
+type dockerHostKey struct{}
+
+// selectHost picks the daemon named by the host query parameter, or the
+// default one, for the rest of the request
+func selectHost() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		name := c.DefaultQuery("host", defaultHostName)
+		host, ok := dockerHosts[name]
+		if !ok {
+			respondError(c, http.StatusNotFound, codeHostNotFound, fmt.Sprintf("Host %s is not configured", name))
+			return
+		}
+		c.Set(hostKey, host)
+		c.Next()
+	}
+}
+
+// hostContext returns the request's context carrying the host it selected,
+// so Docker calls are cancelled with the request
+func hostContext(c *gin.Context) context.Context {
+	host, _ := c.Get(hostKey)
+	if host == nil {
+		host = dockerHosts[defaultHostName]
+	}
+	return withHost(c.Request.Context(), host.(*dockerHost))
+}
+
+// withHost returns ctx carrying host, for work done outside a request
+func withHost(ctx context.Context, host *dockerHost) context.Context {
+	return context.WithValue(ctx, dockerHostKey{}, host)
+}
+
+// hostFrom returns the host carried by ctx, or the default host
+func hostFrom(ctx context.Context) *dockerHost {
+	if host, ok := ctx.Value(dockerHostKey{}).(*dockerHost); ok && host != nil {
+		return host
+	}
+	return dockerHosts[defaultHostName]
+}
+
+// docker returns the Docker client for the host carried by ctx
+func docker(ctx context.Context) *client.Client {
+	return hostFrom(ctx).Client()
+}
+
+// listHosts lists the configured daemons, or those the node_label
+// parameters select, and whether each answers a ping
+func listHosts(c *gin.Context) {
+	hosts, err := selectedHosts(c)
+	if err != nil {
+		badRequest(c, err.Error())
+		return
+	}
+
+	rows := make([]map[string]interface{}, len(hosts))
+	var wg sync.WaitGroup
+	for i, host := range hosts {
+		wg.Add(1)
+		go func(i int, host *dockerHost) {
+			defer wg.Done()
+			row := map[string]interface{}{
+				"name":       host.Name,
+				"endpoint":   host.Endpoint,
+				"tls":        host.TLS,
+				"context":    host.Context,
+				"discovered": host.Discovered,
+				"labels":     host.Labels,
+				"default":    host.Name == defaultHostName,
+				"reachable":  true,
+			}
+			if host.Endpoint == tunnelEndpoint {
+				row["tunnel"] = tunnelStatus(host.Name)
+			}
+			if ping, err := host.Client().Ping(c.Request.Context()); err != nil {
+				row["reachable"] = false
+				row["error"] = err.Error()
+			} else {
+				row["api_version"] = ping.APIVersion
+			}
+			rows[i] = row
+		}(i, host)
+	}
+	wg.Wait()
+
+	respond(c, http.StatusOK, rows)
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// idempotencyHeader carries a client-chosen key that makes a retried
+// mutation return the first attempt's response instead of running again
+const idempotencyHeader = "Idempotency-Key"
+
+// idempotencyBucket holds the responses to keyed requests, keyed by client
+// and idempotency key
+const idempotencyBucket = "idempotency"
+
+// idempotencyTTL is how long a key's response is kept
+var idempotencyTTL = envDuration("CONTAINERSCOPE_IDEMPOTENCY_TTL", 24*time.Hour)
+
+// maxIdempotencyKey bounds the header's length
+const maxIdempotencyKey = 255
+
+// idempotentRequests are the mutations that honour Idempotency-Key
+var idempotentRequests = map[string]bool{
+	"POST /api/v1/containers/stop":     true,
+	"POST /api/v1/containers/start":    true,
+	"POST /api/v1/containers/restart":  true,
+	"DELETE /api/v1/containers/delete": true,
+}
+
+// storedResponse is a response kept for replay
+type storedResponse struct {
+	Status      int       `json:"status"`
+	ContentType string    `json:"content_type"`
+	Body        []byte    `json:"body"`
+	RequestHash string    `json:"request_hash"`
+	Expires     time.Time `json:"expires"`
+}
+
+// idempotencyClaimBucket holds the keys whose first request is still
+// running, on any replica, until the request's deadline
+const idempotencyClaimBucket = "idempotency_claims"
+
+// idempotencyClaim marks a key in use by a running request. Holder is
+// random, so each claim is removed only by the request that made it.
+type idempotencyClaim struct {
+	Holder  string    `json:"holder"`
+	Expires time.Time `json:"expires"`
+}
+
+// claimIdempotencyKey marks storeKey in use until deadline, returning the
+// claim to release it with, or false while another request holds it. A
+// claim outliving its deadline was left by a replica that stopped
+// mid-request, and is taken over; of several requests finding it, only
+// the one whose compare-and-delete removes it can claim the key.
+func claimIdempotencyKey(storeKey string, deadline time.Time) (idempotencyClaim, bool, error) {
+	claim := idempotencyClaim{Holder: newWebhookSecret(), Expires: deadline}
+	for {
+		claimed, err := storeCreate(idempotencyClaimBucket, storeKey, claim)
+		if err != nil || claimed {
+			return claim, claimed, err
+		}
+		var held idempotencyClaim
+		found, err := storeGet(idempotencyClaimBucket, storeKey, &held)
+		if err != nil {
+			return claim, false, err
+		}
+		if found && time.Now().Before(held.Expires) {
+			return claim, false, nil
+		}
+		if found {
+			if _, err := storeDeleteIf(idempotencyClaimBucket, storeKey, held); err != nil {
+				return claim, false, err
+			}
+		}
+	}
+}
+
+// capturingWriter keeps a copy of the response body
+type capturingWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *capturingWriter) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *capturingWriter) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// idempotent replays the stored response when a client repeats an
+// Idempotency-Key within CONTAINERSCOPE_IDEMPOTENCY_TTL, marking it with
+// Idempotent-Replayed: true. Reusing a key for a different request, or
+// while the first is still running, is a 409. Server errors are not
+// stored, so the request can be retried.
+func idempotent() gin.HandlerFunc {
+	go pruneIdempotencyKeys()
+	return func(c *gin.Context) {
+		key := c.GetHeader(idempotencyHeader)
+		if key == "" || !idempotentRequests[c.Request.Method+" "+c.FullPath()] {
+			c.Next()
+			return
+		}
+		if len(key) > maxIdempotencyKey {
+			badRequest(c, "Idempotency-Key may be at most 255 characters")
+			return
+		}
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			badRequest(c, "Error reading request body")
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+		sum := sha256.Sum256([]byte(c.Request.Method + " " + c.Request.URL.Path + "?" + c.Request.URL.RawQuery + "\n" + string(body)))
+		hash := hex.EncodeToString(sum[:])
+		storeKey := clientKey(c) + "/" + key
+
+		deadline, ok := c.Request.Context().Deadline()
+		if !ok {
+			deadline = time.Now().Add(longRequestTimeout)
+		}
+		claim, claimed, err := claimIdempotencyKey(storeKey, deadline)
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, codeInternal, "Error claiming Idempotency-Key: "+err.Error())
+			return
+		}
+		if !claimed {
+			respondError(c, http.StatusConflict, codeConflict, "A request with this Idempotency-Key is still in progress")
+			return
+		}
+		defer storeDeleteIf(idempotencyClaimBucket, storeKey, claim)
+
+		var stored storedResponse
+		if found, err := storeGet(idempotencyBucket, storeKey, &stored); err == nil && found && time.Now().Before(stored.Expires) {
+			if stored.RequestHash != hash {
+				respondError(c, http.StatusConflict, codeConflict, "Idempotency-Key was already used for a different request")
+				return
+			}
+			c.Header("Idempotent-Replayed", "true")
+			c.Data(stored.Status, stored.ContentType, stored.Body)
+			c.Abort()
+			return
+		}
+
+		w := &capturingWriter{ResponseWriter: c.Writer}
+		c.Writer = w
+		c.Next()
+		if w.Status() >= http.StatusInternalServerError {
+			return
+		}
+		stored = storedResponse{
+			Status:      w.Status(),
+			ContentType: w.Header().Get("Content-Type"),
+			Body:        w.body.Bytes(),
+			RequestHash: hash,
+			Expires:     time.Now().Add(idempotencyTTL),
+		}
+		if err := storePut(idempotencyBucket, storeKey, stored); err != nil {
+			logger.Warn("storing idempotent response", "error", err)
+		}
+	}
+}
+
+// pruneIdempotencyKeys deletes expired responses every hour
+func pruneIdempotencyKeys() {
+	for {
+		var expired []string
+		now := time.Now()
+		err := storeEach(idempotencyBucket, func(key string, value []byte) error {
+			var stored storedResponse
+			if json.Unmarshal(value, &stored) != nil || now.After(stored.Expires) {
+				expired = append(expired, key)
+			}
+			return nil
+		})
+		if err != nil {
+			logger.Warn("pruning idempotency keys", "error", err)
+		}
+		for _, key := range expired {
+			storeDelete(idempotencyBucket, key)
+		}
+		time.Sleep(time.Hour)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// slowReadStore holds every read back a while after making it, so
+// concurrent claimants all act on what they read before any of them
+// changes it, as replicas on a slow network would
+type slowReadStore struct {
+	kvStore
+}
+
+func (s slowReadStore) get(bucket, key string) ([]byte, error) {
+	data, err := s.kvStore.get(bucket, key)
+	time.Sleep(10 * time.Millisecond)
+	return data, err
+}
+
+// TestClaimIdempotencyKeyTakeover has many requests find the same expired
+// claim at once; exactly one of them may take it over
+func TestClaimIdempotencyKeyTakeover(t *testing.T) {
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "test.db"), 0o600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	store = slowReadStore{boltStore{db}}
+
+	const key = "client/key"
+	for round := 0; round < 20; round++ {
+		stale := idempotencyClaim{Holder: "stopped replica", Expires: time.Now().Add(-time.Minute)}
+		if err := storePut(idempotencyClaimBucket, key, stale); err != nil {
+			t.Fatal(err)
+		}
+
+		const claimants = 16
+		var wg sync.WaitGroup
+		won := make(chan idempotencyClaim, claimants)
+		start := make(chan struct{})
+		for i := 0; i < claimants; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				<-start
+				claim, claimed, err := claimIdempotencyKey(key, time.Now().Add(time.Minute))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if claimed {
+					won <- claim
+				}
+			}()
+		}
+		close(start)
+		wg.Wait()
+		close(won)
+
+		var winners []idempotencyClaim
+		for claim := range won {
+			winners = append(winners, claim)
+		}
+		if len(winners) != 1 {
+			t.Fatalf("round %d: %d requests claimed the key, want 1", round, len(winners))
+		}
+		var held idempotencyClaim
+		if _, err := storeGet(idempotencyClaimBucket, key, &held); err != nil {
+			t.Fatal(err)
+		}
+		if held.Holder != winners[0].Holder {
+			t.Fatalf("round %d: the store holds %q's claim, not the winner's", round, held.Holder)
+		}
+	}
+}
+
+// TestReleaseIdempotencyClaim checks that a request whose claim was taken
+// over does not remove the new holder's claim when it finishes
+func TestReleaseIdempotencyClaim(t *testing.T) {
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "test.db"), 0o600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	store = boltStore{db}
+
+	const key = "client/key"
+	first, claimed, err := claimIdempotencyKey(key, time.Now().Add(-time.Second))
+	if err != nil || !claimed {
+		t.Fatalf("first claim: claimed %v, error %v", claimed, err)
+	}
+	second, claimed, err := claimIdempotencyKey(key, time.Now().Add(time.Minute))
+	if err != nil || !claimed {
+		t.Fatalf("takeover: claimed %v, error %v", claimed, err)
+	}
+	if deleted, err := storeDeleteIf(idempotencyClaimBucket, key, first); err != nil || deleted {
+		t.Fatalf("releasing the lapsed claim: deleted %v, error %v", deleted, err)
+	}
+	if _, claimed, _ := claimIdempotencyKey(key, time.Now().Add(time.Minute)); claimed {
+		t.Fatal("key was claimed again while the second request holds it")
+	}
+	if deleted, err := storeDeleteIf(idempotencyClaimBucket, key, second); err != nil || !deleted {
+		t.Fatalf("releasing the current claim: deleted %v, error %v", deleted, err)
+	}
+}
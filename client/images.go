@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/pkg/jsonmessage"
+	"github.com/gin-gonic/gin"
+)
+
+// readJSONMessages drains a Docker progress stream (pull, import, load,
+// build) and returns its messages, failing on the first reported error
+func readJSONMessages(r io.Reader) ([]jsonmessage.JSONMessage, error) {
+	messages := []jsonmessage.JSONMessage{}
+	decoder := json.NewDecoder(r)
+	for {
+		var msg jsonmessage.JSONMessage
+		if err := decoder.Decode(&msg); errors.Is(err, io.EOF) {
+			return messages, nil
+		} else if err != nil {
+			return messages, err
+		}
+		if msg.Error != nil {
+			return messages, msg.Error
+		}
+		messages = append(messages, msg)
+	}
+}
+
+// uploadedArchive returns the tar archive a request carries, either as the
+// "file" field of a multipart form or as the raw request body
+func uploadedArchive(c *gin.Context) (io.ReadCloser, error) {
+	if strings.HasPrefix(c.ContentType(), "multipart/") {
+		fh, err := c.FormFile("file")
+		if err != nil {
+			return nil, err
+		}
+		return fh.Open()
+	}
+	return c.Request.Body, nil
+}
+
+// importImage creates an image from a filesystem tar such as one produced
+// by the container export endpoint
+func importImage(c *gin.Context) {
+	ctx := hostContext(c)
+	repository := c.Query("repository")
+	tag := c.DefaultQuery("tag", "latest")
+	if repository == "" {
+		badRequest(c, "repository is required")
+		return
+	}
+
+	archive, err := uploadedArchive(c)
+	if err != nil {
+		badRequest(c, "Expected a tar archive as the request body or a multipart file field")
+		return
+	}
+	defer archive.Close()
+
+	source := types.ImageImportSource{Source: archive, SourceName: "-"}
+	out, err := docker(ctx).ImageImport(ctx, source, repository, types.ImageImportOptions{Tag: tag})
+	if err != nil {
+		dockerError(c, "Error importing image", err)
+		return
+	}
+	defer out.Close()
+
+	messages, err := readJSONMessages(out)
+	if err != nil {
+		dockerError(c, "Error importing image", err)
+		return
+	}
+
+	id := ""
+	if len(messages) > 0 {
+		id = messages[len(messages)-1].Status
+	}
+	respond(c, http.StatusOK, gin.H{"message": "Image imported successfully", "id": id, "image": repository + ":" + tag})
+}
+
+// tagImage adds a new tag to an existing image, e.g. promoting
+// myapp:staging to myapp:prod
+func tagImage(c *gin.Context) {
+	ctx := hostContext(c)
+	var req struct {
+		Source string `json:"source" binding:"required"`
+		Target string `json:"target" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		badRequest(c, "source and target are required")
+		return
+	}
+
+	if err := docker(ctx).ImageTag(ctx, req.Source, req.Target); err != nil {
+		dockerError(c, "Error tagging image", err)
+		return
+	}
+
+	respond(c, http.StatusOK, gin.H{"message": "Image tagged successfully", "source": req.Source, "target": req.Target})
+}
+
+// imageHistory lists an image's layers, newest first, with the command
+// that created each one
+func imageHistory(c *gin.Context) {
+	ctx := hostContext(c)
+	imageID := c.Param("image_id")
+	history, err := docker(ctx).ImageHistory(ctx, imageID)
+	if err != nil {
+		dockerError(c, "Error retrieving image history", err)
+		return
+	}
+
+	layers := []map[string]interface{}{}
+	for _, layer := range history {
+		layers = append(layers, map[string]interface{}{
+			"id":         layer.ID,
+			"created":    time.Unix(layer.Created, 0).Format("2006-01-02 15:04:05"),
+			"created_by": layer.CreatedBy,
+			"tags":       layer.Tags,
+			"size":       layer.Size,
+			"size_human": fmt.Sprintf("%.2f MB", float64(layer.Size)/1024/1024),
+			"comment":    layer.Comment,
+		})
+	}
+
+	respond(c, http.StatusOK, layers)
+}
+
+// inspectImage returns the image's full metadata
+func inspectImage(c *gin.Context) {
+	ctx := hostContext(c)
+	imageID := c.Param("image_id")
+	inspection, _, err := docker(ctx).ImageInspectWithRaw(ctx, imageID)
+	if err != nil {
+		dockerError(c, "Error inspecting image", err)
+		return
+	}
+
+	respond(c, http.StatusOK, inspection)
+}
+
+// saveImage streams an image and its layers as a tar archive that can be
+// loaded on another host
+func saveImage(c *gin.Context) {
+	ctx := hostContext(c)
+	imageID := c.Param("image_id")
+	reader, err := docker(ctx).ImageSave(ctx, []string{imageID})
+	if err != nil {
+		dockerError(c, "Error saving image", err)
+		return
+	}
+	defer reader.Close()
+
+	name := strings.NewReplacer("/", "_", ":", "_").Replace(imageID)
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=image_%s.tar", name))
+	c.DataFromReader(http.StatusOK, -1, "application/x-tar", reader, nil)
+}
+
+// loadImage loads images from a tar archive produced by the save endpoint
+// or `docker save`
+func loadImage(c *gin.Context) {
+	ctx := hostContext(c)
+	archive, err := uploadedArchive(c)
+	if err != nil {
+		badRequest(c, "Expected a tar archive as the request body or a multipart file field")
+		return
+	}
+	defer archive.Close()
+
+	resp, err := docker(ctx).ImageLoad(ctx, archive, true)
+	if err != nil {
+		dockerError(c, "Error loading image", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	messages, err := readJSONMessages(resp.Body)
+	if err != nil {
+		dockerError(c, "Error loading image", err)
+		return
+	}
+
+	loaded := []string{}
+	for _, msg := range messages {
+		if line := strings.TrimSpace(msg.Stream); line != "" {
+			loaded = append(loaded, line)
+		}
+	}
+	respond(c, http.StatusOK, gin.H{"message": "Images loaded successfully", "loaded": loaded})
+}
+
+// danglingImages returns the untagged images, as the dangling filter does
+func danglingImages(images []types.ImageSummary) []types.ImageSummary {
+	dangling := []types.ImageSummary{}
+	for _, image := range images {
+		if len(image.RepoTags) == 0 || (len(image.RepoTags) == 1 && image.RepoTags[0] == "<none>:<none>") {
+			dangling = append(dangling, image)
+		}
+	}
+	return dangling
+}
+
+// imageUsage maps image IDs to the names of every container, running or
+// not, created from them
+func imageUsage(ctx context.Context) (map[string][]string, error) {
+	containers, cached := cachedContainers(ctx, filters.NewArgs())
+	if !cached {
+		var err error
+		containers, err = docker(ctx).ContainerList(ctx, container.ListOptions{All: true})
+		if err != nil {
+			return nil, err
+		}
+	}
+	usage := map[string][]string{}
+	for _, cont := range containers {
+		usage[cont.ImageID] = append(usage[cont.ImageID], strings.TrimPrefix(cont.Names[0], "/"))
+	}
+	return usage, nil
+}
+
+// containerNames returns names, or an empty list rather than null
+func containerNames(names []string) []string {
+	if names == nil {
+		return []string{}
+	}
+	return names
+}
+
+// imageContainers lists the containers created from an image
+func imageContainers(c *gin.Context) {
+	ctx := hostContext(c)
+	imageID := c.Param("image_id")
+	inspection, _, err := docker(ctx).ImageInspectWithRaw(ctx, imageID)
+	if err != nil {
+		dockerError(c, "Error inspecting image", err)
+		return
+	}
+
+	containers, err := docker(ctx).ContainerList(ctx, container.ListOptions{All: true})
+	if err != nil {
+		dockerError(c, "Error listing containers", err)
+		return
+	}
+
+	users := []map[string]interface{}{}
+	for _, cont := range containers {
+		if cont.ImageID != inspection.ID {
+			continue
+		}
+		users = append(users, map[string]interface{}{
+			"name":    strings.TrimPrefix(cont.Names[0], "/"),
+			"id":      cont.ID[:10],
+			"full_id": cont.ID,
+			"running": cont.State == "running",
+		})
+	}
+
+	respond(c, http.StatusOK, gin.H{"image": inspection.ID, "in_use": len(users) > 0, "containers": users})
+}
+
+// searchImages searches Docker Hub, or the registry a term is prefixed
+// with, for images to deploy. Results come official first, then by stars.
+func searchImages(c *gin.Context) {
+	ctx := hostContext(c)
+	term := strings.TrimSpace(c.Query("q"))
+	if term == "" {
+		badRequest(c, "q is required")
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "25"))
+	if err != nil || limit < 1 || limit > 100 {
+		badRequest(c, "limit must be between 1 and 100")
+		return
+	}
+	searchFilters := filters.NewArgs()
+	if c.Query("official") == "true" {
+		searchFilters.Add("is-official", "true")
+	}
+	if v := c.Query("min_stars"); v != "" {
+		if n, err := strconv.Atoi(v); err != nil || n < 0 {
+			badRequest(c, "min_stars must be a non-negative integer")
+			return
+		}
+		searchFilters.Add("stars", v)
+	}
+
+	results, err := docker(ctx).ImageSearch(ctx, term, types.ImageSearchOptions{
+		RegistryAuth: encodedRegistryAuth(term),
+		Filters:      searchFilters,
+		Limit:        limit,
+	})
+	if err != nil {
+		dockerError(c, "Error searching images", err)
+		return
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].IsOfficial != results[j].IsOfficial {
+			return results[i].IsOfficial
+		}
+		return results[i].StarCount > results[j].StarCount
+	})
+
+	rows := []map[string]interface{}{}
+	for _, result := range results {
+		rows = append(rows, map[string]interface{}{
+			"name":        result.Name,
+			"description": result.Description,
+			"stars":       result.StarCount,
+			"official":    result.IsOfficial,
+		})
+	}
+	respond(c, http.StatusOK, rows)
+}
+
+// pullImage pulls ref, with any credentials known for its registry, and
+// waits for the pull to finish
+func pullImage(ctx context.Context, ref string) error {
+	out, err := docker(ctx).ImagePull(ctx, ref, types.ImagePullOptions{RegistryAuth: encodedRegistryAuth(ref)})
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	_, err = readJSONMessages(out)
+	return err
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ipGroup is a set of routes with its own CIDR rules, read from
+// CONTAINERSCOPE_<NAME>_ALLOW and CONTAINERSCOPE_<NAME>_DENY. A denied
+// address is always refused; when allow is set only addresses in it get in.
+type ipGroup struct {
+	name  string
+	allow []netip.Prefix
+	deny  []netip.Prefix
+	// mutatingOnly applies the rules only to requests that change state
+	mutatingOnly bool
+}
+
+// ipGroups are the route groups that can be restricted: the whole API,
+// its mutating requests, /debug and /internal/metrics
+var ipGroups = map[string]*ipGroup{
+	"api":       {name: "api"},
+	"mutations": {name: "mutations", mutatingOnly: true},
+	"debug":     {name: "debug"},
+	"metrics":   {name: "metrics"},
+}
+
+// trustedProxies may set X-Forwarded-For and X-Real-IP; other clients are
+// identified by their connection's address so they cannot claim another
+var trustedProxies = splitList(os.Getenv("CONTAINERSCOPE_TRUSTED_PROXIES"))
+
+// splitList splits a comma separated list, dropping empty entries
+func splitList(v string) []string {
+	var list []string
+	for _, entry := range strings.Split(v, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			list = append(list, entry)
+		}
+	}
+	return list
+}
+
+// loadIPRules parses every group's allow and deny lists of CIDRs or
+// single addresses
+func loadIPRules() error {
+	for _, group := range ipGroups {
+		var err error
+		prefix := "CONTAINERSCOPE_" + strings.ToUpper(group.name)
+		if group.allow, err = parsePrefixes(prefix + "_ALLOW"); err != nil {
+			return err
+		}
+		if group.deny, err = parsePrefixes(prefix + "_DENY"); err != nil {
+			return err
+		}
+		if len(group.allow) > 0 || len(group.deny) > 0 {
+			logger.Info("address rules enabled", "group", group.name, "allow", len(group.allow), "deny", len(group.deny))
+		}
+	}
+	return nil
+}
+
+// parsePrefixes reads the environment variable name as a comma separated
+// list of CIDRs; a bare address stands for itself
+func parsePrefixes(name string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, entry := range splitList(os.Getenv(name)) {
+		if !strings.Contains(entry, "/") {
+			addr, err := netip.ParseAddr(entry)
+			if err != nil {
+				return nil, fmt.Errorf("%s: invalid address %q", name, entry)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid CIDR %q", name, entry)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// permits applies the group's rules to addr
+func (g *ipGroup) permits(addr netip.Addr) bool {
+	for _, prefix := range g.deny {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	if len(g.allow) == 0 {
+		return true
+	}
+	for _, prefix := range g.allow {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// restrictIP refuses clients the named groups' rules do not permit with
+// 403, before any token is checked
+func restrictIP(names ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		mutating := !readOnlyRequest(c)
+		addr, err := netip.ParseAddr(c.ClientIP())
+		addr = addr.Unmap()
+		for _, name := range names {
+			group := ipGroups[name]
+			if len(group.allow) == 0 && len(group.deny) == 0 || group.mutatingOnly && !mutating {
+				continue
+			}
+			if err != nil || !group.permits(addr) {
+				ipDenied.WithLabelValues(group.name).Inc()
+				respondError(c, http.StatusForbidden, codeForbidden, fmt.Sprintf("Address %s may not use these endpoints", c.ClientIP()))
+				return
+			}
+		}
+		c.Next()
+	}
+}
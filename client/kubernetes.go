@@ -0,0 +1,548 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/errdefs"
+	"github.com/gin-gonic/gin"
+)
+
+// Where a pod finds its service account's credentials
+const (
+	kubeTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	kubeCAFile    = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+)
+
+// kubeAPI reads the pods of one node from the API server, or from the
+// node's kubelet when CONTAINERSCOPE_KUBELET_URL is set
+type kubeAPI struct {
+	server  string
+	kubelet string
+	node    string
+	client  *http.Client
+}
+
+var (
+	kubeMu     sync.Mutex
+	kubeClient *kubeAPI
+)
+
+// kubeConn sets up the Kubernetes client on first use. The agent is meant
+// to run as a DaemonSet: the API server comes from the in-cluster
+// environment unless CONTAINERSCOPE_KUBE_API names it, the node from
+// CONTAINERSCOPE_KUBE_NODE or NODE_NAME, set with the downward API, and
+// requests carry the pod's service account token.
+func kubeConn() (*kubeAPI, error) {
+	kubeMu.Lock()
+	defer kubeMu.Unlock()
+	if kubeClient != nil {
+		return kubeClient, nil
+	}
+	server := os.Getenv("CONTAINERSCOPE_KUBE_API")
+	if server == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" {
+			return nil, errdefs.Unavailable(fmt.Errorf("not running in a Kubernetes pod; set CONTAINERSCOPE_KUBE_API"))
+		}
+		server = "https://" + net.JoinHostPort(host, port)
+	}
+	node := envOr("CONTAINERSCOPE_KUBE_NODE", os.Getenv("NODE_NAME"))
+	if node == "" {
+		return nil, errdefs.Unavailable(fmt.Errorf("the node is unknown; set NODE_NAME from spec.nodeName"))
+	}
+
+	// The kubelet's serving certificate is signed by the cluster CA when
+	// the cluster issues them, which is the only case supported
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if pem, err := os.ReadFile(envOr("CONTAINERSCOPE_KUBE_CA_FILE", kubeCAFile)); err == nil {
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in the Kubernetes CA file")
+		}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	kubeClient = &kubeAPI{
+		server:  strings.TrimSuffix(server, "/"),
+		kubelet: strings.TrimSuffix(os.Getenv("CONTAINERSCOPE_KUBELET_URL"), "/"),
+		node:    node,
+		client:  &http.Client{Transport: transport},
+	}
+	return kubeClient, nil
+}
+
+// get sends an authenticated GET to the API server, or to the kubelet for
+// a path starting with kubelet:, and turns error responses into errdefs
+// errors so dockerError reports them with a matching status. The token is
+// read for every request since the kubelet rotates it.
+func (k *kubeAPI) get(ctx context.Context, path string, query url.Values) (*http.Response, error) {
+	base := k.server
+	if kubeletPath, ok := strings.CutPrefix(path, "kubelet:"); ok {
+		base, path = k.kubelet, kubeletPath
+	}
+	target := base + path
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	if token, err := os.ReadFile(envOr("CONTAINERSCOPE_KUBE_TOKEN_FILE", kubeTokenFile)); err == nil {
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+	resp, err := k.client.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		return nil, errdefs.Unavailable(err)
+	}
+	if resp.StatusCode == http.StatusOK {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	var status struct {
+		Message string `json:"message"`
+	}
+	err = fmt.Errorf("kubernetes returned %s", resp.Status)
+	if json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&status) == nil && status.Message != "" {
+		err = fmt.Errorf("kubernetes returned %s: %s", resp.Status, status.Message)
+	}
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return nil, errdefs.NotFound(err)
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return nil, errdefs.Forbidden(err)
+	case http.StatusBadRequest:
+		return nil, errdefs.InvalidParameter(err)
+	case http.StatusServiceUnavailable:
+		return nil, errdefs.Unavailable(err)
+	}
+	return nil, err
+}
+
+// getJSON decodes the response to a GET into v
+func (k *kubeAPI) getJSON(ctx context.Context, path string, query url.Values, v interface{}) error {
+	resp, err := k.get(ctx, path, query)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// kubePod is the part of a pod the agent reports
+type kubePod struct {
+	Metadata struct {
+		Name              string            `json:"name"`
+		Namespace         string            `json:"namespace"`
+		UID               string            `json:"uid"`
+		Labels            map[string]string `json:"labels"`
+		CreationTimestamp time.Time         `json:"creationTimestamp"`
+	} `json:"metadata"`
+	Spec struct {
+		NodeName   string                   `json:"nodeName"`
+		Containers []map[string]interface{} `json:"containers"`
+	} `json:"spec"`
+	Status struct {
+		Phase             string                `json:"phase"`
+		PodIP             string                `json:"podIP"`
+		QOSClass          string                `json:"qosClass"`
+		ContainerStatuses []kubeContainerStatus `json:"containerStatuses"`
+	} `json:"status"`
+}
+
+// kubeContainerStatus is the kubelet's view of one container of a pod.
+// State holds one of running, waiting or terminated.
+type kubeContainerStatus struct {
+	Name         string `json:"name"`
+	Image        string `json:"image"`
+	ImageID      string `json:"imageID"`
+	ContainerID  string `json:"containerID"`
+	Ready        bool   `json:"ready"`
+	RestartCount int    `json:"restartCount"`
+	State        map[string]struct {
+		StartedAt  time.Time `json:"startedAt"`
+		FinishedAt time.Time `json:"finishedAt"`
+		ExitCode   int       `json:"exitCode"`
+		Reason     string    `json:"reason"`
+		Message    string    `json:"message"`
+	} `json:"state"`
+}
+
+// kubeContainer is a container of a pod on the node
+type kubeContainer struct {
+	pod    *kubePod
+	status kubeContainerStatus
+}
+
+// ID is the runtime's container ID, without the runtime prefix; it is
+// empty for a container that has not been created yet
+func (kc kubeContainer) ID() string {
+	_, id, _ := strings.Cut(kc.status.ContainerID, "://")
+	return id
+}
+
+// Name names the container after its pod, as the containerd runtime does
+func (kc kubeContainer) Name() string {
+	return kc.pod.Metadata.Name + "/" + kc.status.Name
+}
+
+// State maps the kubelet's container state onto Docker's: running, exited
+// or created for a container still waiting to start
+func (kc kubeContainer) State() string {
+	if _, ok := kc.status.State["running"]; ok {
+		return "running"
+	}
+	if _, ok := kc.status.State["terminated"]; ok {
+		return "exited"
+	}
+	return "created"
+}
+
+// Runtime is the container runtime the kubelet uses, from the ID's prefix
+func (kc kubeContainer) Runtime() string {
+	runtime, _, _ := strings.Cut(kc.status.ContainerID, "://")
+	return runtime
+}
+
+// kubePods lists the pods scheduled on the node, in the namespace query
+// parameter or CONTAINERSCOPE_KUBE_NAMESPACE when either is set
+func kubePods(ctx context.Context, c *gin.Context, k *kubeAPI) ([]kubePod, error) {
+	ns := c.DefaultQuery("namespace", os.Getenv("CONTAINERSCOPE_KUBE_NAMESPACE"))
+	var list struct {
+		Items []kubePod `json:"items"`
+	}
+	var err error
+	if k.kubelet != "" {
+		err = k.getJSON(ctx, "kubelet:/pods", nil, &list)
+	} else {
+		path := "/api/v1/pods"
+		if ns != "" {
+			path = "/api/v1/namespaces/" + url.PathEscape(ns) + "/pods"
+		}
+		err = k.getJSON(ctx, path, url.Values{"fieldSelector": {"spec.nodeName=" + k.node}}, &list)
+	}
+	if err != nil {
+		return nil, err
+	}
+	pods := list.Items[:0]
+	for _, pod := range list.Items {
+		if ns == "" || pod.Metadata.Namespace == ns {
+			pods = append(pods, pod)
+		}
+	}
+	return pods, nil
+}
+
+// kubeContainers flattens pods into their containers
+func kubeContainers(pods []kubePod) []kubeContainer {
+	containers := []kubeContainer{}
+	for i := range pods {
+		for _, status := range pods[i].Status.ContainerStatuses {
+			containers = append(containers, kubeContainer{pod: &pods[i], status: status})
+		}
+	}
+	return containers
+}
+
+// findKubeContainer looks a container up by ID or unique ID prefix among
+// the node's pods
+func findKubeContainer(ctx context.Context, c *gin.Context, k *kubeAPI, id string) (kubeContainer, error) {
+	pods, err := kubePods(ctx, c, k)
+	if err != nil {
+		return kubeContainer{}, err
+	}
+	var found []kubeContainer
+	for _, kc := range kubeContainers(pods) {
+		if kc.ID() == id {
+			return kc, nil
+		}
+		if id != "" && strings.HasPrefix(kc.ID(), id) {
+			found = append(found, kc)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return kubeContainer{}, errdefs.NotFound(fmt.Errorf("no such container: %s", id))
+	case 1:
+		return found[0], nil
+	}
+	return kubeContainer{}, errdefs.InvalidParameter(fmt.Errorf("container ID %s is ambiguous", id))
+}
+
+// kubeListContainers lists the containers of the pods on the node, with
+// the same core fields as the Docker listing. Only running containers are
+// included unless ?all=true.
+func kubeListContainers(c *gin.Context) {
+	ctx := c.Request.Context()
+	k, err := kubeConn()
+	if err != nil {
+		dockerError(c, "Error connecting to Kubernetes", err)
+		return
+	}
+	pods, err := kubePods(ctx, c, k)
+	if err != nil {
+		dockerError(c, "Error listing pods", err)
+		return
+	}
+
+	rows := []map[string]interface{}{}
+	for _, kc := range kubeContainers(pods) {
+		state := kc.State()
+		if c.Query("all") != "true" && state != "running" {
+			continue
+		}
+		rows = append(rows, map[string]interface{}{
+			"id":            kc.ID(),
+			"name":          kc.Name(),
+			"image":         kc.status.Image,
+			"state":         state,
+			"namespace":     kc.pod.Metadata.Namespace,
+			"pod":           kc.pod.Metadata.Name,
+			"runtime":       kc.Runtime(),
+			"labels":        kc.pod.Metadata.Labels,
+			"ready":         kc.status.Ready,
+			"restart_count": kc.status.RestartCount,
+			"created":       kc.pod.Metadata.CreationTimestamp.Unix(),
+		})
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i]["name"].(string) < rows[j]["name"].(string) })
+
+	respond(c, http.StatusOK, rows)
+}
+
+// kubeInspectContainer returns the container's status, its spec from the
+// pod and the pod it belongs to
+func kubeInspectContainer(c *gin.Context) {
+	ctx := c.Request.Context()
+	k, err := kubeConn()
+	if err != nil {
+		dockerError(c, "Error connecting to Kubernetes", err)
+		return
+	}
+	kc, err := findKubeContainer(ctx, c, k, c.Param("container_id"))
+	if err != nil {
+		dockerError(c, "Error inspecting container", err)
+		return
+	}
+	var spec map[string]interface{}
+	for _, s := range kc.pod.Spec.Containers {
+		if s["name"] == kc.status.Name {
+			spec = s
+		}
+	}
+
+	respond(c, http.StatusOK, gin.H{
+		"id":            kc.ID(),
+		"name":          kc.Name(),
+		"namespace":     kc.pod.Metadata.Namespace,
+		"image":         kc.status.Image,
+		"image_id":      kc.status.ImageID,
+		"runtime":       kc.Runtime(),
+		"state":         kc.State(),
+		"status":        kc.status.State,
+		"ready":         kc.status.Ready,
+		"restart_count": kc.status.RestartCount,
+		"spec":          spec,
+		"pod": gin.H{
+			"name":      kc.pod.Metadata.Name,
+			"uid":       kc.pod.Metadata.UID,
+			"node":      kc.pod.Spec.NodeName,
+			"phase":     kc.pod.Status.Phase,
+			"ip":        kc.pod.Status.PodIP,
+			"qos_class": kc.pod.Status.QOSClass,
+			"labels":    kc.pod.Metadata.Labels,
+			"created":   kc.pod.Metadata.CreationTimestamp,
+		},
+	})
+}
+
+// kubeContainerLogs reads a container's log through the API server or the
+// kubelet, which keep it for the container's current and previous run;
+// ?previous=true reads the run before the last restart
+func kubeContainerLogs(c *gin.Context) {
+	ctx := c.Request.Context()
+	k, err := kubeConn()
+	if err != nil {
+		dockerError(c, "Error connecting to Kubernetes", err)
+		return
+	}
+	kc, err := findKubeContainer(ctx, c, k, c.Param("container_id"))
+	if err != nil {
+		dockerError(c, "Error retrieving container logs", err)
+		return
+	}
+	q, err := parseLogQuery(c)
+	if err != nil {
+		badRequest(c, err.Error())
+		return
+	}
+	since, until := logTimeBound(q.options.Since), logTimeBound(q.options.Until)
+	lines, _ := strconv.Atoi(q.options.Tail)
+
+	// Timestamps are always asked for so until can be applied here
+	query := url.Values{"timestamps": {"true"}}
+	if !since.IsZero() {
+		query.Set("sinceTime", since.UTC().Format(time.RFC3339))
+	}
+	if lines > 0 && until.IsZero() {
+		query.Set("tailLines", strconv.Itoa(lines))
+	}
+	if c.Query("previous") == "true" {
+		query.Set("previous", "true")
+	}
+	pod, ns := url.PathEscape(kc.pod.Metadata.Name), url.PathEscape(kc.pod.Metadata.Namespace)
+	path := "/api/v1/namespaces/" + ns + "/pods/" + pod + "/log"
+	if k.kubelet != "" {
+		path = "kubelet:/containerLogs/" + ns + "/" + pod + "/" + url.PathEscape(kc.status.Name)
+	} else {
+		query.Set("container", kc.status.Name)
+	}
+	resp, err := k.get(ctx, path, query)
+	if err != nil {
+		dockerError(c, "Error retrieving container logs", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	var logLines []string
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		stamp, line, _ := strings.Cut(scanner.Text(), " ")
+		ts, err := time.Parse(time.RFC3339Nano, stamp)
+		if err != nil {
+			continue
+		}
+		if !until.IsZero() && ts.After(until) {
+			continue
+		}
+		if q.options.Timestamps {
+			line = stamp + " " + line
+		}
+		if q.grep != nil && !q.grep.MatchString(stripANSI(line)) {
+			continue
+		}
+		logLines = append(logLines, q.render(line))
+		if lines > 0 && len(logLines) > lines {
+			logLines = logLines[1:]
+		}
+	}
+
+	respond(c, http.StatusOK, formatLogs(strings.Join(logLines, "\n")))
+}
+
+// kubeContainerStats returns the kubelet's resource summary for the
+// container, along with its pod's network usage, which containers share
+func kubeContainerStats(c *gin.Context) {
+	ctx := c.Request.Context()
+	k, err := kubeConn()
+	if err != nil {
+		dockerError(c, "Error connecting to Kubernetes", err)
+		return
+	}
+	kc, err := findKubeContainer(ctx, c, k, c.Param("container_id"))
+	if err != nil {
+		dockerError(c, "Error retrieving container stats", err)
+		return
+	}
+	if kc.State() != "running" {
+		badRequest(c, "Container is not running")
+		return
+	}
+	path := "/api/v1/nodes/" + url.PathEscape(k.node) + "/proxy/stats/summary"
+	if k.kubelet != "" {
+		path = "kubelet:/stats/summary"
+	}
+	var summary struct {
+		Pods []struct {
+			PodRef struct {
+				UID string `json:"uid"`
+			} `json:"podRef"`
+			Containers []json.RawMessage `json:"containers"`
+			Network    json.RawMessage   `json:"network"`
+		} `json:"pods"`
+	}
+	if err := k.getJSON(ctx, path, nil, &summary); err != nil {
+		dockerError(c, "Error retrieving container stats", err)
+		return
+	}
+	for _, pod := range summary.Pods {
+		if pod.PodRef.UID != kc.pod.Metadata.UID {
+			continue
+		}
+		for _, metrics := range pod.Containers {
+			var cont struct {
+				Name string `json:"name"`
+				CPU  struct {
+					Time time.Time `json:"time"`
+				} `json:"cpu"`
+			}
+			if json.Unmarshal(metrics, &cont) != nil || cont.Name != kc.status.Name {
+				continue
+			}
+			respond(c, http.StatusOK, gin.H{"timestamp": cont.CPU.Time, "metrics": metrics, "network": pod.Network})
+			return
+		}
+	}
+	dockerError(c, "Error retrieving container stats", errdefs.NotFound(fmt.Errorf("the kubelet has no stats for %s yet", kc.Name())))
+}
+
+// kubeListNamespaces lists the namespaces with pods on the node
+func kubeListNamespaces(c *gin.Context) {
+	k, err := kubeConn()
+	if err != nil {
+		dockerError(c, "Error connecting to Kubernetes", err)
+		return
+	}
+	pods, err := kubePods(c.Request.Context(), c, k)
+	if err != nil {
+		dockerError(c, "Error listing pods", err)
+		return
+	}
+	seen := map[string]bool{}
+	nss := []string{}
+	for _, pod := range pods {
+		if !seen[pod.Metadata.Namespace] {
+			seen[pod.Metadata.Namespace] = true
+			nss = append(nss, pod.Metadata.Namespace)
+		}
+	}
+	sort.Strings(nss)
+
+	respond(c, http.StatusOK, nss)
+}
+
+// kubeVersion returns the API server's version and the node the agent
+// reports on
+func kubeVersion(c *gin.Context) {
+	k, err := kubeConn()
+	if err != nil {
+		dockerError(c, "Error connecting to Kubernetes", err)
+		return
+	}
+	var version map[string]interface{}
+	if err := k.getJSON(c.Request.Context(), "/version", nil, &version); err != nil {
+		dockerError(c, "Error retrieving version", err)
+		return
+	}
+
+	respond(c, http.StatusOK, gin.H{"runtime": runtimeKubernetes, "server": version, "node": k.node})
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-ldap/ldap/v3"
+)
+
+// LDAP settings. Users sign in with their directory username and password:
+// the agent finds their entry with CONTAINERSCOPE_LDAP_USER_FILTER under
+// CONTAINERSCOPE_LDAP_USER_BASE, binds as it to check the password, and
+// maps the groups in its memberOf attribute to a role through
+// CONTAINERSCOPE_LDAP_ROLES.
+var (
+	ldapURL          = os.Getenv("CONTAINERSCOPE_LDAP_URL")
+	ldapStartTLS     = os.Getenv("CONTAINERSCOPE_LDAP_STARTTLS") == "true"
+	ldapCAFile       = os.Getenv("CONTAINERSCOPE_LDAP_CA_FILE")
+	ldapBindDN       = os.Getenv("CONTAINERSCOPE_LDAP_BIND_DN")
+	ldapBindPassword = os.Getenv("CONTAINERSCOPE_LDAP_BIND_PASSWORD")
+	ldapUserBase     = os.Getenv("CONTAINERSCOPE_LDAP_USER_BASE")
+	ldapUserFilter   = envOr("CONTAINERSCOPE_LDAP_USER_FILTER", "(uid=%s)")
+	ldapGroupAttr    = envOr("CONTAINERSCOPE_LDAP_GROUP_ATTRIBUTE", "memberOf")
+	ldapDefaultRole  = os.Getenv("CONTAINERSCOPE_LDAP_DEFAULT_ROLE")
+	ldapRoles        map[string]string
+	ldapTLSConfig    *tls.Config
+)
+
+// ldapTimeout bounds connecting to the directory and each request to it
+const ldapTimeout = 10 * time.Second
+
+// ldapLoginLimit is how many sign-ins a username may attempt, as
+// CONTAINERSCOPE_LDAP_LOGIN_LIMIT, 5/m by default, so a password cannot be
+// guessed through the agent at the directory's pace
+var (
+	ldapLoginLimit    = rate{n: 5, period: time.Minute}
+	ldapLoginAttempts *rateLimiter
+)
+
+// errLDAPCredentials is returned for an unknown user or wrong password,
+// which are not told apart
+var errLDAPCredentials = errors.New("invalid username or password")
+
+func ldapEnabled() bool {
+	return ldapURL != ""
+}
+
+// loadLDAP checks the LDAP settings, parses the role mapping and loads the
+// CA that signs the directory's certificate
+func loadLDAP() error {
+	if !ldapEnabled() {
+		return nil
+	}
+	u, err := url.Parse(ldapURL)
+	if err != nil || (u.Scheme != "ldap" && u.Scheme != "ldaps") || u.Host == "" {
+		return fmt.Errorf("CONTAINERSCOPE_LDAP_URL: expected ldap://host[:port] or ldaps://host[:port], got %q", ldapURL)
+	}
+	if ldapUserBase == "" || !strings.Contains(ldapUserFilter, "%s") {
+		return errors.New("CONTAINERSCOPE_LDAP_USER_BASE is required, and CONTAINERSCOPE_LDAP_USER_FILTER must contain %s")
+	}
+	if _, err := ldap.CompileFilter(strings.ReplaceAll(ldapUserFilter, "%s", "x")); err != nil {
+		return fmt.Errorf("CONTAINERSCOPE_LDAP_USER_FILTER: %w", err)
+	}
+	if ldapDefaultRole != "" && roleRank[ldapDefaultRole] == 0 {
+		return fmt.Errorf("CONTAINERSCOPE_LDAP_DEFAULT_ROLE: unknown role %q", ldapDefaultRole)
+	}
+	roles, err := parseRoleMap("CONTAINERSCOPE_LDAP_ROLES")
+	if err != nil {
+		return err
+	}
+	// Directories compare DNs case-insensitively
+	ldapRoles = map[string]string{}
+	for group, role := range roles {
+		ldapRoles[strings.ToLower(group)] = role
+	}
+
+	ldapTLSConfig = &tls.Config{ServerName: u.Hostname(), MinVersion: tls.VersionTLS12}
+	if ldapCAFile != "" {
+		pem, err := os.ReadFile(ldapCAFile)
+		if err != nil {
+			return fmt.Errorf("CONTAINERSCOPE_LDAP_CA_FILE: %w", err)
+		}
+		ldapTLSConfig.RootCAs = x509.NewCertPool()
+		if !ldapTLSConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("CONTAINERSCOPE_LDAP_CA_FILE: no certificates in %s", ldapCAFile)
+		}
+	}
+	if u.Scheme == "ldap" && !ldapStartTLS {
+		logger.Warn("LDAP passwords are sent in the clear; use ldaps:// or CONTAINERSCOPE_LDAP_STARTTLS=true")
+	}
+	if limit := envRate("CONTAINERSCOPE_LDAP_LOGIN_LIMIT"); limit.n > 0 {
+		ldapLoginLimit = limit
+	}
+	ldapLoginAttempts = newRateLimiter(ldapLoginLimit)
+	logger.Info("LDAP sign-in enabled", "url", ldapURL, "groups", len(ldapRoles))
+	return nil
+}
+
+// ldapUser is what a successful sign-in learns about the user
+type ldapUser struct {
+	DN     string
+	Name   string
+	Email  string
+	Groups []string
+}
+
+// ldapAuthenticate checks username and password against the directory
+func ldapAuthenticate(username, password string) (ldapUser, error) {
+	var user ldapUser
+	// An empty password would be an unauthenticated bind, which servers
+	// accept for any DN
+	if username == "" || password == "" {
+		return user, errLDAPCredentials
+	}
+	conn, err := dialLDAP()
+	if err != nil {
+		return user, err
+	}
+	defer conn.Close()
+
+	if ldapBindDN != "" {
+		if err := conn.Bind(ldapBindDN, ldapBindPassword); err != nil {
+			return user, fmt.Errorf("binding as %s: %w", ldapBindDN, err)
+		}
+	}
+	// Two entries are enough to see the filter is ambiguous
+	result, err := conn.Search(ldap.NewSearchRequest(
+		ldapUserBase, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, int(ldapTimeout/time.Second), false,
+		strings.ReplaceAll(ldapUserFilter, "%s", ldap.EscapeFilter(username)),
+		[]string{"cn", "mail", ldapGroupAttr}, nil,
+	))
+	if err != nil && !(ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) && result != nil) {
+		return user, fmt.Errorf("searching for %s: %w", username, err)
+	}
+	if len(result.Entries) != 1 {
+		return user, errLDAPCredentials
+	}
+	entry := result.Entries[0]
+	if err := conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return user, errLDAPCredentials
+		}
+		return user, err
+	}
+
+	user = ldapUser{DN: entry.DN, Name: username, Groups: entry.GetEqualFoldAttributeValues(ldapGroupAttr)}
+	if mail := entry.GetEqualFoldAttributeValues("mail"); len(mail) > 0 {
+		user.Email = mail[0]
+	}
+	return user, nil
+}
+
+// dialLDAP connects to CONTAINERSCOPE_LDAP_URL, over TLS for ldaps:// or
+// after StartTLS when that is enabled
+func dialLDAP() (*ldap.Conn, error) {
+	conn, err := ldap.DialURL(ldapURL, ldap.DialWithDialer(&net.Dialer{Timeout: ldapTimeout}), ldap.DialWithTLSConfig(ldapTLSConfig))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(ldapTimeout)
+	if u, _ := url.Parse(ldapURL); u.Scheme == "ldap" && ldapStartTLS {
+		if err := conn.StartTLS(ldapTLSConfig); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("StartTLS: %w", err)
+		}
+	}
+	return conn, nil
+}
+
+// ldapLogin signs a user in with their directory credentials, setting the
+// session cookie and returning the token for clients to send as a bearer
+// token
+func ldapLogin(c *gin.Context) {
+	var req struct {
+		Username string `json:"username" binding:"required"`
+		Password string `json:"password" binding:"required"`
+	}
+	if !ldapEnabled() {
+		respondError(c, http.StatusNotFound, codeNotFound, "No directory is configured")
+		return
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		badRequest(c, "username and password are required")
+		return
+	}
+	// Directories match usernames case-insensitively
+	if ok, wait := ldapLoginAttempts.allow(strings.ToLower(req.Username)); !ok {
+		logger.Warn("LDAP sign-in attempts limited", "user", req.Username, "client_ip", c.ClientIP())
+		rejectRate(c, "ldap_login", wait)
+		return
+	}
+
+	user, err := ldapAuthenticate(req.Username, req.Password)
+	if errors.Is(err, errLDAPCredentials) {
+		logger.Warn("LDAP sign-in refused", "user", req.Username)
+		respondError(c, http.StatusUnauthorized, codeUnauthorized, "Invalid username or password")
+		return
+	} else if err != nil {
+		logger.Warn("LDAP sign-in failed", "user", req.Username, "error", err)
+		respondError(c, http.StatusBadGateway, codeUpstreamError, "The directory is unavailable")
+		return
+	}
+	groups := make([]string, len(user.Groups))
+	for i, group := range user.Groups {
+		groups[i] = strings.ToLower(group)
+	}
+	s := session{Subject: user.DN, Name: user.Name, Email: user.Email, Groups: user.Groups, Provider: "ldap"}
+	if s.Role = mapRole(ldapRoles, groups, ldapDefaultRole); s.Role == "" {
+		logger.Warn("LDAP sign-in refused, no role for groups", "user", s.Name, "groups", user.Groups)
+		respondError(c, http.StatusForbidden, codeForbidden, fmt.Sprintf("%s is not in a group with access to ContainerScope", s.Name))
+		return
+	}
+	token, err := startSession(c, s)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, codeInternal, err.Error())
+		return
+	}
+
+	respond(c, http.StatusOK, gin.H{"token": token, "expires_at": time.Now().Add(sessionTTL), "user": s.principal()})
+}
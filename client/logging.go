@@ -0,0 +1,76 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// requestIDHeader carries the request ID in both directions so callers can
+// pass their own and correlate responses with the agent's logs.
+const requestIDHeader = "X-Request-ID"
+
+// requestIDKey is the gin context key the request ID is stored under
+const requestIDKey = "request_id"
+
+var logger = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+
+// newRequestID returns a random 16 character hex ID
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// requestID reuses the caller's X-Request-ID when it looks sane, otherwise
+// generates one, and echoes it back in the response header
+func requestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(requestIDHeader)
+		if id == "" || len(id) > 64 {
+			id = newRequestID()
+		}
+		c.Set(requestIDKey, id)
+		c.Header(requestIDHeader, id)
+		c.Next()
+	}
+}
+
+// accessLog writes one structured log line per request, including any
+// errors handlers attached with c.Error
+func accessLog() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		attrs := []any{
+			slog.String("request_id", c.GetString(requestIDKey)),
+			slog.String("method", c.Request.Method),
+			slog.String("path", c.Request.URL.Path),
+			slog.String("query", c.Request.URL.RawQuery),
+			slog.Int("status", c.Writer.Status()),
+			slog.Int("bytes", c.Writer.Size()),
+			slog.Float64("latency_ms", float64(time.Since(start).Microseconds())/1000),
+			slog.String("client_ip", c.ClientIP()),
+		}
+		if id := traceID(c.Request.Context()); id != "" {
+			attrs = append(attrs, slog.String("trace_id", id))
+		}
+		level := slog.LevelInfo
+		if len(c.Errors) > 0 {
+			attrs = append(attrs, slog.String("error", c.Errors.String()))
+		}
+		if c.Writer.Status() >= http.StatusInternalServerError {
+			level = slog.LevelError
+		}
+		logger.Log(c.Request.Context(), level, "request", attrs...)
+	}
+}
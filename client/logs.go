@@ -0,0 +1,450 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	timetypes "github.com/docker/docker/api/types/time"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/gin-gonic/gin"
+)
+
+// logMaxBytes caps the log output a single request reads, so a chatty
+// container cannot exhaust the agent's memory or a client's patience
+var logMaxBytes = envInt("CONTAINERSCOPE_LOG_MAX_BYTES", 64<<20)
+
+// maxLogLine is the longest line the log reader accepts; Docker itself
+// splits lines at 16KB
+const maxLogLine = 1 << 20
+
+// logOptions reads the lines, follow, since, until and timestamps query
+// parameters. As before, lines that are missing or invalid mean none,
+// unless since is given; lines=all returns the whole log.
+func logOptions(c *gin.Context) (container.LogsOptions, error) {
+	options := container.LogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+		Follow:     c.Query("follow") == "true",
+		Timestamps: c.Query("timestamps") == "true",
+	}
+	var err error
+	now := time.Now()
+	if options.Since, err = logTime(c, "since", now); err != nil {
+		return options, err
+	}
+	if options.Until, err = logTime(c, "until", now); err != nil {
+		return options, err
+	}
+	switch lines, err := strconv.Atoi(c.Query("lines")); {
+	case c.Query("lines") == "all", c.Query("lines") == "" && options.Since != "":
+		options.Tail = "all"
+	case err != nil:
+		options.Tail = "0"
+	default:
+		options.Tail = strconv.Itoa(lines)
+	}
+	return options, nil
+}
+
+// logTime converts a since or until query parameter, given as an RFC3339
+// time, a Unix timestamp or a duration before now, into the Unix
+// timestamp Docker expects
+func logTime(c *gin.Context, name string, now time.Time) (string, error) {
+	v := c.Query(name)
+	if v == "" {
+		return "", nil
+	}
+	ts, err := timetypes.GetTimestamp(v, now)
+	if err != nil {
+		return "", fmt.Errorf("%s must be an RFC3339 time, a Unix timestamp or a duration such as 15m", name)
+	}
+	return ts, nil
+}
+
+// logTimeBound parses a timestamp made by logTime, or returns the zero
+// time for none
+func logTimeBound(ts string) time.Time {
+	if ts == "" {
+		return time.Time{}
+	}
+	sec, nsec, err := timetypes.ParseTimestamps(ts, 0)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(sec, nsec)
+}
+
+// logGrep compiles the grep query parameter, a regular expression output
+// lines must match, or returns nil when there is none
+func logGrep(c *gin.Context) (*regexp.Regexp, error) {
+	v := c.Query("grep")
+	if v == "" {
+		return nil, nil
+	}
+	re, err := regexp.Compile(v)
+	if err != nil {
+		return nil, fmt.Errorf("grep is not a valid regular expression: %v", err)
+	}
+	return re, nil
+}
+
+// logQuery is what a logs request asks for, read from its query
+// parameters
+type logQuery struct {
+	options container.LogsOptions
+	grep    *regexp.Regexp
+	limit   int64
+	// ansi is "strip" or "html" to remove or convert terminal escape
+	// sequences, or "" to pass them through
+	ansi string
+}
+
+// parseLogQuery reads all of a logs request's query parameters
+func parseLogQuery(c *gin.Context) (logQuery, error) {
+	var q logQuery
+	var err error
+	if q.options, err = logOptions(c); err != nil {
+		return q, err
+	}
+	if q.grep, err = logGrep(c); err != nil {
+		return q, err
+	}
+	if q.limit, err = logByteLimit(c); err != nil {
+		return q, err
+	}
+	q.ansi, err = logANSIMode(c)
+	return q, err
+}
+
+// logANSIMode reads strip_ansi=true, or ansi=strip or ansi=html
+func logANSIMode(c *gin.Context) (string, error) {
+	mode := c.Query("ansi")
+	if c.Query("strip_ansi") == "true" {
+		if mode != "" && mode != "strip" {
+			return "", fmt.Errorf("strip_ansi cannot be combined with ansi=%s", mode)
+		}
+		mode = "strip"
+	}
+	if mode != "" && mode != "strip" && mode != "html" {
+		return "", fmt.Errorf("ansi must be strip or html")
+	}
+	return mode, nil
+}
+
+// render applies the ANSI mode to a line of output
+func (q logQuery) render(line string) string {
+	switch q.ansi {
+	case "strip":
+		return stripANSI(line)
+	case "html":
+		return ansiToHTML(line)
+	}
+	return line
+}
+
+// logByteLimit reads the max_bytes query parameter, which may lower but
+// not raise CONTAINERSCOPE_LOG_MAX_BYTES. Following output is only
+// limited when max_bytes asks for it.
+func logByteLimit(c *gin.Context) (int64, error) {
+	v := c.Query("max_bytes")
+	if v == "" && c.Query("follow") == "true" {
+		return math.MaxInt64, nil
+	}
+	if v == "" {
+		return logMaxBytes, nil
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("max_bytes must be a positive number of bytes")
+	}
+	if n > logMaxBytes {
+		n = logMaxBytes
+	}
+	return n, nil
+}
+
+// logReader is a container's demultiplexed log output
+type logReader struct {
+	*io.PipeReader
+	raw io.ReadCloser
+}
+
+func (r logReader) Close() error {
+	r.PipeReader.Close()
+	return r.raw.Close()
+}
+
+// openLogs starts reading a container's logs. Unless the container has a
+// TTY, Docker interleaves stdout and stderr in frames, which are unpacked
+// here into plain output as it arrives.
+func openLogs(ctx context.Context, containerID string, options container.LogsOptions) (io.ReadCloser, error) {
+	inspection, err := docker(ctx).ContainerInspect(ctx, containerID)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := docker(ctx).ContainerLogs(ctx, containerID, options)
+	if err != nil {
+		return nil, err
+	}
+	if inspection.Config != nil && inspection.Config.Tty {
+		return raw, nil
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := stdcopy.StdCopy(pw, pw, raw)
+		pw.CloseWithError(err)
+	}()
+	return logReader{PipeReader: pr, raw: raw}, nil
+}
+
+// scanLogs calls fn with each line of r that matches grep, numbered by
+// its position in the output, and stops once the matching lines add up to
+// limit bytes, reporting whether output was cut off. A nil grep matches
+// every line; colour codes are ignored when matching.
+func scanLogs(r io.Reader, limit int64, grep *regexp.Regexp, fn func(n int, line string) error) (bool, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxLogLine)
+	var written int64
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if grep != nil && !grep.MatchString(stripANSI(line)) {
+			continue
+		}
+		written += int64(len(line)) + 1
+		if written > limit {
+			return true, nil
+		}
+		if err := fn(n, line); err != nil {
+			return false, err
+		}
+	}
+	return false, scanner.Err()
+}
+
+// formatLogLine numbers a line the way formatLogs does, or returns ""
+// for an empty line, which formatLogs skips
+func formatLogLine(n int, line string) string {
+	if line == "" {
+		return ""
+	}
+	return fmt.Sprintf("%d: %s\n\n", n, strings.TrimSpace(line))
+}
+
+// truncatedNotice ends output that hit the byte limit
+func truncatedNotice(limit int64) string {
+	return fmt.Sprintf("[output truncated after %d bytes]\n", limit)
+}
+
+// getContainerLogs returns line-numbered logs as a JSON string, written
+// to the response as they are read rather than collected first
+func getContainerLogs(c *gin.Context) {
+	ctx := hostContext(c)
+	q, err := parseLogQuery(c)
+	if err != nil {
+		badRequest(c, err.Error())
+		return
+	}
+	q.options.Follow = false
+	out, err := openLogs(ctx, c.Param("container_id"), q.options)
+	if err != nil {
+		dockerError(c, "Error retrieving container logs", err)
+		return
+	}
+	defer out.Close()
+
+	c.Header("Content-Type", "application/json; charset=utf-8")
+	c.Status(http.StatusOK)
+	w := bufio.NewWriter(c.Writer)
+	defer w.Flush()
+
+	// The envelope is written by hand around the escaped lines
+	w.WriteString(`{"data":"`)
+	truncated, err := scanLogs(out, q.limit, q.grep, func(n int, line string) error {
+		_, err := w.WriteString(jsonEscape(formatLogLine(n, q.render(line))))
+		return err
+	})
+	if truncated {
+		w.WriteString(jsonEscape(truncatedNotice(q.limit)))
+	}
+	if err != nil {
+		c.Error(err)
+	}
+	w.WriteString(`","error":null}`)
+}
+
+// jsonEscape returns s escaped for use inside a JSON string
+func jsonEscape(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b[1 : len(b)-1])
+}
+
+// copyLogs writes r to w line-numbered, as downloads show it, calling
+// flush after every line when it is not nil
+func copyLogs(w *bufio.Writer, r io.Reader, q logQuery, flush func() error) error {
+	truncated, err := scanLogs(r, q.limit, q.grep, func(n int, line string) error {
+		if _, err := w.WriteString(formatLogLine(n, q.render(line))); err != nil {
+			return err
+		}
+		if flush != nil {
+			return flush()
+		}
+		return nil
+	})
+	if truncated {
+		w.WriteString(truncatedNotice(q.limit))
+	}
+	return err
+}
+
+// downloadContainerLogs sends line-numbered logs as a text attachment,
+// streamed as they are read and gzipped with compress=true. With
+// follow=true new output keeps coming until the client disconnects.
+func downloadContainerLogs(c *gin.Context) {
+	ctx := hostContext(c)
+	containerID := c.Param("container_id")
+	q, err := parseLogQuery(c)
+	if err != nil {
+		badRequest(c, err.Error())
+		return
+	}
+	out, err := openLogs(ctx, containerID, q.options)
+	if err != nil {
+		dockerError(c, "Error retrieving container logs", err)
+		return
+	}
+	defer out.Close()
+
+	filename := fmt.Sprintf("container_logs_%s.txt", containerName(c))
+	contentType := "text/plain"
+	var dst io.Writer = c.Writer
+	var gz *gzip.Writer
+	if c.Query("compress") == "true" {
+		gz = gzip.NewWriter(c.Writer)
+		defer gz.Close()
+		dst = gz
+		filename += ".gz"
+		contentType = "application/gzip"
+	}
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%s", filename))
+	c.Header("Content-Type", contentType)
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Status(http.StatusOK)
+	w := bufio.NewWriter(dst)
+	defer w.Flush()
+
+	// Followers should see each line as it happens
+	var flush func() error
+	if q.options.Follow {
+		flush = func() error {
+			if err := w.Flush(); err != nil {
+				return err
+			}
+			if gz != nil {
+				if err := gz.Flush(); err != nil {
+					return err
+				}
+			}
+			c.Writer.Flush()
+			return nil
+		}
+	}
+	if err := copyLogs(w, out, q, flush); err != nil {
+		c.Error(err)
+	}
+}
+
+// logBundleRequest selects the containers for POST /logs/bundle, either
+// by ID or by label
+type logBundleRequest struct {
+	ContainerIDs []string `json:"container_ids"`
+	Label        string   `json:"label"`
+}
+
+// bundleLogs returns a zip archive with one log file per selected
+// container, for attaching to a support ticket. The logs query
+// parameters apply to every container; without lines, whole logs are
+// included up to the byte limit.
+func bundleLogs(c *gin.Context) {
+	var req logBundleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		badRequest(c, "Invalid request")
+		return
+	}
+	if (len(req.ContainerIDs) > 0) == (req.Label != "") {
+		badRequest(c, "Specify exactly one of container_ids or label")
+		return
+	}
+	q, err := parseLogQuery(c)
+	if err != nil {
+		badRequest(c, err.Error())
+		return
+	}
+	q.options.Follow = false
+	if c.Query("lines") == "" {
+		q.options.Tail = "all"
+	}
+
+	ctx := hostContext(c)
+	targets, err := resolveTargets(ctx, actionRequest{ContainerIDs: req.ContainerIDs, Label: req.Label})
+	if err != nil {
+		dockerError(c, "Error listing containers", err)
+		return
+	}
+	if len(targets) == 0 {
+		respondError(c, http.StatusNotFound, codeContainerNotFound, "No containers match the label")
+		return
+	}
+
+	filename := fmt.Sprintf("container_logs_%s.zip", time.Now().Format("20060102_150405"))
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%s", filename))
+	c.Header("Content-Type", "application/zip")
+	c.Status(http.StatusOK)
+	archive := zip.NewWriter(c.Writer)
+	defer archive.Close()
+
+	for _, id := range targets {
+		if err := addLogFile(ctx, archive, id, q); err != nil {
+			// The response has started, so the archive ends early
+			c.Error(err)
+			return
+		}
+	}
+}
+
+// addLogFile adds a container's logs to archive as <name>.log. A
+// container whose logs cannot be read gets a file saying why, so one
+// missing container does not spoil the bundle.
+func addLogFile(ctx context.Context, archive *zip.Writer, containerID string, q logQuery) error {
+	name := containerID
+	if inspection, err := docker(ctx).ContainerInspect(ctx, containerID); err == nil {
+		name = strings.TrimPrefix(inspection.Name, "/")
+	}
+	out, openErr := openLogs(ctx, containerID, q.options)
+	if openErr != nil {
+		name += ".error"
+	}
+	f, err := archive.CreateHeader(&zip.FileHeader{Name: name + ".log", Method: zip.Deflate, Modified: time.Now()})
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	defer w.Flush()
+	if openErr != nil {
+		_, err := fmt.Fprintf(w, "Error retrieving logs for %s: %v\n", containerID, openErr)
+		return err
+	}
+	defer out.Close()
+	return copyLogs(w, out, q, nil)
+}
@@ -2,33 +2,25 @@
 package main
 
 import (
-	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
-	"io"
 	"net/http"
 	"os"
-	"strconv"
 	"strings"
 	"time"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
-	"github.com/docker/docker/client"
+	"github.com/docker/docker/api/types/filters"
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
+	"golang.org/x/sync/errgroup"
 )
 
-var dockerClient *client.Client
 var hostname string
 
 func init() {
-	var err error
-	dockerClient, err = client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
-	if err != nil {
-		panic(err)
-	}
-
 	hostname = os.Getenv("HOSTNAME")
 	if hostname == "" {
 		hostname, _ = os.Hostname()
@@ -47,8 +39,10 @@ func formatLogs(logs string) string {
 	return sb.String()
 }
 
-// formatImages formats the list of images
-func formatImages(images []types.ImageSummary) []map[string]interface{} {
+// formatImages formats the list of images; usage maps image IDs to the
+// names of the containers created from them. Untagged images are skipped
+// unless includeUntagged is set.
+func formatImages(images []types.ImageSummary, usage map[string][]string, includeUntagged bool) []map[string]interface{} {
 	imageList := []map[string]interface{}{}
 	for _, image := range images {
 		var repository, tag string
@@ -67,7 +61,7 @@ func formatImages(images []types.ImageSummary) []map[string]interface{} {
 		}
 
 		// Skip images with <none> repository
-		if repository == "<none>" || repository == "" {
+		if (repository == "<none>" || repository == "") && !includeUntagged {
 			continue
 		}
 
@@ -78,13 +72,15 @@ func formatImages(images []types.ImageSummary) []map[string]interface{} {
 		}
 
 		imageInfo := map[string]interface{}{
-			"node":      hostname,
-			"id":        image.ID,
-			"name":      name[0],
+			"node":       hostname,
+			"id":         image.ID,
+			"name":       name[0],
 			"repository": repository,
-			"tag":       tag,
-			"created":   createdTime,
-			"size":      fmt.Sprintf("%.2f MB", float64(image.Size)/1024/1024),
+			"tag":        tag,
+			"created":    createdTime,
+			"size":       fmt.Sprintf("%.2f MB", float64(image.Size)/1024/1024),
+			"in_use":     len(usage[image.ID]) > 0,
+			"containers": containerNames(usage[image.ID]),
 		}
 		imageList = append(imageList, imageInfo)
 	}
@@ -92,270 +88,857 @@ func formatImages(images []types.ImageSummary) []map[string]interface{} {
 }
 
 func main() {
-	r := gin.Default()
-
-	// Enable CORS
-	r.Use(cors.Default())
+	if err := openStore(); err != nil {
+		logger.Error("opening data store", "error", err)
+		os.Exit(1)
+	}
+	if err := loadHosts(); err != nil {
+		logger.Error("configuring docker hosts", "error", err)
+		os.Exit(1)
+	}
+	if err := loadSecretKey(); err != nil {
+		logger.Error("loading secret key", "error", err)
+		os.Exit(1)
+	}
+	if err := loadTokens(); err != nil {
+		logger.Error("loading API tokens", "error", err)
+		os.Exit(1)
+	}
+	if err := loadOIDC(); err != nil {
+		logger.Error("configuring OIDC", "error", err)
+		os.Exit(1)
+	}
+	if err := loadLDAP(); err != nil {
+		logger.Error("configuring LDAP", "error", err)
+		os.Exit(1)
+	}
+	if oidcEnabled() || ldapEnabled() {
+		go pruneSessions()
+	}
+	if err := loadRedaction(); err != nil {
+		logger.Error("loading redaction rules", "error", err)
+		os.Exit(1)
+	}
+	if err := loadPortRanges(); err != nil {
+		logger.Error("loading port ranges", "error", err)
+		os.Exit(1)
+	}
+	if err := startTracing(); err != nil {
+		logger.Error("configuring tracing", "error", err)
+		os.Exit(1)
+	}
+	if err := loadIPRules(); err != nil {
+		logger.Error("loading address rules", "error", err)
+		os.Exit(1)
+	}
 
-	// List containers
-	r.GET("/containers", listContainers)
+	r := gin.New()
 
-	// Get container logs
-	r.GET("/containers/:container_id/logs", getContainerLogs)
+	// Match on the escaped path so image references such as
+	// library%2Fnginx:latest fit in a single path parameter
+	r.UseRawPath = true
 
-	// Download container logs
-	r.GET("/containers/:container_id/logs/download", downloadContainerLogs)
+	// Only believe forwarded client addresses from configured proxies
+	if err := r.SetTrustedProxies(trustedProxies); err != nil {
+		logger.Error("CONTAINERSCOPE_TRUSTED_PROXIES", "error", err)
+		os.Exit(1)
+	}
 
-	// Stop container
-	r.POST("/containers/stop", stopContainer)
+	// Structured access logs tagged with a per-request ID
+	r.Use(requestID(), accessLog(), gin.Recovery())
 
-	// Start container
-	r.POST("/containers/start", startContainer)
+	// Request counts, latency and concurrency for /internal/metrics
+	r.Use(httpMetrics())
 
-	// Restart container
-	r.POST("/containers/restart", restartContainer)
+	// A span per request when tracing is on, continuing the caller's trace
+	r.Use(traceRequests())
 
-	// Inspect container
-	r.GET("/containers/:container_id/inspect", inspectContainer)
+	// Enable CORS, letting browsers read the request ID
+	corsConfig := cors.DefaultConfig()
+	if len(corsOrigins) > 0 {
+		corsConfig.AllowOrigins = corsOrigins
+	} else {
+		corsConfig.AllowAllOrigins = true
+	}
+	corsConfig.AddAllowHeaders(requestIDHeader, "If-None-Match", idempotencyHeader, confirmationHeader, "traceparent", "tracestate")
+	corsConfig.AddExposeHeaders(requestIDHeader, totalCountHeader, "ETag", "Server-Timing", "Retry-After", "Idempotent-Replayed")
+	if err := corsConfig.Validate(); err != nil {
+		logger.Error("CONTAINERSCOPE_CORS_ORIGINS", "error", err)
+		os.Exit(1)
+	}
+	r.Use(cors.New(corsConfig))
 
-	// Container stats
-	r.GET("/containers/:container_id/stats", containerStats)
+	// Liveness, daemon readiness and build information for load balancers
+	// and orchestrators
+	r.GET("/healthz", healthz)
+	r.GET("/readyz", readyz)
+	r.GET("/version", agentVersion)
 
-	// Delete container
-	r.DELETE("/containers/delete", deleteContainer)
+	// Signing in through the identity provider or directory, for the web UI
+	authGroup := r.Group("/auth", restrictIP("api"))
+	{
+		authGroup.GET("/login", login)
+		authGroup.GET("/oidc/login", oidcLoginStart)
+		authGroup.GET("/oidc/callback", oidcCallback)
+		authGroup.POST("/ldap/login", ldapLogin)
+		authGroup.POST("/logout", logout)
+	}
 
-	// List images
-	r.GET("/images", listImages)
+	// Prometheus metrics about the agent itself
+	r.GET("/internal/metrics", restrictIP("metrics"), metricsHandler())
 
-	r.Run(":5050")
-}
+	// Agents of tunnel hosts dial in here, authenticated by their tunnel
+	// token, and open a stream to their daemon for each connection
+	tunnelGroup := r.Group("/tunnel", restrictIP("api"))
+	{
+		tunnelGroup.GET("/:name", acceptTunnel)
+		tunnelGroup.GET("/:name/streams/:id", acceptTunnelStream)
+	}
 
-func listContainers(c *gin.Context) {
-	containers, err := dockerClient.ContainerList(context.Background(), container.ListOptions{All: true})
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Error listing containers: %v", err)})
-		return
+	// Profiling and runtime stats, for the admin token only
+	debugGroup := r.Group("/debug", restrictIP("debug"), requireAdmin())
+	{
+		debugGroup.GET("/pprof/*profile", pprofHandler)
+		debugGroup.POST("/pprof/*profile", pprofHandler)
+		debugGroup.GET("/vars", debugVars)
 	}
 
-	images, err := dockerClient.ImageList(context.Background(), types.ImageListOptions{})
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Error listing images: %v", err)})
-		return
+	// Serve the containerd endpoints instead when that runtime is selected
+	// Requests target the daemon named by ?host=, or the default one
+	// Addresses outside the api and mutations rules are refused, and
+	// callers need an API token once CONTAINERSCOPE_TOKENS_FILE is set
+	// Clients over their rate limit are turned away first, and retried
+	// mutations carrying an Idempotency-Key replay their first response
+	v1 := r.Group("/api/v1", restrictIP("api", "mutations"), authenticate(), limitRate(), withTimeout(), idempotent(), runtimeDispatch(), selectHost())
+
+	// Who the caller is signed in as, and their role
+	v1.GET("/whoami", whoami)
+
+	// Configured Docker hosts
+	v1.GET("/hosts", listHosts)
+
+	// Containers and usage across the hosts, selected and grouped by their
+	// node labels
+	v1.GET("/hosts/containers", fleetContainers)
+	v1.GET("/hosts/stats", fleetStats)
+
+	// Find containers by name, image or label on every host
+	v1.GET("/search", searchContainers)
+
+	// Docker CLI contexts the hosts can be configured from
+	v1.GET("/contexts", listDockerContexts)
+
+	// Hosts advertised over mDNS, Consul or etcd
+	v1.GET("/discovery", listDiscoveredHosts)
+
+	// The replicas sharing the store, and which one leads
+	v1.GET("/cluster", clusterStatus)
+
+	// Container state changes pushed over a WebSocket
+	v1.GET("/ws/updates", containerUpdates)
+
+	// Logs of matching containers on every host, followed over a WebSocket
+	v1.GET("/ws/logs", followHostLogs)
+
+	containers := v1.Group("/containers", notFoundAs(codeContainerNotFound), resolveContainerParam())
+	{
+		// List containers
+		containers.GET("", listContainers)
+
+		// Containers in a restart loop, OOM-killed or unhealthy
+		containers.GET("/problems", containerProblems)
+
+		// Containers recently killed for running out of memory
+		containers.GET("/oom-kills", listOOMKills)
+
+		// Configuration differences between two containers
+		containers.GET("/diff", diffContainers)
+
+		// Get container logs
+		containers.GET("/:container_id/logs", getContainerLogs)
+
+		// Download container logs
+		containers.GET("/:container_id/logs/download", downloadContainerLogs)
+
+		// Stop container
+		containers.POST("/stop", stopContainer)
+
+		// Start container
+		containers.POST("/start", startContainer)
+
+		// Restart container
+		containers.POST("/restart", restartContainer)
+
+		// Inspect container
+		containers.GET("/:container_id/inspect", inspectContainer)
+
+		// Inspect several containers at once
+		containers.POST("/inspect", batchInspect)
+
+		// Environment variables, with secrets masked
+		containers.GET("/:container_id/env", containerEnv)
+
+		// Container stats
+		containers.GET("/:container_id/stats", containerStats)
+
+		// Traffic and rates per network interface
+		containers.GET("/:container_id/network", containerNetwork)
+
+		// GPUs attached to a container and its use of them
+		containers.GET("/:container_id/gpu", containerGPU)
+
+		// Container health check status and recent results
+		containers.GET("/:container_id/health", containerHealth)
+
+		// Processes running inside a container
+		containers.GET("/:container_id/top", containerTop)
+
+		// CPU and memory of each process in a container
+		containers.GET("/:container_id/processes/stats", containerProcessStats)
+
+		// Browse, download and upload files inside a container
+		containers.GET("/:container_id/files", listContainerFiles)
+		containers.GET("/:container_id/files/download", downloadContainerFiles)
+		containers.POST("/:container_id/files", uploadContainerFiles)
+
+		// Export a container filesystem as tar
+		containers.GET("/:container_id/export", exportContainer)
+
+		// Pull the container's image and recreate it if it changed
+		containers.POST("/:container_id/redeploy", redeployContainer)
+
+		// Replace a container with one running a different image
+		containers.POST("/:container_id/recreate", recreateWithImage)
+
+		// Start the new image next to the old container, check it, then swap
+		containers.POST("/:container_id/bluegreen", blueGreenSwap)
+
+		// Move a container and its volumes to another host
+		containers.POST("/:container_id/migrate", migrateContainer)
+
+		// DNS, TCP and ping checks from inside a container's network
+		containers.POST("/:container_id/diagnose", diagnoseContainer)
+
+		// Capture a container's traffic to a pcap file, for admins only
+		containers.POST("/:container_id/capture", requireAdmin(), captureContainer)
+
+		// Equivalent docker run command and compose file for a container
+		containers.GET("/:container_id/runcommand", containerRunCommand)
+		containers.GET("/:container_id/compose", containerCompose)
+
+		// How a container differs from its service in a stack's compose file
+		containers.GET("/:container_id/drift", getContainerDrift)
+
+		// Preview a delete and get its confirmation token
+		containers.GET("/delete/preview", previewDelete)
+
+		// Delete container
+		containers.DELETE("/delete", deleteContainer)
+
+		// Preview a prune and get its confirmation token
+		containers.GET("/prune/preview", previewPrune)
+
+		// Remove stopped containers
+		containers.POST("/prune", pruneContainers)
 	}
 
-	imageMap := make(map[string]string)
-	for _, img := range images {
-		if len(img.RepoTags) > 0 {
-			imageMap[img.ID] = img.RepoTags[0]
-		} else {
-			imageMap[img.ID] = ""
-		}
+	images := v1.Group("/images", notFoundAs(codeImageNotFound))
+	{
+		// List images
+		images.GET("", listImages)
+
+		// Import a filesystem tar as an image
+		images.POST("/import", importImage)
+
+		// Tag an image with a new reference
+		images.POST("/tag", tagImage)
+
+		// Image layers and metadata
+		images.GET("/:image_id/history", imageHistory)
+		images.GET("/:image_id/inspect", inspectImage)
+
+		// Build an image from a Dockerfile or tar context
+		images.POST("/build", buildImage)
+
+		// Save images to and load them from tar archives
+		images.GET("/:image_id/save", saveImage)
+		images.POST("/load", loadImage)
+
+		// Containers created from an image
+		images.GET("/:image_id/containers", imageContainers)
+
+		// Search Docker Hub for images to deploy
+		images.GET("/search", searchImages)
+
+		// Pull and push with stored registry credentials
+		images.POST("/pull", imagePull)
+		images.POST("/push", imagePush)
+
+		// Compare local images with their registry tags
+		images.GET("/update-check", imagesUpdateCheck)
+		images.GET("/:image_id/update-check", imageUpdateCheck)
 	}
 
-	containerList := []map[string]interface{}{}
-	for _, cont := range containers {
-		portsInfo := []string{}
-		for port, bindings := range cont.Ports {
-			if len(bindings) > 0 {
-				externalPort := bindings[0].HostPort
-				internalPort := strconv.Itoa(int(port.Int()))
-				portsInfo = append(portsInfo, fmt.Sprintf("%s:%s", externalPort, internalPort))
-			}
-		}
+	volumes := v1.Group("/volumes", notFoundAs(codeVolumeNotFound))
+	{
+		// Volumes with their disk usage, and those no container uses
+		volumes.GET("", listVolumes)
+		volumes.GET("/orphans", listOrphanVolumes)
 
-		containerInfo := map[string]interface{}{
-			"node":    hostname,
-			"name":    cont.Names[0][1:], // Remove leading '/'
-			"id":      cont.ID[:10],      // Short ID
-			"running": cont.State == "running",
-			"ports":   portsInfo,
-			"image":   imageMap[cont.ImageID],
-		}
-		containerList = append(containerList, containerInfo)
+		// Back a volume up to a tar archive and restore it from one
+		volumes.POST("/:name/backup", backupVolume)
+		volumes.POST("/:name/restore", restoreVolume)
+
+		// Browse, preview and download the files in a volume, and upload
+		// when CONTAINERSCOPE_VOLUME_WRITE allows it
+		volumes.GET("/:name/files", listVolumeFiles)
+		volumes.GET("/:name/files/preview", previewVolumeFile)
+		volumes.GET("/:name/files/download", downloadVolumeFiles)
+		volumes.POST("/:name/files", uploadVolumeFiles)
 	}
 
-	c.JSON(http.StatusOK, containerList)
-}
+	networks := v1.Group("/networks")
+	{
+		// Networks and the containers attached to them, as a graph
+		networks.GET("/topology", networkTopology)
+	}
 
-func getContainerLogs(c *gin.Context) {
-	containerID := c.Param("container_id")
-	linesStr := c.Query("lines")
-	var lines int
-	if linesStr != "" {
-		var err error
-		lines, err = strconv.Atoi(linesStr)
-		if err != nil {
-			lines = 0
-		}
+	system := v1.Group("/system")
+	{
+		// Daemon info, versions and disk usage
+		system.GET("/info", systemInfo)
+		system.GET("/version", systemVersion)
+		system.GET("/df", systemDiskUsage)
 	}
 
-	options := container.LogsOptions{
-		ShowStdout: true,
-		ShowStderr: true,
-		Tail:       fmt.Sprintf("%d", lines),
+	projects := v1.Group("/projects")
+	{
+		// Compose projects and project-wide actions
+		projects.GET("", listProjects)
+		projects.POST("/:project/start", startProject)
+		projects.POST("/:project/stop", stopProject)
+		projects.POST("/:project/restart", restartProject)
 	}
 
-	out, err := dockerClient.ContainerLogs(context.Background(), containerID, options)
-	if err != nil {
-		c.String(http.StatusInternalServerError, "Error retrieving container logs: %v", err)
-		return
+	groups := v1.Group("/groups")
+	{
+		// Restart a label selector's or project's containers one at a
+		// time, waiting for each to be healthy
+		groups.POST("/restart", rollingRestart)
 	}
-	defer out.Close()
 
-	logBytes, err := io.ReadAll(out)
+	stacks := v1.Group("/stacks")
+	{
+		// Compose stacks deployed through the agent
+		stacks.GET("", listStacks)
+		stacks.POST("", createStack)
+		stacks.GET("/:stack", getStack)
+		stacks.PUT("/:stack", updateStack)
+		stacks.DELETE("/:stack", deleteStack)
+
+		// How a stack's containers differ from its compose file
+		stacks.GET("/:stack/drift", getStackDrift)
+	}
+
+	// GraphQL queries over containers, images, stats and hosts
+	v1.GET("/graphql", graphqlQuery)
+	v1.POST("/graphql", graphqlQuery)
+
+	// containerd or Kubernetes namespaces
+	v1.GET("/namespaces", requireRuntime(runtimeContainerd), containerdListNamespaces)
+
+	// Whether the daemon is in a swarm
+	v1.GET("/swarm", swarmStatus)
+
+	swarmGroup := v1.Group("/swarm", swarmManager(), notFoundAs(codeNotFound))
+	{
+		// Swarm services, their tasks, and nodes
+		swarmGroup.GET("/services", listServices)
+		swarmGroup.GET("/services/:service_id", inspectService)
+		swarmGroup.GET("/services/:service_id/tasks", serviceTasks)
+		swarmGroup.POST("/services/:service_id/scale", scaleService)
+		swarmGroup.POST("/services/:service_id/update", updateService)
+		swarmGroup.GET("/nodes", listNodes)
+
+		// Secrets and configs; values are write-only
+		swarmGroup.GET("/secrets", listSecrets)
+		swarmGroup.POST("/secrets", createSecret)
+		swarmGroup.DELETE("/secrets/:secret_id", deleteSecret)
+		swarmGroup.GET("/configs", listConfigs)
+		swarmGroup.POST("/configs", createConfig)
+		swarmGroup.DELETE("/configs/:config_id", deleteConfig)
+	}
+
+	logs := v1.Group("/logs")
+	{
+		// Zip of several containers' logs
+		logs.POST("/bundle", bundleLogs)
+		// Several containers' logs merged by time
+		logs.GET("/aggregate", aggregateLogs)
+	}
+
+	eventsGroup := v1.Group("/events")
+	{
+		// Stored container events
+		eventsGroup.GET("/history", eventHistory)
+	}
+
+	updates := v1.Group("/updates")
+	{
+		// Automatic update status and per-container policies
+		updates.GET("", updateStatus)
+		updates.PUT("/policies/:container", setPolicy(updatePolicyBucket))
+		updates.DELETE("/policies/:container", deletePolicy(updatePolicyBucket, "Update policy deleted successfully"))
+	}
+
+	autohealGroup := v1.Group("/autoheal")
+	{
+		// Autoheal settings, recent restarts and per-container policies
+		autohealGroup.GET("", autohealStatus)
+		autohealGroup.PUT("/policies/:container", setPolicy(autohealPolicyBucket))
+		autohealGroup.DELETE("/policies/:container", deletePolicy(autohealPolicyBucket, "Autoheal policy deleted successfully"))
+	}
+
+	quarantine := v1.Group("/quarantine")
+	{
+		// Deleted containers kept for CONTAINERSCOPE_QUARANTINE_RETENTION
+		quarantine.GET("", listQuarantine)
+		quarantine.POST("/:container_id/restore", restoreContainer)
+		quarantine.DELETE("/:container_id", purgeContainer)
+	}
+
+	webhooksGroup := v1.Group("/webhooks")
+	{
+		// Webhook subscriptions to container, image and autoheal events
+		webhooksGroup.GET("", listWebhooks)
+		webhooksGroup.POST("", createWebhook)
+		webhooksGroup.GET("/:id", getWebhook)
+		webhooksGroup.PUT("/:id", updateWebhook)
+		webhooksGroup.DELETE("/:id", deleteWebhook)
+		webhooksGroup.GET("/:id/deliveries", listWebhookDeliveries)
+		// Send a test event
+		webhooksGroup.POST("/:id/test", testWebhook)
+	}
+
+	registries := v1.Group("/registries")
+	{
+		// Registry credentials for pulls, pushes and update checks;
+		// passwords and tokens are write-only
+		registries.GET("", listRegistries)
+		registries.POST("", createRegistry)
+		registries.GET("/:name", getRegistry)
+		registries.PUT("/:name", updateRegistry)
+		registries.DELETE("/:name", deleteRegistry)
+		// Browse a repository's tags; the repository may contain slashes
+		registries.GET("/:name/repos/*repo", listRegistryTags)
+	}
+
+	schedules := v1.Group("/schedules")
+	{
+		// Cron-style maintenance tasks and their recorded runs
+		schedules.GET("", listSchedules)
+		schedules.POST("", createSchedule)
+		schedules.GET("/:id", getSchedule)
+		schedules.PUT("/:id", updateSchedule)
+		schedules.DELETE("/:id", deleteSchedule)
+		schedules.GET("/:id/runs", listScheduleRuns)
+		// Run a schedule now
+		schedules.POST("/:id/run", runScheduleNow)
+	}
+
+	templates := v1.Group("/templates")
+	{
+		// Parameterized container definitions
+		templates.GET("", listTemplates)
+		templates.POST("", createTemplate)
+		templates.GET("/:id", getTemplate)
+		templates.PUT("/:id", updateTemplate)
+		templates.DELETE("/:id", deleteTemplate)
+		// Create and start a container from a template
+		templates.POST("/:id/deploy", deployTemplate)
+	}
+
+	node := v1.Group("/node")
+	{
+		// Host CPU, memory, disk and uptime
+		node.GET("/stats", nodeStats)
+
+		// NVIDIA GPUs and the containers using them
+		node.GET("/gpus", nodeGPUs)
+
+		// Published host ports, who holds them and how full the ranges are
+		node.GET("/ports", nodePorts)
+
+		// Bind mounts and named volumes, and the containers using each
+		node.GET("/mounts", nodeMounts)
+	}
+
+	// API description and interactive docs
+	r.GET("/openapi.json", openAPIJSON)
+	r.GET("/docs", swaggerUI)
+	r.StaticFS("/docs/assets", swaggerUIAssets())
+
+	// Web UI
+	r.GET("/", uiIndex)
+	r.StaticFS("/assets", uiAssets())
+
+	// Refuse to start with an endpoint the spec does not describe
+	missing, err := missingFromSpec(r.Routes())
 	if err != nil {
-		c.String(http.StatusInternalServerError, "Error reading container logs: %v", err)
-		return
+		logger.Error("reading openapi.json", "error", err)
+		os.Exit(1)
+	}
+	if len(missing) > 0 {
+		logger.Error("routes missing from openapi.json", "routes", missing)
+		os.Exit(1)
+	}
+
+	if runtimeName == runtimeDocker {
+		startWatchdog()
+		startEventBuses()
+		startListCache()
+		startTunnel()
+		startAdvertising()
+		startStatsCollector()
+		if err := checkStatsExport(); err != nil {
+			logger.Error("exporting container stats", "error", err)
+			os.Exit(1)
+		}
+		// Jobs that act on containers or record and send what happens run
+		// on one replica when several share the store
+		runAsLeader(func(ctx context.Context) {
+			if err := startStatsExport(ctx); err != nil {
+				logger.Error("exporting container stats", "error", err)
+			}
+			startEventHistory(ctx)
+			startOOMTracker(ctx)
+			startLogForwarding(ctx)
+			startUpdater(ctx)
+			startScheduler(ctx)
+			startAutoheal(ctx)
+			startWebhooks(ctx)
+			startQuarantineReaper(ctx)
+		})
 	}
 
-	formattedLogs := formatLogs(string(logBytes))
-	c.String(http.StatusOK, formattedLogs)
+	r.Run(":5050")
 }
 
-func downloadContainerLogs(c *gin.Context) {
-	containerID := c.Param("container_id")
-	linesStr := c.Query("lines")
-	var lines int
-	if linesStr != "" {
-		var err error
-		lines, err = strconv.Atoi(linesStr)
-		if err != nil {
-			lines = 0
+// containerStatuses are the values Docker accepts for the status filter
+var containerStatuses = map[string]bool{
+	"created": true, "restarting": true, "running": true, "removing": true,
+	"paused": true, "exited": true, "dead": true,
+}
+
+// containerFilters translates the list query parameters into Docker
+// filters so the daemon does the filtering
+func containerFilters(c *gin.Context) (filters.Args, error) {
+	args := filters.NewArgs()
+	for _, status := range c.QueryArray("status") {
+		if !containerStatuses[status] {
+			return args, fmt.Errorf("invalid status %q", status)
 		}
+		args.Add("status", status)
 	}
+	for _, name := range c.QueryArray("name") {
+		args.Add("name", name)
+	}
+	for _, image := range c.QueryArray("image") {
+		args.Add("ancestor", image)
+	}
+	for _, label := range c.QueryArray("label") {
+		if label == "" || strings.HasPrefix(label, "=") {
+			return args, fmt.Errorf("invalid label %q, expected key or key=value", label)
+		}
+		args.Add("label", label)
+	}
+	return scopeFilters(c.Request.Context(), args), nil
+}
 
-	options := container.LogsOptions{
-		ShowStdout: true,
-		ShowStderr: true,
-		Tail:       fmt.Sprintf("%d", lines),
+// formatPort renders a published port as public:private
+func formatPort(port types.Port) string {
+	return fmt.Sprintf("%d:%d", port.PublicPort, port.PrivatePort)
+}
+
+// formatPorts renders a container's published ports. A port published on
+// both IPv4 and IPv6 is listed by the daemon once per address but appears
+// here once.
+func formatPorts(cont types.Container) []string {
+	type key struct {
+		public, private uint16
+		proto           string
+	}
+	seen := map[key]bool{}
+	ports := []string{}
+	for _, port := range cont.Ports {
+		k := key{port.PublicPort, port.PrivatePort, port.Type}
+		if port.PublicPort == 0 || seen[k] {
+			continue
+		}
+		seen[k] = true
+		ports = append(ports, formatPort(port))
 	}
+	return ports
+}
 
-	out, err := dockerClient.ContainerLogs(context.Background(), containerID, options)
+func listContainers(c *gin.Context) {
+	ctx := hostContext(c)
+	listFilters, err := containerFilters(c)
 	if err != nil {
-		c.String(http.StatusInternalServerError, "Error retrieving container logs: %v", err)
+		badRequest(c, err.Error())
 		return
 	}
-	defer out.Close()
-
-	logBytes, err := io.ReadAll(out)
+	params, err := parseListParams(c, "name", "created", "size")
 	if err != nil {
-		c.String(http.StatusInternalServerError, "Error reading container logs: %v", err)
+		badRequest(c, err.Error())
 		return
 	}
 
-	formattedLogs := formatLogs(string(logBytes))
-	filename := fmt.Sprintf("container_logs_%s.txt", containerID)
-
-	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%s", filename))
-	c.Header("Content-Type", "text/plain")
-	c.Data(http.StatusOK, "text/plain", []byte(formattedLogs))
-}
-
-func stopContainer(c *gin.Context) {
-	var req struct {
-		ContainerID string `json:"container_id"`
+	// Fetch whatever the cache cannot answer from the daemon, concurrently.
+	// Sizes are expensive for the daemon to compute, so only ask when
+	// sorting by them or showing details.
+	detail := c.Query("detail") == "true"
+	withSizes := params.sort == "size" || detail
+	containers, containersCached := cachedContainers(ctx, listFilters)
+	containersCached = containersCached && !withSizes
+	imageMap, imagesCached := cachedImageTags(ctx)
+	var containersTime, imagesTime time.Duration
+	errMsg := "Error listing containers"
+	g, gctx := errgroup.WithContext(ctx)
+	if !containersCached {
+		g.Go(func() error {
+			start := time.Now()
+			listOptions := container.ListOptions{All: true, Filters: listFilters, Size: withSizes}
+			var err error
+			containers, err = docker(gctx).ContainerList(gctx, listOptions)
+			containersTime = time.Since(start)
+			return err
+		})
+	}
+	if !imagesCached {
+		g.Go(func() error {
+			start := time.Now()
+			images, err := docker(gctx).ImageList(gctx, types.ImageListOptions{})
+			imagesTime = time.Since(start)
+			if err != nil {
+				errMsg = "Error listing images"
+				return err
+			}
+			imageMap = imageTags(images)
+			return nil
+		})
 	}
-	if err := c.BindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+	if err := g.Wait(); err != nil {
+		dockerError(c, errMsg, err)
 		return
 	}
+	c.Header("Server-Timing", serverTiming("containers", containersTime, containersCached)+", "+serverTiming("images", imagesTime, imagesCached))
 
-	if err := dockerClient.ContainerStop(context.Background(), req.ContainerID, container.StopOptions{}); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Error stopping container: %v", err)})
-		return
+	switch params.sort {
+	case "name":
+		sortBy(params, containers, func(a, b types.Container) bool { return a.Names[0] < b.Names[0] })
+	case "created":
+		sortBy(params, containers, func(a, b types.Container) bool { return a.Created < b.Created })
+	case "size":
+		sortBy(params, containers, func(a, b types.Container) bool { return a.SizeRw < b.SizeRw })
 	}
+	containers = paginate(c, params, containers)
 
-	c.JSON(http.StatusOK, gin.H{"message": "Container stopped successfully"})
-}
-
-func startContainer(c *gin.Context) {
-	var req struct {
-		ContainerID string `json:"container_id"`
-	}
-	if err := c.BindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
-		return
+	containerList := []map[string]interface{}{}
+	for _, cont := range containers {
+		containerInfo := map[string]interface{}{
+			"node":    hostname,
+			"host":    hostFrom(ctx).Name,
+			"name":    cont.Names[0][1:], // Remove leading '/'
+			"id":      cont.ID[:10],      // Short ID
+			"full_id": cont.ID,
+			"running": cont.State == "running",
+			"ports":   formatPorts(cont),
+			"image":   imageMap[cont.ImageID],
+			"health":  healthFromStatus(cont.Status),
+			"project": cont.Labels[composeProjectLabel],
+			"service": cont.Labels[composeServiceLabel],
+		}
+		if withSizes {
+			containerInfo["size_rw"] = cont.SizeRw
+			containerInfo["size_root_fs"] = cont.SizeRootFs
+		}
+		containerList = append(containerList, containerInfo)
 	}
 
-	if err := dockerClient.ContainerStart(context.Background(), req.ContainerID, container.StartOptions{}); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Error starting container: %v", err)})
-		return
+	if detail {
+		containerList, err = addContainerDetails(ctx, containers, containerList)
+		if err != nil {
+			dockerError(c, "Error inspecting containers", err)
+			return
+		}
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Container started successfully"})
+	respondETag(c, containerList)
+}
+
+func stopContainer(c *gin.Context) {
+	runContainerAction(c, "stopped", "Error stopping container", stopAction)
+}
+
+func startContainer(c *gin.Context) {
+	runContainerAction(c, "started", "Error starting container", startAction)
 }
 
 func restartContainer(c *gin.Context) {
-	var req struct {
-		ContainerID string `json:"container_id"`
-	}
-	if err := c.BindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
-		return
+	runContainerAction(c, "restarted", "Error restarting container", restartAction)
+}
+
+// stopAction, startAction and restartAction are shared by the action
+// endpoints and scheduled tasks
+func stopAction(ctx context.Context, containerID string, req actionRequest) error {
+	if running, err := containerRunning(ctx, containerID); err == nil && !running {
+		return actionWarning("Container was already stopped")
 	}
+	return docker(ctx).ContainerStop(ctx, containerID, req.stopOptions())
+}
 
-	if err := dockerClient.ContainerRestart(context.Background(), req.ContainerID, container.StopOptions{}); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Error restarting container: %v", err)})
-		return
+func startAction(ctx context.Context, containerID string, req actionRequest) error {
+	if running, err := containerRunning(ctx, containerID); err == nil && running {
+		return actionWarning("Container was already running")
 	}
+	return docker(ctx).ContainerStart(ctx, containerID, container.StartOptions{})
+}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Container restarted successfully"})
+func restartAction(ctx context.Context, containerID string, req actionRequest) error {
+	return docker(ctx).ContainerRestart(ctx, containerID, req.stopOptions())
 }
 
+// inspectContainer returns Docker's inspect output. ?size=true adds the
+// writable layer's size and the container's total size as SizeRw and
+// SizeRootFs, which the daemon takes a while to compute. The redaction rules
+// for the caller's role apply unless an admin asks for ?reveal=true.
 func inspectContainer(c *gin.Context) {
+	ctx := hostContext(c)
 	containerID := c.Param("container_id")
-	inspection, _, err := dockerClient.ContainerInspectWithRaw(context.Background(), containerID, false)
+	reveal, ok := wantsReveal(c)
+	if !ok {
+		return
+	}
+	inspection, _, err := docker(ctx).ContainerInspectWithRaw(ctx, containerID, c.Query("size") == "true")
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Error inspecting container: %v", err)})
+		dockerError(c, "Error inspecting container", err)
 		return
 	}
+	if !reveal {
+		redactInspection(&inspection, callerRole(c))
+	}
 
-	c.JSON(http.StatusOK, inspection)
+	respond(c, http.StatusOK, inspection)
 }
 
 func containerStats(c *gin.Context) {
+	ctx := hostContext(c)
 	containerID := c.Param("container_id")
-	stats, err := dockerClient.ContainerStatsOneShot(context.Background(), containerID)
+	stats, err := docker(ctx).ContainerStatsOneShot(ctx, containerID)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Error retrieving container stats: %v", err)})
+		dockerError(c, "Error retrieving container stats", err)
 		return
 	}
 	defer stats.Body.Close()
 
-	var buf bytes.Buffer
-	_, err = io.Copy(&buf, stats.Body)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Error reading container stats: %v", err)})
+	var raw json.RawMessage
+	if err := json.NewDecoder(stats.Body).Decode(&raw); err != nil {
+		dockerError(c, "Error reading container stats", err)
 		return
 	}
 
-	c.Data(http.StatusOK, "application/json", buf.Bytes())
+	respond(c, http.StatusOK, raw)
 }
 
-func deleteContainer(c *gin.Context) {
-	var req struct {
-		ContainerID string `json:"container_id"`
-	}
-	if err := c.BindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+// containerNetwork reports a container's traffic per network interface,
+// with rates from the background collector's last two samples. A container
+// the collector has not reached yet is sampled now, without rates.
+func containerNetwork(c *gin.Context) {
+	ctx := hostContext(c)
+	containerID := c.Param("container_id")
+	if v, ok := c.Get(resolvedContainerKey); ok && v.(types.Container).State != "running" {
+		respondError(c, http.StatusConflict, codeConflict, "Container is not running")
 		return
 	}
+	sample, ok := collectedSample(ctx, containerID)
+	if !ok {
+		stats, err := sampleStats(ctx, containerID)
+		if err != nil {
+			dockerError(c, "Error retrieving container stats", err)
+			return
+		}
+		sample = statsSample{Stats: stats, Network: networkTraffic(stats, nil), BlockIO: blockTraffic(stats, nil)}
+	}
+	rx, tx := networkRates(sample.Network)
+	respond(c, http.StatusOK, gin.H{
+		"container":           containerID,
+		"name":                containerName(c),
+		"sampled_at":          sample.Stats.Read,
+		"rx_bytes_per_second": rx,
+		"tx_bytes_per_second": tx,
+		"interfaces":          sample.Network,
+	})
+}
 
-	if err := dockerClient.ContainerRemove(context.Background(), req.ContainerID, container.RemoveOptions{Force: true}); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Error deleting container: %v", err)})
+func deleteContainer(c *gin.Context) {
+	if !confirmDelete(c) {
 		return
 	}
-
-	c.JSON(http.StatusOK, gin.H{"message": "Container deleted successfully"})
+	runContainerAction(c, "deleted", "Error deleting container", removeContainer)
 }
 
 func listImages(c *gin.Context) {
-	images, err := dockerClient.ImageList(context.Background(), types.ImageListOptions{})
+	ctx := hostContext(c)
+	params, err := parseListParams(c, "name", "created", "size")
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Error listing images: %v", err)})
+		badRequest(c, err.Error())
 		return
 	}
 
-	formattedImages := formatImages(images)
-	c.JSON(http.StatusOK, formattedImages)
+	// ?dangling=true lists only untagged images, ?all=true adds them to the
+	// tagged ones
+	dangling := c.Query("dangling") == "true"
+	includeUntagged := dangling || c.Query("all") == "true"
+	listOptions := types.ImageListOptions{}
+	if dangling {
+		listOptions.Filters = filters.NewArgs(filters.Arg("dangling", "true"))
+	}
+
+	images, cached := cachedImages(ctx)
+	if cached && dangling {
+		images = danglingImages(images)
+	} else if !cached {
+		images, err = docker(ctx).ImageList(ctx, listOptions)
+		if err != nil {
+			dockerError(c, "Error listing images", err)
+			return
+		}
+	}
+
+	switch params.sort {
+	case "name":
+		sortBy(params, images, func(a, b types.ImageSummary) bool { return firstTag(a) < firstTag(b) })
+	case "created":
+		sortBy(params, images, func(a, b types.ImageSummary) bool { return a.Created < b.Created })
+	case "size":
+		sortBy(params, images, func(a, b types.ImageSummary) bool { return a.Size < b.Size })
+	}
+
+	usage, err := imageUsage(ctx)
+	if err != nil {
+		dockerError(c, "Error listing containers", err)
+		return
+	}
+
+	formattedImages := paginate(c, params, formatImages(images, usage, includeUntagged))
+	respondETag(c, formattedImages)
+}
+
+// firstTag returns the image's first repo tag, or "" when it is untagged
+func firstTag(image types.ImageSummary) string {
+	if len(image.RepoTags) > 0 {
+		return image.RepoTags[0]
+	}
+	return ""
 }
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics about the agent itself, served at /internal/metrics. Routes are
+// labelled by pattern and Docker calls by normalised endpoint to keep the
+// number of series bounded.
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "containerscope_http_requests_total",
+		Help: "HTTP requests served, by method, route and status.",
+	}, []string{"method", "route", "status"})
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "containerscope_http_request_duration_seconds",
+		Help:    "Time to serve HTTP requests, by method and route.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route"})
+	httpInFlight = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "containerscope_http_requests_in_flight",
+		Help: "HTTP requests currently being served.",
+	})
+	apiErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "containerscope_api_errors_total",
+		Help: "Error responses, by error code.",
+	}, []string{"code"})
+	dockerDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "containerscope_docker_request_duration_seconds",
+		Help:    "Time until the Docker daemon answered, by host, method and endpoint.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"host", "method", "endpoint"})
+	dockerErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "containerscope_docker_request_errors_total",
+		Help: "Docker API calls that failed or returned an error status, by host and endpoint.",
+	}, []string{"host", "endpoint"})
+	forwardQueued = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "containerscope_log_forward_queued",
+		Help: "Log lines waiting to be forwarded.",
+	})
+	forwardSent = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "containerscope_log_forward_sent_total",
+		Help: "Log lines delivered to the log forwarding sink.",
+	})
+	forwardDropped = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "containerscope_log_forward_dropped_total",
+		Help: "Log lines dropped because the queue was full or the sink kept failing.",
+	})
+	autohealActions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "containerscope_autoheal_actions_total",
+		Help: "Autoheal restarts of unhealthy containers, by host and result: restarted, failed or gave_up.",
+	}, []string{"host", "result"})
+	rateLimited = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "containerscope_rate_limited_total",
+		Help: "Requests rejected with 429, by the limit they exceeded: general, expensive or ldap_login.",
+	}, []string{"limit"})
+	ipDenied = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "containerscope_ip_denied_total",
+		Help: "Requests refused by the address rules, by route group.",
+	}, []string{"group"})
+	webhookDeliveries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "containerscope_webhook_deliveries_total",
+		Help: "Webhook deliveries, by result: success or failed after every attempt.",
+	}, []string{"result"})
+)
+
+// httpMetrics records the count, latency and concurrency of requests
+func httpMetrics() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		httpInFlight.Inc()
+		start := time.Now()
+		c.Next()
+		httpInFlight.Dec()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		httpDuration.WithLabelValues(c.Request.Method, route).Observe(time.Since(start).Seconds())
+		httpRequests.WithLabelValues(c.Request.Method, route, strconv.Itoa(c.Writer.Status())).Inc()
+	}
+}
+
+// serverTiming formats one Server-Timing header entry, marking work the
+// cache answered instead of timing it
+func serverTiming(name string, d time.Duration, cached bool) string {
+	if cached {
+		return name + `;desc="cache"`
+	}
+	return fmt.Sprintf("%s;dur=%.1f", name, float64(d.Microseconds())/1000)
+}
+
+// metricsHandler serves the agent's metrics in the Prometheus text format
+func metricsHandler() gin.HandlerFunc {
+	return gin.WrapH(promhttp.Handler())
+}
+
+// dockerTransport times and traces every request a Docker client sends
+type dockerTransport struct {
+	host string
+	next http.RoundTripper
+}
+
+func (t *dockerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	endpoint := dockerEndpoint(req.URL.Path)
+	req, span := startDockerSpan(req, t.host, endpoint)
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	endDockerSpan(span, resp, err)
+	dockerDuration.WithLabelValues(t.host, req.Method, endpoint).Observe(time.Since(start).Seconds())
+	if err != nil || resp.StatusCode >= http.StatusBadRequest {
+		dockerErrors.WithLabelValues(t.host, endpoint).Inc()
+	}
+	return resp, err
+}
+
+// apiVersionPrefix matches the /v1.44 prefix of versioned Docker API paths
+var apiVersionPrefix = regexp.MustCompile(`^/v[0-9.]+`)
+
+// dockerStaticPaths are the second path segments that name an operation
+// rather than an object, as in /containers/json or /images/create
+var dockerStaticPaths = map[string]bool{
+	"json": true, "create": true, "prune": true, "load": true, "get": true,
+	"search": true, "import": true,
+}
+
+// dockerEndpoint reduces a Docker API path to its shape, replacing IDs and
+// names, so /v1.44/containers/3f2a/logs becomes containers/{id}/logs
+func dockerEndpoint(path string) string {
+	path = strings.Trim(apiVersionPrefix.ReplaceAllString(path, ""), "/")
+	parts := strings.Split(path, "/")
+	switch {
+	case len(parts) == 1:
+		return parts[0]
+	case len(parts) == 2 && dockerStaticPaths[parts[1]]:
+		return path
+	case len(parts) == 2:
+		return parts[0] + "/{id}"
+	}
+	return parts[0] + "/{id}/" + parts[len(parts)-1]
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/api/types/volume"
+	"github.com/docker/docker/errdefs"
+	"github.com/gin-gonic/gin"
+)
+
+// migrateImageRepo is the repository committed containers are tagged in
+// while they are moved to another host
+const migrateImageRepo = "containerscope-migrate"
+
+// migrateRequest is the optional body of POST /containers/:id/migrate
+type migrateRequest struct {
+	// Commit moves the container's filesystem changes along with it by
+	// committing it to an image first
+	Commit bool `json:"commit"`
+	// Volumes copies the contents of its named volumes; nil copies them
+	Volumes *bool `json:"volumes"`
+	// RemoveSource removes the old container once the new one is up;
+	// otherwise it is left stopped with its restart policy cleared
+	RemoveSource bool `json:"remove_source"`
+}
+
+// migration holds what is known about a container being moved and the
+// hosts it is moved between
+type migration struct {
+	source, target context.Context
+	old            types.ContainerJSON
+	name           string
+	// volumes are the named volumes copied, by mount destination
+	volumes  map[string]string
+	warnings []string
+}
+
+// transferImage copies an image from the source host to the target with
+// save and load, so images that were built locally or come from a
+// registry the target cannot reach move too
+func (m *migration) transferImage(ref string) error {
+	archive, err := docker(m.source).ImageSave(m.source, []string{ref})
+	if err != nil {
+		return fmt.Errorf("saving image %s: %w", ref, err)
+	}
+	defer archive.Close()
+	resp, err := docker(m.target).ImageLoad(m.target, archive, true)
+	if err != nil {
+		return fmt.Errorf("loading image %s: %w", ref, err)
+	}
+	defer resp.Body.Close()
+	if _, err := readJSONMessages(resp.Body); err != nil {
+		return fmt.Errorf("loading image %s: %w", ref, err)
+	}
+	return nil
+}
+
+// checkTarget finds what would stop the container from being created on
+// the target before anything is stopped: a container with its name, a
+// volume it would overwrite, or a network that does not exist there
+func (m *migration) checkTarget(hostConfig *container.HostConfig, networks []string, copyVolumes bool) error {
+	if _, err := docker(m.target).ContainerInspect(m.target, m.name); err == nil {
+		return errdefs.Conflict(fmt.Errorf("a container named %s already exists on the target", m.name))
+	} else if !errdefs.IsNotFound(err) {
+		return err
+	}
+	for _, mnt := range m.old.Mounts {
+		switch mnt.Type {
+		case mount.TypeVolume:
+			if !copyVolumes {
+				continue
+			}
+			if _, err := docker(m.target).VolumeInspect(m.target, mnt.Name); err == nil {
+				return errdefs.Conflict(fmt.Errorf("volume %s already exists on the target", mnt.Name))
+			} else if !errdefs.IsNotFound(err) {
+				return err
+			}
+			m.volumes[mnt.Destination] = mnt.Name
+		case mount.TypeBind:
+			m.warnings = append(m.warnings, fmt.Sprintf("%s is bind mounted from %s, which is not copied", mnt.Destination, mnt.Source))
+		}
+	}
+	for _, name := range networks {
+		if _, err := docker(m.target).NetworkInspect(m.target, name, types.NetworkInspectOptions{}); errdefs.IsNotFound(err) {
+			return errdefs.Conflict(fmt.Errorf("network %s does not exist on the target", name))
+		} else if err != nil {
+			return err
+		}
+	}
+	return checkPortConflicts(m.target, hostConfig, "")
+}
+
+// createVolumes creates the volumes to copy on the target with the
+// source's driver, options and labels
+func (m *migration) createVolumes() ([]string, error) {
+	created := []string{}
+	for _, name := range m.volumes {
+		vol, err := docker(m.source).VolumeInspect(m.source, name)
+		if err != nil {
+			return created, fmt.Errorf("inspecting volume %s: %w", name, err)
+		}
+		if _, err := docker(m.target).VolumeCreate(m.target, volume.CreateOptions{
+			Name:       vol.Name,
+			Driver:     vol.Driver,
+			DriverOpts: vol.Options,
+			Labels:     vol.Labels,
+		}); err != nil {
+			return created, fmt.Errorf("creating volume %s: %w", name, err)
+		}
+		created = append(created, name)
+	}
+	return created, nil
+}
+
+// copyVolumes copies each volume's contents from the stopped old container
+// into the new one, which is created but not yet started
+func (m *migration) copyVolumes(newID string) error {
+	for dest, name := range m.volumes {
+		reader, _, err := docker(m.source).CopyFromContainer(m.source, m.old.ID, dest)
+		if err != nil {
+			return fmt.Errorf("reading volume %s: %w", name, err)
+		}
+		// The archive's top entry is named after the mount point, so it is
+		// unpacked into the mount point's parent
+		err = docker(m.target).CopyToContainer(m.target, newID, path.Dir(dest), reader, types.CopyToContainerOptions{})
+		reader.Close()
+		if err != nil {
+			return fmt.Errorf("writing volume %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// migrateContainer moves a container from the selected host to the one
+// named by ?target_node=. The container is stopped, its image (or, with
+// commit, a commit of the container) is copied over unless the target has
+// it, its named volumes are recreated there and filled from the source,
+// and a container with the same name and configuration is created and
+// started if the old one was running. Anything that would clash on the
+// target fails the request with 409 before the container is stopped. If
+// a later step fails, what was created on the target is removed and the
+// old container is started again.
+func migrateContainer(c *gin.Context) {
+	targetName := c.Query("target_node")
+	if targetName == "" {
+		badRequest(c, "target_node is required")
+		return
+	}
+	targetHost, ok := dockerHosts[targetName]
+	if !ok {
+		respondError(c, http.StatusNotFound, codeHostNotFound, fmt.Sprintf("Host %s is not configured", targetName))
+		return
+	}
+	ctx := hostContext(c)
+	if targetHost == hostFrom(ctx) {
+		badRequest(c, "target_node must be another host")
+		return
+	}
+	var req migrateRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			badRequest(c, "Invalid request")
+			return
+		}
+	}
+
+	recreateMu.Lock()
+	defer recreateMu.Unlock()
+
+	old, err := docker(ctx).ContainerInspect(ctx, c.Param("container_id"))
+	if err != nil {
+		dockerError(c, "Error inspecting container", err)
+		return
+	}
+	if mode := old.HostConfig.NetworkMode; mode.IsContainer() {
+		respondError(c, http.StatusConflict, codeConflict, "Containers sharing another container's network cannot be migrated")
+		return
+	}
+	m := &migration{
+		source:   ctx,
+		target:   withHost(c.Request.Context(), targetHost),
+		old:      old,
+		name:     strings.TrimPrefix(old.Name, "/"),
+		volumes:  map[string]string{},
+		warnings: []string{},
+	}
+	imageRef := old.Config.Image
+	config, hostConfig := replacementConfig(ctx, old, imageRef)
+	primary, extra := recreateNetworks(old)
+	networks := []string{}
+	if primary != nil {
+		for name := range primary.EndpointsConfig {
+			networks = append(networks, name)
+		}
+	}
+	for name := range extra {
+		networks = append(networks, name)
+	}
+	if err := m.checkTarget(&hostConfig, networks, req.Volumes == nil || *req.Volumes); err != nil {
+		dockerError(c, "Error migrating container", err)
+		return
+	}
+
+	wasRunning := old.State.Running
+	restart := func() {
+		if wasRunning {
+			_ = docker(ctx).ContainerStart(ctx, old.ID, container.StartOptions{})
+		}
+	}
+	if wasRunning {
+		if err := docker(ctx).ContainerStop(ctx, old.ID, container.StopOptions{}); err != nil {
+			dockerError(c, "Error stopping container", err)
+			return
+		}
+	}
+
+	// Copy the image over unless the target already has it
+	if req.Commit {
+		imageRef = fmt.Sprintf("%s/%s:%d", migrateImageRepo, m.name, time.Now().Unix())
+		if _, err := docker(ctx).ContainerCommit(ctx, old.ID, container.CommitOptions{Reference: imageRef}); err != nil {
+			restart()
+			dockerError(c, "Error committing container", err)
+			return
+		}
+		config.Image = imageRef
+		defer func() {
+			if _, err := docker(ctx).ImageRemove(ctx, imageRef, types.ImageRemoveOptions{}); err != nil {
+				logger.Warn("could not remove migration image", "image", imageRef, "error", err)
+			}
+		}()
+	}
+	if _, _, err := docker(m.target).ImageInspectWithRaw(m.target, imageRef); errdefs.IsNotFound(err) {
+		err = m.transferImage(imageRef)
+		if err != nil {
+			restart()
+			dockerError(c, "Error copying image", err)
+			return
+		}
+	} else if err != nil {
+		restart()
+		dockerError(c, "Error inspecting image on the target", err)
+		return
+	}
+
+	createdVolumes, err := m.createVolumes()
+	cleanup := func(newID string) {
+		if newID != "" {
+			_ = docker(m.target).ContainerRemove(m.target, newID, container.RemoveOptions{Force: true})
+		}
+		for _, name := range createdVolumes {
+			_ = docker(m.target).VolumeRemove(m.target, name, true)
+		}
+		restart()
+	}
+	if err != nil {
+		cleanup("")
+		dockerError(c, "Error creating volumes", err)
+		return
+	}
+	created, err := docker(m.target).ContainerCreate(m.target, &config, &hostConfig, primary, nil, m.name)
+	if err != nil {
+		cleanup("")
+		dockerError(c, "Error creating container on the target", err)
+		return
+	}
+	for networkName, endpoint := range extra {
+		if err := docker(m.target).NetworkConnect(m.target, networkName, created.ID, endpoint); err != nil {
+			cleanup(created.ID)
+			dockerError(c, "Error connecting network "+networkName, err)
+			return
+		}
+	}
+	if err := m.copyVolumes(created.ID); err != nil {
+		cleanup(created.ID)
+		dockerError(c, "Error copying volumes", err)
+		return
+	}
+	if wasRunning {
+		if err := docker(m.target).ContainerStart(m.target, created.ID, container.StartOptions{}); err != nil {
+			cleanup(created.ID)
+			dockerError(c, "Error starting container on the target", err)
+			return
+		}
+	}
+
+	// The old container must not come back and run twice
+	if req.RemoveSource {
+		if err := docker(ctx).ContainerRemove(ctx, old.ID, container.RemoveOptions{}); err != nil {
+			m.warnings = append(m.warnings, "could not remove the old container: "+err.Error())
+		}
+	} else if _, err := docker(ctx).ContainerUpdate(ctx, old.ID, container.UpdateConfig{RestartPolicy: container.RestartPolicy{Name: container.RestartPolicyDisabled}}); err != nil {
+		m.warnings = append(m.warnings, "could not clear the old container's restart policy: "+err.Error())
+	}
+
+	copied := make([]string, 0, len(m.volumes))
+	for _, name := range m.volumes {
+		copied = append(copied, name)
+	}
+	sort.Strings(copied)
+	logger.Info("migrated container", "container", m.name, "from", hostFrom(ctx).Name, "to", targetName)
+	respond(c, http.StatusOK, gin.H{
+		"message":  fmt.Sprintf("Container %s migrated to %s", m.name, targetName),
+		"id":       created.ID,
+		"source":   gin.H{"host": hostFrom(ctx).Name, "id": old.ID, "removed": req.RemoveSource},
+		"target":   targetName,
+		"image":    imageRef,
+		"volumes":  copied,
+		"warnings": m.warnings,
+	})
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/gin-gonic/gin"
+)
+
+// mountUser is a container referencing a bind path or volume
+type mountUser struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	State       string `json:"state"`
+	Destination string `json:"destination"`
+	RW          bool   `json:"rw"`
+	Mode        string `json:"mode,omitempty"`
+}
+
+// hostMount is a host path or named volume and the containers using it
+type hostMount struct {
+	Type       string      `json:"type"`
+	Source     string      `json:"source"`
+	Name       string      `json:"name,omitempty"`
+	Driver     string      `json:"driver,omitempty"`
+	Containers []mountUser `json:"containers"`
+}
+
+// underPath reports whether source is p or inside it, or contains it, so
+// asking about a directory finds mounts of its parents and children
+func underPath(source, p string) bool {
+	source, p = path.Clean(source), path.Clean(p)
+	within := func(child, parent string) bool {
+		return child == parent || parent == "/" || strings.HasPrefix(child, parent+"/")
+	}
+	return within(source, p) || within(p, source)
+}
+
+// nodeMounts lists the bind mounts and named volumes the selected host's
+// containers use, with the containers referencing each and whether they
+// write to it. ?path= keeps the mounts of a host directory, its parents
+// and its children; ?type=bind or volume keeps one kind.
+func nodeMounts(c *gin.Context) {
+	ctx := hostContext(c)
+	kind := c.Query("type")
+	if kind != "" && kind != string(mount.TypeBind) && kind != string(mount.TypeVolume) {
+		badRequest(c, "type must be bind or volume")
+		return
+	}
+	only := c.Query("path")
+	if only != "" && !path.IsAbs(only) {
+		badRequest(c, "path must be an absolute host path")
+		return
+	}
+
+	containers, err := docker(ctx).ContainerList(ctx, container.ListOptions{All: true})
+	if err != nil {
+		dockerError(c, "Error listing containers", err)
+		return
+	}
+
+	byKey := map[string]*hostMount{}
+	for _, cont := range containers {
+		if !inScope(ctx, cont.Labels) {
+			continue
+		}
+		for _, m := range cont.Mounts {
+			if m.Type != mount.TypeBind && m.Type != mount.TypeVolume {
+				continue
+			}
+			if kind != "" && string(m.Type) != kind {
+				continue
+			}
+			if only != "" && !underPath(m.Source, only) {
+				continue
+			}
+			key := string(m.Type) + ":" + m.Source
+			if m.Type == mount.TypeVolume {
+				key = string(m.Type) + ":" + m.Name
+			}
+			entry, ok := byKey[key]
+			if !ok {
+				entry = &hostMount{Type: string(m.Type), Source: m.Source, Name: m.Name, Driver: m.Driver, Containers: []mountUser{}}
+				byKey[key] = entry
+			}
+			entry.Containers = append(entry.Containers, mountUser{
+				ID:          cont.ID,
+				Name:        strings.TrimPrefix(cont.Names[0], "/"),
+				State:       cont.State,
+				Destination: m.Destination,
+				RW:          m.RW,
+				Mode:        m.Mode,
+			})
+		}
+	}
+
+	mounts := make([]hostMount, 0, len(byKey))
+	for _, entry := range byKey {
+		sort.Slice(entry.Containers, func(i, j int) bool { return entry.Containers[i].Name < entry.Containers[j].Name })
+		mounts = append(mounts, *entry)
+	}
+	sort.Slice(mounts, func(i, j int) bool {
+		if mounts[i].Type != mounts[j].Type {
+			return mounts[i].Type < mounts[j].Type
+		}
+		return mounts[i].Source < mounts[j].Source
+	})
+	respond(c, http.StatusOK, gin.H{"host": hostFrom(ctx).Name, "mounts": mounts})
+}
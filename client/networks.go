@@ -0,0 +1,183 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/gin-gonic/gin"
+)
+
+// topologyNode is a network or a container in the topology graph. IDs are
+// prefixed with the kind, so the two never clash.
+type topologyNode struct {
+	ID   string `json:"id"`
+	Type string `json:"type"`
+	Name string `json:"name"`
+
+	// Networks
+	Driver   string   `json:"driver,omitempty"`
+	Scope    string   `json:"scope,omitempty"`
+	Internal bool     `json:"internal,omitempty"`
+	Subnets  []string `json:"subnets,omitempty"`
+
+	// Containers
+	Image   string `json:"image,omitempty"`
+	State   string `json:"state,omitempty"`
+	Project string `json:"project,omitempty"`
+}
+
+// topologyEdge attaches a container to a network, or to the container
+// whose network namespace it shares
+type topologyEdge struct {
+	Source  string   `json:"source"`
+	Target  string   `json:"target"`
+	Type    string   `json:"type"`
+	IPv4    string   `json:"ipv4,omitempty"`
+	IPv6    string   `json:"ipv6,omitempty"`
+	MAC     string   `json:"mac,omitempty"`
+	Aliases []string `json:"aliases,omitempty"`
+}
+
+// networkTopology returns the selected host's networks and containers as
+// a graph for drawing a network map: containers on the same network can
+// reach each other. Only running containers are included unless ?all=true.
+// ?network= keeps one network, by name or ID, and the containers on it.
+// Scoped tokens only see their containers and the networks they are on.
+func networkTopology(c *gin.Context) {
+	ctx := hostContext(c)
+	only := c.Query("network")
+
+	networks, err := docker(ctx).NetworkList(ctx, types.NetworkListOptions{})
+	if err != nil {
+		dockerError(c, "Error listing networks", err)
+		return
+	}
+	containers, err := docker(ctx).ContainerList(ctx, container.ListOptions{
+		All:     c.Query("all") == "true",
+		Filters: scopeFilters(ctx, filters.NewArgs()),
+	})
+	if err != nil {
+		dockerError(c, "Error listing containers", err)
+		return
+	}
+
+	nodes := []topologyNode{}
+	edges := []topologyEdge{}
+	networkNodes := map[string]string{}
+	for _, nw := range networks {
+		if only != "" && only != nw.Name && !strings.HasPrefix(nw.ID, only) {
+			continue
+		}
+		node := topologyNode{
+			ID:       "network:" + nw.ID,
+			Type:     "network",
+			Name:     nw.Name,
+			Driver:   nw.Driver,
+			Scope:    nw.Scope,
+			Internal: nw.Internal,
+		}
+		for _, config := range nw.IPAM.Config {
+			if config.Subnet != "" {
+				node.Subnets = append(node.Subnets, config.Subnet)
+			}
+		}
+		networkNodes[nw.ID] = node.ID
+		nodes = append(nodes, node)
+	}
+	if only != "" && len(nodes) == 0 {
+		respondError(c, http.StatusNotFound, codeNotFound, "No such network: "+only)
+		return
+	}
+
+	// Containers sharing another's namespace have no endpoints of their own;
+	// they are linked to that container once every container has a node
+	containerNodes := map[string]string{}
+	shared := map[string]string{}
+	attached := map[string]bool{}
+	for _, cont := range containers {
+		if len(cont.Names) == 0 {
+			continue
+		}
+		id := "container:" + cont.ID
+		containerNodes[cont.ID] = id
+		if mode := container.NetworkMode(cont.HostConfig.NetworkMode); mode.IsContainer() {
+			shared[id] = mode.ConnectedContainer()
+		}
+		if cont.NetworkSettings == nil {
+			continue
+		}
+		for _, endpoint := range cont.NetworkSettings.Networks {
+			target, ok := networkNodes[endpoint.NetworkID]
+			if !ok {
+				continue
+			}
+			edge := topologyEdge{
+				Source:  id,
+				Target:  target,
+				Type:    "attachment",
+				IPv4:    endpoint.IPAddress,
+				IPv6:    endpoint.GlobalIPv6Address,
+				MAC:     endpoint.MacAddress,
+				Aliases: endpoint.Aliases,
+			}
+			edges = append(edges, edge)
+			attached[id], attached[target] = true, true
+		}
+	}
+	for id, ref := range shared {
+		for fullID, target := range containerNodes {
+			if strings.HasPrefix(fullID, ref) {
+				if only != "" && !attached[target] {
+					break
+				}
+				edges = append(edges, topologyEdge{Source: id, Target: target, Type: "network_mode"})
+				attached[id], attached[target] = true, true
+				break
+			}
+		}
+	}
+	for _, cont := range containers {
+		id, ok := containerNodes[cont.ID]
+		if !ok || (only != "" && !attached[id]) {
+			continue
+		}
+		nodes = append(nodes, topologyNode{
+			ID:      id,
+			Type:    "container",
+			Name:    strings.TrimPrefix(cont.Names[0], "/"),
+			Image:   cont.Image,
+			State:   cont.State,
+			Project: cont.Labels[composeProjectLabel],
+		})
+	}
+
+	// A scoped token should not learn about networks none of its containers
+	// are on
+	if len(tokenScope(ctx)) > 0 {
+		visible := nodes[:0]
+		for _, node := range nodes {
+			if node.Type != "network" || attached[node.ID] {
+				visible = append(visible, node)
+			}
+		}
+		nodes = visible
+	}
+
+	sort.SliceStable(nodes, func(i, j int) bool {
+		if nodes[i].Type != nodes[j].Type {
+			return nodes[i].Type == "network"
+		}
+		return nodes[i].Name < nodes[j].Name
+	})
+	sort.SliceStable(edges, func(i, j int) bool {
+		if edges[i].Source != edges[j].Source {
+			return edges[i].Source < edges[j].Source
+		}
+		return edges[i].Target < edges[j].Target
+	})
+	respondETag(c, gin.H{"nodes": nodes, "edges": edges})
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// hostProc and hostRoot let an agent running in a container read the host's
+// /proc and filesystems when they are bind-mounted, e.g. -v /proc:/host/proc
+var (
+	hostProc = envOr("HOST_PROC", "/proc")
+	hostRoot = envOr("HOST_ROOT", "")
+)
+
+// nodeStats reports the host's CPU, memory, disk and uptime
+func nodeStats(c *gin.Context) {
+	stats, err := collectHostStats()
+	if err != nil {
+		c.Error(err)
+		respondError(c, http.StatusNotImplemented, codeNotSupported, err.Error())
+		return
+	}
+	stats.Node = hostname
+	respond(c, http.StatusOK, stats)
+}
+
+// hostStats is the host-level context for container metrics
+type hostStats struct {
+	Node          string       `json:"node"`
+	UptimeSeconds float64      `json:"uptime_seconds"`
+	CPU           hostCPU      `json:"cpu"`
+	Memory        hostMemory   `json:"memory"`
+	Filesystems   []filesystem `json:"filesystems"`
+}
+
+type hostCPU struct {
+	Cores   int        `json:"cores"`
+	Load    [3]float64 `json:"load"` // 1, 5 and 15 minute averages
+	Percent float64    `json:"percent"`
+}
+
+type hostMemory struct {
+	Total     uint64 `json:"total"`
+	Available uint64 `json:"available"`
+	Used      uint64 `json:"used"`
+	SwapTotal uint64 `json:"swap_total"`
+	SwapFree  uint64 `json:"swap_free"`
+}
+
+type filesystem struct {
+	Device     string  `json:"device"`
+	MountPoint string  `json:"mount_point"`
+	Type       string  `json:"type"`
+	Total      uint64  `json:"total"`
+	Used       uint64  `json:"used"`
+	Free       uint64  `json:"free"`
+	UsedPct    float64 `json:"used_percent"`
+}
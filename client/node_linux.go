@@ -0,0 +1,169 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// cpuSampleInterval is the window used to measure CPU utilization
+const cpuSampleInterval = 250 * time.Millisecond
+
+func collectHostStats() (*hostStats, error) {
+	stats := &hostStats{}
+
+	uptime, err := os.ReadFile(filepath.Join(hostProc, "uptime"))
+	if err != nil {
+		return nil, err
+	}
+	if fields := strings.Fields(string(uptime)); len(fields) > 0 {
+		stats.UptimeSeconds, _ = strconv.ParseFloat(fields[0], 64)
+	}
+
+	if stats.CPU, err = readCPU(); err != nil {
+		return nil, err
+	}
+	if stats.Memory, err = readMemory(); err != nil {
+		return nil, err
+	}
+	if stats.Filesystems, err = readFilesystems(); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+func readCPU() (hostCPU, error) {
+	var cpu hostCPU
+
+	loadavg, err := os.ReadFile(filepath.Join(hostProc, "loadavg"))
+	if err != nil {
+		return cpu, err
+	}
+	fields := strings.Fields(string(loadavg))
+	for i := 0; i < 3 && i < len(fields); i++ {
+		cpu.Load[i], _ = strconv.ParseFloat(fields[i], 64)
+	}
+
+	idle1, total1, cores, err := readCPUTimes()
+	if err != nil {
+		return cpu, err
+	}
+	time.Sleep(cpuSampleInterval)
+	idle2, total2, _, err := readCPUTimes()
+	if err != nil {
+		return cpu, err
+	}
+	cpu.Cores = cores
+	if total2 > total1 {
+		cpu.Percent = 100 * (1 - float64(idle2-idle1)/float64(total2-total1))
+	}
+	return cpu, nil
+}
+
+// readCPUTimes returns the aggregate idle and total jiffies from /proc/stat
+// and the number of CPUs listed there
+func readCPUTimes() (idle, total uint64, cores int, err error) {
+	f, err := os.Open(filepath.Join(hostProc, "stat"))
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || !strings.HasPrefix(fields[0], "cpu") {
+			continue
+		}
+		if fields[0] != "cpu" {
+			cores++
+			continue
+		}
+		for i, field := range fields[1:] {
+			v, _ := strconv.ParseUint(field, 10, 64)
+			total += v
+			// idle and iowait
+			if i == 3 || i == 4 {
+				idle += v
+			}
+		}
+	}
+	return idle, total, cores, scanner.Err()
+}
+
+func readMemory() (hostMemory, error) {
+	var mem hostMemory
+
+	f, err := os.Open(filepath.Join(hostProc, "meminfo"))
+	if err != nil {
+		return mem, err
+	}
+	defer f.Close()
+
+	values := map[string]uint64{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		kb, _ := strconv.ParseUint(fields[1], 10, 64)
+		values[strings.TrimSuffix(fields[0], ":")] = kb * 1024
+	}
+	if err := scanner.Err(); err != nil {
+		return mem, err
+	}
+
+	mem.Total = values["MemTotal"]
+	mem.Available = values["MemAvailable"]
+	mem.Used = mem.Total - mem.Available
+	mem.SwapTotal = values["SwapTotal"]
+	mem.SwapFree = values["SwapFree"]
+	return mem, nil
+}
+
+// readFilesystems reports usage for every block-device backed mount in
+// the host's mount table
+func readFilesystems() ([]filesystem, error) {
+	f, err := os.Open(filepath.Join(hostProc, "1", "mounts"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	filesystems := []filesystem{}
+	seen := map[string]bool{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || !strings.HasPrefix(fields[0], "/dev/") || seen[fields[0]] {
+			continue
+		}
+		seen[fields[0]] = true
+
+		var st syscall.Statfs_t
+		if err := syscall.Statfs(filepath.Join(hostRoot, fields[1]), &st); err != nil {
+			continue
+		}
+		fs := filesystem{
+			Device:     fields[0],
+			MountPoint: fields[1],
+			Type:       fields[2],
+			Total:      st.Blocks * uint64(st.Bsize),
+			Free:       st.Bavail * uint64(st.Bsize),
+			Used:       (st.Blocks - st.Bfree) * uint64(st.Bsize),
+		}
+		if fs.Total > 0 {
+			fs.UsedPct = math.Round(10000*float64(fs.Used)/float64(fs.Total)) / 100
+		}
+		filesystems = append(filesystems, fs)
+	}
+	return filesystems, scanner.Err()
+}
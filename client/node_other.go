@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+func collectHostStats() (*hostStats, error) {
+	return nil, errors.New("host metrics are only available on Linux")
+}
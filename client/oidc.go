@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	gooidc "github.com/coreos/go-oidc/v3/oidc"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/oauth2"
+)
+
+// OpenID Connect settings. Users sign in with the authorization code flow
+// at CONTAINERSCOPE_OIDC_ISSUER, and the groups in their ID token pick their
+// role through CONTAINERSCOPE_OIDC_ROLES.
+var (
+	oidcIssuer       = os.Getenv("CONTAINERSCOPE_OIDC_ISSUER")
+	oidcClientID     = os.Getenv("CONTAINERSCOPE_OIDC_CLIENT_ID")
+	oidcClientSecret = os.Getenv("CONTAINERSCOPE_OIDC_CLIENT_SECRET")
+	oidcRedirectURL  = os.Getenv("CONTAINERSCOPE_OIDC_REDIRECT_URL")
+	oidcScopes       = envOr("CONTAINERSCOPE_OIDC_SCOPES", "openid profile email groups")
+	oidcGroupsClaim  = envOr("CONTAINERSCOPE_OIDC_GROUPS_CLAIM", "groups")
+	oidcDefaultRole  = os.Getenv("CONTAINERSCOPE_OIDC_DEFAULT_ROLE")
+	oidcRoles        map[string]string
+)
+
+// oidcLoginTTL is how long a user has to complete a sign-in at the IdP
+const oidcLoginTTL = 10 * time.Minute
+
+// oidcClient talks to the identity provider
+var oidcClient = &http.Client{Timeout: 10 * time.Second}
+
+// oidcLoginBucket holds the sign-ins waiting for the IdP to redirect
+// back, keyed by the hash of their state parameter, so the callback can
+// reach any replica
+const oidcLoginBucket = "oidc_logins"
+
+// oidcLogin is a sign-in waiting for the IdP to redirect back
+type oidcLogin struct {
+	Nonce    string    `json:"nonce"`
+	Verifier string    `json:"verifier"`
+	Redirect string    `json:"redirect"`
+	Expires  time.Time `json:"expires"`
+}
+
+// oidc caches the issuer's discovery document, fetched on first use; the
+// provider fetches its signing keys itself, and again when an unknown key
+// appears
+var oidc struct {
+	sync.Mutex
+	provider *gooidc.Provider
+}
+
+func oidcEnabled() bool {
+	return oidcIssuer != ""
+}
+
+// loadOIDC checks the OIDC settings and parses the role mapping
+func loadOIDC() error {
+	if !oidcEnabled() {
+		return nil
+	}
+	if oidcClientID == "" || oidcRedirectURL == "" {
+		return errors.New("CONTAINERSCOPE_OIDC_CLIENT_ID and CONTAINERSCOPE_OIDC_REDIRECT_URL are required with CONTAINERSCOPE_OIDC_ISSUER")
+	}
+	if oidcDefaultRole != "" && roleRank[oidcDefaultRole] == 0 {
+		return fmt.Errorf("CONTAINERSCOPE_OIDC_DEFAULT_ROLE: unknown role %q", oidcDefaultRole)
+	}
+	var err error
+	if oidcRoles, err = parseRoleMap("CONTAINERSCOPE_OIDC_ROLES"); err != nil {
+		return err
+	}
+	logger.Info("OIDC sign-in enabled", "issuer", oidcIssuer, "groups", len(oidcRoles))
+	return nil
+}
+
+// oidcDiscover returns the issuer's provider, discovering its endpoints
+// the first time
+func oidcDiscover(ctx context.Context) (*gooidc.Provider, error) {
+	oidc.Lock()
+	provider := oidc.provider
+	oidc.Unlock()
+	if provider != nil {
+		return provider, nil
+	}
+
+	provider, err := gooidc.NewProvider(gooidc.ClientContext(ctx, oidcClient), oidcIssuer)
+	if err != nil {
+		return nil, fmt.Errorf("discovering %s: %w", oidcIssuer, err)
+	}
+	oidc.Lock()
+	oidc.provider = provider
+	oidc.Unlock()
+	return provider, nil
+}
+
+// oidcConfig is the OAuth2 client the agent signs users in with
+func oidcConfig(provider *gooidc.Provider) *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     oidcClientID,
+		ClientSecret: oidcClientSecret,
+		Endpoint:     provider.Endpoint(),
+		RedirectURL:  oidcRedirectURL,
+		Scopes:       strings.Fields(oidcScopes),
+	}
+}
+
+// safeRedirect keeps a post-sign-in redirect on this server
+func safeRedirect(path string) string {
+	if !strings.HasPrefix(path, "/") || strings.HasPrefix(path, "//") || strings.HasPrefix(path, "/\\") {
+		return "/"
+	}
+	return path
+}
+
+// oidcLoginStart sends the browser to the IdP, remembering where to return
+// to afterwards
+func oidcLoginStart(c *gin.Context) {
+	provider, err := oidcDiscover(c.Request.Context())
+	if err != nil {
+		logger.Warn("OIDC discovery failed", "error", err)
+		respondError(c, http.StatusBadGateway, codeUpstreamError, "The identity provider is unavailable")
+		return
+	}
+
+	state, login := newWebhookSecret(), oidcLogin{
+		Nonce:    newWebhookSecret(),
+		Verifier: oauth2.GenerateVerifier(),
+		Redirect: safeRedirect(c.DefaultQuery("redirect", "/")),
+		Expires:  time.Now().Add(oidcLoginTTL),
+	}
+	if err := storeOIDCLogin(state, login); err != nil {
+		respondError(c, http.StatusInternalServerError, codeInternal, "Error starting sign-in: "+err.Error())
+		return
+	}
+
+	c.Redirect(http.StatusFound, oidcConfig(provider).AuthCodeURL(state, gooidc.Nonce(login.Nonce), oauth2.S256ChallengeOption(login.Verifier)))
+}
+
+// storeOIDCLogin keeps a sign-in until the IdP redirects back, and
+// forgets the expired ones
+func storeOIDCLogin(state string, login oidcLogin) error {
+	now := time.Now()
+	var expired []string
+	err := storeEach(oidcLoginBucket, func(key string, value []byte) error {
+		var pending oidcLogin
+		if json.Unmarshal(value, &pending) != nil || now.After(pending.Expires) {
+			expired = append(expired, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range expired {
+		storeDelete(oidcLoginBucket, key)
+	}
+	// The state is hashed like session tokens, so the store does not hold it
+	return storePut(oidcLoginBucket, sessionKey(state), login)
+}
+
+// oidcCallback completes a sign-in: it exchanges the code for tokens,
+// verifies the ID token, maps the user's groups to a role and starts a
+// session
+func oidcCallback(c *gin.Context) {
+	if msg := c.Query("error"); msg != "" {
+		respondError(c, http.StatusUnauthorized, codeUnauthorized, "Sign-in failed: "+msg+" "+c.Query("error_description"))
+		return
+	}
+	var login oidcLogin
+	ok, err := storeTake(oidcLoginBucket, sessionKey(c.Query("state")), &login)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, codeInternal, "Error reading sign-in: "+err.Error())
+		return
+	}
+	if !ok || time.Now().After(login.Expires) {
+		badRequest(c, "Unknown or expired sign-in; start again")
+		return
+	}
+
+	ctx := gooidc.ClientContext(c.Request.Context(), oidcClient)
+	provider, err := oidcDiscover(ctx)
+	if err != nil {
+		logger.Warn("OIDC discovery failed", "error", err)
+		respondError(c, http.StatusBadGateway, codeUpstreamError, "The identity provider is unavailable")
+		return
+	}
+	token, err := oidcConfig(provider).Exchange(ctx, c.Query("code"), oauth2.VerifierOption(login.Verifier))
+	if err != nil {
+		logger.Warn("OIDC code exchange failed", "error", err)
+		respondError(c, http.StatusUnauthorized, codeUnauthorized, "Sign-in failed: the identity provider did not accept the code")
+		return
+	}
+	claims, err := oidcVerify(ctx, provider, token, login.Nonce)
+	if err != nil {
+		logger.Warn("OIDC ID token rejected", "error", err)
+		respondError(c, http.StatusUnauthorized, codeUnauthorized, "Sign-in failed: invalid ID token")
+		return
+	}
+
+	groups, ok := claimStrings(claims[oidcGroupsClaim])
+	if !ok && provider.UserInfoEndpoint() != "" {
+		userinfo := map[string]interface{}{}
+		info, err := provider.UserInfo(ctx, oauth2.StaticTokenSource(token))
+		if err == nil {
+			err = info.Claims(&userinfo)
+		}
+		if err != nil {
+			logger.Warn("OIDC userinfo failed", "error", err)
+		} else if info.Subject == claims["sub"] {
+			groups, _ = claimStrings(userinfo[oidcGroupsClaim])
+		}
+	}
+	s := session{Provider: "oidc", Groups: groups}
+	s.Subject, _ = claims["sub"].(string)
+	s.Email, _ = claims["email"].(string)
+	for _, claim := range []string{"preferred_username", "email", "name", "sub"} {
+		if s.Name, _ = claims[claim].(string); s.Name != "" {
+			break
+		}
+	}
+	if s.Role = mapRole(oidcRoles, groups, oidcDefaultRole); s.Role == "" {
+		logger.Warn("OIDC sign-in refused, no role for groups", "user", s.Name, "groups", groups)
+		respondError(c, http.StatusForbidden, codeForbidden, fmt.Sprintf("%s is not in a group with access to ContainerScope", s.Name))
+		return
+	}
+	if _, err := startSession(c, s); err != nil {
+		respondError(c, http.StatusInternalServerError, codeInternal, err.Error())
+		return
+	}
+	c.Redirect(http.StatusFound, login.Redirect)
+}
+
+// oidcVerify checks the ID token that came with token against the
+// issuer's keys, and its issuer, audience, expiry and nonce, returning its
+// claims
+func oidcVerify(ctx context.Context, provider *gooidc.Provider, token *oauth2.Token, nonce string) (map[string]interface{}, error) {
+	raw, ok := token.Extra("id_token").(string)
+	if !ok || raw == "" {
+		return nil, errors.New("no id_token in the response")
+	}
+	idToken, err := provider.Verifier(&gooidc.Config{ClientID: oidcClientID}).Verify(ctx, raw)
+	if err != nil {
+		return nil, err
+	}
+	if idToken.Nonce != nonce {
+		return nil, errors.New("nonce mismatch")
+	}
+	claims := map[string]interface{}{}
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// claimStrings reads a claim that may be a string or a list of them
+func claimStrings(v interface{}) ([]string, bool) {
+	switch v := v.(type) {
+	case string:
+		return []string{v}, true
+	case []interface{}:
+		list := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				list = append(list, s)
+			}
+		}
+		return list, true
+	}
+	return nil, false
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/events"
+	"github.com/gin-gonic/gin"
+)
+
+// oomBucket holds an oomRecord per container, keyed by host and ID
+const oomBucket = "oom_kills"
+
+// oomRecord counts the times a container was killed for running out of
+// memory
+type oomRecord struct {
+	Host        string    `json:"host"`
+	ContainerID string    `json:"container_id"`
+	Container   string    `json:"container"`
+	Image       string    `json:"image"`
+	Count       int       `json:"count"`
+	LastKilled  time.Time `json:"last_killed"`
+	// MemoryLimit is the container's limit in bytes at the last kill; 0
+	// means none, so the host itself ran out of memory
+	MemoryLimit int64 `json:"memory_limit"`
+}
+
+func oomKey(host, containerID string) string {
+	return host + "/" + containerID
+}
+
+// startOOMTracker counts every host's OOM kills from its event bus, until
+// ctx is done
+func startOOMTracker(ctx context.Context) {
+	for name, host := range dockerHosts {
+		go trackOOMs(ctx, host, eventBuses[name])
+	}
+}
+
+// trackOOMs records the oom events of one host
+func trackOOMs(ctx context.Context, host *dockerHost, bus *eventBus) {
+	evs := bus.subscribeUntil(ctx)
+	for ev := range evs {
+		if ev.Resync || ev.Type != events.ContainerEventType || ev.Action != events.ActionOOM {
+			continue
+		}
+		key := oomKey(host.Name, ev.Actor.ID)
+		var record oomRecord
+		if _, err := storeGet(oomBucket, key, &record); err != nil {
+			logger.Warn("reading OOM record", "container", ev.Actor.ID, "error", err)
+		}
+		record.Host, record.ContainerID = host.Name, ev.Actor.ID
+		record.Container = ev.Actor.Attributes["name"]
+		record.Image = ev.Actor.Attributes["image"]
+		record.Count++
+		record.LastKilled = time.Unix(ev.Time, 0)
+
+		inspectCtx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+		if inspection, err := host.Client().ContainerInspect(inspectCtx, ev.Actor.ID); err == nil && inspection.HostConfig != nil {
+			record.MemoryLimit = inspection.HostConfig.Memory
+		}
+		cancel()
+
+		logger.Warn("container killed for running out of memory", "host", host.Name, "container", record.Container, "count", record.Count)
+		if err := storePut(oomBucket, key, record); err != nil {
+			logger.Warn("recording OOM kill", "container", record.Container, "error", err)
+		}
+	}
+}
+
+// oomCount returns how many OOM kills the agent has seen for a container
+func oomCount(host, containerID string) int {
+	var record oomRecord
+	if found, err := storeGet(oomBucket, oomKey(host, containerID), &record); err != nil || !found {
+		return 0
+	}
+	return record.Count
+}
+
+// listOOMKills lists the selected host's containers killed for running
+// out of memory since the since parameter, 24h by default, most recent
+// first
+func listOOMKills(c *gin.Context) {
+	host := hostFrom(hostContext(c)).Name
+	since, err := logTime(c, "since", time.Now())
+	if err != nil {
+		badRequest(c, err.Error())
+		return
+	}
+	cutoff := time.Now().Add(-24 * time.Hour)
+	if since != "" {
+		cutoff = logTimeBound(since)
+	}
+
+	victims := []oomRecord{}
+	err = storeEach(oomBucket, func(key string, value []byte) error {
+		if !strings.HasPrefix(key, host+"/") {
+			return nil
+		}
+		var record oomRecord
+		if json.Unmarshal(value, &record) == nil && !record.LastKilled.Before(cutoff) {
+			victims = append(victims, record)
+		}
+		return nil
+	})
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, codeInternal, "Error reading OOM kills")
+		return
+	}
+	sort.Slice(victims, func(i, j int) bool { return victims[i].LastKilled.After(victims[j].LastKilled) })
+	respond(c, http.StatusOK, victims)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// totalCountHeader reports the number of items before pagination
+const totalCountHeader = "X-Total-Count"
+
+const (
+	defaultPerPage = 50
+	maxPerPage     = 500
+)
+
+// listParams holds the paging and sorting options shared by list endpoints
+type listParams struct {
+	page    int // 1-based; 0 means return everything
+	perPage int
+	sort    string
+	desc    bool
+}
+
+// parseListParams reads ?page=&per_page=&sort=&order= and validates sort
+// against the keys the endpoint supports
+func parseListParams(c *gin.Context, sortKeys ...string) (listParams, error) {
+	p := listParams{perPage: defaultPerPage}
+
+	if v := c.Query("page"); v != "" {
+		page, err := strconv.Atoi(v)
+		if err != nil || page < 1 {
+			return p, fmt.Errorf("invalid page %q", v)
+		}
+		p.page = page
+	}
+	if v := c.Query("per_page"); v != "" {
+		perPage, err := strconv.Atoi(v)
+		if err != nil || perPage < 1 || perPage > maxPerPage {
+			return p, fmt.Errorf("invalid per_page %q, must be between 1 and %d", v, maxPerPage)
+		}
+		p.perPage = perPage
+		if p.page == 0 {
+			p.page = 1
+		}
+	}
+
+	if v := c.Query("sort"); v != "" {
+		valid := false
+		for _, key := range sortKeys {
+			valid = valid || key == v
+		}
+		if !valid {
+			return p, fmt.Errorf("invalid sort %q, expected one of %s", v, strings.Join(sortKeys, ", "))
+		}
+		p.sort = v
+	}
+	switch order := c.DefaultQuery("order", "asc"); order {
+	case "asc":
+	case "desc":
+		p.desc = true
+	default:
+		return p, fmt.Errorf("invalid order %q, expected asc or desc", order)
+	}
+	return p, nil
+}
+
+// sortBy stably sorts items with less, reversing it for descending order
+func sortBy[T any](p listParams, items []T, less func(a, b T) bool) {
+	sort.SliceStable(items, func(i, j int) bool {
+		if p.desc {
+			return less(items[j], items[i])
+		}
+		return less(items[i], items[j])
+	})
+}
+
+// paginate sets the total count header and returns the requested page
+func paginate[T any](c *gin.Context, p listParams, items []T) []T {
+	c.Header(totalCountHeader, strconv.Itoa(len(items)))
+	if p.page == 0 {
+		return items
+	}
+	start := (p.page - 1) * p.perPage
+	if start >= len(items) {
+		return items[:0]
+	}
+	end := start + p.perPage
+	if end > len(items) {
+		end = len(items)
+	}
+	return items[start:end]
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// containerPolicy overrides an opt-in label for one container. Policies are
+// keyed by container name, since IDs change every time a container is
+// recreated.
+type containerPolicy struct {
+	Container string    `json:"container"`
+	Enabled   bool      `json:"enabled"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// loadPolicies loads every policy in bucket keyed by container name
+func loadPolicies(bucket string) (map[string]containerPolicy, error) {
+	policies := map[string]containerPolicy{}
+	err := storeEach(bucket, func(key string, value []byte) error {
+		var policy containerPolicy
+		if err := json.Unmarshal(value, &policy); err != nil {
+			return err
+		}
+		policies[key] = policy
+		return nil
+	})
+	return policies, err
+}
+
+// policyEnabled applies the policy for name, if any, over the label value
+func policyEnabled(bucket, name string, labels map[string]string, label string) bool {
+	var policy containerPolicy
+	if found, err := storeGet(bucket, name, &policy); err == nil && found {
+		return policy.Enabled
+	}
+	return labels[label] == "true"
+}
+
+// setPolicy returns a handler that enables or disables a feature for a
+// container name by storing a policy in bucket
+func setPolicy(bucket string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			Enabled *bool `json:"enabled"`
+		}
+		if err := c.ShouldBindJSON(&req); (err != nil && !errors.Is(err, io.EOF)) || req.Enabled == nil {
+			badRequest(c, "enabled is required")
+			return
+		}
+
+		policy := containerPolicy{Container: c.Param("container"), Enabled: *req.Enabled, UpdatedAt: time.Now()}
+		if err := storePut(bucket, policy.Container, policy); err != nil {
+			respondError(c, http.StatusInternalServerError, codeInternal, err.Error())
+			return
+		}
+
+		respond(c, http.StatusOK, policy)
+	}
+}
+
+// deletePolicy returns a handler that removes a container's policy from
+// bucket so its label applies again
+func deletePolicy(bucket, message string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if err := storeDelete(bucket, c.Param("container")); err != nil {
+			respondError(c, http.StatusInternalServerError, codeInternal, err.Error())
+			return
+		}
+
+		respondMessage(c, message)
+	}
+}
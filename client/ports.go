@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/errdefs"
+	"github.com/docker/go-connections/nat"
+	"github.com/gin-gonic/gin"
+)
+
+// Host port ranges watched for exhaustion, on top of the ephemeral range
+// Docker assigns -P ports from. CONTAINERSCOPE_PORT_RANGES lists ranges
+// such as 8000-8099; a range is nearly exhausted once
+// CONTAINERSCOPE_PORT_RANGE_WARN_PERCENT of it is published.
+var (
+	portRanges    = splitList(os.Getenv("CONTAINERSCOPE_PORT_RANGES"))
+	portRangeWarn = envInt("CONTAINERSCOPE_PORT_RANGE_WARN_PERCENT", 80)
+)
+
+// defaultEphemeralRange is Linux's default ip_local_port_range, which
+// Docker falls back to when it cannot read the host's
+var defaultEphemeralRange = [2]int{32768, 60999}
+
+// publishedPort is a host port a running container publishes. IPv4 and
+// IPv6 bindings of the same port are one entry.
+type publishedPort struct {
+	HostPort      int      `json:"host_port"`
+	Protocol      string   `json:"protocol"`
+	HostIPs       []string `json:"host_ips"`
+	ContainerPort int      `json:"container_port"`
+	ContainerID   string   `json:"container_id"`
+	Container     string   `json:"container"`
+}
+
+// portRange is a range of host ports and how much of it is published
+type portRange struct {
+	Start           int     `json:"start"`
+	End             int     `json:"end"`
+	Source          string  `json:"source"`
+	Used            int     `json:"used"`
+	Free            int     `json:"free"`
+	UsedPercent     float64 `json:"used_percent"`
+	NearlyExhausted bool    `json:"nearly_exhausted"`
+}
+
+// publishedPorts lists the host ports published by the running containers
+// on ctx's host, by port
+func publishedPorts(ctx context.Context) ([]publishedPort, error) {
+	containers, err := docker(ctx).ContainerList(ctx, container.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	type key struct {
+		port  uint16
+		proto string
+		id    string
+	}
+	byKey := map[key]*publishedPort{}
+	for _, cont := range containers {
+		for _, p := range cont.Ports {
+			if p.PublicPort == 0 {
+				continue
+			}
+			k := key{p.PublicPort, p.Type, cont.ID}
+			entry, ok := byKey[k]
+			if !ok {
+				entry = &publishedPort{
+					HostPort:      int(p.PublicPort),
+					Protocol:      p.Type,
+					ContainerPort: int(p.PrivatePort),
+					ContainerID:   cont.ID,
+					Container:     strings.TrimPrefix(cont.Names[0], "/"),
+				}
+				byKey[k] = entry
+			}
+			if !contains(entry.HostIPs, p.IP) {
+				entry.HostIPs = append(entry.HostIPs, p.IP)
+			}
+		}
+	}
+	ports := make([]publishedPort, 0, len(byKey))
+	for _, entry := range byKey {
+		ports = append(ports, *entry)
+	}
+	sort.Slice(ports, func(i, j int) bool {
+		if ports[i].HostPort != ports[j].HostPort {
+			return ports[i].HostPort < ports[j].HostPort
+		}
+		if ports[i].Protocol != ports[j].Protocol {
+			return ports[i].Protocol < ports[j].Protocol
+		}
+		return ports[i].Container < ports[j].Container
+	})
+	return ports, nil
+}
+
+// ephemeralRange reads the range Docker assigns ports for -P from
+func ephemeralRange() [2]int {
+	data, err := os.ReadFile(filepath.Join(hostProc, "sys", "net", "ipv4", "ip_local_port_range"))
+	if err != nil {
+		return defaultEphemeralRange
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) != 2 {
+		return defaultEphemeralRange
+	}
+	start, err1 := strconv.Atoi(fields[0])
+	end, err2 := strconv.Atoi(fields[1])
+	if err1 != nil || err2 != nil || start > end {
+		return defaultEphemeralRange
+	}
+	return [2]int{start, end}
+}
+
+// parsePortRange reads a range such as 8000-8099, or a single port
+func parsePortRange(s string) ([2]int, error) {
+	start, end, err := nat.ParsePortRangeToInt(s)
+	if err != nil || start < 1 || end > 65535 {
+		return [2]int{}, fmt.Errorf("invalid port range %q", s)
+	}
+	return [2]int{start, end}, nil
+}
+
+// loadPortRanges checks CONTAINERSCOPE_PORT_RANGES at startup
+func loadPortRanges() error {
+	for _, s := range portRanges {
+		if _, err := parsePortRange(s); err != nil {
+			return fmt.Errorf("CONTAINERSCOPE_PORT_RANGES: %w", err)
+		}
+	}
+	return nil
+}
+
+// rangeUsage counts the distinct published host ports within r
+func rangeUsage(r [2]int, source string, ports []publishedPort) portRange {
+	used := map[int]bool{}
+	for _, p := range ports {
+		if p.HostPort >= r[0] && p.HostPort <= r[1] {
+			used[p.HostPort] = true
+		}
+	}
+	size := r[1] - r[0] + 1
+	usage := portRange{Start: r[0], End: r[1], Source: source, Used: len(used), Free: size - len(used)}
+	usage.UsedPercent = float64(usage.Used) / float64(size) * 100
+	usage.NearlyExhausted = usage.UsedPercent >= float64(portRangeWarn)
+	return usage
+}
+
+// portConflict is a requested host port another container already
+// publishes
+type portConflict struct {
+	HostPort  int
+	Protocol  string
+	Container string
+}
+
+// unspecifiedIP reports whether a binding address means every address
+func unspecifiedIP(ip string) bool {
+	return ip == "" || ip == "0.0.0.0" || ip == "::"
+}
+
+// findPortConflicts returns the bindings that would clash with ports
+// running containers other than exclude publish. Bindings without a host
+// port are assigned one by Docker and never clash.
+func findPortConflicts(bindings nat.PortMap, ports []publishedPort, exclude string) []portConflict {
+	var conflicts []portConflict
+	for containerPort, list := range bindings {
+		for _, b := range list {
+			if b.HostPort == "" {
+				continue
+			}
+			start, end, err := nat.ParsePortRangeToInt(b.HostPort)
+			if err != nil {
+				continue
+			}
+			for _, p := range ports {
+				if p.ContainerID == exclude || p.Protocol != containerPort.Proto() || p.HostPort < start || p.HostPort > end {
+					continue
+				}
+				for _, ip := range p.HostIPs {
+					if unspecifiedIP(b.HostIP) || unspecifiedIP(ip) || b.HostIP == ip {
+						conflicts = append(conflicts, portConflict{HostPort: p.HostPort, Protocol: p.Protocol, Container: p.Container})
+						break
+					}
+				}
+			}
+		}
+	}
+	return conflicts
+}
+
+// checkPortConflicts fails with a conflict error when hostConfig would
+// publish a host port another running container holds, before anything
+// is created or stopped. exclude is the container being replaced.
+func checkPortConflicts(ctx context.Context, hostConfig *container.HostConfig, exclude string) error {
+	if hostConfig == nil || len(hostConfig.PortBindings) == 0 {
+		return nil
+	}
+	ports, err := publishedPorts(ctx)
+	if err != nil {
+		return err
+	}
+	conflicts := findPortConflicts(hostConfig.PortBindings, ports, exclude)
+	if len(conflicts) == 0 {
+		return nil
+	}
+	taken := make([]string, 0, len(conflicts))
+	for _, c := range conflicts {
+		taken = append(taken, fmt.Sprintf("%d/%s is published by %s", c.HostPort, c.Protocol, c.Container))
+	}
+	return errdefs.Conflict(fmt.Errorf("host port conflict: %s", strings.Join(taken, ", ")))
+}
+
+// nodePorts lists the host ports published on the selected host, which
+// container holds each, and how full the port ranges are. ?port= narrows
+// the list to what holds one port.
+func nodePorts(c *gin.Context) {
+	ctx := hostContext(c)
+	var only int
+	if v := c.Query("port"); v != "" {
+		port, err := strconv.Atoi(v)
+		if err != nil || port < 1 || port > 65535 {
+			badRequest(c, "port must be between 1 and 65535")
+			return
+		}
+		only = port
+	}
+	ports, err := publishedPorts(ctx)
+	if err != nil {
+		dockerError(c, "Error listing containers", err)
+		return
+	}
+
+	ranges := []portRange{rangeUsage(ephemeralRange(), "ephemeral", ports)}
+	for _, s := range portRanges {
+		r, _ := parsePortRange(s)
+		ranges = append(ranges, rangeUsage(r, "configured", ports))
+	}
+
+	if only != 0 {
+		filtered := []publishedPort{}
+		for _, p := range ports {
+			if p.HostPort == only {
+				filtered = append(filtered, p)
+			}
+		}
+		ports = filtered
+	}
+	respond(c, http.StatusOK, gin.H{"host": hostFrom(ctx).Name, "ports": ports, "ranges": ranges})
+}
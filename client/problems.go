@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/gin-gonic/gin"
+)
+
+// Defaults for GET /containers/problems: a container that died restarts
+// times within window is in a restart loop, and problemLogLines of its
+// output are attached
+const (
+	defaultProblemRestarts = 3
+	defaultProblemWindow   = 10 * time.Minute
+	defaultProblemLogLines = 20
+)
+
+// Problem kinds reported by GET /containers/problems
+const (
+	problemRestartLoop = "restart_loop"
+	problemOOMKilled   = "oom_killed"
+	problemUnhealthy   = "unhealthy"
+)
+
+// containerProblem is a container that needs attention and why
+type containerProblem struct {
+	ContainerID   string   `json:"container_id"`
+	FullID        string   `json:"full_id"`
+	Name          string   `json:"name"`
+	Image         string   `json:"image"`
+	State         string   `json:"state"`
+	Problems      []string `json:"problems"`
+	Restarts      int      `json:"restarts"`
+	OOMKills      int      `json:"oom_kills"`
+	ExitCode      int      `json:"exit_code"`
+	OOMKilled     bool     `json:"oom_killed"`
+	FinishedAt    string   `json:"finished_at,omitempty"`
+	FailingStreak int      `json:"failing_streak,omitempty"`
+	Logs          []string `json:"logs"`
+}
+
+// windowEvents counts the die and oom events of each container on host
+// since from, from the event history
+func windowEvents(host string, from time.Time) (dies, ooms map[string]int, err error) {
+	dies, ooms = map[string]int{}, map[string]int{}
+	err = storeEachRange(eventHistoryBucket, historyKey(from, 0), "", func(_ string, value []byte) error {
+		var event historyEvent
+		if json.Unmarshal(value, &event) != nil || event.Host != host {
+			return nil
+		}
+		switch event.Action {
+		case "die":
+			dies[event.ContainerID]++
+		case "oom":
+			ooms[event.ContainerID]++
+		}
+		return nil
+	})
+	return dies, ooms, err
+}
+
+// tailLogs returns the last lines of a container's output
+func tailLogs(ctx context.Context, containerID string, lines int) ([]string, error) {
+	out, err := openLogs(ctx, containerID, container.LogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+		Tail:       strconv.Itoa(lines),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer out.Close()
+	tail := []string{}
+	_, err = scanLogs(out, logMaxBytes, nil, func(_ int, line string) error {
+		tail = append(tail, line)
+		return nil
+	})
+	return tail, err
+}
+
+// containerProblems lists containers in a restart loop, recently killed
+// for running out of memory, or failing their health check, with their
+// last exit and recent output. restarts and window set what counts as a
+// loop; lines sets how much output is attached.
+func containerProblems(c *gin.Context) {
+	ctx := hostContext(c)
+	restarts := defaultProblemRestarts
+	if v := c.Query("restarts"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			badRequest(c, "restarts must be a positive number")
+			return
+		}
+		restarts = n
+	}
+	window := defaultProblemWindow
+	if v := c.Query("window"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			badRequest(c, "window must be a positive duration such as 10m")
+			return
+		}
+		window = d
+	}
+	lines := defaultProblemLogLines
+	if v := c.Query("lines"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			badRequest(c, "lines must be 0 or more")
+			return
+		}
+		lines = n
+	}
+
+	since := time.Now().Add(-window)
+	dies, ooms, err := windowEvents(hostFrom(ctx).Name, since)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, codeInternal, "Error reading event history")
+		return
+	}
+	list, err := docker(ctx).ContainerList(ctx, container.ListOptions{All: true, Filters: scopeFilters(ctx, filters.NewArgs())})
+	if err != nil {
+		dockerError(c, "Error listing containers", err)
+		return
+	}
+
+	problems := []containerProblem{}
+	for _, cont := range list {
+		var kinds []string
+		if dies[cont.ID] >= restarts {
+			kinds = append(kinds, problemRestartLoop)
+		}
+		if ooms[cont.ID] > 0 {
+			kinds = append(kinds, problemOOMKilled)
+		}
+		if healthFromStatus(cont.Status) == types.Unhealthy {
+			kinds = append(kinds, problemUnhealthy)
+		}
+		// A container that has not restarted since its OOM kill shows it
+		// in its state even when the event predates the history
+		if len(kinds) == 0 && cont.State != "exited" {
+			continue
+		}
+
+		inspection, err := docker(ctx).ContainerInspect(ctx, cont.ID)
+		if err != nil {
+			continue
+		}
+		state := inspection.State
+		if state.OOMKilled && ooms[cont.ID] == 0 {
+			if finished, err := time.Parse(time.RFC3339Nano, state.FinishedAt); err == nil && finished.After(since) {
+				kinds = append(kinds, problemOOMKilled)
+			}
+		}
+		if len(kinds) == 0 {
+			continue
+		}
+
+		problem := containerProblem{
+			ContainerID: cont.ID[:10],
+			FullID:      cont.ID,
+			Name:        strings.TrimPrefix(inspection.Name, "/"),
+			Image:       cont.Image,
+			State:       cont.State,
+			Problems:    kinds,
+			Restarts:    dies[cont.ID],
+			OOMKills:    ooms[cont.ID],
+			ExitCode:    state.ExitCode,
+			OOMKilled:   state.OOMKilled,
+			Logs:        []string{},
+		}
+		if !strings.HasPrefix(state.FinishedAt, "0001-") {
+			problem.FinishedAt = state.FinishedAt
+		}
+		if state.Health != nil {
+			problem.FailingStreak = state.Health.FailingStreak
+		}
+		if lines > 0 {
+			if tail, err := tailLogs(ctx, cont.ID, lines); err == nil {
+				problem.Logs = tail
+			} else {
+				problem.Logs = []string{fmt.Sprintf("[error reading logs: %v]", err)}
+			}
+		}
+		problems = append(problems, problem)
+	}
+
+	sort.Slice(problems, func(i, j int) bool { return problems[i].Name < problems[j].Name })
+	respond(c, http.StatusOK, problems)
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// procPsArgs makes ContainerTop report the columns process stats start
+// from; the daemon runs ps on its host with these arguments
+var procPsArgs = []string{"-o", "pid,ppid,user,rss,pcpu,args"}
+
+// clockTicks is USER_HZ, the unit of the CPU times in /proc/<pid>/stat,
+// which is 100 on every Linux architecture Docker runs on
+const clockTicks = 100
+
+// processStat is one process of a container with its memory and CPU use
+type processStat struct {
+	PID        int     `json:"pid"`
+	PPID       int     `json:"ppid"`
+	User       string  `json:"user"`
+	Command    string  `json:"command"`
+	RSS        uint64  `json:"rss_bytes"`
+	CPUPercent float64 `json:"cpu_percent"`
+}
+
+// topProcesses lists a container's processes with the host PIDs and the
+// memory and lifetime CPU average ps reports
+func topProcesses(ctx context.Context, containerID string) ([]processStat, error) {
+	top, err := docker(ctx).ContainerTop(ctx, containerID, procPsArgs)
+	if err != nil {
+		return nil, err
+	}
+	columns := map[string]int{}
+	for i, title := range top.Titles {
+		columns[title] = i
+	}
+	field := func(row []string, title string) string {
+		if i, ok := columns[title]; ok && i < len(row) {
+			return row[i]
+		}
+		return ""
+	}
+	procs := make([]processStat, 0, len(top.Processes))
+	for _, row := range top.Processes {
+		pid, err := strconv.Atoi(field(row, "PID"))
+		if err != nil {
+			continue
+		}
+		ppid, _ := strconv.Atoi(field(row, "PPID"))
+		rss, _ := strconv.ParseUint(field(row, "RSS"), 10, 64)
+		cpu, _ := strconv.ParseFloat(field(row, "%CPU"), 64)
+		procs = append(procs, processStat{
+			PID:        pid,
+			PPID:       ppid,
+			User:       field(row, "USER"),
+			Command:    field(row, "COMMAND"),
+			RSS:        rss * 1024,
+			CPUPercent: cpu,
+		})
+	}
+	return procs, nil
+}
+
+// procCPUTicks reads the user and system CPU time of a process from its
+// /proc/<pid>/stat, in clock ticks
+func procCPUTicks(pid int) (uint64, error) {
+	data, err := os.ReadFile(filepath.Join(hostProc, strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return 0, err
+	}
+	// The command name is in parentheses and may contain spaces, so
+	// fields are counted from after it: state is field 3, utime 14
+	end := bytes.LastIndexByte(data, ')')
+	if end < 0 {
+		return 0, fmt.Errorf("malformed stat for pid %d", pid)
+	}
+	fields := strings.Fields(string(data[end+1:]))
+	if len(fields) < 13 {
+		return 0, fmt.Errorf("malformed stat for pid %d", pid)
+	}
+	utime, err := strconv.ParseUint(fields[11], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	stime, err := strconv.ParseUint(fields[12], 10, 64)
+	return utime + stime, err
+}
+
+// procRSS reads a process's resident memory from /proc/<pid>/statm
+func procRSS(pid int) (uint64, error) {
+	data, err := os.ReadFile(filepath.Join(hostProc, strconv.Itoa(pid), "statm"))
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) < 2 {
+		return 0, fmt.Errorf("malformed statm for pid %d", pid)
+	}
+	pages, err := strconv.ParseUint(fields[1], 10, 64)
+	return pages * uint64(os.Getpagesize()), err
+}
+
+// procVisible reports whether the agent sees the container's processes
+// under hostProc: the daemon is local and the agent shares its PID view
+func procVisible(procs []processStat, containerID string) bool {
+	if len(procs) == 0 {
+		return false
+	}
+	for _, p := range procs {
+		if processContainer(p.PID) != containerID {
+			return false
+		}
+	}
+	return true
+}
+
+// sampleProcesses replaces each process's CPU with its use over interval
+// and its RSS with the current value, both from /proc. Processes that
+// exit in the meantime are dropped.
+func sampleProcesses(ctx context.Context, procs []processStat, interval time.Duration) ([]processStat, error) {
+	before := map[int]uint64{}
+	for _, p := range procs {
+		if ticks, err := procCPUTicks(p.PID); err == nil {
+			before[p.PID] = ticks
+		}
+	}
+	start := time.Now()
+	select {
+	case <-time.After(interval):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	elapsed := time.Since(start).Seconds()
+
+	sampled := make([]processStat, 0, len(procs))
+	for _, p := range procs {
+		first, ok := before[p.PID]
+		if !ok {
+			continue
+		}
+		ticks, err := procCPUTicks(p.PID)
+		if err != nil || ticks < first {
+			continue
+		}
+		p.CPUPercent = float64(ticks-first) / clockTicks / elapsed * 100
+		if rss, err := procRSS(p.PID); err == nil {
+			p.RSS = rss
+		}
+		sampled = append(sampled, p)
+	}
+	return sampled, nil
+}
+
+// containerProcessStats reports each of a container's processes with its
+// CPU and resident memory, largest first. When the agent can read the
+// processes under HOST_PROC it measures CPU over ?interval= (default 1s);
+// otherwise CPU is ps's average over each process's lifetime.
+func containerProcessStats(c *gin.Context) {
+	ctx := hostContext(c)
+	containerID := c.Param("container_id")
+	interval, err := time.ParseDuration(c.DefaultQuery("interval", "1s"))
+	if err != nil || interval < 100*time.Millisecond || interval > 10*time.Second {
+		badRequest(c, "interval must be a duration between 100ms and 10s")
+		return
+	}
+	order := c.DefaultQuery("sort", "rss")
+	if order != "rss" && order != "cpu" {
+		badRequest(c, "sort must be rss or cpu")
+		return
+	}
+
+	procs, err := topProcesses(ctx, containerID)
+	if err != nil {
+		dockerError(c, "Error listing container processes", err)
+		return
+	}
+	source := "ps"
+	if procVisible(procs, containerID) {
+		if procs, err = sampleProcesses(ctx, procs, interval); err != nil {
+			dockerError(c, "Error sampling container processes", err)
+			return
+		}
+		source = "proc"
+	}
+
+	if order == "cpu" {
+		sort.SliceStable(procs, func(i, j int) bool { return procs[i].CPUPercent > procs[j].CPUPercent })
+	} else {
+		sort.SliceStable(procs, func(i, j int) bool { return procs[i].RSS > procs[j].RSS })
+	}
+	var totalRSS uint64
+	var totalCPU float64
+	for _, p := range procs {
+		totalRSS += p.RSS
+		totalCPU += p.CPUPercent
+	}
+	body := gin.H{
+		"container":         containerID,
+		"name":              containerName(c),
+		"source":            source,
+		"total_rss_bytes":   totalRSS,
+		"total_cpu_percent": totalCPU,
+		"processes":         procs,
+	}
+	if source == "proc" {
+		body["interval"] = interval.String()
+	}
+	respond(c, http.StatusOK, body)
+}
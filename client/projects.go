@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/gin-gonic/gin"
+)
+
+// Labels docker compose puts on every container it manages
+const (
+	composeProjectLabel = "com.docker.compose.project"
+	composeServiceLabel = "com.docker.compose.service"
+)
+
+// projectService summarizes the containers of one compose service
+type projectService struct {
+	Name       string   `json:"name"`
+	Containers []string `json:"containers"`
+	Running    int      `json:"running"`
+	Total      int      `json:"total"`
+}
+
+// project summarizes a compose project
+type project struct {
+	Name     string            `json:"name"`
+	Status   string            `json:"status"` // running, partial or stopped
+	Running  int               `json:"running"`
+	Total    int               `json:"total"`
+	Services []*projectService `json:"services"`
+}
+
+// aggregateStatus reports running when everything runs, stopped when
+// nothing does, and partial otherwise
+func aggregateStatus(running, total int) string {
+	switch running {
+	case total:
+		return "running"
+	case 0:
+		return "stopped"
+	}
+	return "partial"
+}
+
+// listProjects groups containers by their compose project and service labels
+func listProjects(c *gin.Context) {
+	ctx := hostContext(c)
+	containers, err := docker(ctx).ContainerList(ctx, container.ListOptions{
+		All:     true,
+		Filters: filters.NewArgs(filters.Arg("label", composeProjectLabel)),
+	})
+	if err != nil {
+		dockerError(c, "Error listing containers", err)
+		return
+	}
+
+	projects := map[string]*project{}
+	services := map[string]*projectService{}
+	for _, cont := range containers {
+		projectName := cont.Labels[composeProjectLabel]
+		p, ok := projects[projectName]
+		if !ok {
+			p = &project{Name: projectName}
+			projects[projectName] = p
+		}
+
+		serviceName := cont.Labels[composeServiceLabel]
+		key := projectName + "/" + serviceName
+		s, ok := services[key]
+		if !ok {
+			s = &projectService{Name: serviceName, Containers: []string{}}
+			services[key] = s
+			p.Services = append(p.Services, s)
+		}
+
+		running := cont.State == "running"
+		s.Containers = append(s.Containers, strings.TrimPrefix(cont.Names[0], "/"))
+		s.Total++
+		p.Total++
+		if running {
+			s.Running++
+			p.Running++
+		}
+	}
+
+	projectList := []*project{}
+	for _, p := range projects {
+		p.Status = aggregateStatus(p.Running, p.Total)
+		sort.Slice(p.Services, func(i, j int) bool { return p.Services[i].Name < p.Services[j].Name })
+		projectList = append(projectList, p)
+	}
+	sort.Slice(projectList, func(i, j int) bool { return projectList[i].Name < projectList[j].Name })
+
+	respond(c, http.StatusOK, projectList)
+}
+
+// projectAction applies a container action to every container in a project
+func projectAction(done string, action containerActionFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		name := c.Param("project")
+		req := actionRequest{Label: composeProjectLabel + "=" + name}
+
+		ctx := hostContext(c)
+		targets, err := resolveTargets(ctx, req)
+		if err != nil {
+			dockerError(c, "Error listing containers", err)
+			return
+		}
+		if len(targets) == 0 {
+			respondError(c, http.StatusNotFound, codeProjectNotFound, fmt.Sprintf("No containers found for project %s", name))
+			return
+		}
+
+		results := runBulk(ctx, targets, req, action)
+		failed := 0
+		for _, result := range results {
+			if !result.Success {
+				failed++
+			}
+		}
+		respond(c, http.StatusOK, gin.H{
+			"message":   fmt.Sprintf("Project %s %s", name, done),
+			"results":   results,
+			"succeeded": len(results) - failed,
+			"failed":    failed,
+		})
+	}
+}
+
+var (
+	startProject = projectAction("started", func(ctx context.Context, containerID string, req actionRequest) error {
+		return docker(ctx).ContainerStart(ctx, containerID, container.StartOptions{})
+	})
+	stopProject = projectAction("stopped", func(ctx context.Context, containerID string, req actionRequest) error {
+		return docker(ctx).ContainerStop(ctx, containerID, container.StopOptions{})
+	})
+	restartProject = projectAction("restarted", func(ctx context.Context, containerID string, req actionRequest) error {
+		return docker(ctx).ContainerRestart(ctx, containerID, container.StopOptions{})
+	})
+)
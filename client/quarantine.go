@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/errdefs"
+	"github.com/gin-gonic/gin"
+)
+
+// quarantineBucket holds quarantined containers keyed by host and full ID
+const quarantineBucket = "quarantine"
+
+// quarantinePrefix starts the name a quarantined container is renamed to
+const quarantinePrefix = "trash_"
+
+// inQuarantine reports whether a listed container has been quarantined.
+// Quarantined containers keep their labels but are only acted on by ID or
+// name, so label selections skip them.
+func inQuarantine(cont types.Container) bool {
+	return len(cont.Names) > 0 && strings.HasPrefix(cont.Names[0], "/"+quarantinePrefix)
+}
+
+// quarantineByDefault makes deletes quarantine containers unless the
+// request sets quarantine to false; quarantineRetention is how long they
+// are kept before the reaper removes them
+var (
+	quarantineByDefault = os.Getenv("CONTAINERSCOPE_QUARANTINE") == "true"
+	quarantineRetention = envDuration("CONTAINERSCOPE_QUARANTINE_RETENTION", 24*time.Hour)
+)
+
+// quarantinedContainer is a deleted container kept, stopped and renamed,
+// until it is restored or its retention runs out
+type quarantinedContainer struct {
+	ID             string    `json:"id"`
+	Host           string    `json:"host"`
+	Name           string    `json:"name"`
+	QuarantineName string    `json:"quarantine_name"`
+	Image          string    `json:"image"`
+	QuarantinedAt  time.Time `json:"quarantined_at"`
+	ExpiresAt      time.Time `json:"expires_at"`
+	// WasRunning restarts the container on restore; RestartPolicy is put
+	// back then, having been cleared so the daemon does not start it
+	WasRunning    bool                    `json:"was_running"`
+	RestartPolicy container.RestartPolicy `json:"restart_policy"`
+	// RemoveVolumes is applied when the reaper removes the container
+	RemoveVolumes bool `json:"remove_volumes"`
+}
+
+// quarantineKey is the store key of a container on host
+func quarantineKey(host, containerID string) string {
+	return host + "/" + containerID
+}
+
+// quarantines reports whether a delete request quarantines its containers
+func (req actionRequest) quarantines() bool {
+	if req.Quarantine != nil {
+		return *req.Quarantine
+	}
+	return quarantineByDefault
+}
+
+// removeContainer deletes a container for DELETE /containers/delete,
+// quarantining it instead when the request asks for that. Deleting a
+// container that is already quarantined removes it for good.
+func removeContainer(ctx context.Context, containerID string, req actionRequest) error {
+	// Bulk deletes pass names and prefixes through as given
+	cont, err := resolveContainer(ctx, containerID)
+	if err != nil {
+		return err
+	}
+	containerID = cont.ID
+	key := quarantineKey(hostFrom(ctx).Name, containerID)
+	var record quarantinedContainer
+	found, err := storeGet(quarantineBucket, key, &record)
+	if err != nil {
+		return err
+	}
+	if !req.quarantines() || found {
+		if err := docker(ctx).ContainerRemove(ctx, containerID, req.removeOptions()); err != nil {
+			return err
+		}
+		if found {
+			return storeDelete(quarantineBucket, key)
+		}
+		return nil
+	}
+	return quarantineContainer(ctx, containerID, req)
+}
+
+// quarantineContainer stops a container, clears its restart policy and
+// renames it to trash_<name>_<time>, recording how to restore it
+func quarantineContainer(ctx context.Context, containerID string, req actionRequest) error {
+	inspection, err := docker(ctx).ContainerInspect(ctx, containerID)
+	if err != nil {
+		return err
+	}
+	if inspection.State.Running && !req.removeOptions().Force {
+		return errdefs.Conflict(fmt.Errorf("container %s is running; stop it first or set force", containerID))
+	}
+	name := strings.TrimPrefix(inspection.Name, "/")
+	now := time.Now()
+	record := quarantinedContainer{
+		ID:             inspection.ID,
+		Host:           hostFrom(ctx).Name,
+		Name:           name,
+		QuarantineName: fmt.Sprintf("%s%s_%s", quarantinePrefix, name, now.UTC().Format("20060102T150405")),
+		Image:          inspection.Config.Image,
+		QuarantinedAt:  now,
+		ExpiresAt:      now.Add(quarantineRetention),
+		WasRunning:     inspection.State.Running,
+		RemoveVolumes:  req.RemoveVolumes,
+	}
+	if inspection.HostConfig != nil {
+		record.RestartPolicy = inspection.HostConfig.RestartPolicy
+	}
+
+	if record.WasRunning {
+		if err := docker(ctx).ContainerStop(ctx, containerID, req.stopOptions()); err != nil {
+			return err
+		}
+	}
+	if !record.RestartPolicy.IsNone() {
+		update := container.UpdateConfig{RestartPolicy: container.RestartPolicy{Name: container.RestartPolicyDisabled}}
+		if _, err := docker(ctx).ContainerUpdate(ctx, containerID, update); err != nil {
+			return err
+		}
+	}
+	if err := docker(ctx).ContainerRename(ctx, containerID, record.QuarantineName); err != nil {
+		return err
+	}
+	logger.Info("container quarantined", "host", record.Host, "container", name, "expires", record.ExpiresAt)
+	return storePut(quarantineBucket, quarantineKey(record.Host, record.ID), record)
+}
+
+// listQuarantine lists the host's quarantined containers, soonest to
+// expire first
+func listQuarantine(c *gin.Context) {
+	host := hostFrom(hostContext(c)).Name
+	records := []quarantinedContainer{}
+	err := storeEach(quarantineBucket, func(key string, value []byte) error {
+		var record quarantinedContainer
+		if err := json.Unmarshal(value, &record); err != nil {
+			return err
+		}
+		if record.Host == host {
+			records = append(records, record)
+		}
+		return nil
+	})
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, codeInternal, err.Error())
+		return
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].ExpiresAt.Before(records[j].ExpiresAt) })
+	respond(c, http.StatusOK, records)
+}
+
+// quarantineRecord finds the record for the request's :container_id,
+// which may be the container's ID or prefix, its quarantine name or its
+// original name, replying 404 when no quarantined container matches. The
+// most recently quarantined container wins when a name was reused.
+func quarantineRecord(c *gin.Context) (quarantinedContainer, bool) {
+	ref := strings.TrimPrefix(c.Param("container_id"), "/")
+	host := hostFrom(hostContext(c)).Name
+	var match quarantinedContainer
+	found := false
+	err := storeEach(quarantineBucket, func(key string, value []byte) error {
+		var record quarantinedContainer
+		if err := json.Unmarshal(value, &record); err != nil {
+			return err
+		}
+		if record.Host != host || !(strings.HasPrefix(record.ID, ref) || record.QuarantineName == ref || record.Name == ref) {
+			return nil
+		}
+		if !found || record.QuarantinedAt.After(match.QuarantinedAt) {
+			match, found = record, true
+		}
+		return nil
+	})
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, codeInternal, err.Error())
+		return match, false
+	}
+	if !found {
+		respondError(c, http.StatusNotFound, codeContainerNotFound, "No quarantined container matches "+ref)
+		return match, false
+	}
+	return match, true
+}
+
+// restoreContainer renames a quarantined container back, puts back its
+// restart policy and starts it again if it was running
+func restoreContainer(c *gin.Context) {
+	ctx := hostContext(c)
+	record, ok := quarantineRecord(c)
+	if !ok {
+		return
+	}
+
+	if err := docker(ctx).ContainerRename(ctx, record.ID, record.Name); err != nil {
+		dockerError(c, "Error renaming container", err)
+		return
+	}
+	if !record.RestartPolicy.IsNone() {
+		update := container.UpdateConfig{RestartPolicy: record.RestartPolicy}
+		if _, err := docker(ctx).ContainerUpdate(ctx, record.ID, update); err != nil {
+			dockerError(c, "Error restoring restart policy", err)
+			return
+		}
+	}
+	if err := storeDelete(quarantineBucket, quarantineKey(record.Host, record.ID)); err != nil {
+		respondError(c, http.StatusInternalServerError, codeInternal, err.Error())
+		return
+	}
+	if record.WasRunning {
+		if err := docker(ctx).ContainerStart(ctx, record.ID, container.StartOptions{}); err != nil {
+			dockerError(c, "Container restored but could not be started", err)
+			return
+		}
+	}
+
+	respondMessage(c, fmt.Sprintf("Container %s restored successfully", record.Name))
+}
+
+// purgeContainer removes a quarantined container without waiting for its
+// retention to run out
+func purgeContainer(c *gin.Context) {
+	ctx := hostContext(c)
+	record, ok := quarantineRecord(c)
+	if !ok {
+		return
+	}
+	if err := reapContainer(ctx, record); err != nil {
+		dockerError(c, "Error removing container", err)
+		return
+	}
+
+	respondMessage(c, fmt.Sprintf("Container %s removed successfully", record.Name))
+}
+
+// reapContainer removes a quarantined container and its record. One that
+// is already gone only loses its record.
+func reapContainer(ctx context.Context, record quarantinedContainer) error {
+	err := docker(ctx).ContainerRemove(ctx, record.ID, container.RemoveOptions{Force: true, RemoveVolumes: record.RemoveVolumes})
+	if err != nil && !errdefs.IsNotFound(err) {
+		return err
+	}
+	return storeDelete(quarantineBucket, quarantineKey(record.Host, record.ID))
+}
+
+// startQuarantineReaper removes quarantined containers once their
+// retention has run out, checking every minute until ctx is done
+func startQuarantineReaper(ctx context.Context) {
+	go func() {
+		for {
+			reapQuarantine(ctx)
+			if !pause(ctx, time.Minute) {
+				return
+			}
+		}
+	}()
+}
+
+// reapQuarantine removes every expired quarantined container, stopping
+// early once ctx is done
+func reapQuarantine(ctx context.Context) {
+	now := time.Now()
+	var expired []quarantinedContainer
+	err := storeEach(quarantineBucket, func(key string, value []byte) error {
+		var record quarantinedContainer
+		if err := json.Unmarshal(value, &record); err != nil {
+			return err
+		}
+		if now.After(record.ExpiresAt) {
+			expired = append(expired, record)
+		}
+		return nil
+	})
+	if err != nil {
+		logger.Warn("listing quarantined containers", "error", err)
+		return
+	}
+	for _, record := range expired {
+		host, ok := dockerHosts[record.Host]
+		if !ok {
+			continue
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		reapCtx, cancel := context.WithTimeout(withHost(context.Background(), host), requestTimeout)
+		if err := reapContainer(reapCtx, record); err != nil {
+			logger.Warn("removing quarantined container", "host", record.Host, "container", record.QuarantineName, "error", err)
+		} else {
+			logger.Info("quarantined container removed", "host", record.Host, "container", record.QuarantineName)
+		}
+		cancel()
+	}
+}
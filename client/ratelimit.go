@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// rateLimit and expensiveRateLimit hold the configured limits, as "N/unit"
+// such as 20/s or 600/m. A client may make N requests at once, and regains
+// them at that rate. Both are off when unset.
+var (
+	rateLimit          = envRate("CONTAINERSCOPE_RATE_LIMIT")
+	expensiveRateLimit = envRate("CONTAINERSCOPE_RATE_LIMIT_EXPENSIVE")
+)
+
+// expensiveRequests make the daemon stream or compute a lot, so they also
+// count against the stricter expensive limit
+var expensiveRequests = map[string]bool{
+	"GET /api/v1/containers/:container_id/stats":           true,
+	"GET /api/v1/containers/:container_id/logs":            true,
+	"GET /api/v1/containers/:container_id/logs/download":   true,
+	"GET /api/v1/containers/:container_id/top":             true,
+	"GET /api/v1/containers/:container_id/processes/stats": true,
+	"GET /api/v1/containers/:container_id/export":          true,
+	"POST /api/v1/containers/:container_id/capture":        true,
+	"GET /api/v1/containers/problems":                      true,
+	"POST /api/v1/logs/bundle":                             true,
+	"GET /api/v1/logs/aggregate":                           true,
+	"GET /api/v1/ws/logs":                                  true,
+	"GET /api/v1/system/df":                                true,
+	"GET /api/v1/volumes":                                  true,
+	"GET /api/v1/volumes/orphans":                          true,
+	"GET /api/v1/images/update-check":                      true,
+	"GET /api/v1/graphql":                                  true,
+	"GET /api/v1/hosts/containers":                         true,
+	"GET /api/v1/hosts/stats":                              true,
+	"GET /api/v1/search":                                   true,
+	"GET /api/v1/discovery":                                true,
+	"POST /api/v1/graphql":                                 true,
+}
+
+// rate is a number of requests per period; a zero rate is no limit
+type rate struct {
+	n      float64
+	period time.Duration
+}
+
+func (r rate) String() string {
+	return fmt.Sprintf("%g per %s", r.n, r.period)
+}
+
+// envRate parses the environment variable name as N/s, N/m or N/h,
+// returning no limit when it is unset or invalid
+func envRate(name string) rate {
+	v := os.Getenv(name)
+	if v == "" {
+		return rate{}
+	}
+	n, unit, _ := strings.Cut(v, "/")
+	count, err := strconv.ParseFloat(n, 64)
+	period := map[string]time.Duration{"s": time.Second, "m": time.Minute, "h": time.Hour}[unit]
+	if err != nil || count <= 0 || period == 0 {
+		logger.Warn("invalid rate limit, not limiting", "variable", name, "value", v)
+		return rate{}
+	}
+	return rate{n: count, period: period}
+}
+
+// tokenBucket holds up to n tokens and regains them at the limit's rate
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take removes a token if there is one. Otherwise it returns how long
+// until there is.
+func (b *tokenBucket) take(limit rate, now time.Time) (bool, time.Duration) {
+	perToken := limit.period.Seconds() / limit.n
+	b.tokens = math.Min(limit.n, b.tokens+now.Sub(b.last).Seconds()/perToken)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) * perToken * float64(time.Second))
+}
+
+// rateLimiter keeps a bucket per client for one limit
+type rateLimiter struct {
+	mu      sync.Mutex
+	limit   rate
+	buckets map[string]*tokenBucket
+}
+
+func newRateLimiter(limit rate) *rateLimiter {
+	l := &rateLimiter{limit: limit, buckets: map[string]*tokenBucket{}}
+	go l.sweep()
+	return l
+}
+
+// allow takes a token from the client's bucket
+func (l *rateLimiter) allow(client string) (bool, time.Duration) {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.buckets[client]
+	if !ok {
+		b = &tokenBucket{tokens: l.limit.n, last: now}
+		l.buckets[client] = b
+	}
+	return b.take(l.limit, now)
+}
+
+// sweep forgets clients whose buckets have refilled, so the map does not
+// grow with every address ever seen
+func (l *rateLimiter) sweep() {
+	for {
+		time.Sleep(l.limit.period)
+		cutoff := time.Now().Add(-l.limit.period)
+		l.mu.Lock()
+		for client, b := range l.buckets {
+			if b.last.Before(cutoff) {
+				delete(l.buckets, client)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
+
+// clientKey identifies the caller by the principal authenticate found,
+// and by address otherwise. A bearer token alone is not used: with
+// authentication off nothing checks it, and a client could send a new
+// one with every request to start with a full bucket each time.
+func clientKey(c *gin.Context) string {
+	if p, ok := c.Request.Context().Value(principalKey{}).(principal); ok {
+		return "principal:" + p.Provider + ":" + p.Name
+	}
+	return "ip:" + c.ClientIP()
+}
+
+// limitRate rejects requests beyond CONTAINERSCOPE_RATE_LIMIT, and
+// expensive ones beyond CONTAINERSCOPE_RATE_LIMIT_EXPENSIVE, with 429 and
+// a Retry-After header
+func limitRate() gin.HandlerFunc {
+	var general, expensive *rateLimiter
+	if rateLimit.n > 0 {
+		general = newRateLimiter(rateLimit)
+		logger.Info("rate limiting enabled", "limit", rateLimit.String())
+	}
+	if expensiveRateLimit.n > 0 {
+		expensive = newRateLimiter(expensiveRateLimit)
+		logger.Info("rate limiting expensive requests", "limit", expensiveRateLimit.String())
+	}
+	return func(c *gin.Context) {
+		client := clientKey(c)
+		if expensive != nil && expensiveRequests[c.Request.Method+" "+c.FullPath()] {
+			if ok, wait := expensive.allow(client); !ok {
+				rejectRate(c, "expensive", wait)
+				return
+			}
+		}
+		if general != nil {
+			if ok, wait := general.allow(client); !ok {
+				rejectRate(c, "general", wait)
+				return
+			}
+		}
+		c.Next()
+	}
+}
+
+// rejectRate answers 429 with the whole seconds until a retry can succeed
+func rejectRate(c *gin.Context, limit string, wait time.Duration) {
+	rateLimited.WithLabelValues(limit).Inc()
+	c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	respondError(c, http.StatusTooManyRequests, codeRateLimited, "Rate limit exceeded, retry later")
+}
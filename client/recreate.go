@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/api/types/network"
+	"github.com/gin-gonic/gin"
+)
+
+// recreateMu serializes recreates so the updater and API requests never
+// replace the same container at once
+var recreateMu sync.Mutex
+
+// recreateContainer replaces a container with one created from imageRef
+// with the same name, config, host config and networks, and returns the new
+// container's ID. imageRef must already be present locally. The old
+// container is renamed and stopped rather than removed until the new one is
+// up, and is put back if anything fails.
+func recreateContainer(ctx context.Context, containerID, imageRef string) (string, error) {
+	recreateMu.Lock()
+	defer recreateMu.Unlock()
+
+	old, err := docker(ctx).ContainerInspect(ctx, containerID)
+	if err != nil {
+		return "", err
+	}
+	name := strings.TrimPrefix(old.Name, "/")
+	config, hostConfig := replacementConfig(ctx, old, imageRef)
+	primary, extra := recreateNetworks(old)
+
+	// Find out now if another container took the ports while this one was
+	// stopped, rather than after stopping it
+	if err := checkPortConflicts(ctx, &hostConfig, old.ID); err != nil {
+		return "", err
+	}
+
+	backupName := fmt.Sprintf("%s-old-%d", name, time.Now().Unix())
+	if err := docker(ctx).ContainerRename(ctx, old.ID, backupName); err != nil {
+		return "", fmt.Errorf("renaming old container: %w", err)
+	}
+	// The rollback must run even when the request was cancelled or timed
+	// out, which is often why a step failed, or the old container is left
+	// renamed and stopped
+	restore := func(newID string) {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), requestTimeout)
+		defer cancel()
+		if newID != "" {
+			if err := docker(ctx).ContainerRemove(ctx, newID, container.RemoveOptions{Force: true}); err != nil {
+				logger.Warn("could not remove replacement container", "container", newID, "error", err)
+			}
+		}
+		if err := docker(ctx).ContainerRename(ctx, old.ID, name); err != nil {
+			logger.Error("could not restore container name", "container", backupName, "name", name, "error", err)
+		}
+		if old.State.Running {
+			if err := docker(ctx).ContainerStart(ctx, old.ID, container.StartOptions{}); err != nil {
+				logger.Error("could not restart replaced container", "container", name, "error", err)
+			}
+		}
+	}
+
+	if old.State.Running {
+		if err := docker(ctx).ContainerStop(ctx, old.ID, container.StopOptions{}); err != nil {
+			restore("")
+			return "", fmt.Errorf("stopping old container: %w", err)
+		}
+	}
+
+	created, err := docker(ctx).ContainerCreate(ctx, &config, &hostConfig, primary, nil, name)
+	if err != nil {
+		restore("")
+		return "", fmt.Errorf("creating container: %w", err)
+	}
+
+	for networkName, endpoint := range extra {
+		if err := docker(ctx).NetworkConnect(ctx, networkName, created.ID, endpoint); err != nil {
+			restore(created.ID)
+			return "", fmt.Errorf("connecting network %s: %w", networkName, err)
+		}
+	}
+
+	if old.State.Running {
+		if err := docker(ctx).ContainerStart(ctx, created.ID, container.StartOptions{}); err != nil {
+			restore(created.ID)
+			return "", fmt.Errorf("starting container: %w", err)
+		}
+	}
+
+	if err := docker(ctx).ContainerRemove(ctx, old.ID, container.RemoveOptions{}); err != nil {
+		logger.Warn("could not remove replaced container", "container", backupName, "error", err)
+	}
+	return created.ID, nil
+}
+
+// replacementConfig returns the config and host config for a container
+// replacing old, created from imageRef and keeping its anonymous volumes
+func replacementConfig(ctx context.Context, old types.ContainerJSON, imageRef string) (container.Config, container.HostConfig) {
+	config := *old.Config
+	config.Image = imageRef
+	if config.Hostname == old.ID[:12] {
+		config.Hostname = ""
+	}
+	// Drop settings inherited from the old image so the new image's
+	// defaults apply rather than being pinned to stale values
+	if oldImage, _, err := docker(ctx).ImageInspectWithRaw(ctx, old.Image); err == nil && oldImage.Config != nil {
+		stripImageDefaults(&config, oldImage.Config)
+	}
+
+	hostConfig := *old.HostConfig
+	hostConfig.Binds = append(anonymousVolumeBinds(old), hostConfig.Binds...)
+	return config, hostConfig
+}
+
+// stripImageDefaults clears config values that were inherited unchanged
+// from the image the container was created from
+func stripImageDefaults(config, imageConfig *container.Config) {
+	imageEnv := map[string]bool{}
+	for _, env := range imageConfig.Env {
+		imageEnv[env] = true
+	}
+	env := []string{}
+	for _, e := range config.Env {
+		if !imageEnv[e] {
+			env = append(env, e)
+		}
+	}
+	config.Env = env
+
+	labels := map[string]string{}
+	for k, v := range config.Labels {
+		if imageValue, ok := imageConfig.Labels[k]; !ok || imageValue != v {
+			labels[k] = v
+		}
+	}
+	config.Labels = labels
+
+	if strings.Join(config.Cmd, "\x00") == strings.Join(imageConfig.Cmd, "\x00") {
+		config.Cmd = nil
+	}
+	if strings.Join(config.Entrypoint, "\x00") == strings.Join(imageConfig.Entrypoint, "\x00") {
+		config.Entrypoint = nil
+	}
+	if config.WorkingDir == imageConfig.WorkingDir {
+		config.WorkingDir = ""
+	}
+	if config.User == imageConfig.User {
+		config.User = ""
+	}
+	for port := range imageConfig.ExposedPorts {
+		delete(config.ExposedPorts, port)
+	}
+	for volume := range imageConfig.Volumes {
+		delete(config.Volumes, volume)
+	}
+	if config.Healthcheck != nil && imageConfig.Healthcheck != nil &&
+		strings.Join(config.Healthcheck.Test, "\x00") == strings.Join(imageConfig.Healthcheck.Test, "\x00") {
+		config.Healthcheck = nil
+	}
+}
+
+// anonymousVolumeBinds returns binds that reattach the old container's
+// anonymous volumes, which would otherwise be replaced by empty ones
+func anonymousVolumeBinds(old types.ContainerJSON) []string {
+	declared := map[string]bool{}
+	for _, bind := range old.HostConfig.Binds {
+		parts := strings.Split(bind, ":")
+		if len(parts) >= 2 {
+			declared[parts[1]] = true
+		}
+	}
+	for _, m := range old.HostConfig.Mounts {
+		declared[m.Target] = true
+	}
+
+	binds := []string{}
+	for _, m := range old.Mounts {
+		if m.Type == mount.TypeVolume && m.Name != "" && !declared[m.Destination] {
+			binds = append(binds, m.Name+":"+m.Destination)
+		}
+	}
+	return binds
+}
+
+// recreateNetworks splits the old container's networks into the one it can
+// be created with and the ones to connect afterwards, keeping only the
+// user-supplied endpoint settings
+func recreateNetworks(old types.ContainerJSON) (*network.NetworkingConfig, map[string]*network.EndpointSettings) {
+	mode := old.HostConfig.NetworkMode
+	if mode.IsHost() || mode.IsNone() || mode.IsContainer() || old.NetworkSettings == nil {
+		return nil, nil
+	}
+
+	names := []string{}
+	for name := range old.NetworkSettings.Networks {
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		return nil, nil
+	}
+	// Create with the network named by the network mode, connect the rest
+	sort.Strings(names)
+	for i, name := range names {
+		if name == string(mode) {
+			names[0], names[i] = names[i], names[0]
+		}
+	}
+
+	endpoints := map[string]*network.EndpointSettings{}
+	for _, name := range names {
+		endpoint := old.NetworkSettings.Networks[name]
+		aliases := []string{}
+		for _, alias := range endpoint.Aliases {
+			if alias != old.ID[:12] {
+				aliases = append(aliases, alias)
+			}
+		}
+		endpoints[name] = &network.EndpointSettings{
+			IPAMConfig: endpoint.IPAMConfig,
+			Links:      endpoint.Links,
+			Aliases:    aliases,
+			DriverOpts: endpoint.DriverOpts,
+		}
+	}
+
+	primary := &network.NetworkingConfig{EndpointsConfig: map[string]*network.EndpointSettings{names[0]: endpoints[names[0]]}}
+	delete(endpoints, names[0])
+	return primary, endpoints
+}
+
+// recreateWithImage pulls the requested image and replaces the container
+// with one created from it, keeping everything else the same
+func recreateWithImage(c *gin.Context) {
+	var req struct {
+		Image string `json:"image" binding:"required"`
+		Pull  *bool  `json:"pull"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		badRequest(c, "image is required")
+		return
+	}
+
+	ctx := hostContext(c)
+	if req.Pull == nil || *req.Pull {
+		if err := pullImage(ctx, req.Image); err != nil {
+			dockerError(c, "Error pulling image", err)
+			return
+		}
+	}
+
+	newID, err := recreateContainer(ctx, c.Param("container_id"), req.Image)
+	if err != nil {
+		dockerError(c, "Error recreating container", err)
+		return
+	}
+
+	respond(c, http.StatusOK, gin.H{"message": "Container recreated successfully", "id": newID, "image": req.Image})
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/gin-gonic/gin"
+)
+
+// Fields a redaction rule can apply to
+const (
+	redactEnv    = "env"
+	redactCmd    = "cmd"
+	redactLabels = "labels"
+)
+
+// Redaction actions: mask replaces a value, strip removes the variable,
+// argument or label altogether
+const (
+	redactMask  = "mask"
+	redactStrip = "strip"
+)
+
+// redactionRule hides parts of a container's configuration from callers
+// with Roles, or from everyone when Roles is empty. An environment
+// variable, label or command-line option matches when its name contains
+// one of Patterns, ignoring case; a rule without patterns matches all of
+// them.
+type redactionRule struct {
+	Field    string   `json:"field"`
+	Patterns []string `json:"patterns"`
+	Action   string   `json:"action"`
+	Roles    []string `json:"roles"`
+}
+
+// redactionRules are applied in order to inspect output and generated run
+// specs. CONTAINERSCOPE_REDACTION_FILE replaces the default, which masks
+// secret environment variables.
+var redactionRules = []redactionRule{{Field: redactEnv, Patterns: secretEnvPatterns, Action: redactMask}}
+
+// loadRedaction reads the JSON array of rules in
+// CONTAINERSCOPE_REDACTION_FILE
+func loadRedaction() error {
+	path := os.Getenv("CONTAINERSCOPE_REDACTION_FILE")
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var rules []redactionRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	for i := range rules {
+		rule := &rules[i]
+		if rule.Field != redactEnv && rule.Field != redactCmd && rule.Field != redactLabels {
+			return fmt.Errorf("%s: rule %d: unknown field %q, expected env, cmd or labels", path, i+1, rule.Field)
+		}
+		if rule.Action == "" {
+			rule.Action = redactMask
+		}
+		if rule.Action != redactMask && rule.Action != redactStrip {
+			return fmt.Errorf("%s: rule %d: unknown action %q, expected mask or strip", path, i+1, rule.Action)
+		}
+		for _, role := range rule.Roles {
+			if roleRank[role] == 0 {
+				return fmt.Errorf("%s: rule %d: unknown role %q, expected viewer, operator or admin", path, i+1, role)
+			}
+		}
+	}
+	redactionRules = rules
+	logger.Info("redaction rules loaded", "rules", len(redactionRules))
+	return nil
+}
+
+// appliesTo reports whether the rule hides anything from role
+func (rule redactionRule) appliesTo(role string) bool {
+	return len(rule.Roles) == 0 || contains(rule.Roles, role)
+}
+
+// matches reports whether name contains one of the rule's patterns
+func (rule redactionRule) matches(name string) bool {
+	if len(rule.Patterns) == 0 {
+		return true
+	}
+	name = strings.ToUpper(name)
+	for _, pattern := range rule.Patterns {
+		if strings.Contains(name, strings.ToUpper(pattern)) {
+			return true
+		}
+	}
+	return false
+}
+
+// fieldRedaction returns how the rules for role hide the environment
+// variable, label or option name in field: strip, mask, or "" when they
+// leave it alone
+func fieldRedaction(field, name, role string) string {
+	action := ""
+	for _, rule := range redactionRules {
+		if rule.Field != field || !rule.appliesTo(role) || !rule.matches(name) {
+			continue
+		}
+		if rule.Action == redactStrip {
+			return redactStrip
+		}
+		action = redactMask
+	}
+	return action
+}
+
+// callerRole is the role of the request's token or session, or operator
+// when the API is open
+func callerRole(c *gin.Context) string {
+	if p, found, valid := identify(c); found && valid {
+		return p.Role
+	}
+	return roleOperator
+}
+
+// redactEnvList applies rule to variables in Docker's NAME=value form
+func redactEnvList(env []string, rule redactionRule) []string {
+	if env == nil {
+		return nil
+	}
+	out := make([]string, 0, len(env))
+	for _, e := range env {
+		name, _, _ := strings.Cut(e, "=")
+		switch {
+		case !rule.matches(name):
+			out = append(out, e)
+		case rule.Action == redactMask:
+			out = append(out, name+"="+maskedValue)
+		}
+	}
+	return out
+}
+
+// redactArgs applies rule to command-line arguments. A --name=value option
+// loses its value and a --name option the argument after it; any other
+// matching argument is hidden whole.
+func redactArgs(args []string, rule redactionRule) []string {
+	if args == nil {
+		return nil
+	}
+	mask := rule.Action == redactMask
+	out := make([]string, 0, len(args))
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		name, _, hasValue := strings.Cut(arg, "=")
+		if !rule.matches(name) {
+			out = append(out, arg)
+			continue
+		}
+		switch {
+		case len(rule.Patterns) == 0:
+			if mask {
+				out = append(out, maskedValue)
+			}
+		case hasValue:
+			if mask {
+				out = append(out, name+"="+maskedValue)
+			}
+		case strings.HasPrefix(arg, "-"):
+			if mask {
+				out = append(out, arg)
+			}
+			if i+1 < len(args) && !strings.HasPrefix(args[i+1], "-") {
+				i++
+				if mask {
+					out = append(out, maskedValue)
+				}
+			}
+		case mask:
+			out = append(out, maskedValue)
+		}
+	}
+	return out
+}
+
+// redactLabelMap applies rule to labels in place
+func redactLabelMap(labels map[string]string, rule redactionRule) {
+	for key := range labels {
+		if !rule.matches(key) {
+			continue
+		}
+		if rule.Action == redactStrip {
+			delete(labels, key)
+		} else {
+			labels[key] = maskedValue
+		}
+	}
+}
+
+// redactConfig applies the rules for role to a container's configuration
+func redactConfig(config *container.Config, role string) {
+	if config == nil {
+		return
+	}
+	for _, rule := range redactionRules {
+		if !rule.appliesTo(role) {
+			continue
+		}
+		switch rule.Field {
+		case redactEnv:
+			config.Env = redactEnvList(config.Env, rule)
+		case redactCmd:
+			config.Cmd = redactArgs(config.Cmd, rule)
+			config.Entrypoint = redactArgs(config.Entrypoint, rule)
+		case redactLabels:
+			redactLabelMap(config.Labels, rule)
+		}
+	}
+}
+
+// redactInspection applies the rules for role to inspect output, including
+// the arguments the daemon reports the container was started with
+func redactInspection(inspection *types.ContainerJSON, role string) {
+	redactConfig(inspection.Config, role)
+	if inspection.ContainerJSONBase == nil {
+		return
+	}
+	for _, rule := range redactionRules {
+		if rule.appliesTo(role) && rule.Field == redactCmd {
+			inspection.Args = redactArgs(inspection.Args, rule)
+		}
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redisStoreTimeout bounds each store operation against Redis
+const redisStoreTimeout = 10 * time.Second
+
+// redisPageSize is how many keys a range over a bucket reads at a time
+const redisPageSize = 500
+
+// redisCreate sets a field of a bucket's hash and adds it to the bucket's
+// key index unless the field exists, returning 1 if it did
+var redisCreate = redis.NewScript(`
+if redis.call('HSETNX', KEYS[1], ARGV[1], ARGV[2]) == 0 then
+	return 0
+end
+redis.call('ZADD', KEYS[2], 0, ARGV[1])
+return 1
+`)
+
+// redisTake removes a field of a bucket's hash and its index entry,
+// returning the value it held
+var redisTake = redis.NewScript(`
+local value = redis.call('HGET', KEYS[1], ARGV[1])
+if value then
+	redis.call('HDEL', KEYS[1], ARGV[1])
+	redis.call('ZREM', KEYS[2], ARGV[1])
+end
+return value
+`)
+
+// redisDeleteIf removes a field of a bucket's hash and its index entry if
+// it holds the given value, returning 1 if it did
+var redisDeleteIf = redis.NewScript(`
+if redis.call('HGET', KEYS[1], ARGV[1]) ~= ARGV[2] then
+	return 0
+end
+redis.call('HDEL', KEYS[1], ARGV[1])
+redis.call('ZREM', KEYS[2], ARGV[1])
+return 1
+`)
+
+// redisRenew extends the leader key's expiry if it still holds the term
+var redisRenew = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+// redisStore keeps each bucket in Redis as a hash of its keys and values,
+// indexed by a sorted set of the keys for reading them in order, so
+// replicas of the agent share their state
+type redisStore struct {
+	client *redis.Client
+	prefix string
+}
+
+// openRedisStore connects to CONTAINERSCOPE_REDIS_URL and checks that
+// Redis answers before the agent relies on it. Keys start with
+// CONTAINERSCOPE_REDIS_PREFIX, by default containerscope:.
+func openRedisStore() (redisStore, error) {
+	options, err := redis.ParseURL(envOr("CONTAINERSCOPE_REDIS_URL", "redis://127.0.0.1:6379/0"))
+	if err != nil {
+		return redisStore{}, fmt.Errorf("CONTAINERSCOPE_REDIS_URL: %w", err)
+	}
+	s := redisStore{client: redis.NewClient(options), prefix: envOr("CONTAINERSCOPE_REDIS_PREFIX", "containerscope:")}
+	ctx, cancel := context.WithTimeout(context.Background(), redisStoreTimeout)
+	defer cancel()
+	if err := s.client.Ping(ctx).Err(); err != nil {
+		return redisStore{}, fmt.Errorf("redis: %w", err)
+	}
+	return s, nil
+}
+
+// bucket is the hash holding a bucket's values, and index the sorted set
+// of its keys
+func (s redisStore) bucket(name string) (string, string) {
+	return s.prefix + "store:" + name, s.prefix + "index:" + name
+}
+
+func (s redisStore) put(bucket, key string, data []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), redisStoreTimeout)
+	defer cancel()
+	values, index := s.bucket(bucket)
+	_, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, values, key, data)
+		pipe.ZAdd(ctx, index, redis.Z{Member: key})
+		return nil
+	})
+	return err
+}
+
+func (s redisStore) get(bucket, key string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisStoreTimeout)
+	defer cancel()
+	values, _ := s.bucket(bucket)
+	data, err := s.client.HGet(ctx, values, key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	return data, err
+}
+
+func (s redisStore) delete(bucket, key string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), redisStoreTimeout)
+	defer cancel()
+	values, index := s.bucket(bucket)
+	_, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HDel(ctx, values, key)
+		pipe.ZRem(ctx, index, key)
+		return nil
+	})
+	return err
+}
+
+func (s redisStore) create(bucket, key string, data []byte) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisStoreTimeout)
+	defer cancel()
+	values, index := s.bucket(bucket)
+	created, err := redisCreate.Run(ctx, s.client, []string{values, index}, key, data).Int()
+	return created == 1, err
+}
+
+func (s redisStore) take(bucket, key string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisStoreTimeout)
+	defer cancel()
+	values, index := s.bucket(bucket)
+	data, err := redisTake.Run(ctx, s.client, []string{values, index}, key).Text()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return []byte(data), nil
+}
+
+func (s redisStore) deleteIf(bucket, key string, data []byte) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisStoreTimeout)
+	defer cancel()
+	values, index := s.bucket(bucket)
+	deleted, err := redisDeleteIf.Run(ctx, s.client, []string{values, index}, key, data).Int()
+	return deleted == 1, err
+}
+
+// eachRange reads the range a page at a time, so a large bucket such as
+// the event history is not loaded at once. A key deleted between reading
+// the index and the values is skipped.
+func (s redisStore) eachRange(bucket, from, to string, fn func(key string, value []byte) error) error {
+	values, index := s.bucket(bucket)
+	start, end := "["+from, "+"
+	if from == "" {
+		start = "-"
+	}
+	if to != "" {
+		end = "(" + to
+	}
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), redisStoreTimeout)
+		keys, err := s.client.ZRangeByLex(ctx, index, &redis.ZRangeBy{Min: start, Max: end, Count: redisPageSize}).Result()
+		var page []interface{}
+		if err == nil && len(keys) > 0 {
+			page, err = s.client.HMGet(ctx, values, keys...).Result()
+		}
+		cancel()
+		if err != nil {
+			return err
+		}
+		for i, key := range keys {
+			if value, ok := page[i].(string); ok {
+				if err := fn(key, []byte(value)); err != nil {
+					return err
+				}
+			}
+		}
+		if len(keys) < redisPageSize {
+			return nil
+		}
+		// The next page starts just after the last key
+		start = "(" + keys[len(keys)-1]
+	}
+}
+
+func (s redisStore) deleteBefore(bucket, key string) (int, error) {
+	if key == "" {
+		return 0, nil
+	}
+	values, index := s.bucket(bucket)
+	deleted := 0
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), redisStoreTimeout)
+		keys, err := s.client.ZRangeByLex(ctx, index, &redis.ZRangeBy{Min: "-", Max: "(" + key, Count: redisPageSize}).Result()
+		if err == nil && len(keys) > 0 {
+			_, err = s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.HDel(ctx, values, keys...)
+				members := make([]interface{}, len(keys))
+				for i, key := range keys {
+					members[i] = key
+				}
+				pipe.ZRem(ctx, index, members...)
+				return nil
+			})
+		}
+		cancel()
+		if err != nil {
+			return deleted, err
+		}
+		deleted += len(keys)
+		if len(keys) < redisPageSize {
+			return deleted, nil
+		}
+	}
+}
+
+// leaderKey is the Redis key holding the leading replica's ID, which
+// expires unless the leader renews it
+func (s redisStore) leaderKey() string {
+	return s.prefix + "leader"
+}
+
+// campaign sets the leader key if no replica holds it; the replica's ID
+// is the term
+func (s redisStore) campaign(ctx context.Context, id string) (string, error) {
+	set, err := s.client.SetNX(ctx, s.leaderKey(), id, leaderTTL).Result()
+	if err != nil || !set {
+		return "", err
+	}
+	return id, nil
+}
+
+func (s redisStore) renew(ctx context.Context, term string) error {
+	renewed, err := redisRenew.Run(ctx, s.client, []string{s.leaderKey()}, term, leaderTTL.Milliseconds()).Int()
+	if err != nil {
+		return err
+	}
+	if renewed == 0 {
+		return fmt.Errorf("%w: %s", errTermLapsed, term)
+	}
+	return nil
+}
+
+func (s redisStore) leader(ctx context.Context) (string, error) {
+	id, err := s.client.Get(ctx, s.leaderKey()).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", nil
+	}
+	return id, err
+}
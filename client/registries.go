@@ -0,0 +1,492 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/distribution/reference"
+	"github.com/docker/cli/cli/config"
+	clitypes "github.com/docker/cli/cli/config/types"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/registry"
+	"github.com/gin-gonic/gin"
+)
+
+// registryBucket holds registry credentials keyed by name, with their
+// secrets sealed by secretKey
+const registryBucket = "registries"
+
+// dockerHubServer is the address Docker keys Docker Hub credentials by
+const dockerHubServer = "https://index.docker.io/v1/"
+
+// secretKey encrypts secrets the agent stores, read from
+// CONTAINERSCOPE_SECRET_KEY_FILE or generated in the data directory
+var secretKey []byte
+
+// registryNamePattern is what a registry's name may look like
+var registryNamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// loadSecretKey reads the 32-byte key used to seal stored secrets,
+// creating it on first start
+func loadSecretKey() error {
+	path := envOr("CONTAINERSCOPE_SECRET_KEY_FILE", filepath.Join(dataDir(), "secret.key"))
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return err
+		}
+		if err := os.WriteFile(path, []byte(base64.StdEncoding.EncodeToString(key)+"\n"), 0o600); err != nil {
+			return err
+		}
+		logger.Info("generated secret key", "path", path)
+		secretKey = key
+		return nil
+	} else if err != nil {
+		return err
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != 32 {
+		return fmt.Errorf("%s: expected 32 base64-encoded bytes", path)
+	}
+	secretKey = key
+	return nil
+}
+
+// sealSecret encrypts s with AES-GCM, returning base64 of nonce and
+// ciphertext. The empty string stays empty.
+func sealSecret(s string) (string, error) {
+	if s == "" {
+		return "", nil
+	}
+	gcm, err := secretCipher()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, []byte(s), nil)), nil
+}
+
+// openSecret decrypts a value from sealSecret
+func openSecret(sealed string) (string, error) {
+	if sealed == "" {
+		return "", nil
+	}
+	gcm, err := secretCipher()
+	if err != nil {
+		return "", err
+	}
+	data, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil || len(data) < gcm.NonceSize() {
+		return "", errors.New("malformed sealed secret")
+	}
+	plain, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", errors.New("secret does not decrypt with the current secret key")
+	}
+	return string(plain), nil
+}
+
+func secretCipher() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(secretKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// registryCredential is a stored login for a registry. Password and
+// IdentityToken are sealed and never returned by the API.
+type registryCredential struct {
+	Name          string    `json:"name"`
+	Server        string    `json:"server"`
+	Username      string    `json:"username,omitempty"`
+	Password      string    `json:"password,omitempty"`
+	IdentityToken string    `json:"identity_token,omitempty"`
+	Created       time.Time `json:"created"`
+	Updated       time.Time `json:"updated"`
+}
+
+// registryView is a credential as the API shows it, secrets replaced by
+// whether they are set
+type registryView struct {
+	Name             string    `json:"name"`
+	Server           string    `json:"server"`
+	Username         string    `json:"username,omitempty"`
+	HasPassword      bool      `json:"has_password"`
+	HasIdentityToken bool      `json:"has_identity_token"`
+	Created          time.Time `json:"created"`
+	Updated          time.Time `json:"updated"`
+}
+
+func (r registryCredential) view() registryView {
+	return registryView{
+		Name:             r.Name,
+		Server:           r.Server,
+		Username:         r.Username,
+		HasPassword:      r.Password != "",
+		HasIdentityToken: r.IdentityToken != "",
+		Created:          r.Created,
+		Updated:          r.Updated,
+	}
+}
+
+// authConfig decrypts the credential for the daemon
+func (r registryCredential) authConfig() (registry.AuthConfig, error) {
+	password, err := openSecret(r.Password)
+	if err != nil {
+		return registry.AuthConfig{}, err
+	}
+	identityToken, err := openSecret(r.IdentityToken)
+	if err != nil {
+		return registry.AuthConfig{}, err
+	}
+	return registry.AuthConfig{
+		Username:      r.Username,
+		Password:      password,
+		IdentityToken: identityToken,
+		ServerAddress: serverAddress(registryHost(r.Server)),
+	}, nil
+}
+
+// registryHost reduces a registry address, with or without scheme and
+// path, to the host images name it by; Docker Hub's aliases become
+// docker.io
+func registryHost(server string) string {
+	host := server
+	if u, err := url.Parse(server); err == nil && u.Host != "" {
+		host = u.Host
+	}
+	host, _, _ = strings.Cut(host, "/")
+	switch host = strings.ToLower(host); host {
+	case "index.docker.io", "registry-1.docker.io", "registry.hub.docker.com":
+		return "docker.io"
+	}
+	return host
+}
+
+// serverAddress is the address Docker keys a host's credentials by
+func serverAddress(host string) string {
+	if host == "docker.io" {
+		return dockerHubServer
+	}
+	return host
+}
+
+// imageRegistry returns the registry host an image reference pulls from
+func imageRegistry(ref string) (string, bool) {
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return "", false
+	}
+	return reference.Domain(named), true
+}
+
+// loadRegistries returns every stored credential, by name
+func loadRegistries() ([]registryCredential, error) {
+	var creds []registryCredential
+	err := storeEach(registryBucket, func(key string, value []byte) error {
+		var cred registryCredential
+		if err := json.Unmarshal(value, &cred); err != nil {
+			return err
+		}
+		creds = append(creds, cred)
+		return nil
+	})
+	return creds, err
+}
+
+// registryAuthFor finds credentials for the registry an image is pulled
+// from or pushed to: a stored credential for its host, or else the
+// agent's Docker config and credential helpers
+func registryAuthFor(ref string) (registry.AuthConfig, bool) {
+	host, ok := imageRegistry(ref)
+	if !ok {
+		return registry.AuthConfig{}, false
+	}
+	creds, err := loadRegistries()
+	if err != nil {
+		logger.Warn("reading registry credentials", "error", err)
+	}
+	for _, cred := range creds {
+		if registryHost(cred.Server) != host {
+			continue
+		}
+		auth, err := cred.authConfig()
+		if err != nil {
+			logger.Warn("decrypting registry credential", "registry", cred.Name, "error", err)
+			continue
+		}
+		return auth, true
+	}
+	return dockerConfigAuth(host)
+}
+
+// dockerConfigAuth reads credentials for host the way the docker CLI
+// does, from DOCKER_CONFIG or ~/.docker/config.json and any credential
+// helper (credsStore, credHelpers) it names
+func dockerConfigAuth(host string) (registry.AuthConfig, bool) {
+	cf := config.LoadDefaultConfigFile(io.Discard)
+	auth, err := cf.GetAuthConfig(serverAddress(host))
+	if err != nil {
+		logger.Warn("reading Docker credentials", "registry", host, "error", err)
+		return registry.AuthConfig{}, false
+	}
+	if auth.Username == "" && auth.Password == "" && auth.IdentityToken == "" && auth.Auth == "" {
+		return registry.AuthConfig{}, false
+	}
+	return fromCLIAuth(auth), true
+}
+
+func fromCLIAuth(auth clitypes.AuthConfig) registry.AuthConfig {
+	return registry.AuthConfig{
+		Username:      auth.Username,
+		Password:      auth.Password,
+		Auth:          auth.Auth,
+		ServerAddress: auth.ServerAddress,
+		IdentityToken: auth.IdentityToken,
+		RegistryToken: auth.RegistryToken,
+	}
+}
+
+// encodedRegistryAuth is the X-Registry-Auth value for ref, empty when
+// there are no credentials for its registry
+func encodedRegistryAuth(ref string) string {
+	auth, ok := registryAuthFor(ref)
+	if !ok {
+		return ""
+	}
+	encoded, err := registry.EncodeAuthConfig(auth)
+	if err != nil {
+		logger.Warn("encoding registry credentials", "error", err)
+		return ""
+	}
+	return encoded
+}
+
+// buildAuthConfigs is every known credential keyed by server address,
+// for builds pulling base images from any registry. Stored credentials
+// win over the Docker config's.
+func buildAuthConfigs() map[string]registry.AuthConfig {
+	auths := map[string]registry.AuthConfig{}
+	all, err := config.LoadDefaultConfigFile(io.Discard).GetAllCredentials()
+	if err != nil {
+		logger.Warn("reading Docker credentials", "error", err)
+	}
+	for server, auth := range all {
+		auths[server] = fromCLIAuth(auth)
+	}
+	creds, err := loadRegistries()
+	if err != nil {
+		logger.Warn("reading registry credentials", "error", err)
+	}
+	for _, cred := range creds {
+		if auth, err := cred.authConfig(); err == nil {
+			auths[auth.ServerAddress] = auth
+		}
+	}
+	return auths
+}
+
+// registryRequest is the body for creating or replacing a credential.
+// Leaving out password or identity_token on update keeps the stored one;
+// an empty string clears it.
+type registryRequest struct {
+	Name          string  `json:"name"`
+	Server        string  `json:"server" binding:"required"`
+	Username      string  `json:"username"`
+	Password      *string `json:"password"`
+	IdentityToken *string `json:"identity_token"`
+}
+
+// findRegistry loads the credential named by the name parameter, replying
+// 404 when there is none
+func findRegistry(c *gin.Context) (registryCredential, bool) {
+	var cred registryCredential
+	found, err := storeGet(registryBucket, c.Param("name"), &cred)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, codeInternal, "Error reading registry")
+		return cred, false
+	}
+	if !found {
+		respondError(c, http.StatusNotFound, codeNotFound, "Registry not found")
+		return cred, false
+	}
+	return cred, true
+}
+
+// listRegistries returns the stored credentials without their secrets
+func listRegistries(c *gin.Context) {
+	creds, err := loadRegistries()
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, codeInternal, "Error reading registries")
+		return
+	}
+	views := []registryView{}
+	for _, cred := range creds {
+		views = append(views, cred.view())
+	}
+	sort.Slice(views, func(i, j int) bool { return views[i].Name < views[j].Name })
+	respond(c, http.StatusOK, views)
+}
+
+// getRegistry returns one credential without its secrets
+func getRegistry(c *gin.Context) {
+	if cred, ok := findRegistry(c); ok {
+		respond(c, http.StatusOK, cred.view())
+	}
+}
+
+// bindRegistry parses and validates a create or update body
+func bindRegistry(c *gin.Context) (registryRequest, bool) {
+	var req registryRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		badRequest(c, "server is required")
+		return req, false
+	}
+	if registryHost(req.Server) == "" {
+		badRequest(c, "server must be a registry host such as ghcr.io or docker.io")
+		return req, false
+	}
+	return req, true
+}
+
+// saveRegistry applies req to cred, sealing its secrets, and stores it
+func saveRegistry(c *gin.Context, cred registryCredential, req registryRequest, status int) {
+	cred.Server, cred.Username, cred.Updated = req.Server, req.Username, time.Now()
+	var err error
+	if req.Password != nil {
+		if cred.Password, err = sealSecret(*req.Password); err != nil {
+			respondError(c, http.StatusInternalServerError, codeInternal, err.Error())
+			return
+		}
+	}
+	if req.IdentityToken != nil {
+		if cred.IdentityToken, err = sealSecret(*req.IdentityToken); err != nil {
+			respondError(c, http.StatusInternalServerError, codeInternal, err.Error())
+			return
+		}
+	}
+	if err := storePut(registryBucket, cred.Name, cred); err != nil {
+		respondError(c, http.StatusInternalServerError, codeInternal, "Error saving registry")
+		return
+	}
+	respond(c, status, cred.view())
+}
+
+// createRegistry stores a credential under a new name
+func createRegistry(c *gin.Context) {
+	req, ok := bindRegistry(c)
+	if !ok {
+		return
+	}
+	if !registryNamePattern.MatchString(req.Name) {
+		badRequest(c, "name is required and may contain letters, digits, '.', '_' and '-'")
+		return
+	}
+	var existing registryCredential
+	if found, err := storeGet(registryBucket, req.Name, &existing); err != nil {
+		respondError(c, http.StatusInternalServerError, codeInternal, "Error reading registry")
+		return
+	} else if found {
+		respondError(c, http.StatusConflict, codeConflict, fmt.Sprintf("Registry %s already exists", req.Name))
+		return
+	}
+	saveRegistry(c, registryCredential{Name: req.Name, Created: time.Now()}, req, http.StatusCreated)
+}
+
+// updateRegistry replaces a credential's settings; its name stays
+func updateRegistry(c *gin.Context) {
+	cred, ok := findRegistry(c)
+	if !ok {
+		return
+	}
+	if req, ok := bindRegistry(c); ok {
+		saveRegistry(c, cred, req, http.StatusOK)
+	}
+}
+
+// deleteRegistry removes a credential
+func deleteRegistry(c *gin.Context) {
+	cred, ok := findRegistry(c)
+	if !ok {
+		return
+	}
+	if err := storeDelete(registryBucket, cred.Name); err != nil {
+		respondError(c, http.StatusInternalServerError, codeInternal, "Error deleting registry")
+		return
+	}
+	respondMessage(c, "Registry deleted successfully")
+}
+
+// imageRefRequest is the body for pulling or pushing an image
+type imageRefRequest struct {
+	Image string `json:"image" binding:"required"`
+}
+
+// imagePull pulls an image using any credentials known for its
+// registry
+func imagePull(c *gin.Context) {
+	ctx := hostContext(c)
+	var req imageRefRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		badRequest(c, "image is required")
+		return
+	}
+	if err := pullImage(ctx, req.Image); err != nil {
+		dockerError(c, "Error pulling image", err)
+		return
+	}
+	respond(c, http.StatusOK, gin.H{"message": "Image pulled successfully", "image": req.Image})
+}
+
+// imagePush pushes a tagged image using any credentials known for its
+// registry
+func imagePush(c *gin.Context) {
+	ctx := hostContext(c)
+	var req imageRefRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		badRequest(c, "image is required")
+		return
+	}
+	if err := pushImage(ctx, req.Image); err != nil {
+		dockerError(c, "Error pushing image", err)
+		return
+	}
+	respond(c, http.StatusOK, gin.H{"message": "Image pushed successfully", "image": req.Image})
+}
+
+// pushImage pushes ref and waits for the push to finish
+func pushImage(ctx context.Context, ref string) error {
+	// The daemon wants an X-Registry-Auth header on pushes even without
+	// credentials
+	auth := encodedRegistryAuth(ref)
+	if auth == "" {
+		auth, _ = registry.EncodeAuthConfig(registry.AuthConfig{})
+	}
+	out, err := docker(ctx).ImagePush(ctx, ref, types.ImagePushOptions{RegistryAuth: auth})
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	_, err = readJSONMessages(out)
+	return err
+}
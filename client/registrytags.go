@@ -0,0 +1,416 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types/registry"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/sync/errgroup"
+)
+
+// registryClient talks to registries' HTTP APIs for the tag browser
+var registryClient = &http.Client{Timeout: 30 * time.Second}
+
+// manifestMediaTypes are the manifest formats the tag browser accepts
+var manifestMediaTypes = []string{
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+}
+
+// errRegistryUnauthorized is returned when the registry refuses the
+// stored credentials
+var errRegistryUnauthorized = errors.New("the registry refused the stored credentials")
+
+// registryTag is one tag of a repository. Digest and Created are filled in
+// when the registry reports them cheaply or details are asked for.
+type registryTag struct {
+	Name    string     `json:"name"`
+	Digest  string     `json:"digest,omitempty"`
+	Created *time.Time `json:"created,omitempty"`
+}
+
+// registryRepo is a repository on a registry, reached with a stored
+// credential. It fetches a bearer token on the first 401 and reuses it.
+type registryRepo struct {
+	base string
+	repo string
+	auth registry.AuthConfig
+
+	mu    sync.Mutex
+	token string
+}
+
+// newRegistryRepo resolves the API base URL for cred's server. Docker Hub
+// serves its API from registry-1.docker.io and keeps official images
+// under library/.
+func newRegistryRepo(cred registryCredential, repo string) (*registryRepo, error) {
+	auth, err := cred.authConfig()
+	if err != nil {
+		return nil, err
+	}
+	host := registryHost(cred.Server)
+	scheme := "https"
+	if strings.HasPrefix(cred.Server, "http://") {
+		scheme = "http"
+	}
+	if host == "docker.io" {
+		host = "registry-1.docker.io"
+		if !strings.Contains(repo, "/") {
+			repo = "library/" + repo
+		}
+	}
+	return &registryRepo{base: scheme + "://" + host, repo: repo, auth: auth}, nil
+}
+
+// get requests path under the repository's /v2/<repo>/ API, authenticating
+// when challenged. The caller closes the body.
+func (r *registryRepo) get(ctx context.Context, method, path string, accept []string) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, method, r.base+"/v2/"+r.repo+"/"+path, nil)
+		if err != nil {
+			return nil, err
+		}
+		for _, mediaType := range accept {
+			req.Header.Add("Accept", mediaType)
+		}
+		r.mu.Lock()
+		token := r.token
+		r.mu.Unlock()
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		} else if r.auth.Username != "" && r.auth.Password != "" {
+			req.SetBasicAuth(r.auth.Username, r.auth.Password)
+		}
+		resp, err := registryClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusUnauthorized || attempt > 0 {
+			if resp.StatusCode == http.StatusUnauthorized {
+				resp.Body.Close()
+				return nil, errRegistryUnauthorized
+			}
+			return resp, nil
+		}
+		challenge := resp.Header.Get("WWW-Authenticate")
+		resp.Body.Close()
+		if !strings.HasPrefix(strings.ToLower(challenge), "bearer ") {
+			return nil, errRegistryUnauthorized
+		}
+		token, err = r.fetchToken(ctx, challenge)
+		if err != nil {
+			return nil, err
+		}
+		r.mu.Lock()
+		r.token = token
+		r.mu.Unlock()
+	}
+}
+
+// fetchToken answers a Bearer challenge from the registry's token service,
+// with the stored username and password, or the identity token as an
+// OAuth refresh token
+func (r *registryRepo) fetchToken(ctx context.Context, challenge string) (string, error) {
+	params := parseChallenge(challenge[len("bearer "):])
+	realm, err := url.Parse(params["realm"])
+	if err != nil || realm.Scheme == "" {
+		return "", fmt.Errorf("registry sent an unusable token realm %q", params["realm"])
+	}
+	scope := params["scope"]
+	if scope == "" {
+		scope = "repository:" + r.repo + ":pull"
+	}
+
+	var req *http.Request
+	if r.auth.IdentityToken != "" {
+		form := url.Values{
+			"grant_type":    {"refresh_token"},
+			"refresh_token": {r.auth.IdentityToken},
+			"service":       {params["service"]},
+			"scope":         {scope},
+			"client_id":     {"containerscope"},
+		}
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, realm.String(), strings.NewReader(form.Encode()))
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		query := realm.Query()
+		query.Set("scope", scope)
+		if service := params["service"]; service != "" {
+			query.Set("service", service)
+		}
+		realm.RawQuery = query.Encode()
+		if req, err = http.NewRequestWithContext(ctx, http.MethodGet, realm.String(), nil); err != nil {
+			return "", err
+		}
+		if r.auth.Username != "" {
+			req.SetBasicAuth(r.auth.Username, r.auth.Password)
+		}
+	}
+
+	resp, err := registryClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return "", errRegistryUnauthorized
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token service returned %s", resp.Status)
+	}
+	var body struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", err
+	}
+	if body.Token == "" {
+		body.Token = body.AccessToken
+	}
+	if body.Token == "" {
+		return "", errors.New("token service returned no token")
+	}
+	return body.Token, nil
+}
+
+// parseChallenge splits the key="value" pairs of a WWW-Authenticate
+// challenge
+func parseChallenge(s string) map[string]string {
+	params := map[string]string{}
+	for s != "" {
+		key, rest, ok := strings.Cut(strings.TrimLeft(s, " ,"), "=")
+		if !ok {
+			break
+		}
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end < 0 {
+				break
+			}
+			value, s = rest[1:end+1], rest[end+2:]
+		} else {
+			value, s, _ = strings.Cut(rest, ",")
+		}
+		params[strings.ToLower(strings.TrimSpace(key))] = value
+	}
+	return params
+}
+
+// registryStatusError turns an unexpected registry response into an error
+func registryStatusError(resp *http.Response) error {
+	if resp.StatusCode == http.StatusNotFound {
+		return errRegistryNotFound
+	}
+	var body struct {
+		Errors []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	if json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&body) == nil && len(body.Errors) > 0 {
+		return fmt.Errorf("registry returned %s: %s", resp.Status, body.Errors[0].Message)
+	}
+	return fmt.Errorf("registry returned %s", resp.Status)
+}
+
+// errRegistryNotFound is returned for a repository the registry does not
+// have, or does not show with the stored credentials
+var errRegistryNotFound = errors.New("repository not found")
+
+// listTags returns up to limit tags after the cursor, and the cursor for
+// the next page or "" on the last one
+func (r *registryRepo) listTags(ctx context.Context, limit int, cursor string) ([]registryTag, string, error) {
+	query := url.Values{"n": {strconv.Itoa(limit)}}
+	if cursor != "" {
+		query.Set("last", cursor)
+	}
+	resp, err := r.get(ctx, http.MethodGet, "tags/list?"+query.Encode(), nil)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", registryStatusError(resp)
+	}
+	var body struct {
+		Tags []string `json:"tags"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, "", err
+	}
+
+	tags := make([]registryTag, 0, len(body.Tags))
+	for _, name := range body.Tags {
+		tags = append(tags, registryTag{Name: name})
+	}
+	if len(tags) > limit {
+		tags = tags[:limit]
+	}
+	// Registries that paginate say so with a Link header; the rest return
+	// every tag at once
+	next := ""
+	if strings.Contains(resp.Header.Get("Link"), `rel="next"`) && len(tags) > 0 {
+		next = tags[len(tags)-1].Name
+	}
+	return tags, next, nil
+}
+
+// tagDetails fills in a tag's digest and, for single-platform images or
+// the linux/amd64 entry of an index, when its image was created
+func (r *registryRepo) tagDetails(ctx context.Context, tag *registryTag) error {
+	manifest, digest, err := r.manifest(ctx, tag.Name)
+	if err != nil {
+		return err
+	}
+	tag.Digest = digest
+
+	if len(manifest.Manifests) > 0 {
+		platform := manifest.Manifests[0]
+		for _, m := range manifest.Manifests {
+			if m.Platform.OS == "linux" && m.Platform.Architecture == "amd64" {
+				platform = m
+				break
+			}
+		}
+		if manifest, _, err = r.manifest(ctx, platform.Digest); err != nil {
+			return err
+		}
+	}
+	if manifest.Config.Digest == "" {
+		return nil
+	}
+
+	resp, err := r.get(ctx, http.MethodGet, "blobs/"+manifest.Config.Digest, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return registryStatusError(resp)
+	}
+	var config struct {
+		Created *time.Time `json:"created"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 4<<20)).Decode(&config); err != nil {
+		return err
+	}
+	tag.Created = config.Created
+	return nil
+}
+
+// registryManifest is the part of an image manifest or index the tag
+// browser reads
+type registryManifest struct {
+	Config struct {
+		Digest string `json:"digest"`
+	} `json:"config"`
+	Manifests []struct {
+		Digest   string `json:"digest"`
+		Platform struct {
+			OS           string `json:"os"`
+			Architecture string `json:"architecture"`
+		} `json:"platform"`
+	} `json:"manifests"`
+}
+
+// manifest fetches the manifest for a tag or digest, with its digest
+func (r *registryRepo) manifest(ctx context.Context, ref string) (registryManifest, string, error) {
+	var manifest registryManifest
+	resp, err := r.get(ctx, http.MethodGet, "manifests/"+ref, manifestMediaTypes)
+	if err != nil {
+		return manifest, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return manifest, "", registryStatusError(resp)
+	}
+	err = json.NewDecoder(io.LimitReader(resp.Body, 4<<20)).Decode(&manifest)
+	return manifest, resp.Header.Get("Docker-Content-Digest"), err
+}
+
+// repositoryPattern is a repository's path within its registry, as the
+// distribution reference grammar defines it: lowercase components joined
+// by slashes. It keeps ".." and anything else that would reach other
+// registry endpoints with the stored credential out of the URL.
+var repositoryPattern = regexp.MustCompile(`^[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*(?:/[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*)*$`)
+
+// listRegistryTags lists a repository's tags through the registry's HTTP
+// API with a stored credential. ?details=true adds each tag's digest and
+// creation time, at a few requests per tag.
+func listRegistryTags(c *gin.Context) {
+	// The repository may contain slashes, so the route ends in a
+	// wildcard that must itself end in /tags
+	repo, ok := strings.CutSuffix(strings.TrimPrefix(c.Param("repo"), "/"), "/tags")
+	if !ok || repo == "" {
+		respondError(c, http.StatusNotFound, codeNotFound, "Expected /registries/{name}/repos/{repository}/tags")
+		return
+	}
+	if !repositoryPattern.MatchString(repo) {
+		badRequest(c, "Invalid repository name "+strconv.Quote(repo))
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if err != nil || limit < 1 || limit > 1000 {
+		badRequest(c, "limit must be between 1 and 1000")
+		return
+	}
+	details := c.Query("details") == "true"
+	if details && limit > 100 {
+		badRequest(c, "limit may be at most 100 with details=true")
+		return
+	}
+	cred, ok := findRegistry(c)
+	if !ok {
+		return
+	}
+	r, err := newRegistryRepo(cred, repo)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, codeInternal, err.Error())
+		return
+	}
+
+	ctx := c.Request.Context()
+	tags, next, err := r.listTags(ctx, limit, c.Query("cursor"))
+	if err == nil && details {
+		g, gctx := errgroup.WithContext(ctx)
+		g.SetLimit(4)
+		for i := range tags {
+			tag := &tags[i]
+			g.Go(func() error { return r.tagDetails(gctx, tag) })
+		}
+		err = g.Wait()
+	}
+	switch {
+	case errors.Is(err, errRegistryNotFound):
+		respondError(c, http.StatusNotFound, codeNotFound, fmt.Sprintf("Repository %s not found on %s", repo, cred.Server))
+		return
+	case errors.Is(err, errRegistryUnauthorized):
+		respondError(c, http.StatusBadGateway, codeUpstreamError, fmt.Sprintf("%s refused the credentials stored as %s", cred.Server, cred.Name))
+		return
+	case errors.Is(err, context.DeadlineExceeded):
+		respondError(c, http.StatusGatewayTimeout, codeTimeout, "Timed out waiting for the registry")
+		return
+	case err != nil:
+		respondError(c, http.StatusBadGateway, codeUpstreamError, "Error listing tags: "+err.Error())
+		return
+	}
+
+	respond(c, http.StatusOK, gin.H{"registry": cred.Name, "repository": repo, "tags": tags, "next_cursor": next})
+}
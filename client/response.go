@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
+	"github.com/gin-gonic/gin"
+)
+
+// Machine-readable error codes returned in the response envelope
+const (
+	codeBadRequest           = "BAD_REQUEST"
+	codeContainerNotFound    = "CONTAINER_NOT_FOUND"
+	codeImageNotFound        = "IMAGE_NOT_FOUND"
+	codeVolumeNotFound       = "VOLUME_NOT_FOUND"
+	codeProjectNotFound      = "PROJECT_NOT_FOUND"
+	codeStackNotFound        = "STACK_NOT_FOUND"
+	codeHostNotFound         = "HOST_NOT_FOUND"
+	codeConflict             = "CONFLICT"
+	codeComposeError         = "COMPOSE_ERROR"
+	codeNotFound             = "NOT_FOUND"
+	codeDockerError          = "DOCKER_ERROR"
+	codeDockerUnavailable    = "DOCKER_UNAVAILABLE"
+	codeTimeout              = "TIMEOUT"
+	codeUnauthorized         = "UNAUTHORIZED"
+	codeForbidden            = "FORBIDDEN"
+	codeNotSupported         = "NOT_SUPPORTED"
+	codeRateLimited          = "RATE_LIMITED"
+	codeConfirmationRequired = "CONFIRMATION_REQUIRED"
+	codeUpstreamError        = "UPSTREAM_ERROR"
+	codeUnhealthy            = "UNHEALTHY"
+	codeInternal             = "INTERNAL_ERROR"
+)
+
+// notFoundCodeKey is the gin context key holding the code a Docker 404 maps to
+const notFoundCodeKey = "not_found_code"
+
+// apiError is the error half of the response envelope
+type apiError struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// envelope wraps every JSON response; exactly one of Data and Error is set
+type envelope struct {
+	Data  interface{} `json:"data"`
+	Error *apiError   `json:"error"`
+}
+
+// respond writes a successful enveloped response
+func respond(c *gin.Context, status int, data interface{}) {
+	c.JSON(status, envelope{Data: data})
+}
+
+// respondETag writes a successful enveloped response tagged with a hash of
+// its body, or 304 Not Modified when the client already has that body
+func respondETag(c *gin.Context, data interface{}) {
+	body, err := json.Marshal(envelope{Data: data})
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, codeInternal, err.Error())
+		return
+	}
+	sum := sha256.Sum256(body)
+	etag := `"` + hex.EncodeToString(sum[:8]) + `"`
+	c.Header("ETag", etag)
+	for _, tag := range strings.Split(c.GetHeader("If-None-Match"), ",") {
+		if tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/"); tag == etag || tag == "*" {
+			c.Status(http.StatusNotModified)
+			return
+		}
+	}
+	c.Data(http.StatusOK, "application/json; charset=utf-8", body)
+}
+
+// respondMessage writes a successful response whose data is a short message
+func respondMessage(c *gin.Context, message string) {
+	respond(c, http.StatusOK, gin.H{"message": message})
+}
+
+// respondError writes an enveloped error and stops the handler chain
+func respondError(c *gin.Context, status int, code, message string) {
+	apiErrors.WithLabelValues(code).Inc()
+	c.AbortWithStatusJSON(status, envelope{Error: &apiError{
+		Code:      code,
+		Message:   message,
+		RequestID: c.GetString(requestIDKey),
+	}})
+}
+
+// badRequest rejects a malformed request
+func badRequest(c *gin.Context, message string) {
+	respondError(c, http.StatusBadRequest, codeBadRequest, message)
+}
+
+// notFoundAs sets the error code Docker 404s map to for a route group, so
+// a missing container and a missing image are reported distinctly
+func notFoundAs(code string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set(notFoundCodeKey, code)
+		c.Next()
+	}
+}
+
+// dockerStatus maps an error from the Docker SDK to an HTTP status and error
+// code; notFoundCode is the code 404s are reported with
+func dockerStatus(err error, notFoundCode string) (int, string) {
+	switch {
+	case errdefs.IsNotFound(err):
+		if notFoundCode == "" {
+			notFoundCode = codeNotFound
+		}
+		return http.StatusNotFound, notFoundCode
+	case errdefs.IsConflict(err):
+		return http.StatusConflict, codeConflict
+	case errdefs.IsInvalidParameter(err):
+		return http.StatusBadRequest, codeBadRequest
+	case errdefs.IsUnauthorized(err), errdefs.IsForbidden(err):
+		return http.StatusForbidden, codeForbidden
+	case errdefs.IsNotImplemented(err):
+		return http.StatusNotImplemented, codeNotSupported
+	case errdefs.IsDeadline(err), errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout, codeTimeout
+	case errdefs.IsUnavailable(err), client.IsErrConnectionFailed(err):
+		return http.StatusServiceUnavailable, codeDockerUnavailable
+	}
+	return http.StatusInternalServerError, codeDockerError
+}
+
+// dockerError records a failed Docker call against the request and replies
+// with an enveloped error whose status and code reflect what went wrong:
+// 404 with the route's not-found code, 409 for conflicts, 400 for invalid
+// parameters, 503 when the daemon is unreachable, and so on
+func dockerError(c *gin.Context, msg string, err error) {
+	c.Error(err)
+	status, code := dockerStatus(err, c.GetString(notFoundCodeKey))
+	respondError(c, status, code, fmt.Sprintf("%s: %v", msg, err))
+}
+
+// streamResponse copies r to the client as it arrives, flushing after every
+// read, for long-running operations such as builds and pulls
+func streamResponse(c *gin.Context, contentType string, r io.Reader) {
+	c.Header("Content-Type", contentType)
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Status(http.StatusOK)
+	buf := make([]byte, 32*1024)
+	c.Stream(func(w io.Writer) bool {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return false
+			}
+		}
+		if err != nil && !errors.Is(err, io.EOF) {
+			c.Error(err)
+		}
+		return err == nil
+	})
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/gin-gonic/gin"
+)
+
+// defaultHealthTimeout is how long a rolling restart waits for each
+// container to come back when the request does not say
+const defaultHealthTimeout = 2 * time.Minute
+
+// healthPollInterval is how often a restarted container is inspected
+// while waiting for it
+const healthPollInterval = time.Second
+
+// rollingRestartRequest is the body of POST /groups/restart. Exactly one
+// of Label and Project selects the containers.
+type rollingRestartRequest struct {
+	Label   string `json:"label"`
+	Project string `json:"project"`
+
+	// TimeoutSeconds is how long each restart waits before killing; nil
+	// uses the container's own stop timeout
+	TimeoutSeconds *int `json:"timeout_seconds"`
+	// HealthTimeoutSeconds is how long to wait for each container to be
+	// healthy, or running when it has no health check
+	HealthTimeoutSeconds int `json:"health_timeout_seconds"`
+	// AbortOnFailure stops before the next container when one fails
+	AbortOnFailure bool `json:"abort_on_failure"`
+}
+
+// rollingResult reports the restart of one container of the group
+type rollingResult struct {
+	ContainerID string `json:"container_id"`
+	Name        string `json:"name"`
+	Success     bool   `json:"success"`
+	// Health is the state the container reached: healthy, or running for
+	// a container without a health check
+	Health   string `json:"health,omitempty"`
+	Duration string `json:"duration,omitempty"`
+	Skipped  bool   `json:"skipped,omitempty"`
+	Warning  string `json:"warning,omitempty"`
+	Error    string `json:"error,omitempty"`
+	Code     string `json:"code,omitempty"`
+}
+
+// errUnhealthy is returned while waiting for a container that reports
+// unhealthy, exits or takes too long
+var errUnhealthy = errors.New("container did not become healthy")
+
+// waitHealthy waits until a container is healthy, or running when it has
+// no health check, and returns which. It fails as soon as the container
+// reports unhealthy or stops, and once timeout has passed.
+func waitHealthy(ctx context.Context, containerID string, timeout time.Duration) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	for {
+		inspection, err := docker(ctx).ContainerInspect(ctx, containerID)
+		if err != nil {
+			if ctx.Err() != nil {
+				return "", fmt.Errorf("%w after %s", errUnhealthy, timeout)
+			}
+			return "", err
+		}
+		state := inspection.State
+		switch {
+		case state == nil:
+			return "", errUnhealthy
+		case !state.Running && !state.Restarting:
+			return "", fmt.Errorf("%w: it is %s with exit code %d", errUnhealthy, state.Status, state.ExitCode)
+		case state.Restarting:
+		case state.Health == nil || state.Health.Status == types.NoHealthcheck:
+			return "running", nil
+		case state.Health.Status == types.Healthy:
+			return types.Healthy, nil
+		case state.Health.Status == types.Unhealthy:
+			return "", fmt.Errorf("%w: it reports unhealthy", errUnhealthy)
+		}
+		select {
+		case <-ctx.Done():
+			return "", fmt.Errorf("%w after %s", errUnhealthy, timeout)
+		case <-time.After(healthPollInterval):
+		}
+	}
+}
+
+// rollingRestart restarts the containers matching a label selector or in
+// a compose project one at a time, by name, waiting for each to be healthy
+// before moving on so a group of replicas is never down at once. Stopped
+// containers are left alone. With abort_on_failure the restart stops at
+// the first container that fails and the rest are reported as skipped.
+func rollingRestart(c *gin.Context) {
+	var req rollingRestartRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		badRequest(c, "Invalid request")
+		return
+	}
+	if (req.Label == "") == (req.Project == "") {
+		badRequest(c, "Specify exactly one of label or project")
+		return
+	}
+	if req.TimeoutSeconds != nil && *req.TimeoutSeconds < -1 {
+		badRequest(c, "timeout_seconds must be -1 or greater")
+		return
+	}
+	if req.HealthTimeoutSeconds < 0 {
+		badRequest(c, "health_timeout_seconds must not be negative")
+		return
+	}
+	healthTimeout := defaultHealthTimeout
+	if req.HealthTimeoutSeconds > 0 {
+		healthTimeout = time.Duration(req.HealthTimeoutSeconds) * time.Second
+	}
+	label := req.Label
+	if req.Project != "" {
+		label = composeProjectLabel + "=" + req.Project
+	}
+
+	ctx := hostContext(c)
+	list, err := docker(ctx).ContainerList(ctx, container.ListOptions{
+		All:     true,
+		Filters: scopeFilters(ctx, filters.NewArgs(filters.Arg("label", label))),
+	})
+	if err != nil {
+		dockerError(c, "Error listing containers", err)
+		return
+	}
+	group := make([]types.Container, 0, len(list))
+	for _, cont := range list {
+		if len(cont.Names) == 0 || inQuarantine(cont) {
+			continue
+		}
+		group = append(group, cont)
+	}
+	if len(group) == 0 {
+		if req.Project != "" {
+			respondError(c, http.StatusNotFound, codeProjectNotFound, fmt.Sprintf("No containers found for project %s", req.Project))
+		} else {
+			respondError(c, http.StatusNotFound, codeContainerNotFound, "No containers match "+req.Label)
+		}
+		return
+	}
+	sort.Slice(group, func(i, j int) bool { return group[i].Names[0] < group[j].Names[0] })
+
+	results := make([]rollingResult, len(group))
+	aborted := false
+	for i, cont := range group {
+		result := &results[i]
+		*result = rollingResult{ContainerID: cont.ID, Name: strings.TrimPrefix(cont.Names[0], "/")}
+		switch {
+		case aborted:
+			result.Skipped = true
+			continue
+		case cont.State != "running":
+			result.Success, result.Skipped = true, true
+			result.Warning = "Container is not running"
+			continue
+		}
+		start := time.Now()
+		err := docker(ctx).ContainerRestart(ctx, cont.ID, container.StopOptions{Timeout: req.TimeoutSeconds})
+		if err == nil {
+			result.Health, err = waitHealthy(ctx, cont.ID, healthTimeout)
+		}
+		result.Duration = time.Since(start).Round(time.Millisecond).String()
+		if err != nil {
+			if !errors.Is(err, errUnhealthy) {
+				_, result.Code = dockerStatus(err, codeContainerNotFound)
+			}
+			result.Error = err.Error()
+			aborted = req.AbortOnFailure
+			logger.Warn("rolling restart failed", "container", result.Name, "error", err, "host", hostFrom(ctx).Name)
+			continue
+		}
+		result.Success = true
+	}
+
+	restarted, failed, skipped := 0, 0, 0
+	for _, result := range results {
+		switch {
+		case result.Skipped:
+			skipped++
+		case result.Success:
+			restarted++
+		default:
+			failed++
+		}
+	}
+	respond(c, http.StatusOK, gin.H{
+		"results":   results,
+		"restarted": restarted,
+		"failed":    failed,
+		"skipped":   skipped,
+		"aborted":   aborted,
+	})
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/gin-gonic/gin"
+	"gopkg.in/yaml.v3"
+)
+
+// composeLabelPrefix marks labels compose adds itself, which would be
+// wrong to copy into a new definition
+const composeLabelPrefix = "com.docker.compose."
+
+// containerSpec is the user-supplied configuration of a container, with
+// values inherited from its image removed
+type containerSpec struct {
+	name        string
+	image       string
+	config      container.Config
+	hostConfig  *container.HostConfig
+	ports       []string
+	volumes     []string
+	networks    []string
+	labels      []string
+	restart     string
+	networkMode string
+}
+
+// loadContainerSpec inspects a container and reduces it to the settings
+// needed to recreate it by hand
+func loadContainerSpec(ctx context.Context, containerID string) (*containerSpec, error) {
+	inspection, err := docker(ctx).ContainerInspect(ctx, containerID)
+	if err != nil {
+		return nil, err
+	}
+
+	spec := &containerSpec{
+		name:       strings.TrimPrefix(inspection.Name, "/"),
+		image:      inspection.Config.Image,
+		config:     *inspection.Config,
+		hostConfig: inspection.HostConfig,
+	}
+	if image, _, err := docker(ctx).ImageInspectWithRaw(ctx, inspection.Image); err == nil && image.Config != nil {
+		stripImageDefaults(&spec.config, image.Config)
+	}
+	if spec.config.Hostname == inspection.ID[:12] {
+		spec.config.Hostname = ""
+	}
+
+	for port, bindings := range inspection.HostConfig.PortBindings {
+		containerPort := port.Port()
+		if port.Proto() != "tcp" {
+			containerPort += "/" + port.Proto()
+		}
+		for _, binding := range bindings {
+			mapping := binding.HostPort + ":" + containerPort
+			if binding.HostPort == "" {
+				mapping = containerPort
+			}
+			if binding.HostIP != "" {
+				mapping = binding.HostIP + ":" + mapping
+			}
+			spec.ports = append(spec.ports, mapping)
+		}
+	}
+	sort.Strings(spec.ports)
+
+	spec.volumes = specVolumes(inspection)
+
+	for k, v := range spec.config.Labels {
+		if !strings.HasPrefix(k, composeLabelPrefix) {
+			spec.labels = append(spec.labels, k+"="+v)
+		}
+	}
+	sort.Strings(spec.labels)
+
+	mode := inspection.HostConfig.NetworkMode
+	switch {
+	case mode.IsHost(), mode.IsNone(), mode.IsContainer():
+		spec.networkMode = string(mode)
+	case inspection.NetworkSettings != nil:
+		for name := range inspection.NetworkSettings.Networks {
+			if name != "bridge" {
+				spec.networks = append(spec.networks, name)
+			}
+		}
+		sort.Strings(spec.networks)
+	}
+
+	policy := inspection.HostConfig.RestartPolicy
+	if policy.Name != "" && policy.Name != "no" {
+		spec.restart = string(policy.Name)
+		if policy.MaximumRetryCount > 0 {
+			spec.restart += ":" + strconv.Itoa(policy.MaximumRetryCount)
+		}
+	}
+	return spec, nil
+}
+
+// specVolumes lists bind mounts and named volumes as src:dst[:ro]. Anonymous
+// volumes are listed by destination only so a new one is created.
+func specVolumes(inspection types.ContainerJSON) []string {
+	volumes := []string{}
+	for _, m := range inspection.Mounts {
+		var volume string
+		switch m.Type {
+		case mount.TypeBind:
+			volume = m.Source + ":" + m.Destination
+		case mount.TypeVolume:
+			volume = m.Destination
+			if m.Name != "" && !isAnonymousVolume(m.Name) {
+				volume = m.Name + ":" + m.Destination
+			}
+		default:
+			continue
+		}
+		if !m.RW {
+			volume += ":ro"
+		}
+		volumes = append(volumes, volume)
+	}
+	sort.Strings(volumes)
+	return volumes
+}
+
+var anonymousVolumeName = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// isAnonymousVolume reports whether name is a generated volume name
+func isAnonymousVolume(name string) bool {
+	return anonymousVolumeName.MatchString(name)
+}
+
+var shellSafe = regexp.MustCompile(`^[A-Za-z0-9_\-./:=@,+%]+$`)
+
+// shellQuote quotes s for a POSIX shell when it needs it
+func shellQuote(s string) string {
+	if shellSafe.MatchString(s) {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// runCommand renders the spec as a docker run one-liner
+func (spec *containerSpec) runCommand() string {
+	args := []string{"docker", "run", "-d", "--name", spec.name}
+	add := func(flag string, values ...string) {
+		for _, v := range values {
+			args = append(args, flag, shellQuote(v))
+		}
+	}
+
+	if spec.restart != "" {
+		add("--restart", spec.restart)
+	}
+	add("-p", spec.ports...)
+	add("-e", spec.config.Env...)
+	add("-v", spec.volumes...)
+	if spec.networkMode != "" {
+		add("--network", spec.networkMode)
+	} else if len(spec.networks) > 0 {
+		// docker run accepts one network; the rest need docker network connect
+		add("--network", spec.networks[0])
+	}
+	add("--label", spec.labels...)
+	if spec.config.Hostname != "" {
+		add("--hostname", spec.config.Hostname)
+	}
+	if spec.config.User != "" {
+		add("--user", spec.config.User)
+	}
+	if spec.config.WorkingDir != "" {
+		add("-w", spec.config.WorkingDir)
+	}
+	if len(spec.config.Entrypoint) > 0 {
+		add("--entrypoint", spec.config.Entrypoint[0])
+	}
+
+	hc := spec.hostConfig
+	if hc.Memory > 0 {
+		add("--memory", strconv.FormatInt(hc.Memory, 10))
+	}
+	if hc.NanoCPUs > 0 {
+		add("--cpus", strconv.FormatFloat(float64(hc.NanoCPUs)/1e9, 'f', -1, 64))
+	}
+	if hc.Privileged {
+		args = append(args, "--privileged")
+	}
+	add("--cap-add", hc.CapAdd...)
+	add("--cap-drop", hc.CapDrop...)
+	for _, device := range hc.Devices {
+		add("--device", device.PathOnHost+":"+device.PathInContainer)
+	}
+	if hc.LogConfig.Type != "" && hc.LogConfig.Type != "json-file" {
+		add("--log-driver", hc.LogConfig.Type)
+	}
+
+	args = append(args, shellQuote(spec.image))
+	if len(spec.config.Entrypoint) > 1 {
+		for _, arg := range spec.config.Entrypoint[1:] {
+			args = append(args, shellQuote(arg))
+		}
+	}
+	for _, arg := range spec.config.Cmd {
+		args = append(args, shellQuote(arg))
+	}
+	return strings.Join(args, " ")
+}
+
+// composeService is a docker compose service definition; omitempty keeps
+// the output to what the container actually sets
+type composeService struct {
+	Image         string   `yaml:"image"`
+	ContainerName string   `yaml:"container_name"`
+	Restart       string   `yaml:"restart,omitempty"`
+	Ports         []string `yaml:"ports,omitempty"`
+	Environment   []string `yaml:"environment,omitempty"`
+	Volumes       []string `yaml:"volumes,omitempty"`
+	NetworkMode   string   `yaml:"network_mode,omitempty"`
+	Networks      []string `yaml:"networks,omitempty"`
+	Labels        []string `yaml:"labels,omitempty"`
+	Hostname      string   `yaml:"hostname,omitempty"`
+	User          string   `yaml:"user,omitempty"`
+	WorkingDir    string   `yaml:"working_dir,omitempty"`
+	Entrypoint    []string `yaml:"entrypoint,omitempty"`
+	Command       []string `yaml:"command,omitempty"`
+	MemLimit      int64    `yaml:"mem_limit,omitempty"`
+	CPUs          float64  `yaml:"cpus,omitempty"`
+	Privileged    bool     `yaml:"privileged,omitempty"`
+	CapAdd        []string `yaml:"cap_add,omitempty"`
+	CapDrop       []string `yaml:"cap_drop,omitempty"`
+	Devices       []string `yaml:"devices,omitempty"`
+}
+
+// composeYAML renders the spec as a compose file with a single service.
+// Networks are declared external since they already exist on the host.
+func (spec *containerSpec) composeYAML() (string, error) {
+	service := composeService{
+		Image:         spec.image,
+		ContainerName: spec.name,
+		Restart:       spec.restart,
+		Ports:         spec.ports,
+		Environment:   spec.config.Env,
+		Volumes:       spec.volumes,
+		NetworkMode:   spec.networkMode,
+		Networks:      spec.networks,
+		Labels:        spec.labels,
+		Hostname:      spec.config.Hostname,
+		User:          spec.config.User,
+		WorkingDir:    spec.config.WorkingDir,
+		Entrypoint:    spec.config.Entrypoint,
+		Command:       spec.config.Cmd,
+		MemLimit:      spec.hostConfig.Memory,
+		CPUs:          float64(spec.hostConfig.NanoCPUs) / 1e9,
+		Privileged:    spec.hostConfig.Privileged,
+		CapAdd:        spec.hostConfig.CapAdd,
+		CapDrop:       spec.hostConfig.CapDrop,
+	}
+	for _, device := range spec.hostConfig.Devices {
+		service.Devices = append(service.Devices, device.PathOnHost+":"+device.PathInContainer)
+	}
+
+	doc := map[string]interface{}{
+		"services": map[string]composeService{serviceName(spec.name): service},
+	}
+	if len(spec.networks) > 0 {
+		networks := map[string]interface{}{}
+		for _, name := range spec.networks {
+			networks[name] = map[string]bool{"external": true}
+		}
+		doc["networks"] = networks
+	}
+
+	out, err := yaml.Marshal(doc)
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
+
+var invalidServiceChars = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+
+// serviceName turns a container name into a valid compose service name
+func serviceName(name string) string {
+	return strings.ToLower(invalidServiceChars.ReplaceAllString(name, "_"))
+}
+
+// containerRunCommand reverse-engineers a docker run command for a
+// container, redacted for the caller's role unless an admin asks for
+// ?reveal=true
+func containerRunCommand(c *gin.Context) {
+	ctx := hostContext(c)
+	reveal, ok := wantsReveal(c)
+	if !ok {
+		return
+	}
+	spec, err := loadContainerSpec(ctx, c.Param("container_id"))
+	if err != nil {
+		dockerError(c, "Error inspecting container", err)
+		return
+	}
+	if !reveal {
+		redactConfig(&spec.config, callerRole(c))
+	}
+
+	respond(c, http.StatusOK, gin.H{"command": spec.runCommand()})
+}
+
+// containerCompose reverse-engineers a compose file for a container,
+// redacted as containerRunCommand is
+func containerCompose(c *gin.Context) {
+	ctx := hostContext(c)
+	reveal, ok := wantsReveal(c)
+	if !ok {
+		return
+	}
+	spec, err := loadContainerSpec(ctx, c.Param("container_id"))
+	if err != nil {
+		dockerError(c, "Error inspecting container", err)
+		return
+	}
+	if !reveal {
+		redactConfig(&spec.config, callerRole(c))
+	}
+
+	compose, err := spec.composeYAML()
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, codeInternal, fmt.Sprintf("Error rendering compose file: %v", err))
+		return
+	}
+
+	respond(c, http.StatusOK, gin.H{"compose": compose})
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Container runtimes the agent can talk to, chosen with CONTAINERSCOPE_RUNTIME
+const (
+	runtimeDocker     = "docker"
+	runtimeContainerd = "containerd"
+	runtimeKubernetes = "kubernetes"
+)
+
+var runtimeName = envOr("CONTAINERSCOPE_RUNTIME", runtimeDocker)
+
+// containerdRoutes are the endpoints implemented for containerd, keyed by
+// method and route pattern. Everything else is Docker-specific.
+var containerdRoutes = map[string]gin.HandlerFunc{
+	"GET /api/v1/containers":                       containerdListContainers,
+	"GET /api/v1/containers/:container_id/inspect": containerdInspectContainer,
+	"GET /api/v1/containers/:container_id/logs":    containerdContainerLogs,
+	"GET /api/v1/containers/:container_id/stats":   containerdContainerStats,
+	"POST /api/v1/containers/start":                containerdStartContainer,
+	"POST /api/v1/containers/stop":                 containerdStopContainer,
+	"POST /api/v1/containers/restart":              containerdRestartContainer,
+	"DELETE /api/v1/containers/delete":             containerdDeleteContainer,
+	"GET /api/v1/images":                           containerdListImages,
+	"GET /api/v1/namespaces":                       containerdListNamespaces,
+	"GET /api/v1/system/version":                   containerdVersion,
+}
+
+// kubernetesRoutes are the endpoints implemented for Kubernetes, which
+// only reads: pods are managed through Kubernetes itself
+var kubernetesRoutes = map[string]gin.HandlerFunc{
+	"GET /api/v1/containers":                       kubeListContainers,
+	"GET /api/v1/containers/:container_id/inspect": kubeInspectContainer,
+	"GET /api/v1/containers/:container_id/logs":    kubeContainerLogs,
+	"GET /api/v1/containers/:container_id/stats":   kubeContainerStats,
+	"GET /api/v1/namespaces":                       kubeListNamespaces,
+	"GET /api/v1/system/version":                   kubeVersion,
+}
+
+// runtimeDispatch sends requests to the containerd or Kubernetes handlers
+// when that runtime is selected, and rejects Docker-only endpoints with
+// NOT_SUPPORTED
+func runtimeDispatch() gin.HandlerFunc {
+	routes := map[string]map[string]gin.HandlerFunc{
+		runtimeContainerd: containerdRoutes,
+		runtimeKubernetes: kubernetesRoutes,
+	}[runtimeName]
+	return func(c *gin.Context) {
+		if runtimeName == runtimeDocker {
+			c.Next()
+			return
+		}
+		if handler, ok := routes[c.Request.Method+" "+c.FullPath()]; ok {
+			handler(c)
+			c.Abort()
+			return
+		}
+		if c.FullPath() != "" {
+			respondError(c, http.StatusNotImplemented, codeNotSupported, "This endpoint is not available with the "+runtimeName+" runtime")
+		}
+	}
+}
+
+// requireRuntime rejects requests with NOT_SUPPORTED unless the agent is
+// using the named runtime, for endpoints that exist only for that runtime
+func requireRuntime(name string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if runtimeName != name {
+			respondError(c, http.StatusNotImplemented, codeNotSupported, "This endpoint requires the "+name+" runtime")
+			return
+		}
+		c.Next()
+	}
+}
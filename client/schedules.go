@@ -0,0 +1,389 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/filters"
+	"github.com/gin-gonic/gin"
+)
+
+// scheduleBucket holds schedules keyed by ID; scheduleRunBucket holds
+// their runs keyed by schedule ID and start time
+const (
+	scheduleBucket    = "schedules"
+	scheduleRunBucket = "schedule_runs"
+)
+
+// maxScheduleRuns is how many runs are kept per schedule
+const maxScheduleRuns = 100
+
+// scheduleActions are the tasks a schedule can run. The container actions
+// need a target or label; the prunes do not.
+var scheduleActions = map[string]bool{
+	"prune_images":     false,
+	"prune_containers": false,
+	"start":            true,
+	"stop":             true,
+	"restart":          true,
+}
+
+// schedule runs a maintenance task whenever its cron expression matches,
+// in its time zone
+type schedule struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Cron     string `json:"cron"`
+	Timezone string `json:"timezone,omitempty"`
+	Action   string `json:"action"`
+	// Target is a container name or ID; Label selects containers instead
+	Target  string    `json:"target,omitempty"`
+	Label   string    `json:"label,omitempty"`
+	Host    string    `json:"host"`
+	Enabled bool      `json:"enabled"`
+	Created time.Time `json:"created"`
+
+	NextRun *time.Time   `json:"next_run,omitempty"`
+	LastRun *scheduleRun `json:"last_run,omitempty"`
+}
+
+// scheduleRun records one run of a schedule
+type scheduleRun struct {
+	ScheduleID string         `json:"schedule_id"`
+	Started    time.Time      `json:"started"`
+	Finished   time.Time      `json:"finished"`
+	Manual     bool           `json:"manual"`
+	Success    bool           `json:"success"`
+	Message    string         `json:"message,omitempty"`
+	Error      string         `json:"error,omitempty"`
+	Results    []actionResult `json:"results,omitempty"`
+}
+
+// scheduleRequest is the body accepted when creating or replacing a
+// schedule
+type scheduleRequest struct {
+	Name     string `json:"name" binding:"required"`
+	Cron     string `json:"cron" binding:"required"`
+	Timezone string `json:"timezone"`
+	Action   string `json:"action" binding:"required"`
+	Target   string `json:"target"`
+	Label    string `json:"label"`
+	Enabled  *bool  `json:"enabled"`
+}
+
+// validate checks the request and returns its parsed cron expression and
+// time zone
+func (req scheduleRequest) validate() (cronSchedule, *time.Location, error) {
+	cron, err := parseCron(req.Cron)
+	if err != nil {
+		return cron, nil, err
+	}
+	loc := time.Local
+	if req.Timezone != "" {
+		if loc, err = time.LoadLocation(req.Timezone); err != nil {
+			return cron, nil, fmt.Errorf("unknown timezone %q", req.Timezone)
+		}
+	}
+	needsTarget, ok := scheduleActions[req.Action]
+	switch {
+	case !ok:
+		return cron, nil, fmt.Errorf("action must be one of prune_images, prune_containers, start, stop or restart")
+	case needsTarget && (req.Target == "") == (req.Label == ""):
+		return cron, nil, fmt.Errorf("%s needs exactly one of target or label", req.Action)
+	case !needsTarget && (req.Target != "" || req.Label != ""):
+		return cron, nil, fmt.Errorf("%s takes no target or label", req.Action)
+	case req.Target != "":
+		if err := checkContainerRef(req.Target); err != nil {
+			return cron, nil, err
+		}
+	}
+	return cron, loc, nil
+}
+
+// location returns the schedule's time zone, or the agent's
+func (s schedule) location() *time.Location {
+	if s.Timezone != "" {
+		if loc, err := time.LoadLocation(s.Timezone); err == nil {
+			return loc
+		}
+	}
+	return time.Local
+}
+
+// startScheduler runs due schedules at the start of every minute until
+// ctx is done. Runs already started finish, as stopping one part way
+// could leave its containers half done.
+func startScheduler(ctx context.Context) {
+	go func() {
+		for {
+			now := time.Now()
+			if !pause(ctx, now.Truncate(time.Minute).Add(time.Minute).Sub(now)) {
+				return
+			}
+			runDueSchedules(time.Now())
+		}
+	}()
+}
+
+// runDueSchedules starts every enabled schedule whose expression matches
+// the minute of now
+func runDueSchedules(now time.Time) {
+	schedules, err := loadSchedules()
+	if err != nil {
+		logger.Warn("loading schedules", "error", err)
+		return
+	}
+	for _, s := range schedules {
+		if !s.Enabled {
+			continue
+		}
+		cron, err := parseCron(s.Cron)
+		if err != nil || !cron.matches(now.In(s.location())) {
+			continue
+		}
+		go runSchedule(s, false)
+	}
+}
+
+// loadSchedules returns every stored schedule, ordered by name
+func loadSchedules() ([]schedule, error) {
+	schedules := []schedule{}
+	err := storeEach(scheduleBucket, func(_ string, value []byte) error {
+		var s schedule
+		if err := json.Unmarshal(value, &s); err != nil {
+			return err
+		}
+		schedules = append(schedules, s)
+		return nil
+	})
+	sort.Slice(schedules, func(i, j int) bool { return schedules[i].Name < schedules[j].Name })
+	return schedules, err
+}
+
+// runSchedule performs a schedule's task and records the run
+func runSchedule(s schedule, manual bool) scheduleRun {
+	run := scheduleRun{ScheduleID: s.ID, Started: time.Now(), Manual: manual}
+	host, ok := dockerHosts[s.Host]
+	if !ok {
+		run.Error = fmt.Sprintf("host %s is not configured", s.Host)
+	} else {
+		ctx, cancel := context.WithTimeout(withHost(context.Background(), host), longRequestTimeout)
+		run.Message, run.Results, run.Error = performScheduledAction(ctx, s)
+		cancel()
+	}
+	run.Finished = time.Now()
+	run.Success = run.Error == ""
+	for _, result := range run.Results {
+		run.Success = run.Success && result.Success
+	}
+
+	logger.Info("schedule ran", "schedule", s.Name, "action", s.Action, "success", run.Success, "error", run.Error)
+	key := s.ID + "/" + historyKey(run.Started, 0)
+	if err := storePut(scheduleRunBucket, key, run); err != nil {
+		logger.Warn("recording schedule run", "schedule", s.Name, "error", err)
+	}
+	trimScheduleRuns(s.ID)
+	return run
+}
+
+// performScheduledAction runs the task of s, returning a summary, the
+// per-container results of container actions, and an error message
+func performScheduledAction(ctx context.Context, s schedule) (string, []actionResult, string) {
+	switch s.Action {
+	case "prune_images":
+		report, err := docker(ctx).ImagesPrune(ctx, filters.NewArgs(filters.Arg("dangling", "true")))
+		if err != nil {
+			return "", nil, err.Error()
+		}
+		return fmt.Sprintf("Removed %d images, reclaimed %d bytes", len(report.ImagesDeleted), report.SpaceReclaimed), nil, ""
+	case "prune_containers":
+		list, err := pruneCandidates(ctx, pruneRequest{})
+		if err != nil {
+			return "", nil, err.Error()
+		}
+		report := removePruneCandidates(ctx, list)
+		return fmt.Sprintf("Removed %d containers, reclaimed %d bytes", len(report.ContainersDeleted), report.SpaceReclaimed), nil, ""
+	}
+
+	action := map[string]containerActionFunc{"start": startAction, "stop": stopAction, "restart": restartAction}[s.Action]
+	req := actionRequest{Label: s.Label}
+	if s.Target != "" {
+		req.ContainerIDs = []string{s.Target}
+	}
+	targets, err := resolveTargets(ctx, req)
+	if err != nil {
+		return "", nil, err.Error()
+	}
+	if len(targets) == 0 {
+		return "No containers matched", nil, ""
+	}
+	results := runBulk(ctx, targets, req, action)
+	return fmt.Sprintf("Ran %s on %d containers", s.Action, len(results)), results, ""
+}
+
+// scheduleRunRange returns the key range of a schedule's runs
+func scheduleRunRange(id string) (string, string) {
+	// "0" is the byte after "/"
+	return id + "/", id + "0"
+}
+
+// trimScheduleRuns deletes all but the newest maxScheduleRuns runs
+func trimScheduleRuns(id string) {
+	from, to := scheduleRunRange(id)
+	var keys []string
+	storeEachRange(scheduleRunBucket, from, to, func(key string, _ []byte) error {
+		keys = append(keys, key)
+		return nil
+	})
+	for len(keys) > maxScheduleRuns {
+		storeDelete(scheduleRunBucket, keys[0])
+		keys = keys[1:]
+	}
+}
+
+// scheduleRuns returns a schedule's runs, newest first
+func scheduleRuns(id string) ([]scheduleRun, error) {
+	from, to := scheduleRunRange(id)
+	runs := []scheduleRun{}
+	err := storeEachRange(scheduleRunBucket, from, to, func(_ string, value []byte) error {
+		var run scheduleRun
+		if err := json.Unmarshal(value, &run); err != nil {
+			return err
+		}
+		runs = append([]scheduleRun{run}, runs...)
+		return nil
+	})
+	return runs, err
+}
+
+// withRunInfo fills in when a schedule runs next and how it last ran
+func withRunInfo(s schedule) schedule {
+	if cron, err := parseCron(s.Cron); err == nil && s.Enabled {
+		if next := cron.next(time.Now().In(s.location())); !next.IsZero() {
+			s.NextRun = &next
+		}
+	}
+	if runs, err := scheduleRuns(s.ID); err == nil && len(runs) > 0 {
+		s.LastRun = &runs[0]
+	}
+	return s
+}
+
+// findSchedule loads the schedule named by the id parameter, replying 404
+// when there is none
+func findSchedule(c *gin.Context) (schedule, bool) {
+	var s schedule
+	found, err := storeGet(scheduleBucket, c.Param("id"), &s)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, codeInternal, "Error reading schedule")
+		return s, false
+	}
+	if !found {
+		respondError(c, http.StatusNotFound, codeNotFound, "Schedule not found")
+		return s, false
+	}
+	return s, true
+}
+
+// listSchedules returns every schedule with its next and last run
+func listSchedules(c *gin.Context) {
+	schedules, err := loadSchedules()
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, codeInternal, "Error reading schedules")
+		return
+	}
+	for i := range schedules {
+		schedules[i] = withRunInfo(schedules[i])
+	}
+	respond(c, http.StatusOK, schedules)
+}
+
+// getSchedule returns one schedule
+func getSchedule(c *gin.Context) {
+	if s, ok := findSchedule(c); ok {
+		respond(c, http.StatusOK, withRunInfo(s))
+	}
+}
+
+// saveSchedule validates the request body and stores it as s
+func saveSchedule(c *gin.Context, s schedule, status int) {
+	var req scheduleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		badRequest(c, "name, cron and action are required")
+		return
+	}
+	if _, _, err := req.validate(); err != nil {
+		badRequest(c, err.Error())
+		return
+	}
+	s.Name, s.Cron, s.Timezone, s.Action = req.Name, strings.TrimSpace(req.Cron), req.Timezone, req.Action
+	s.Target, s.Label = req.Target, req.Label
+	s.Enabled = req.Enabled == nil || *req.Enabled
+	if err := storePut(scheduleBucket, s.ID, s); err != nil {
+		respondError(c, http.StatusInternalServerError, codeInternal, "Error saving schedule")
+		return
+	}
+	respond(c, status, withRunInfo(s))
+}
+
+// createSchedule adds a schedule for the selected host
+func createSchedule(c *gin.Context) {
+	s := schedule{ID: newRequestID(), Host: hostFrom(hostContext(c)).Name, Created: time.Now()}
+	saveSchedule(c, s, http.StatusCreated)
+}
+
+// updateSchedule replaces a schedule's settings
+func updateSchedule(c *gin.Context) {
+	if s, ok := findSchedule(c); ok {
+		saveSchedule(c, s, http.StatusOK)
+	}
+}
+
+// deleteSchedule removes a schedule and its runs
+func deleteSchedule(c *gin.Context) {
+	s, ok := findSchedule(c)
+	if !ok {
+		return
+	}
+	if err := storeDelete(scheduleBucket, s.ID); err != nil {
+		respondError(c, http.StatusInternalServerError, codeInternal, "Error deleting schedule")
+		return
+	}
+	from, to := scheduleRunRange(s.ID)
+	var keys []string
+	storeEachRange(scheduleRunBucket, from, to, func(key string, _ []byte) error {
+		keys = append(keys, key)
+		return nil
+	})
+	for _, key := range keys {
+		storeDelete(scheduleRunBucket, key)
+	}
+	respondMessage(c, "Schedule deleted successfully")
+}
+
+// listScheduleRuns returns a schedule's recorded runs, newest first
+func listScheduleRuns(c *gin.Context) {
+	s, ok := findSchedule(c)
+	if !ok {
+		return
+	}
+	runs, err := scheduleRuns(s.ID)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, codeInternal, "Error reading schedule runs")
+		return
+	}
+	respond(c, http.StatusOK, runs)
+}
+
+// runScheduleNow runs a schedule immediately, whether or not it is
+// enabled, and returns the run
+func runScheduleNow(c *gin.Context) {
+	if s, ok := findSchedule(c); ok {
+		respond(c, http.StatusOK, runSchedule(s, true))
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	"github.com/docker/docker/api/types/filters"
+)
+
+// tokenScopeKey is the context key holding a label-scoped token's labels
+type tokenScopeKey struct{}
+
+// unscopedRoutes are container endpoints a label-scoped token may not use,
+// since they reach containers outside any scope
+var unscopedRoutes = map[string]bool{
+	"GET /api/v1/containers/oom-kills":     true,
+	"GET /api/v1/containers/prune/preview": true,
+	"POST /api/v1/containers/prune":        true,
+}
+
+// scopedRoute reports whether a label-scoped token may use a route: the
+// container endpoints, which filter and check containers against its
+// labels
+func scopedRoute(route string) bool {
+	_, path, _ := strings.Cut(route, " ")
+	return strings.HasPrefix(path, "/api/v1/containers") && !unscopedRoutes[route]
+}
+
+// tokenScope returns the labels the request's token is limited to, or nil
+func tokenScope(ctx context.Context) []string {
+	labels, _ := ctx.Value(tokenScopeKey{}).([]string)
+	return labels
+}
+
+// scopeFilters adds the token's labels to a container list's filters, so
+// the daemon or the cache only returns containers in scope
+func scopeFilters(ctx context.Context, args filters.Args) filters.Args {
+	for _, label := range tokenScope(ctx) {
+		args.Add("label", label)
+	}
+	return args
+}
+
+// inScope reports whether a container's labels match the token's scope
+func inScope(ctx context.Context, labels map[string]string) bool {
+	scope := tokenScope(ctx)
+	return len(scope) == 0 || scopeFilters(ctx, filters.NewArgs()).MatchKVList("label", labels)
+}
+
+// checkScope returns a not found error for a container outside the
+// token's scope, for bulk actions that pass references through unresolved
+func checkScope(ctx context.Context, containerID string) error {
+	if len(tokenScope(ctx)) == 0 {
+		return nil
+	}
+	_, err := resolveContainer(ctx, containerID)
+	return err
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/gin-gonic/gin"
+)
+
+// Bounds on how many matches a search returns
+const (
+	defaultSearchLimit = 100
+	maxSearchLimit     = 1000
+)
+
+// searchMatch is a container a search found, and where
+type searchMatch struct {
+	Host    string   `json:"host"`
+	Name    string   `json:"name"`
+	ID      string   `json:"id"`
+	FullID  string   `json:"full_id"`
+	Image   string   `json:"image"`
+	State   string   `json:"state"`
+	Status  string   `json:"status"`
+	Project string   `json:"project,omitempty"`
+	Matched []string `json:"matched"`
+	rank    int
+}
+
+// matchContainer checks a container's name, image and labels for the
+// lower-cased query and ranks the match: an exact name first, then a name
+// starting with the query, any other name match, and images and labels
+// last. ok is false when nothing matched.
+func matchContainer(cont types.Container, query string) (matched []string, rank int, ok bool) {
+	name := strings.TrimPrefix(cont.Names[0], "/")
+	rank = 4
+	switch lower := strings.ToLower(name); {
+	case lower == query:
+		rank = 0
+	case strings.HasPrefix(lower, query):
+		rank = 1
+	case strings.Contains(lower, query):
+		rank = 2
+	}
+	if rank < 4 {
+		matched = append(matched, "name")
+	}
+	if strings.Contains(strings.ToLower(cont.Image), query) {
+		matched = append(matched, "image")
+		rank = min(rank, 3)
+	}
+	keys := make([]string, 0, len(cont.Labels))
+	for key := range cont.Labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if strings.Contains(strings.ToLower(key+"="+cont.Labels[key]), query) {
+			matched = append(matched, "label:"+key)
+			rank = min(rank, 3)
+		}
+	}
+	return matched, rank, len(matched) > 0
+}
+
+// searchContainers finds containers whose name, image or labels contain
+// ?q=, case-insensitively, on every host the node_label parameters select,
+// searching the hosts concurrently. Stopped containers are included, so
+// the result answers where a container lives as well as where it runs.
+// Matches come best first, up to ?limit=; hosts that cannot be reached are
+// listed under errors.
+func searchContainers(c *gin.Context) {
+	query := strings.ToLower(strings.TrimSpace(c.Query("q")))
+	if query == "" {
+		badRequest(c, "q is required")
+		return
+	}
+	limit := defaultSearchLimit
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxSearchLimit {
+			badRequest(c, fmt.Sprintf("limit must be between 1 and %d", maxSearchLimit))
+			return
+		}
+		limit = n
+	}
+	hosts, err := selectedHosts(c)
+	if err != nil {
+		badRequest(c, err.Error())
+		return
+	}
+
+	var mu sync.Mutex
+	matches := []searchMatch{}
+	errs := forEachHost(c.Request.Context(), hosts, func(ctx context.Context, host *dockerHost) error {
+		containers, err := docker(ctx).ContainerList(ctx, container.ListOptions{All: true, Filters: scopeFilters(ctx, filters.NewArgs())})
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		for _, cont := range containers {
+			if len(cont.Names) == 0 {
+				continue
+			}
+			matched, rank, ok := matchContainer(cont, query)
+			if !ok {
+				continue
+			}
+			matches = append(matches, searchMatch{
+				Host:    host.Name,
+				Name:    strings.TrimPrefix(cont.Names[0], "/"),
+				ID:      cont.ID[:10],
+				FullID:  cont.ID,
+				Image:   cont.Image,
+				State:   cont.State,
+				Status:  cont.Status,
+				Project: cont.Labels[composeProjectLabel],
+				Matched: matched,
+				rank:    rank,
+			})
+		}
+		return nil
+	})
+
+	sort.Slice(matches, func(i, j int) bool {
+		a, b := matches[i], matches[j]
+		switch {
+		case a.rank != b.rank:
+			return a.rank < b.rank
+		case (a.State == "running") != (b.State == "running"):
+			return a.State == "running"
+		case a.Name != b.Name:
+			return a.Name < b.Name
+		}
+		return a.Host < b.Host
+	})
+	total := len(matches)
+	if total > limit {
+		matches = matches[:limit]
+	}
+
+	respond(c, http.StatusOK, gin.H{
+		"query":     query,
+		"matches":   matches,
+		"total":     total,
+		"truncated": total > limit,
+		"errors":    errs,
+	})
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/errdefs"
+	"github.com/gin-gonic/gin"
+)
+
+// swarmObjectRequest is the body for creating a secret or config. Values are
+// write-only: they are never returned by the list endpoints.
+type swarmObjectRequest struct {
+	Name   string            `json:"name" binding:"required"`
+	Data   *string           `json:"data"`
+	Base64 bool              `json:"base64"`
+	Labels map[string]string `json:"labels"`
+}
+
+// value returns the decoded data, or an error message for the caller
+func (req swarmObjectRequest) value() ([]byte, string) {
+	if req.Data == nil {
+		return nil, "data is required"
+	}
+	if !req.Base64 {
+		return []byte(*req.Data), ""
+	}
+	data, err := base64.StdEncoding.DecodeString(*req.Data)
+	if err != nil {
+		return nil, "data is not valid base64"
+	}
+	return data, ""
+}
+
+// bindSwarmObject parses the create body, responding on failure
+func bindSwarmObject(c *gin.Context) (swarmObjectRequest, []byte, bool) {
+	var req swarmObjectRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		badRequest(c, "name and data are required")
+		return req, nil, false
+	}
+	data, msg := req.value()
+	if msg != "" {
+		badRequest(c, msg)
+		return req, nil, false
+	}
+	return req, data, true
+}
+
+// swarmObjectError reports objects still used by services, which the
+// daemon rejects as invalid parameters, as conflicts
+func swarmObjectError(c *gin.Context, msg string, err error) {
+	if errdefs.IsInvalidParameter(err) {
+		c.Error(err)
+		respondError(c, http.StatusConflict, codeConflict, fmt.Sprintf("%s: %v", msg, err))
+		return
+	}
+	dockerError(c, msg, err)
+}
+
+func listSecrets(c *gin.Context) {
+	ctx := hostContext(c)
+	secrets, err := docker(ctx).SecretList(ctx, types.SecretListOptions{})
+	if err != nil {
+		dockerError(c, "Error listing secrets", err)
+		return
+	}
+
+	rows := []map[string]interface{}{}
+	for _, secret := range secrets {
+		row := map[string]interface{}{
+			"id":      secret.ID,
+			"name":    secret.Spec.Name,
+			"labels":  secret.Spec.Labels,
+			"created": secret.CreatedAt,
+			"updated": secret.UpdatedAt,
+		}
+		if secret.Spec.Driver != nil {
+			row["driver"] = secret.Spec.Driver.Name
+		}
+		rows = append(rows, row)
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i]["name"].(string) < rows[j]["name"].(string) })
+
+	respond(c, http.StatusOK, rows)
+}
+
+func createSecret(c *gin.Context) {
+	ctx := hostContext(c)
+	req, data, ok := bindSwarmObject(c)
+	if !ok {
+		return
+	}
+
+	created, err := docker(ctx).SecretCreate(ctx, swarm.SecretSpec{
+		Annotations: swarm.Annotations{Name: req.Name, Labels: req.Labels},
+		Data:        data,
+	})
+	if err != nil {
+		swarmObjectError(c, "Error creating secret", err)
+		return
+	}
+
+	respond(c, http.StatusCreated, gin.H{"id": created.ID, "name": req.Name})
+}
+
+func deleteSecret(c *gin.Context) {
+	ctx := hostContext(c)
+	if err := docker(ctx).SecretRemove(ctx, c.Param("secret_id")); err != nil {
+		swarmObjectError(c, "Error removing secret", err)
+		return
+	}
+
+	respondMessage(c, "Secret removed successfully")
+}
+
+func listConfigs(c *gin.Context) {
+	ctx := hostContext(c)
+	configs, err := docker(ctx).ConfigList(ctx, types.ConfigListOptions{})
+	if err != nil {
+		dockerError(c, "Error listing configs", err)
+		return
+	}
+
+	rows := []map[string]interface{}{}
+	for _, config := range configs {
+		rows = append(rows, map[string]interface{}{
+			"id":      config.ID,
+			"name":    config.Spec.Name,
+			"labels":  config.Spec.Labels,
+			"created": config.CreatedAt,
+			"updated": config.UpdatedAt,
+		})
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i]["name"].(string) < rows[j]["name"].(string) })
+
+	respond(c, http.StatusOK, rows)
+}
+
+func createConfig(c *gin.Context) {
+	ctx := hostContext(c)
+	req, data, ok := bindSwarmObject(c)
+	if !ok {
+		return
+	}
+
+	created, err := docker(ctx).ConfigCreate(ctx, swarm.ConfigSpec{
+		Annotations: swarm.Annotations{Name: req.Name, Labels: req.Labels},
+		Data:        data,
+	})
+	if err != nil {
+		swarmObjectError(c, "Error creating config", err)
+		return
+	}
+
+	respond(c, http.StatusCreated, gin.H{"id": created.ID, "name": req.Name})
+}
+
+func deleteConfig(c *gin.Context) {
+	ctx := hostContext(c)
+	if err := docker(ctx).ConfigRemove(ctx, c.Param("config_id")); err != nil {
+		swarmObjectError(c, "Error removing config", err)
+		return
+	}
+
+	respondMessage(c, "Config removed successfully")
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// sessionBucket holds signed-in sessions keyed by the hash of their token
+const sessionBucket = "sessions"
+
+// sessionCookie carries the session token for the web UI; API clients may
+// send the same token as a bearer token
+const sessionCookie = "containerscope_session"
+
+// sessionTTL is how long a sign-in lasts
+var sessionTTL = envDuration("CONTAINERSCOPE_SESSION_TTL", 12*time.Hour)
+
+// session is a user signed in through an identity provider
+type session struct {
+	Subject  string    `json:"subject"`
+	Name     string    `json:"name"`
+	Email    string    `json:"email,omitempty"`
+	Role     string    `json:"role"`
+	Groups   []string  `json:"groups,omitempty"`
+	Provider string    `json:"provider"`
+	Created  time.Time `json:"created"`
+	Expires  time.Time `json:"expires"`
+}
+
+func (s session) principal() principal {
+	return principal{Name: s.Name, Role: s.Role, Provider: s.Provider}
+}
+
+// sessionKey is the store key for a session token; only its hash is kept
+func sessionKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// startSession stores a session and sets its cookie, returning the token
+func startSession(c *gin.Context, s session) (string, error) {
+	token := newWebhookSecret()
+	s.Created = time.Now()
+	s.Expires = s.Created.Add(sessionTTL)
+	if err := storePut(sessionBucket, sessionKey(token), s); err != nil {
+		return "", err
+	}
+	setSessionCookie(c, token, int(sessionTTL.Seconds()))
+	logger.Info("signed in", "user", s.Name, "role", s.Role, "provider", s.Provider)
+	return token, nil
+}
+
+// setSessionCookie sets or, with a negative maxAge, clears the cookie. It
+// is marked Secure when the request came over HTTPS.
+func setSessionCookie(c *gin.Context, token string, maxAge int) {
+	secure := c.Request.TLS != nil || c.GetHeader("X-Forwarded-Proto") == "https"
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(sessionCookie, token, maxAge, "/", "", secure, true)
+}
+
+// lookupSession returns the unexpired session for token
+func lookupSession(token string) (session, bool) {
+	var s session
+	found, err := storeGet(sessionBucket, sessionKey(token), &s)
+	if err != nil || !found || time.Now().After(s.Expires) {
+		return s, false
+	}
+	return s, true
+}
+
+// login shows the sign-in form when LDAP is configured, offering single
+// sign-on too if that is, and otherwise sends the browser straight to the
+// identity provider
+func login(c *gin.Context) {
+	switch {
+	case ldapEnabled():
+		page, err := uiFiles.ReadFile("ui/login.html")
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, codeInternal, err.Error())
+			return
+		}
+		if oidcEnabled() {
+			page = bytes.Replace(page, []byte(`<p id="sso" hidden>`), []byte(`<p id="sso">`), 1)
+		}
+		c.Data(http.StatusOK, "text/html; charset=utf-8", page)
+	case oidcEnabled():
+		c.Redirect(http.StatusFound, "/auth/oidc/login?"+c.Request.URL.RawQuery)
+	default:
+		respondError(c, http.StatusNotFound, codeNotFound, "No sign-in provider is configured")
+	}
+}
+
+// logout ends the caller's session
+func logout(c *gin.Context) {
+	token := bearerToken(c)
+	if token == "" {
+		token, _ = c.Cookie(sessionCookie)
+	}
+	if token != "" {
+		if err := storeDelete(sessionBucket, sessionKey(token)); err != nil {
+			respondError(c, http.StatusInternalServerError, codeInternal, err.Error())
+			return
+		}
+	}
+	setSessionCookie(c, "", -1)
+	respondMessage(c, "Signed out successfully")
+}
+
+// pruneSessions deletes expired sessions every hour
+func pruneSessions() {
+	for {
+		var expired []string
+		now := time.Now()
+		err := storeEach(sessionBucket, func(key string, value []byte) error {
+			var s session
+			if json.Unmarshal(value, &s) != nil || now.After(s.Expires) {
+				expired = append(expired, key)
+			}
+			return nil
+		})
+		if err != nil {
+			logger.Warn("pruning sessions", "error", err)
+		}
+		for _, key := range expired {
+			storeDelete(sessionBucket, key)
+		}
+		time.Sleep(time.Hour)
+	}
+}
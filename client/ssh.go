@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/docker/cli/cli/connhelper"
+	"github.com/docker/docker/client"
+)
+
+// sshFlags are passed to every ssh invocation. Connections to a host share
+// one multiplexed ssh session that outlives idle periods by
+// CONTAINERSCOPE_SSH_PERSIST, so new API connections skip the handshake.
+func sshFlags() []string {
+	controlDir := filepath.Join(dataDir(), "ssh")
+	_ = os.MkdirAll(controlDir, 0o700)
+
+	flags := []string{
+		"-o", "BatchMode=yes",
+		"-o", "ServerAliveInterval=15",
+		"-o", "ControlMaster=auto",
+		"-o", "ControlPath=" + filepath.Join(controlDir, "%C"),
+		"-o", "ControlPersist=" + envDuration("CONTAINERSCOPE_SSH_PERSIST", 10*time.Minute).String(),
+	}
+	if key := os.Getenv("CONTAINERSCOPE_SSH_KEY"); key != "" {
+		flags = append(flags, "-i", key, "-o", "IdentitiesOnly=yes")
+	}
+	if knownHosts := os.Getenv("CONTAINERSCOPE_SSH_KNOWN_HOSTS"); knownHosts != "" {
+		flags = append(flags, "-o", "UserKnownHostsFile="+knownHosts)
+	}
+	return flags
+}
+
+// sshBinDir holds the ssh wrapper writeSSHWrapper writes
+func sshBinDir() string {
+	return filepath.Join(dataDir(), "ssh", "bin")
+}
+
+// writeSSHWrapper writes an ssh script to sshBinDir that runs the real ssh
+// with sshFlags. Tools that run ssh themselves, such as docker compose,
+// find it first on their PATH, so they use the same key, known_hosts file
+// and shared session as the agent.
+func writeSSHWrapper() error {
+	ssh, err := exec.LookPath("ssh")
+	if err != nil {
+		return err
+	}
+	script := "#!/bin/sh\nexec " + shellQuote(ssh)
+	for _, flag := range sshFlags() {
+		script += " " + shellQuote(flag)
+	}
+	script += ` "$@"` + "\n"
+	if err := os.MkdirAll(sshBinDir(), 0o700); err != nil {
+		return err
+	}
+	// Replace the script in one step, as compose may be running it
+	tmp, err := os.CreateTemp(sshBinDir(), ".ssh-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(script); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0o700); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(sshBinDir(), "ssh"))
+}
+
+// sshClientOpts returns client options that reach the daemon at an ssh://
+// endpoint through `docker system dial-stdio` on the remote host. Each new
+// connection runs ssh again, so a dropped session is re-established on the
+// next request.
+func sshClientOpts(endpoint string) ([]client.Opt, error) {
+	if err := writeSSHWrapper(); err != nil {
+		return nil, fmt.Errorf("writing ssh wrapper: %w", err)
+	}
+	helper, err := connhelper.GetConnectionHelperWithSSHOpts(endpoint, sshFlags())
+	if err != nil {
+		return nil, err
+	}
+	httpClient := &http.Client{
+		Transport: &http.Transport{
+			DialContext:         helper.Dialer,
+			MaxIdleConnsPerHost: 8,
+			IdleConnTimeout:     90 * time.Second,
+		},
+	}
+	return []client.Opt{
+		client.WithHTTPClient(httpClient),
+		client.WithHost(helper.Host),
+		client.WithDialContext(helper.Dialer),
+		client.WithAPIVersionNegotiation(),
+	}, nil
+}
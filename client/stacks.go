@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/gin-gonic/gin"
+	"gopkg.in/yaml.v3"
+)
+
+// composeTimeout bounds a single docker compose invocation, which may pull
+// images
+const composeTimeout = 10 * time.Minute
+
+// stackComposeFile is the file name each stack's definition is stored under
+const stackComposeFile = "docker-compose.yaml"
+
+// stackName follows compose's own project name rules
+var stackName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// stacksMu serializes compose runs so two deploys of a stack cannot overlap
+var stacksMu sync.Mutex
+
+// stacksDir is the directory holding the stacks deployed to ctx's host
+func stacksDir(ctx context.Context) string {
+	host := hostFrom(ctx)
+	if host.Name == defaultHostName {
+		return filepath.Join(dataDir(), "stacks")
+	}
+	return filepath.Join(dataDir(), "hosts", host.Name, "stacks")
+}
+
+// stackDir is the directory holding a stack's compose file
+func stackDir(ctx context.Context, name string) string {
+	return filepath.Join(stacksDir(ctx), name)
+}
+
+// composeCommand prepares docker compose for a stack
+func composeCommand(ctx context.Context, name string, args ...string) *exec.Cmd {
+	dir := stackDir(ctx, name)
+	cmdArgs := append([]string{"compose", "-p", name, "-f", filepath.Join(dir, stackComposeFile)}, args...)
+	cmd := exec.CommandContext(ctx, "docker", cmdArgs...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), composeEnv(hostFrom(ctx))...)
+	return cmd
+}
+
+// runCompose runs docker compose for a stack and returns its combined output
+func runCompose(ctx context.Context, name string, args ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, composeTimeout)
+	defer cancel()
+
+	out, err := composeCommand(ctx, name, args...).CombinedOutput()
+	return string(out), err
+}
+
+// composeEnv points docker compose at host. For an ssh:// host the ssh
+// wrapper comes first on the PATH, so compose connects with the agent's
+// ssh options.
+func composeEnv(host *dockerHost) []string {
+	env := []string{"DOCKER_HOST=" + host.Endpoint}
+	if strings.HasPrefix(host.Endpoint, "ssh://") {
+		env = append(env, "PATH="+sshBinDir()+string(os.PathListSeparator)+os.Getenv("PATH"))
+	}
+	if host.TLS {
+		env = append(env, "DOCKER_TLS_VERIFY=1")
+	}
+	if host.certDir != "" {
+		env = append(env, "DOCKER_CERT_PATH="+host.certDir)
+	}
+	return env
+}
+
+// stackRequest is the body for creating or updating a stack
+type stackRequest struct {
+	Name    string `json:"name"`
+	Compose string `json:"compose" binding:"required"`
+}
+
+// deployStack validates and stores the compose file, then brings the stack
+// up. The previous file is restored if compose rejects the new one.
+func deployStack(c *gin.Context, name, compose string, create bool) {
+	ctx := hostContext(c)
+	if !stackName.MatchString(name) {
+		badRequest(c, "Stack name must be lowercase letters, digits, '-' or '_'")
+		return
+	}
+	var parsed map[string]interface{}
+	if err := yaml.Unmarshal([]byte(compose), &parsed); err != nil || parsed["services"] == nil {
+		badRequest(c, "compose must be a YAML document with a services section")
+		return
+	}
+
+	stacksMu.Lock()
+	defer stacksMu.Unlock()
+
+	dir := stackDir(ctx, name)
+	file := filepath.Join(dir, stackComposeFile)
+	previous, err := os.ReadFile(file)
+	exists := err == nil
+	if create && exists {
+		respondError(c, http.StatusConflict, codeConflict, fmt.Sprintf("Stack %s already exists", name))
+		return
+	}
+	if !create && !exists {
+		respondError(c, http.StatusNotFound, codeStackNotFound, fmt.Sprintf("Stack %s not found", name))
+		return
+	}
+
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		respondError(c, http.StatusInternalServerError, codeInternal, err.Error())
+		return
+	}
+	if err := os.WriteFile(file, []byte(compose), 0o600); err != nil {
+		respondError(c, http.StatusInternalServerError, codeInternal, err.Error())
+		return
+	}
+
+	output, err := runCompose(ctx, name, "up", "-d", "--remove-orphans")
+	if err != nil {
+		if exists {
+			_ = os.WriteFile(file, previous, 0o600)
+		} else {
+			_ = os.RemoveAll(dir)
+		}
+		c.Error(err)
+		respondError(c, http.StatusUnprocessableEntity, codeComposeError, fmt.Sprintf("docker compose up failed: %v\n%s", err, output))
+		return
+	}
+
+	status := http.StatusOK
+	if create {
+		status = http.StatusCreated
+	}
+	respond(c, status, gin.H{"name": name, "output": output})
+}
+
+func createStack(c *gin.Context) {
+	var req stackRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		badRequest(c, "name and compose are required")
+		return
+	}
+	deployStack(c, req.Name, req.Compose, true)
+}
+
+func updateStack(c *gin.Context) {
+	var req stackRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		badRequest(c, "compose is required")
+		return
+	}
+	deployStack(c, c.Param("stack"), req.Compose, false)
+}
+
+// stackStatus summarizes the containers compose started for a stack
+func stackStatus(ctx context.Context, name string) (gin.H, error) {
+	containers, err := docker(ctx).ContainerList(ctx, container.ListOptions{
+		All:     true,
+		Filters: filters.NewArgs(filters.Arg("label", composeProjectLabel+"="+name)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	running := 0
+	names := []string{}
+	for _, cont := range containers {
+		names = append(names, strings.TrimPrefix(cont.Names[0], "/"))
+		if cont.State == "running" {
+			running++
+		}
+	}
+	sort.Strings(names)
+	status := aggregateStatus(running, len(containers))
+	if len(containers) == 0 {
+		status = "down"
+	}
+	return gin.H{"name": name, "status": status, "running": running, "total": len(containers), "containers": names}, nil
+}
+
+// listStacks lists the stacks deployed through the agent
+func listStacks(c *gin.Context) {
+	ctx := hostContext(c)
+	entries, err := os.ReadDir(stacksDir(ctx))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		respondError(c, http.StatusInternalServerError, codeInternal, err.Error())
+		return
+	}
+
+	stacks := []gin.H{}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		status, err := stackStatus(ctx, entry.Name())
+		if err != nil {
+			dockerError(c, "Error listing containers", err)
+			return
+		}
+		stacks = append(stacks, status)
+	}
+
+	respond(c, http.StatusOK, stacks)
+}
+
+// getStack returns a stack's compose file and status
+func getStack(c *gin.Context) {
+	ctx := hostContext(c)
+	name := c.Param("stack")
+	compose, err := os.ReadFile(filepath.Join(stackDir(ctx, name), stackComposeFile))
+	if err != nil || !stackName.MatchString(name) {
+		respondError(c, http.StatusNotFound, codeStackNotFound, fmt.Sprintf("Stack %s not found", name))
+		return
+	}
+
+	status, err := stackStatus(ctx, name)
+	if err != nil {
+		dockerError(c, "Error listing containers", err)
+		return
+	}
+	status["compose"] = string(compose)
+	respond(c, http.StatusOK, status)
+}
+
+// deleteStack tears a stack down and forgets it; ?volumes=true also
+// removes its named volumes
+func deleteStack(c *gin.Context) {
+	ctx := hostContext(c)
+	name := c.Param("stack")
+	if !stackName.MatchString(name) {
+		respondError(c, http.StatusNotFound, codeStackNotFound, fmt.Sprintf("Stack %s not found", name))
+		return
+	}
+
+	stacksMu.Lock()
+	defer stacksMu.Unlock()
+
+	if _, err := os.Stat(filepath.Join(stackDir(ctx, name), stackComposeFile)); err != nil {
+		respondError(c, http.StatusNotFound, codeStackNotFound, fmt.Sprintf("Stack %s not found", name))
+		return
+	}
+
+	args := []string{"down", "--remove-orphans"}
+	if c.Query("volumes") == "true" {
+		args = append(args, "--volumes")
+	}
+	output, err := runCompose(ctx, name, args...)
+	if err != nil {
+		c.Error(err)
+		respondError(c, http.StatusUnprocessableEntity, codeComposeError, fmt.Sprintf("docker compose down failed: %v\n%s", err, output))
+		return
+	}
+	if err := os.RemoveAll(stackDir(ctx, name)); err != nil {
+		respondError(c, http.StatusInternalServerError, codeInternal, err.Error())
+		return
+	}
+
+	respond(c, http.StatusOK, gin.H{"message": "Stack removed successfully", "output": output})
+}
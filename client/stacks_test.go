@@ -0,0 +1,71 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestComposeEnvSSH checks that docker compose reaches an ssh:// host
+// through the agent's ssh options rather than the service user's own
+func TestComposeEnvSSH(t *testing.T) {
+	if _, err := exec.LookPath("ssh"); err != nil {
+		t.Skip("ssh is not installed")
+	}
+	dir := t.TempDir()
+	// ssh leaves out an identity file that does not exist
+	key := filepath.Join(dir, "id_ed25519")
+	if err := os.WriteFile(key, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CONTAINERSCOPE_DATA_DIR", filepath.Join(dir, "data"))
+	t.Setenv("CONTAINERSCOPE_SSH_KEY", key)
+	t.Setenv("CONTAINERSCOPE_SSH_KNOWN_HOSTS", filepath.Join(dir, "known_hosts"))
+	if err := writeSSHWrapper(); err != nil {
+		t.Fatal(err)
+	}
+
+	env := map[string]string{}
+	for _, kv := range composeEnv(&dockerHost{Name: "db", Endpoint: "ssh://deploy@db1"}) {
+		key, value, _ := strings.Cut(kv, "=")
+		env[key] = value
+	}
+	if env["DOCKER_HOST"] != "ssh://deploy@db1" {
+		t.Errorf("DOCKER_HOST = %q, want ssh://deploy@db1", env["DOCKER_HOST"])
+	}
+	if !strings.HasPrefix(env["PATH"], sshBinDir()+string(os.PathListSeparator)) {
+		t.Fatalf("PATH is %q, want it to start with the ssh wrapper's directory %q", env["PATH"], sshBinDir())
+	}
+
+	// ssh -G prints the options it would connect with, without connecting;
+	// the shell looks ssh up on compose's PATH as compose does
+	cmd := exec.Command("sh", "-c", "ssh -G db1")
+	cmd.Env = append(os.Environ(), "PATH="+env["PATH"])
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"identityfile " + key + "\n",
+		"userknownhostsfile " + filepath.Join(dir, "known_hosts") + "\n",
+		"controlmaster auto\n",
+		// ssh expands %C in the control path to a hash of the connection
+		"controlpath " + filepath.Join(dataDir(), "ssh") + "/",
+		"batchmode yes\n",
+	} {
+		if !strings.Contains(string(out), want) {
+			t.Errorf("ssh through compose's PATH is missing %q", want)
+		}
+	}
+}
+
+// TestComposeEnvTCP checks that other hosts keep the service's PATH
+func TestComposeEnvTCP(t *testing.T) {
+	for _, kv := range composeEnv(&dockerHost{Name: "web", Endpoint: "tcp://10.0.0.5:2376"}) {
+		if strings.HasPrefix(kv, "PATH=") {
+			t.Errorf("composeEnv sets %s for a tcp:// host", kv)
+		}
+	}
+}
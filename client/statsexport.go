@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+// Pushing container metrics, for pipelines that cannot scrape agents.
+// CONTAINERSCOPE_STATS_EXPORT lists the exporters to run: statsd, otlp or
+// both. The OTLP exporter reads the standard OTEL_EXPORTER_OTLP_* settings.
+var (
+	statsExport    = splitList(os.Getenv("CONTAINERSCOPE_STATS_EXPORT"))
+	statsdAddress  = envOr("CONTAINERSCOPE_STATSD_ADDRESS", "127.0.0.1:8125")
+	statsdPrefix   = envOr("CONTAINERSCOPE_STATSD_PREFIX", "containerscope")
+	statsdTags     = os.Getenv("CONTAINERSCOPE_STATSD_TAGS") == "true"
+	statsdMaxBytes = 1400
+)
+
+// checkStatsExport rejects an exporter CONTAINERSCOPE_STATS_EXPORT names
+// that does not exist, before a replica leads and starts them
+func checkStatsExport() error {
+	for _, name := range statsExport {
+		if name != "statsd" && name != "otlp" {
+			return fmt.Errorf("CONTAINERSCOPE_STATS_EXPORT: unknown exporter %q, expected statsd or otlp", name)
+		}
+	}
+	return nil
+}
+
+// startStatsExport starts the configured exporters, which read from the
+// stats collector until ctx is done
+func startStatsExport(ctx context.Context) error {
+	if len(statsExport) == 0 {
+		return nil
+	}
+	for _, name := range statsExport {
+		switch name {
+		case "statsd":
+			exporter, err := newStatsdExporter()
+			if err != nil {
+				return err
+			}
+			addStatsListener(ctx, exporter.send)
+			go func() {
+				<-ctx.Done()
+				exporter.conn.Close()
+			}()
+		case "otlp":
+			if err := startOTLPMetrics(ctx); err != nil {
+				return err
+			}
+		}
+	}
+	logger.Info("exporting container stats", "exporters", statsExport, "interval", statsInterval.String())
+	return nil
+}
+
+// statsdExporter sends each round of samples as StatsD gauges, and network
+// traffic since the last round as counters. With CONTAINERSCOPE_STATSD_TAGS
+// the host and container go in DogStatsD tags; otherwise they are part of
+// the metric name.
+type statsdExporter struct {
+	conn net.Conn
+
+	mu      sync.Mutex
+	network map[string][2]uint64
+}
+
+func newStatsdExporter() (*statsdExporter, error) {
+	conn, err := net.Dial("udp", statsdAddress)
+	if err != nil {
+		return nil, fmt.Errorf("CONTAINERSCOPE_STATSD_ADDRESS: %w", err)
+	}
+	return &statsdExporter{conn: conn, network: map[string][2]uint64{}}, nil
+}
+
+// statsdName replaces the characters StatsD gives meaning to
+var statsdName = strings.NewReplacer(".", "_", ":", "_", "|", "_", "@", "_", "#", "_", ",", "_", " ", "_")
+
+func (e *statsdExporter) send(host string, samples []statsSample) {
+	var packet bytes.Buffer
+	flush := func() {
+		if packet.Len() > 0 {
+			e.conn.Write(bytes.TrimSuffix(packet.Bytes(), []byte("\n")))
+			packet.Reset()
+		}
+	}
+	write := func(sample statsSample, metric, kind string, value float64) {
+		var line string
+		if statsdTags {
+			line = fmt.Sprintf("%s.container.%s:%s|%s|#host:%s,container:%s,image:%s\n", statsdPrefix, metric, formatStatsd(value), kind,
+				statsdName.Replace(host), statsdName.Replace(sample.Name()), statsdName.Replace(sample.Container.Image))
+		} else {
+			line = fmt.Sprintf("%s.%s.%s.%s:%s|%s\n", statsdPrefix, statsdName.Replace(host), statsdName.Replace(sample.Name()), metric, formatStatsd(value), kind)
+		}
+		if packet.Len()+len(line) > statsdMaxBytes {
+			flush()
+		}
+		packet.WriteString(line)
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	seen := map[string]bool{}
+	for _, sample := range samples {
+		usage := computeUsage(sample.Stats)
+		write(sample, "cpu_percent", "g", usage.CPUPercent)
+		write(sample, "memory_bytes", "g", usage.MemoryUsage)
+		write(sample, "memory_limit_bytes", "g", usage.MemoryLimit)
+		write(sample, "memory_percent", "g", usage.MemoryPercent)
+		write(sample, "pids", "g", float64(usage.Pids))
+
+		// Counters carry the traffic since the last round; the first
+		// round and a restarted container only set the baseline
+		key := host + "/" + sample.Container.ID
+		seen[key] = true
+		current := [2]uint64{uint64(usage.NetworkRx), uint64(usage.NetworkTx)}
+		if previous, ok := e.network[key]; ok && current[0] >= previous[0] && current[1] >= previous[1] {
+			write(sample, "network_rx_bytes", "c", float64(current[0]-previous[0]))
+			write(sample, "network_tx_bytes", "c", float64(current[1]-previous[1]))
+		}
+		e.network[key] = current
+	}
+	for key := range e.network {
+		if strings.HasPrefix(key, host+"/") && !seen[key] {
+			delete(e.network, key)
+		}
+	}
+	flush()
+}
+
+// formatStatsd writes a value without an exponent, which some StatsD
+// servers do not parse
+func formatStatsd(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+// startOTLPMetrics exports the collector's samples over OTLP/HTTP as
+// observable instruments, read at every collection round until ctx is done
+func startOTLPMetrics(ctx context.Context) error {
+	exporter, err := otlpmetrichttp.New(context.Background())
+	if err != nil {
+		return fmt.Errorf("OTLP metrics exporter: %w", err)
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(semconv.ServiceName("containerscope-agent"), semconv.ServiceVersion(version)))
+	if err != nil {
+		return err
+	}
+	provider := sdkmetric.NewMeterProvider(
+		sdkmetric.WithResource(res),
+		sdkmetric.WithReader(sdkmetric.NewPeriodicReader(exporter, sdkmetric.WithInterval(statsInterval))),
+	)
+	meter := provider.Meter("containerscope")
+
+	cpu, _ := meter.Float64ObservableGauge("container.cpu.utilization", metric.WithUnit("1"), metric.WithDescription("CPU usage, 1 being one whole CPU"))
+	memory, _ := meter.Int64ObservableGauge("container.memory.usage", metric.WithUnit("By"), metric.WithDescription("Memory used, excluding inactive page cache"))
+	memoryLimit, _ := meter.Int64ObservableGauge("container.memory.limit", metric.WithUnit("By"))
+	memoryUtilization, _ := meter.Float64ObservableGauge("container.memory.utilization", metric.WithUnit("1"), metric.WithDescription("Memory used as a fraction of the limit"))
+	pids, _ := meter.Int64ObservableGauge("container.pids", metric.WithUnit("{process}"))
+	network, _ := meter.Int64ObservableCounter("container.network.io", metric.WithUnit("By"), metric.WithDescription("Bytes received and sent since the container started"))
+
+	_, err = meter.RegisterCallback(func(ctx context.Context, o metric.Observer) error {
+		for host, sc := range statsCollectors {
+			for _, sample := range sc.latest() {
+				usage := computeUsage(sample.Stats)
+				attrs := metric.WithAttributes(
+					attribute.String("host", host),
+					semconv.ContainerID(sample.Container.ID),
+					semconv.ContainerName(sample.Name()),
+					semconv.ContainerImageName(sample.Container.Image),
+				)
+				o.ObserveFloat64(cpu, usage.CPUPercent/100, attrs)
+				o.ObserveInt64(memory, int64(usage.MemoryUsage), attrs)
+				o.ObserveInt64(memoryLimit, int64(usage.MemoryLimit), attrs)
+				o.ObserveFloat64(memoryUtilization, usage.MemoryPercent/100, attrs)
+				o.ObserveInt64(pids, int64(usage.Pids), attrs)
+				o.ObserveInt64(network, int64(usage.NetworkRx), attrs, metric.WithAttributes(attribute.String("network.io.direction", "receive")))
+				o.ObserveInt64(network, int64(usage.NetworkTx), attrs, metric.WithAttributes(attribute.String("network.io.direction", "transmit")))
+			}
+		}
+		return nil
+	}, cpu, memory, memoryLimit, memoryUtilization, pids, network)
+	if err != nil {
+		provider.Shutdown(context.Background())
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+		defer cancel()
+		provider.Shutdown(shutdownCtx)
+	}()
+	return nil
+}
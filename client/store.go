@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// kvStore keeps raw values by bucket and key, in key order within a bucket
+type kvStore interface {
+	put(bucket, key string, data []byte) error
+	// get returns nil for a missing key
+	get(bucket, key string) ([]byte, error)
+	delete(bucket, key string) error
+	// create puts data under key unless the key exists, reporting whether
+	// it did, in one step
+	create(bucket, key string, data []byte) (bool, error)
+	// take deletes key and returns what it held, nil for a missing key, in
+	// one step
+	take(bucket, key string) ([]byte, error)
+	// deleteIf deletes key if it holds exactly data, reporting whether it
+	// did, in one step
+	deleteIf(bucket, key string, data []byte) (bool, error)
+	// eachRange visits the keys from from up to but not including to; an
+	// empty to means the end of the bucket
+	eachRange(bucket, from, to string, fn func(key string, value []byte) error) error
+	deleteBefore(bucket, key string) (int, error)
+}
+
+// store is the agent's database for state that must survive restarts,
+// one bucket per feature with JSON-encoded values. It is an embedded
+// database by default, or etcd or Redis shared by several replicas.
+var store kvStore
+
+// storeKind is the store CONTAINERSCOPE_STORE selected, and storeShared
+// is true when it is shared with other replicas, which then elect their
+// leader through election
+var (
+	storeKind   string
+	storeShared bool
+	election    leaderElection
+)
+
+// dataDir is where the agent keeps its database and other state
+func dataDir() string {
+	return envOr("CONTAINERSCOPE_DATA_DIR", "data")
+}
+
+// openStore opens the store CONTAINERSCOPE_STORE selects: bolt, the
+// database under dataDir, etcd or redis, creating dataDir if needed
+func openStore() error {
+	// The data directory also holds files such as the secret key, whichever
+	// store keeps the state
+	dir := dataDir()
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	storeKind = envOr("CONTAINERSCOPE_STORE", "bolt")
+	switch storeKind {
+	case "bolt":
+	case "etcd":
+		s, err := openEtcdStore()
+		if err != nil {
+			return err
+		}
+		store, storeShared, election = s, true, s
+		return nil
+	case "redis":
+		s, err := openRedisStore()
+		if err != nil {
+			return err
+		}
+		store, storeShared, election = s, true, s
+		return nil
+	default:
+		return fmt.Errorf("CONTAINERSCOPE_STORE: unknown store %q, expected bolt, etcd or redis", storeKind)
+	}
+	db, err := bolt.Open(filepath.Join(dir, "containerscope.db"), 0o600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return err
+	}
+	store = boltStore{db}
+	return nil
+}
+
+// storePut saves v as JSON under key in bucket
+func storePut(bucket, key string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return store.put(bucket, key, data)
+}
+
+// storeGet loads key from bucket into v, reporting whether it existed
+func storeGet(bucket, key string, v interface{}) (bool, error) {
+	data, err := store.get(bucket, key)
+	if err != nil || data == nil {
+		return false, err
+	}
+	return true, json.Unmarshal(data, v)
+}
+
+// storeDelete removes key from bucket; deleting a missing key is not an error
+func storeDelete(bucket, key string) error {
+	return store.delete(bucket, key)
+}
+
+// storeCreate saves v as JSON under key in bucket unless key exists,
+// reporting whether it did. Of several replicas creating the same key at
+// once, one succeeds.
+func storeCreate(bucket, key string, v interface{}) (bool, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return false, err
+	}
+	return store.create(bucket, key, data)
+}
+
+// storeTake removes key from bucket and loads what it held into v,
+// reporting whether it existed. Of several replicas taking the same key
+// at once, one gets it.
+func storeTake(bucket, key string, v interface{}) (bool, error) {
+	data, err := store.take(bucket, key)
+	if err != nil || data == nil {
+		return false, err
+	}
+	return true, json.Unmarshal(data, v)
+}
+
+// storeDeleteIf removes key from bucket if it still holds v as JSON,
+// reporting whether it did, so a replica does not remove a value another
+// replica has since replaced
+func storeDeleteIf(bucket, key string, v interface{}) (bool, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return false, err
+	}
+	return store.deleteIf(bucket, key, data)
+}
+
+// storeEach calls fn with every key and raw JSON value in bucket, in key order
+func storeEach(bucket string, fn func(key string, value []byte) error) error {
+	return store.eachRange(bucket, "", "", fn)
+}
+
+// storeEachRange calls fn with every key in bucket from from up to but not
+// including to, in key order; an empty to means the end of the bucket
+func storeEachRange(bucket, from, to string, fn func(key string, value []byte) error) error {
+	return store.eachRange(bucket, from, to, fn)
+}
+
+// storeDeleteBefore removes every key in bucket that sorts before key,
+// returning how many were removed
+func storeDeleteBefore(bucket, key string) (int, error) {
+	return store.deleteBefore(bucket, key)
+}
+
+// boltStore is the embedded database, one bolt bucket per bucket
+type boltStore struct {
+	db *bolt.DB
+}
+
+func (s boltStore) put(bucket, key string, data []byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(key), data)
+	})
+}
+
+func (s boltStore) get(bucket, key string) ([]byte, error) {
+	var data []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket([]byte(bucket)); b != nil {
+			// Values are only valid during the transaction
+			if v := b.Get([]byte(key)); v != nil {
+				data = append([]byte{}, v...)
+			}
+		}
+		return nil
+	})
+	return data, err
+}
+
+func (s boltStore) delete(bucket, key string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if b := tx.Bucket([]byte(bucket)); b != nil {
+			return b.Delete([]byte(key))
+		}
+		return nil
+	})
+}
+
+func (s boltStore) create(bucket, key string, data []byte) (bool, error) {
+	created := false
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		if err != nil || b.Get([]byte(key)) != nil {
+			return err
+		}
+		created = true
+		return b.Put([]byte(key), data)
+	})
+	return created, err
+}
+
+func (s boltStore) take(bucket, key string) ([]byte, error) {
+	var data []byte
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		if v := b.Get([]byte(key)); v != nil {
+			data = append([]byte{}, v...)
+			return b.Delete([]byte(key))
+		}
+		return nil
+	})
+	return data, err
+}
+
+func (s boltStore) deleteIf(bucket, key string, data []byte) (bool, error) {
+	deleted := false
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil || !bytes.Equal(b.Get([]byte(key)), data) {
+			return nil
+		}
+		deleted = true
+		return b.Delete([]byte(key))
+	})
+	return deleted, err
+}
+
+func (s boltStore) eachRange(bucket, from, to string, fn func(key string, value []byte) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		cur := b.Cursor()
+		for k, v := cur.Seek([]byte(from)); k != nil && (to == "" || string(k) < to); k, v = cur.Next() {
+			if err := fn(string(k), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s boltStore) deleteBefore(bucket, key string) (int, error) {
+	removed := 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		// Deleting under a cursor can skip keys, so collect them first
+		var keys [][]byte
+		cur := b.Cursor()
+		for k, _ := cur.First(); k != nil && string(k) < key; k, _ = cur.Next() {
+			keys = append(keys, k)
+		}
+		for _, k := range keys {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		removed = len(keys)
+		return nil
+	})
+	return removed, err
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/gin-gonic/gin"
+)
+
+// swarmStatus reports whether the daemon is part of a swarm and whether it
+// can serve the swarm endpoints, which only managers can
+func swarmStatus(c *gin.Context) {
+	ctx := hostContext(c)
+	info, err := docker(ctx).Info(ctx)
+	if err != nil {
+		dockerError(c, "Error retrieving system info", err)
+		return
+	}
+
+	respond(c, http.StatusOK, gin.H{
+		"active":     info.Swarm.LocalNodeState == swarm.LocalNodeStateActive,
+		"state":      info.Swarm.LocalNodeState,
+		"manager":    info.Swarm.ControlAvailable,
+		"node_id":    info.Swarm.NodeID,
+		"cluster_id": clusterID(info.Swarm),
+		"nodes":      info.Swarm.Nodes,
+		"managers":   info.Swarm.Managers,
+	})
+}
+
+func clusterID(info swarm.Info) string {
+	if info.Cluster == nil {
+		return ""
+	}
+	return info.Cluster.ID
+}
+
+// swarmManager rejects requests with NOT_SUPPORTED unless the daemon is an
+// active swarm manager
+func swarmManager() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := hostContext(c)
+		info, err := docker(ctx).Info(ctx)
+		if err != nil {
+			dockerError(c, "Error retrieving system info", err)
+			return
+		}
+		if info.Swarm.LocalNodeState != swarm.LocalNodeStateActive || !info.Swarm.ControlAvailable {
+			respondError(c, http.StatusNotImplemented, codeNotSupported, "This node is not a swarm manager")
+			return
+		}
+		c.Next()
+	}
+}
+
+// serviceMode returns the service's mode and, for replicated services, the
+// desired replica count
+func serviceMode(spec swarm.ServiceSpec) (string, *uint64) {
+	switch {
+	case spec.Mode.Replicated != nil:
+		return "replicated", spec.Mode.Replicated.Replicas
+	case spec.Mode.Global != nil:
+		return "global", nil
+	case spec.Mode.ReplicatedJob != nil:
+		return "replicated-job", spec.Mode.ReplicatedJob.TotalCompletions
+	case spec.Mode.GlobalJob != nil:
+		return "global-job", nil
+	}
+	return "", nil
+}
+
+// listServices lists swarm services with their running and desired task
+// counts, like `docker service ls`
+func listServices(c *gin.Context) {
+	ctx := hostContext(c)
+	services, err := docker(ctx).ServiceList(ctx, types.ServiceListOptions{Status: true})
+	if err != nil {
+		dockerError(c, "Error listing services", err)
+		return
+	}
+
+	rows := []map[string]interface{}{}
+	for _, service := range services {
+		mode, replicas := serviceMode(service.Spec)
+		row := map[string]interface{}{
+			"id":       service.ID,
+			"name":     service.Spec.Name,
+			"image":    service.Spec.TaskTemplate.ContainerSpec.Image,
+			"mode":     mode,
+			"replicas": replicas,
+			"created":  service.CreatedAt,
+			"updated":  service.UpdatedAt,
+			"labels":   service.Spec.Labels,
+		}
+		if service.ServiceStatus != nil {
+			row["running_tasks"] = service.ServiceStatus.RunningTasks
+			row["desired_tasks"] = service.ServiceStatus.DesiredTasks
+		}
+		if service.Endpoint.Ports != nil {
+			ports := []string{}
+			for _, port := range service.Endpoint.Ports {
+				if port.PublishedPort > 0 {
+					ports = append(ports, formatServicePort(port))
+				}
+			}
+			row["ports"] = ports
+		}
+		if service.UpdateStatus != nil {
+			row["update_state"] = service.UpdateStatus.State
+		}
+		rows = append(rows, row)
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i]["name"].(string) < rows[j]["name"].(string) })
+
+	respond(c, http.StatusOK, rows)
+}
+
+// formatServicePort renders a published port as published:target/protocol
+func formatServicePort(port swarm.PortConfig) string {
+	return fmt.Sprintf("%d:%d/%s", port.PublishedPort, port.TargetPort, port.Protocol)
+}
+
+// inspectService returns the full service object
+func inspectService(c *gin.Context) {
+	ctx := hostContext(c)
+	service, _, err := docker(ctx).ServiceInspectWithRaw(ctx, c.Param("service_id"), types.ServiceInspectOptions{})
+	if err != nil {
+		dockerError(c, "Error inspecting service", err)
+		return
+	}
+
+	respond(c, http.StatusOK, service)
+}
+
+// nodeNames maps swarm node IDs to hostnames
+func nodeNames(ctx context.Context) map[string]string {
+	names := map[string]string{}
+	nodes, err := docker(ctx).NodeList(ctx, types.NodeListOptions{})
+	if err != nil {
+		return names
+	}
+	for _, node := range nodes {
+		names[node.ID] = node.Description.Hostname
+	}
+	return names
+}
+
+// serviceTasks lists a service's tasks, newest first, like `docker service ps`
+func serviceTasks(c *gin.Context) {
+	ctx := hostContext(c)
+	service, _, err := docker(ctx).ServiceInspectWithRaw(ctx, c.Param("service_id"), types.ServiceInspectOptions{})
+	if err != nil {
+		dockerError(c, "Error inspecting service", err)
+		return
+	}
+
+	tasks, err := docker(ctx).TaskList(ctx, types.TaskListOptions{
+		Filters: filters.NewArgs(filters.Arg("service", service.ID)),
+	})
+	if err != nil {
+		dockerError(c, "Error listing tasks", err)
+		return
+	}
+	sort.Slice(tasks, func(i, j int) bool { return tasks[i].CreatedAt.After(tasks[j].CreatedAt) })
+
+	names := nodeNames(ctx)
+	rows := []map[string]interface{}{}
+	for _, task := range tasks {
+		row := map[string]interface{}{
+			"id":            task.ID,
+			"slot":          task.Slot,
+			"node_id":       task.NodeID,
+			"node":          names[task.NodeID],
+			"image":         task.Spec.ContainerSpec.Image,
+			"desired_state": task.DesiredState,
+			"state":         task.Status.State,
+			"message":       task.Status.Message,
+			"error":         task.Status.Err,
+			"timestamp":     task.Status.Timestamp,
+			"created":       task.CreatedAt,
+		}
+		if task.Status.ContainerStatus != nil {
+			row["container_id"] = task.Status.ContainerStatus.ContainerID
+		}
+		rows = append(rows, row)
+	}
+
+	respond(c, http.StatusOK, rows)
+}
+
+// updateServiceSpec applies change to the service's current spec and submits
+// it, returning any warnings from the daemon
+func updateServiceSpec(ctx context.Context, serviceID string, queryRegistry bool, change func(*swarm.ServiceSpec) error) ([]string, error) {
+	service, _, err := docker(ctx).ServiceInspectWithRaw(ctx, serviceID, types.ServiceInspectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	spec := service.Spec
+	if err := change(&spec); err != nil {
+		return nil, err
+	}
+	options := types.ServiceUpdateOptions{QueryRegistry: queryRegistry}
+	if spec.TaskTemplate.ContainerSpec != nil {
+		options.EncodedRegistryAuth = encodedRegistryAuth(spec.TaskTemplate.ContainerSpec.Image)
+	}
+	resp, err := docker(ctx).ServiceUpdate(ctx, service.ID, service.Version, spec, options)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Warnings, nil
+}
+
+// errNotReplicated is returned when scaling a global service
+type errNotReplicated struct{}
+
+func (errNotReplicated) Error() string { return "only replicated services can be scaled" }
+
+// scaleService sets a replicated service's replica count
+func scaleService(c *gin.Context) {
+	ctx := hostContext(c)
+	var req struct {
+		Replicas *uint64 `json:"replicas" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		badRequest(c, "replicas is required")
+		return
+	}
+
+	warnings, err := updateServiceSpec(ctx, c.Param("service_id"), false, func(spec *swarm.ServiceSpec) error {
+		if spec.Mode.Replicated == nil {
+			return errNotReplicated{}
+		}
+		spec.Mode.Replicated.Replicas = req.Replicas
+		return nil
+	})
+	if _, ok := err.(errNotReplicated); ok {
+		badRequest(c, err.Error())
+		return
+	}
+	if err != nil {
+		dockerError(c, "Error scaling service", err)
+		return
+	}
+
+	respond(c, http.StatusOK, gin.H{"message": "Service scaled successfully", "replicas": *req.Replicas, "warnings": warnings})
+}
+
+// updateService rolls a service onto a new image, or with force set
+// redeploys its tasks even when nothing changed
+func updateService(c *gin.Context) {
+	ctx := hostContext(c)
+	var req struct {
+		Image string `json:"image"`
+		Force bool   `json:"force"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || (req.Image == "" && !req.Force) {
+		badRequest(c, "image or force is required")
+		return
+	}
+
+	warnings, err := updateServiceSpec(ctx, c.Param("service_id"), req.Image != "", func(spec *swarm.ServiceSpec) error {
+		if req.Image != "" {
+			spec.TaskTemplate.ContainerSpec.Image = req.Image
+		}
+		if req.Force {
+			spec.TaskTemplate.ForceUpdate++
+		}
+		return nil
+	})
+	if err != nil {
+		dockerError(c, "Error updating service", err)
+		return
+	}
+
+	respond(c, http.StatusOK, gin.H{"message": "Service update started", "warnings": warnings})
+}
+
+// listNodes lists the swarm's nodes, like `docker node ls`
+func listNodes(c *gin.Context) {
+	ctx := hostContext(c)
+	nodes, err := docker(ctx).NodeList(ctx, types.NodeListOptions{})
+	if err != nil {
+		dockerError(c, "Error listing nodes", err)
+		return
+	}
+
+	rows := []map[string]interface{}{}
+	for _, node := range nodes {
+		row := map[string]interface{}{
+			"id":             node.ID,
+			"hostname":       node.Description.Hostname,
+			"role":           node.Spec.Role,
+			"availability":   node.Spec.Availability,
+			"state":          node.Status.State,
+			"address":        node.Status.Addr,
+			"engine_version": node.Description.Engine.EngineVersion,
+			"labels":         node.Spec.Labels,
+			"nano_cpus":      node.Description.Resources.NanoCPUs,
+			"memory_bytes":   node.Description.Resources.MemoryBytes,
+		}
+		if node.ManagerStatus != nil {
+			row["leader"] = node.ManagerStatus.Leader
+			row["reachability"] = node.ManagerStatus.Reachability
+		}
+		rows = append(rows, row)
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i]["hostname"].(string) < rows[j]["hostname"].(string) })
+
+	respond(c, http.StatusOK, rows)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/docker/docker/api/types"
+	"github.com/gin-gonic/gin"
+)
+
+// systemInfo returns the daemon's info: storage driver, cgroup version,
+// runtimes, resource counts and so on
+func systemInfo(c *gin.Context) {
+	ctx := hostContext(c)
+	info, err := docker(ctx).Info(ctx)
+	if err != nil {
+		dockerError(c, "Error retrieving system info", err)
+		return
+	}
+
+	respond(c, http.StatusOK, info)
+}
+
+// systemVersion returns the daemon and API versions
+func systemVersion(c *gin.Context) {
+	ctx := hostContext(c)
+	version, err := docker(ctx).ServerVersion(ctx)
+	if err != nil {
+		dockerError(c, "Error retrieving version", err)
+		return
+	}
+
+	respond(c, http.StatusOK, gin.H{
+		"server":             version,
+		"client_api_version": docker(ctx).ClientVersion(),
+	})
+}
+
+// systemDiskUsage summarizes the space used by images, containers, volumes
+// and the build cache, like `docker system df`
+func systemDiskUsage(c *gin.Context) {
+	ctx := hostContext(c)
+	usage, err := docker(ctx).DiskUsage(ctx, types.DiskUsageOptions{})
+	if err != nil {
+		dockerError(c, "Error retrieving disk usage", err)
+		return
+	}
+
+	var images, containers, volumes, buildCache struct {
+		Total       int   `json:"total"`
+		Active      int   `json:"active"`
+		Size        int64 `json:"size"`
+		Reclaimable int64 `json:"reclaimable"`
+	}
+
+	images.Size = usage.LayersSize
+	images.Reclaimable = usage.LayersSize
+	for _, image := range usage.Images {
+		images.Total++
+		if image.Containers > 0 {
+			images.Active++
+			images.Reclaimable -= image.Size - image.SharedSize
+		}
+	}
+	if images.Reclaimable < 0 {
+		images.Reclaimable = 0
+	}
+
+	for _, cont := range usage.Containers {
+		containers.Total++
+		containers.Size += cont.SizeRw
+		if cont.State == "running" {
+			containers.Active++
+		} else {
+			containers.Reclaimable += cont.SizeRw
+		}
+	}
+
+	for _, volume := range usage.Volumes {
+		volumes.Total++
+		if volume.UsageData == nil || volume.UsageData.Size < 0 {
+			continue
+		}
+		volumes.Size += volume.UsageData.Size
+		if volume.UsageData.RefCount > 0 {
+			volumes.Active++
+		} else {
+			volumes.Reclaimable += volume.UsageData.Size
+		}
+	}
+
+	for _, cache := range usage.BuildCache {
+		buildCache.Total++
+		buildCache.Size += cache.Size
+		if cache.InUse {
+			buildCache.Active++
+		} else if !cache.Shared {
+			buildCache.Reclaimable += cache.Size
+		}
+	}
+
+	respond(c, http.StatusOK, gin.H{
+		"images":      images,
+		"containers":  containers,
+		"volumes":     volumes,
+		"build_cache": buildCache,
+	})
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/distribution/reference"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/errdefs"
+	"github.com/docker/go-connections/nat"
+	"github.com/gin-gonic/gin"
+)
+
+// templateBucket holds container templates keyed by ID
+const templateBucket = "templates"
+
+// templateLabel marks containers deployed from a template with its ID
+const templateLabel = "containerscope.template"
+
+// envNamePattern is what a template variable's name may look like
+var envNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// containerTemplate is a reusable container definition. Its variables
+// become the container's environment, and ${NAME} references to them in
+// the image, command, ports, volumes, labels and network are expanded on
+// deploy.
+type containerTemplate struct {
+	ID          string        `json:"id"`
+	Name        string        `json:"name"`
+	Description string        `json:"description,omitempty"`
+	Image       string        `json:"image"`
+	Command     []string      `json:"command,omitempty"`
+	Env         []templateVar `json:"env,omitempty"`
+	// Ports and Volumes are specs as docker run -p and -v take them
+	Ports   []string          `json:"ports,omitempty"`
+	Volumes []string          `json:"volumes,omitempty"`
+	Labels  map[string]string `json:"labels,omitempty"`
+	// Restart is a restart policy such as unless-stopped or on-failure:3
+	Restart string    `json:"restart,omitempty"`
+	Network string    `json:"network,omitempty"`
+	Created time.Time `json:"created"`
+	Updated time.Time `json:"updated"`
+}
+
+// templateVar is a variable of a template. A required variable without a
+// default must be given on deploy.
+type templateVar struct {
+	Name        string `json:"name"`
+	Default     string `json:"default,omitempty"`
+	Description string `json:"description,omitempty"`
+	Required    bool   `json:"required,omitempty"`
+}
+
+// templateRequest is the body accepted when creating or replacing a
+// template
+type templateRequest struct {
+	Name        string            `json:"name" binding:"required"`
+	Description string            `json:"description"`
+	Image       string            `json:"image" binding:"required"`
+	Command     []string          `json:"command"`
+	Env         []templateVar     `json:"env"`
+	Ports       []string          `json:"ports"`
+	Volumes     []string          `json:"volumes"`
+	Labels      map[string]string `json:"labels"`
+	Restart     string            `json:"restart"`
+	Network     string            `json:"network"`
+}
+
+// validate checks what can be checked before variables are known
+func (req templateRequest) validate() error {
+	seen := map[string]bool{}
+	for _, v := range req.Env {
+		if !envNamePattern.MatchString(v.Name) {
+			return fmt.Errorf("invalid variable name %q", v.Name)
+		}
+		if seen[v.Name] {
+			return fmt.Errorf("variable %s is declared twice", v.Name)
+		}
+		seen[v.Name] = true
+	}
+	if !strings.Contains(req.Restart, "${") {
+		if _, err := parseRestart(req.Restart); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseRestart reads a restart policy as docker run --restart takes it
+func parseRestart(s string) (container.RestartPolicy, error) {
+	name, count, _ := strings.Cut(s, ":")
+	policy := container.RestartPolicy{Name: container.RestartPolicyMode(name)}
+	if count != "" {
+		n, err := strconv.Atoi(count)
+		if err != nil {
+			return policy, fmt.Errorf("invalid restart policy %q", s)
+		}
+		policy.MaximumRetryCount = n
+	}
+	if err := container.ValidateRestartPolicy(policy); err != nil {
+		return policy, fmt.Errorf("invalid restart policy %q: %v", s, err)
+	}
+	return policy, nil
+}
+
+// deployRequest is the body of POST /templates/:id/deploy
+type deployRequest struct {
+	// Name is the container's name; Docker picks one when empty
+	Name string `json:"name"`
+	// Env sets variables, overriding defaults; names the template does not
+	// declare are added to the environment as they are
+	Env map[string]string `json:"env"`
+	// Pull pulls the image even when it is present
+	Pull bool `json:"pull"`
+	// Start starts the container; nil starts it
+	Start *bool `json:"start"`
+}
+
+// templateExpander expands ${NAME} references to a deploy's variables and
+// remembers the first reference to one that is not set
+type templateExpander struct {
+	values  map[string]string
+	missing string
+}
+
+func (e *templateExpander) expand(s string) string {
+	return os.Expand(s, func(name string) string {
+		value, ok := e.values[name]
+		if !ok && e.missing == "" {
+			e.missing = name
+		}
+		return value
+	})
+}
+
+// buildContainer turns a template and deploy request into the container
+// to create
+func (t containerTemplate) buildContainer(req deployRequest) (*container.Config, *container.HostConfig, *network.NetworkingConfig, error) {
+	values := map[string]string{}
+	for _, v := range t.Env {
+		values[v.Name] = v.Default
+	}
+	for name, value := range req.Env {
+		values[name] = value
+	}
+	env := []string{}
+	declared := map[string]bool{}
+	for _, v := range t.Env {
+		declared[v.Name] = true
+		value, given := req.Env[v.Name]
+		if !given {
+			value = v.Default
+		}
+		if v.Required && value == "" {
+			return nil, nil, nil, fmt.Errorf("variable %s is required", v.Name)
+		}
+		if given || value != "" {
+			env = append(env, v.Name+"="+value)
+		}
+	}
+	extra := make([]string, 0, len(req.Env))
+	for name := range req.Env {
+		if !declared[name] {
+			if !envNamePattern.MatchString(name) {
+				return nil, nil, nil, fmt.Errorf("invalid variable name %q", name)
+			}
+			extra = append(extra, name)
+		}
+	}
+	sort.Strings(extra)
+	for _, name := range extra {
+		env = append(env, name+"="+req.Env[name])
+	}
+
+	e := &templateExpander{values: values}
+	config := &container.Config{
+		Image:  e.expand(t.Image),
+		Env:    env,
+		Labels: map[string]string{templateLabel: t.ID},
+	}
+	for _, arg := range t.Command {
+		config.Cmd = append(config.Cmd, e.expand(arg))
+	}
+	for key, value := range t.Labels {
+		config.Labels[e.expand(key)] = e.expand(value)
+	}
+	ports := make([]string, 0, len(t.Ports))
+	for _, p := range t.Ports {
+		ports = append(ports, e.expand(p))
+	}
+	volumes := make([]string, 0, len(t.Volumes))
+	for _, v := range t.Volumes {
+		volumes = append(volumes, e.expand(v))
+	}
+	restart, networkName := e.expand(t.Restart), e.expand(t.Network)
+	if e.missing != "" {
+		return nil, nil, nil, fmt.Errorf("template references ${%s}, which is not a variable", e.missing)
+	}
+
+	if _, err := reference.ParseNormalizedNamed(config.Image); err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid image %q: %v", config.Image, err)
+	}
+	exposed, bindings, err := nat.ParsePortSpecs(ports)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid port: %v", err)
+	}
+	config.ExposedPorts = exposed
+	hostConfig := &container.HostConfig{PortBindings: bindings}
+	for _, v := range volumes {
+		if strings.Contains(v, ":") {
+			hostConfig.Binds = append(hostConfig.Binds, v)
+			continue
+		}
+		if config.Volumes == nil {
+			config.Volumes = map[string]struct{}{}
+		}
+		config.Volumes[v] = struct{}{}
+	}
+	if restart != "" {
+		if hostConfig.RestartPolicy, err = parseRestart(restart); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	var networking *network.NetworkingConfig
+	if networkName != "" {
+		hostConfig.NetworkMode = container.NetworkMode(networkName)
+		if hostConfig.NetworkMode.IsUserDefined() {
+			networking = &network.NetworkingConfig{EndpointsConfig: map[string]*network.EndpointSettings{networkName: {}}}
+		}
+	}
+	return config, hostConfig, networking, nil
+}
+
+// findTemplate loads the template named by the id parameter, replying 404
+// when there is none
+func findTemplate(c *gin.Context) (containerTemplate, bool) {
+	var t containerTemplate
+	found, err := storeGet(templateBucket, c.Param("id"), &t)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, codeInternal, "Error reading template")
+		return t, false
+	}
+	if !found {
+		respondError(c, http.StatusNotFound, codeNotFound, "Template not found")
+		return t, false
+	}
+	return t, true
+}
+
+// listTemplates returns every template, by name
+func listTemplates(c *gin.Context) {
+	templates := []containerTemplate{}
+	err := storeEach(templateBucket, func(_ string, value []byte) error {
+		var t containerTemplate
+		if err := json.Unmarshal(value, &t); err != nil {
+			return err
+		}
+		templates = append(templates, t)
+		return nil
+	})
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, codeInternal, "Error reading templates")
+		return
+	}
+	sort.Slice(templates, func(i, j int) bool { return templates[i].Name < templates[j].Name })
+	respond(c, http.StatusOK, templates)
+}
+
+// getTemplate returns one template
+func getTemplate(c *gin.Context) {
+	if t, ok := findTemplate(c); ok {
+		respond(c, http.StatusOK, t)
+	}
+}
+
+// saveTemplate validates the request body and stores it as t
+func saveTemplate(c *gin.Context, t containerTemplate, status int) {
+	var req templateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		badRequest(c, "name and image are required")
+		return
+	}
+	if err := req.validate(); err != nil {
+		badRequest(c, err.Error())
+		return
+	}
+	t.Name, t.Description, t.Image, t.Command = req.Name, req.Description, req.Image, req.Command
+	t.Env, t.Ports, t.Volumes, t.Labels = req.Env, req.Ports, req.Volumes, req.Labels
+	t.Restart, t.Network = req.Restart, req.Network
+	t.Updated = time.Now()
+	if err := storePut(templateBucket, t.ID, t); err != nil {
+		respondError(c, http.StatusInternalServerError, codeInternal, "Error saving template")
+		return
+	}
+	respond(c, status, t)
+}
+
+// createTemplate adds a template
+func createTemplate(c *gin.Context) {
+	saveTemplate(c, containerTemplate{ID: newRequestID(), Created: time.Now()}, http.StatusCreated)
+}
+
+// updateTemplate replaces a template's definition
+func updateTemplate(c *gin.Context) {
+	if t, ok := findTemplate(c); ok {
+		saveTemplate(c, t, http.StatusOK)
+	}
+}
+
+// deleteTemplate removes a template; containers deployed from it stay
+func deleteTemplate(c *gin.Context) {
+	t, ok := findTemplate(c)
+	if !ok {
+		return
+	}
+	if err := storeDelete(templateBucket, t.ID); err != nil {
+		respondError(c, http.StatusInternalServerError, codeInternal, "Error deleting template")
+		return
+	}
+	respondMessage(c, "Template deleted successfully")
+}
+
+// deployTemplate creates a container from a template on the selected host
+// and starts it. The image is pulled when missing, and the ports are
+// checked against running containers before anything is created.
+func deployTemplate(c *gin.Context) {
+	t, ok := findTemplate(c)
+	if !ok {
+		return
+	}
+	var req deployRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			badRequest(c, "Invalid request")
+			return
+		}
+	}
+	config, hostConfig, networking, err := t.buildContainer(req)
+	if err != nil {
+		badRequest(c, err.Error())
+		return
+	}
+
+	ctx := hostContext(c)
+	if err := checkPortConflicts(ctx, hostConfig, ""); err != nil {
+		dockerError(c, "Error deploying template", err)
+		return
+	}
+	_, _, err = docker(ctx).ImageInspectWithRaw(ctx, config.Image)
+	if req.Pull || errdefs.IsNotFound(err) {
+		if err := pullImage(ctx, config.Image); err != nil {
+			dockerError(c, "Error pulling "+config.Image, err)
+			return
+		}
+	} else if err != nil {
+		dockerError(c, "Error inspecting image", err)
+		return
+	}
+
+	created, err := docker(ctx).ContainerCreate(ctx, config, hostConfig, networking, nil, req.Name)
+	if err != nil {
+		dockerError(c, "Error creating container", err)
+		return
+	}
+	started := req.Start == nil || *req.Start
+	if started {
+		if err := docker(ctx).ContainerStart(ctx, created.ID, container.StartOptions{}); err != nil {
+			_ = docker(ctx).ContainerRemove(ctx, created.ID, container.RemoveOptions{Force: true})
+			dockerError(c, "Error starting container", err)
+			return
+		}
+	}
+	logger.Info("deployed template", "template", t.Name, "container", created.ID[:12], "host", hostFrom(ctx).Name)
+	respond(c, http.StatusCreated, gin.H{
+		"container_id": created.ID,
+		"template":     t.ID,
+		"started":      started,
+		"warnings":     created.Warnings,
+	})
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// requestTimeout bounds the Docker calls made while serving a request;
+// longRequestTimeout applies to transfers and other slow operations
+var (
+	requestTimeout     = envDuration("CONTAINERSCOPE_REQUEST_TIMEOUT", time.Minute)
+	longRequestTimeout = envDuration("CONTAINERSCOPE_LONG_REQUEST_TIMEOUT", 30*time.Minute)
+)
+
+// longRequests are the endpoints that move whole archives, build, pull,
+// deploy or restart groups one by one, keyed by method and route pattern
+var longRequests = map[string]bool{
+	"GET /api/v1/containers/:container_id/logs/download":  true,
+	"GET /api/v1/containers/:container_id/files/download": true,
+	"POST /api/v1/containers/:container_id/files":         true,
+	"GET /api/v1/containers/:container_id/export":         true,
+	"POST /api/v1/containers/:container_id/redeploy":      true,
+	"POST /api/v1/containers/:container_id/recreate":      true,
+	"POST /api/v1/containers/:container_id/bluegreen":     true,
+	"POST /api/v1/containers/:container_id/migrate":       true,
+	"POST /api/v1/containers/:container_id/diagnose":      true,
+	"POST /api/v1/containers/:container_id/capture":       true,
+	"POST /api/v1/logs/bundle":                            true,
+	"POST /api/v1/images/import":                          true,
+	"POST /api/v1/images/build":                           true,
+	"GET /api/v1/images/:image_id/save":                   true,
+	"POST /api/v1/images/load":                            true,
+	"POST /api/v1/images/pull":                            true,
+	"POST /api/v1/images/push":                            true,
+	"POST /api/v1/volumes/:name/backup":                   true,
+	"POST /api/v1/volumes/:name/restore":                  true,
+	"GET /api/v1/volumes/:name/files/download":            true,
+	"POST /api/v1/volumes/:name/files":                    true,
+	"GET /api/v1/images/update-check":                     true,
+	"GET /api/v1/images/:image_id/update-check":           true,
+	"POST /api/v1/stacks":                                 true,
+	"PUT /api/v1/stacks/:stack":                           true,
+	"DELETE /api/v1/stacks/:stack":                        true,
+	"POST /api/v1/swarm/services/:service_id/update":      true,
+	"POST /api/v1/schedules/:id/run":                      true,
+	"POST /api/v1/templates/:id/deploy":                   true,
+	"POST /api/v1/groups/restart":                         true,
+}
+
+// streamingRequests stay open until the client leaves, so they get no
+// deadline at all
+var streamingRequests = map[string]bool{
+	"GET /api/v1/ws/updates": true,
+	"GET /api/v1/ws/logs":    true,
+}
+
+// followRequests are the log endpoints that stream new output with
+// follow=true, and then get no deadline either. Elsewhere follow means
+// nothing and leaves the deadline in place.
+var followRequests = map[string]bool{
+	"GET /api/v1/containers/:container_id/logs/download": true,
+	"GET /api/v1/logs/aggregate":                         true,
+}
+
+// withTimeout derives the request context with a deadline, so Docker calls
+// stop when the client goes away or the daemon hangs. A timeout query
+// parameter such as 5m overrides the default, up to the long timeout.
+func withTimeout() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		route := c.Request.Method + " " + c.FullPath()
+		if streamingRequests[route] || (followRequests[route] && c.Query("follow") == "true") {
+			c.Next()
+			return
+		}
+		timeout := requestTimeout
+		if longRequests[route] {
+			timeout = longRequestTimeout
+		}
+		if v := c.Query("timeout"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d <= 0 {
+				badRequest(c, "timeout must be a positive duration such as 30s or 5m")
+				return
+			}
+			if d > longRequestTimeout {
+				badRequest(c, fmt.Sprintf("timeout may be at most %s", longRequestTimeout))
+				return
+			}
+			timeout = d
+		}
+		ctx, cancel := context.WithTimeout(c.Request.Context(), timeout)
+		defer cancel()
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+	}
+}
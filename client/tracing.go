@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Tracing of API requests and the Docker calls they make, exported over
+// OTLP/HTTP when CONTAINERSCOPE_TRACING is true. The exporter and sampler
+// read the standard OTEL_EXPORTER_OTLP_* and OTEL_TRACES_SAMPLER settings.
+// Until then the global tracer provider is a no-op and spans cost nothing.
+var tracingEnabled = os.Getenv("CONTAINERSCOPE_TRACING") == "true"
+
+// tracer creates the agent's spans
+var tracer = otel.Tracer("containerscope")
+
+// startTracing installs the OTLP tracer provider and the W3C propagators,
+// so a caller's traceparent header continues its trace here
+func startTracing() error {
+	if !tracingEnabled {
+		return nil
+	}
+	exporter, err := otlptracehttp.New(context.Background())
+	if err != nil {
+		return fmt.Errorf("OTLP trace exporter: %w", err)
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(semconv.ServiceName("containerscope-agent"), semconv.ServiceVersion(version)))
+	if err != nil {
+		return err
+	}
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithResource(res), sdktrace.WithBatcher(exporter)))
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	logger.Info("tracing requests over OTLP")
+	return nil
+}
+
+// traceRequests starts a server span for each request, named by its route
+// pattern. Handlers that resolve a container have its full ID recorded.
+func traceRequests() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !tracingEnabled {
+			c.Next()
+			return
+		}
+		ctx := otel.GetTextMapPropagator().Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+		route := c.FullPath()
+		name := c.Request.Method
+		if route != "" {
+			name += " " + route
+		}
+		ctx, span := tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(
+			semconv.HTTPRequestMethodKey.String(c.Request.Method),
+			semconv.HTTPRoute(route),
+			semconv.URLPath(c.Request.URL.Path),
+			semconv.ClientAddress(c.ClientIP()),
+			attribute.String("request_id", c.GetString(requestIDKey)),
+		))
+		defer span.End()
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+
+		status := c.Writer.Status()
+		span.SetAttributes(semconv.HTTPResponseStatusCode(status))
+		if host, ok := c.Get(hostKey); ok {
+			span.SetAttributes(attribute.String("docker.host", host.(*dockerHost).Name))
+		}
+		if id := c.Param("container_id"); id != "" {
+			span.SetAttributes(semconv.ContainerID(id))
+		}
+		if status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+		if len(c.Errors) > 0 {
+			span.RecordError(c.Errors.Last())
+		}
+	}
+}
+
+// startDockerSpan starts a client span for a Docker API request, carrying
+// the container ID when the path names one. Only calls made for a traced
+// request get one; background polling would otherwise start a trace every
+// few seconds. The daemon continues the trace when it has tracing of its
+// own.
+func startDockerSpan(req *http.Request, host, endpoint string) (*http.Request, trace.Span) {
+	if !trace.SpanFromContext(req.Context()).IsRecording() {
+		return req, trace.SpanFromContext(context.Background())
+	}
+	ctx, span := tracer.Start(req.Context(), "docker "+req.Method+" "+endpoint, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		semconv.HTTPRequestMethodKey.String(req.Method),
+		semconv.URLPath(req.URL.Path),
+		attribute.String("docker.host", host),
+		attribute.String("docker.endpoint", endpoint),
+	))
+	if strings.HasPrefix(endpoint, "containers/{id}") {
+		parts := strings.Split(strings.Trim(apiVersionPrefix.ReplaceAllString(req.URL.Path, ""), "/"), "/")
+		span.SetAttributes(semconv.ContainerID(parts[1]))
+	}
+	// RoundTrippers must not change the caller's request
+	req = req.Clone(ctx)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+	return req, span
+}
+
+// endDockerSpan records the daemon's answer on a Docker client span
+func endDockerSpan(span trace.Span, resp *http.Response, err error) {
+	switch {
+	case err != nil:
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	case resp.StatusCode >= http.StatusBadRequest:
+		span.SetAttributes(semconv.HTTPResponseStatusCode(resp.StatusCode))
+		span.SetStatus(codes.Error, resp.Status)
+	default:
+		span.SetAttributes(semconv.HTTPResponseStatusCode(resp.StatusCode))
+	}
+	span.End()
+}
+
+// traceID returns the ID of the trace ctx is part of, or "" when it is not
+// being traced
+func traceID(ctx context.Context) string {
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		return sc.TraceID().String()
+	}
+	return ""
+}
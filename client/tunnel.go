@@ -0,0 +1,550 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/client"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// tunnelEndpoint is the CONTAINERSCOPE_HOSTS endpoint of a host whose
+// agent dials in, for daemons behind NAT or a firewall that cannot be
+// reached directly
+const tunnelEndpoint = "tunnel:"
+
+// tunnelDialTimeout bounds how long opening a connection to a daemon
+// through its tunnel waits for the agent on the other end
+const tunnelDialTimeout = 10 * time.Second
+
+// tunnelMessage is sent over a tunnel's control connection. The hub sends
+// dial to ask for a stream to the daemon; the agent answers with error
+// when it cannot reach the daemon.
+type tunnelMessage struct {
+	Type  string `json:"type"`
+	ID    string `json:"id"`
+	Error string `json:"error,omitempty"`
+}
+
+// tunnelStream is what a pending dial receives: the agent's stream to its
+// daemon, or why there is none
+type tunnelStream struct {
+	ws  *websocket.Conn
+	err error
+}
+
+// tunnel is an agent's control connection to this one, through which the
+// daemon it stands for is reached
+type tunnel struct {
+	name   string
+	remote string
+	since  time.Time
+	done   chan struct{}
+
+	// writeMu serializes writes on the control connection
+	writeMu sync.Mutex
+	control *websocket.Conn
+
+	mu      sync.Mutex
+	pending map[string]chan tunnelStream
+}
+
+// tunnels holds the connected tunnel of each tunnel host by name
+var tunnels = struct {
+	sync.Mutex
+	byHost map[string]*tunnel
+}{byHost: map[string]*tunnel{}}
+
+// connectedTunnel returns the host's tunnel, or nil if its agent is not
+// connected
+func connectedTunnel(name string) *tunnel {
+	tunnels.Lock()
+	defer tunnels.Unlock()
+	return tunnels.byHost[name]
+}
+
+// tunnelToken is the token the agent behind a tunnel host must present:
+// CONTAINERSCOPE_TUNNEL_TOKEN_<NAME>, or CONTAINERSCOPE_TUNNEL_TOKEN
+func tunnelToken(name string) string {
+	return envOr(hostEnv("CONTAINERSCOPE_TUNNEL_TOKEN", name), os.Getenv("CONTAINERSCOPE_TUNNEL_TOKEN"))
+}
+
+// newTunnelHost creates a host reached through the tunnel its agent opens
+func newTunnelHost(name string) (*dockerHost, error) {
+	if name == defaultHostName {
+		return nil, fmt.Errorf("the default host cannot be a tunnel")
+	}
+	if tunnelToken(name) == "" {
+		return nil, fmt.Errorf("set %s or CONTAINERSCOPE_TUNNEL_TOKEN for the agent to authenticate with", hostEnv("CONTAINERSCOPE_TUNNEL_TOKEN", name))
+	}
+	host := &dockerHost{Name: name, Endpoint: tunnelEndpoint}
+	if err := host.connect(); err != nil {
+		return nil, err
+	}
+	return host, nil
+}
+
+// tunnelStatus describes whether a tunnel host's agent is connected, and
+// since when and from where
+func tunnelStatus(name string) gin.H {
+	t := connectedTunnel(name)
+	if t == nil {
+		return gin.H{"connected": false}
+	}
+	return gin.H{"connected": true, "since": t.since, "remote": t.remote}
+}
+
+// tunnelClientOpts returns client options that reach a tunnel host's
+// daemon by asking its agent for a stream per connection. Requests fail
+// fast while the agent is not connected.
+func tunnelClientOpts(name string) []client.Opt {
+	dial := func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return dialTunnel(ctx, name)
+	}
+	httpClient := &http.Client{
+		Transport: &http.Transport{
+			DialContext:         dial,
+			MaxIdleConnsPerHost: 8,
+			IdleConnTimeout:     90 * time.Second,
+		},
+	}
+	return []client.Opt{
+		client.WithHTTPClient(httpClient),
+		client.WithHost("http://" + name),
+		client.WithDialContext(dial),
+		client.WithAPIVersionNegotiation(),
+	}
+}
+
+// dialTunnel opens a connection to a tunnel host's daemon: it asks the
+// agent to dial its daemon and connect back with a stream, and waits for
+// that stream
+func dialTunnel(ctx context.Context, name string) (net.Conn, error) {
+	t := connectedTunnel(name)
+	if t == nil {
+		return nil, fmt.Errorf("host %s: agent is not connected", name)
+	}
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, err
+	}
+	id := hex.EncodeToString(buf)
+	ch := make(chan tunnelStream, 1)
+	t.mu.Lock()
+	t.pending[id] = ch
+	t.mu.Unlock()
+
+	if err := t.send(tunnelMessage{Type: "dial", ID: id}); err != nil {
+		t.take(id)
+		return nil, fmt.Errorf("host %s: %w", name, err)
+	}
+	timer := time.NewTimer(tunnelDialTimeout)
+	defer timer.Stop()
+	var err error
+	select {
+	case stream := <-ch:
+		if stream.err != nil {
+			return nil, fmt.Errorf("host %s: %w", name, stream.err)
+		}
+		return &tunnelConn{ws: stream.ws}, nil
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-timer.C:
+		err = fmt.Errorf("host %s: agent did not open a stream within %s", name, tunnelDialTimeout)
+	case <-t.done:
+		err = fmt.Errorf("host %s: agent disconnected", name)
+	}
+	// A stream the agent opens after all is closed once it arrives
+	if t.take(id) == nil {
+		go func() {
+			if stream := <-ch; stream.ws != nil {
+				stream.ws.Close()
+			}
+		}()
+	}
+	return nil, err
+}
+
+// send writes a message on the control connection
+func (t *tunnel) send(msg tunnelMessage) error {
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
+	t.control.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	return t.control.WriteJSON(msg)
+}
+
+// take removes and returns the channel a pending dial waits on, or nil if
+// it was taken already
+func (t *tunnel) take(id string) chan tunnelStream {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	ch := t.pending[id]
+	delete(t.pending, id)
+	return ch
+}
+
+// tunnelHost checks the name and token of a tunnel request, replying with
+// an error when they do not match a tunnel host
+func tunnelHost(c *gin.Context) (*dockerHost, bool) {
+	host, ok := dockerHosts[c.Param("name")]
+	if !ok || host.Endpoint != tunnelEndpoint {
+		respondError(c, http.StatusNotFound, codeHostNotFound, fmt.Sprintf("Host %s is not a tunnel host", c.Param("name")))
+		return nil, false
+	}
+	token := bearerToken(c)
+	if token == "" {
+		c.Header("WWW-Authenticate", `Bearer realm="containerscope"`)
+		respondError(c, http.StatusUnauthorized, codeUnauthorized, "Tunnel token required")
+		return nil, false
+	}
+	if !tokenMatches(token, tunnelToken(host.Name)) {
+		respondError(c, http.StatusForbidden, codeForbidden, "Invalid tunnel token")
+		return nil, false
+	}
+	return host, true
+}
+
+// acceptTunnel takes the control connection of the agent behind a tunnel
+// host, replacing any earlier one, and keeps it until either side goes
+// away. Pings in both directions find connections that died silently.
+func acceptTunnel(c *gin.Context) {
+	host, ok := tunnelHost(c)
+	if !ok {
+		return
+	}
+	ws, err := wsUpgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		// The upgrader has already replied
+		c.Error(err)
+		return
+	}
+	t := &tunnel{
+		name:    host.Name,
+		remote:  c.ClientIP(),
+		since:   time.Now(),
+		done:    make(chan struct{}),
+		control: ws,
+		pending: map[string]chan tunnelStream{},
+	}
+	tunnels.Lock()
+	old := tunnels.byHost[host.Name]
+	tunnels.byHost[host.Name] = t
+	tunnels.Unlock()
+	if old != nil {
+		old.control.Close()
+	}
+	logger.Info("tunnel connected", "host", host.Name, "remote", t.remote)
+
+	defer func() {
+		tunnels.Lock()
+		if tunnels.byHost[host.Name] == t {
+			delete(tunnels.byHost, host.Name)
+		}
+		tunnels.Unlock()
+		close(t.done)
+		ws.Close()
+		logger.Info("tunnel disconnected", "host", host.Name, "remote", t.remote)
+	}()
+
+	keepAlive(ws, t.done)
+	for {
+		var msg tunnelMessage
+		if err := ws.ReadJSON(&msg); err != nil {
+			return
+		}
+		if msg.Type == "error" {
+			if ch := t.take(msg.ID); ch != nil {
+				ch <- tunnelStream{err: errors.New(msg.Error)}
+			}
+		}
+	}
+}
+
+// acceptTunnelStream takes a stream an agent opens to its daemon for a
+// pending dial, and hands it to the dial
+func acceptTunnelStream(c *gin.Context) {
+	host, ok := tunnelHost(c)
+	if !ok {
+		return
+	}
+	t := connectedTunnel(host.Name)
+	var ch chan tunnelStream
+	if t != nil {
+		ch = t.take(c.Param("id"))
+	}
+	if ch == nil {
+		respondError(c, http.StatusNotFound, codeNotFound, "No dial is waiting for this stream")
+		return
+	}
+	ws, err := wsUpgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		ch <- tunnelStream{err: err}
+		c.Error(err)
+		return
+	}
+	ch <- tunnelStream{ws: ws}
+}
+
+// keepAlive pings the other end of ws every wsPingInterval and expects to
+// hear from it within two intervals, so a reader blocked on a dead
+// connection fails instead of waiting forever. Pings from the other end
+// count as hearing from it too.
+func keepAlive(ws *websocket.Conn, done <-chan struct{}) {
+	extend := func() { ws.SetReadDeadline(time.Now().Add(2 * wsPingInterval)) }
+	extend()
+	ws.SetPongHandler(func(string) error {
+		extend()
+		return nil
+	})
+	ws.SetPingHandler(func(data string) error {
+		extend()
+		err := ws.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(10*time.Second))
+		if errors.Is(err, websocket.ErrCloseSent) {
+			return nil
+		}
+		return err
+	})
+	go func() {
+		ticker := time.NewTicker(wsPingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(10*time.Second)); err != nil {
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+}
+
+// tunnelConn carries a byte stream over a WebSocket as binary messages
+type tunnelConn struct {
+	ws     *websocket.Conn
+	reader io.Reader
+}
+
+func (c *tunnelConn) Read(p []byte) (int, error) {
+	for {
+		if c.reader == nil {
+			kind, r, err := c.ws.NextReader()
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+				return 0, io.EOF
+			} else if err != nil {
+				return 0, err
+			}
+			if kind != websocket.BinaryMessage {
+				continue
+			}
+			c.reader = r
+		}
+		n, err := c.reader.Read(p)
+		if err == io.EOF {
+			c.reader = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (c *tunnelConn) Write(p []byte) (int, error) {
+	if err := c.ws.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close says goodbye before closing, so the other end sees the stream end
+// rather than fail
+func (c *tunnelConn) Close() error {
+	_ = c.ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+	return c.ws.Close()
+}
+
+func (c *tunnelConn) LocalAddr() net.Addr  { return c.ws.LocalAddr() }
+func (c *tunnelConn) RemoteAddr() net.Addr { return c.ws.RemoteAddr() }
+
+func (c *tunnelConn) SetDeadline(t time.Time) error {
+	if err := c.ws.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.ws.SetWriteDeadline(t)
+}
+
+func (c *tunnelConn) SetReadDeadline(t time.Time) error  { return c.ws.SetReadDeadline(t) }
+func (c *tunnelConn) SetWriteDeadline(t time.Time) error { return c.ws.SetWriteDeadline(t) }
+
+// tunnelDialer is how an agent reaches the hub it tunnels to
+type tunnelDialer struct {
+	base   string
+	name   string
+	header http.Header
+	dialer *websocket.Dialer
+}
+
+// startTunnel connects this agent's default daemon to the hubs at
+// CONTAINERSCOPE_TUNNEL_URL, comma separated for replicas of a hub, where
+// it is configured as the tunnel host CONTAINERSCOPE_TUNNEL_NAME, by
+// default the machine's hostname. The agent dials out and keeps each
+// connection open, reconnecting with backoff, so a hub reaches a daemon
+// behind NAT or a firewall without any inbound connection. The hub gets
+// the daemon's whole API.
+func startTunnel() {
+	for _, base := range splitList(os.Getenv("CONTAINERSCOPE_TUNNEL_URL")) {
+		d, err := newTunnelDialer(base)
+		if err != nil {
+			logger.Error("tunnel disabled", "error", err)
+			return
+		}
+		logger.Info("tunnelling to hub", "url", base, "name", d.name)
+		go d.run()
+	}
+}
+
+// newTunnelDialer reads the agent side of the tunnel configuration
+func newTunnelDialer(base string) (*tunnelDialer, error) {
+	u, err := url.Parse(base)
+	if err != nil {
+		return nil, fmt.Errorf("CONTAINERSCOPE_TUNNEL_URL: %w", err)
+	}
+	switch u.Scheme {
+	case "http", "ws":
+		u.Scheme = "ws"
+	case "https", "wss":
+		u.Scheme = "wss"
+	default:
+		return nil, fmt.Errorf("CONTAINERSCOPE_TUNNEL_URL: expected an http, https, ws or wss URL, got %q", base)
+	}
+	name := os.Getenv("CONTAINERSCOPE_TUNNEL_NAME")
+	if name == "" {
+		if name, err = os.Hostname(); err != nil {
+			return nil, fmt.Errorf("CONTAINERSCOPE_TUNNEL_NAME: %w", err)
+		}
+	}
+	token := os.Getenv("CONTAINERSCOPE_TUNNEL_TOKEN")
+	if token == "" {
+		return nil, fmt.Errorf("CONTAINERSCOPE_TUNNEL_TOKEN is required")
+	}
+	dialer := *websocket.DefaultDialer
+	if caFile := os.Getenv("CONTAINERSCOPE_TUNNEL_CA_FILE"); caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("CONTAINERSCOPE_TUNNEL_CA_FILE: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("CONTAINERSCOPE_TUNNEL_CA_FILE: no certificates in %s", caFile)
+		}
+		dialer.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	return &tunnelDialer{
+		base:   strings.TrimSuffix(u.String(), "/") + "/tunnel/" + url.PathEscape(name),
+		name:   name,
+		header: http.Header{"Authorization": {"Bearer " + token}},
+		dialer: &dialer,
+	}, nil
+}
+
+// run keeps the control connection to the hub open, reconnecting with
+// backoff when it drops or the hub cannot be reached
+func (d *tunnelDialer) run() {
+	backoff := time.Second
+	for {
+		connected, err := d.serve()
+		if connected {
+			backoff = time.Second
+		}
+		logger.Warn("tunnel to hub lost", "url", d.base, "error", err, "retry_in", backoff)
+		time.Sleep(backoff)
+		if backoff < 30*time.Second {
+			backoff *= 2
+		}
+	}
+}
+
+// serve opens the control connection and answers the hub's dials until it
+// closes. connected says whether the hub accepted the connection.
+func (d *tunnelDialer) serve() (connected bool, err error) {
+	ws, resp, err := d.dialer.Dial(d.base, d.header)
+	if err != nil {
+		if resp != nil {
+			return false, fmt.Errorf("%w: %s", err, resp.Status)
+		}
+		return false, err
+	}
+	defer ws.Close()
+	logger.Info("tunnel to hub open", "url", d.base)
+
+	done := make(chan struct{})
+	defer close(done)
+	var writeMu sync.Mutex
+	keepAlive(ws, done)
+	for {
+		var msg tunnelMessage
+		if err := ws.ReadJSON(&msg); err != nil {
+			return true, err
+		}
+		if msg.Type != "dial" {
+			continue
+		}
+		go func() {
+			if err := d.stream(msg.ID); err != nil {
+				writeMu.Lock()
+				ws.SetWriteDeadline(time.Now().Add(10 * time.Second))
+				ws.WriteJSON(tunnelMessage{Type: "error", ID: msg.ID, Error: err.Error()})
+				writeMu.Unlock()
+			}
+		}()
+	}
+}
+
+// stream connects the default daemon to a new stream to the hub and
+// copies between them until either side closes. It fails only when the
+// daemon cannot be reached, which the hub is told about.
+func (d *tunnelDialer) stream(id string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), tunnelDialTimeout)
+	defer cancel()
+	daemon, err := dockerHosts[defaultHostName].Client().Dialer()(ctx)
+	if err != nil {
+		return err
+	}
+	defer daemon.Close()
+	ws, _, err := d.dialer.DialContext(ctx, d.base+"/streams/"+id, d.header)
+	if err != nil {
+		logger.Warn("opening tunnel stream", "url", d.base, "error", err)
+		return nil
+	}
+	conn := &tunnelConn{ws: ws}
+	defer conn.Close()
+
+	copied := make(chan struct{}, 2)
+	go func() {
+		io.Copy(daemon, conn)
+		copied <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, daemon)
+		copied <- struct{}{}
+	}()
+	<-copied
+	return nil
+}
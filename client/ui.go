@@ -0,0 +1,32 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// uiFiles is the web UI, a small single-page app over the /api/v1 endpoints
+//
+//go:embed ui
+var uiFiles embed.FS
+
+// uiAssets serves the UI's scripts and styles
+func uiAssets() http.FileSystem {
+	sub, err := fs.Sub(uiFiles, "ui")
+	if err != nil {
+		panic(err)
+	}
+	return http.FS(sub)
+}
+
+func uiIndex(c *gin.Context) {
+	page, err := uiFiles.ReadFile("ui/index.html")
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, codeInternal, err.Error())
+		return
+	}
+	c.Data(http.StatusOK, "text/html; charset=utf-8", page)
+}
@@ -0,0 +1,306 @@
+// ContainerScope web UI: a thin client over the /api/v1 endpoints
+
+const state = {
+  host: "",
+  selected: null,
+  cpu: [],
+  mem: [],
+  prevStats: null,
+  timer: null,
+  socket: null,
+};
+
+const historyLength = 60;
+const pollInterval = 3000;
+
+async function api(method, path, body) {
+  const url = new URL("/api/v1" + path, location.origin);
+  if (state.host) {
+    url.searchParams.set("host", state.host);
+  }
+  const response = await fetch(url, {
+    method,
+    headers: body ? { "Content-Type": "application/json" } : {},
+    body: body ? JSON.stringify(body) : undefined,
+  });
+  if (response.status === 401) {
+    // Sign in through the identity provider and come back here
+    location.href = "/auth/login?redirect=" + encodeURIComponent(location.pathname + location.search);
+    return new Promise(() => {});
+  }
+  const envelope = await response.json();
+  if (envelope.error) {
+    throw new Error(envelope.error.message);
+  }
+  return envelope.data;
+}
+
+function showError(err) {
+  const el = document.getElementById("error");
+  el.hidden = !err;
+  el.textContent = err ? err.message : "";
+}
+
+function cell(text, className) {
+  const td = document.createElement("td");
+  td.textContent = text;
+  if (className) {
+    td.className = className;
+  }
+  return td;
+}
+
+function actionButton(label, action, id) {
+  const button = document.createElement("button");
+  button.textContent = label;
+  button.addEventListener("click", async (event) => {
+    event.stopPropagation();
+    button.disabled = true;
+    try {
+      await api("POST", "/containers/" + action, { container_id: id });
+      await loadContainers();
+    } catch (err) {
+      showError(err);
+    } finally {
+      button.disabled = false;
+    }
+  });
+  return button;
+}
+
+async function loadHosts() {
+  const select = document.getElementById("host");
+  try {
+    const hosts = await api("GET", "/hosts");
+    select.replaceChildren(...hosts.map((host) => {
+      const option = document.createElement("option");
+      option.value = host.name;
+      option.textContent = host.name + (host.reachable ? "" : " (unreachable)");
+      option.selected = host.default;
+      return option;
+    }));
+    state.host = select.value;
+  } catch (err) {
+    // The containerd runtime has no hosts
+    select.parentElement.hidden = true;
+  }
+}
+
+function containerRow(container) {
+  const tr = document.createElement("tr");
+  tr.dataset.id = container.id;
+  tr.classList.toggle("selected", state.selected === container.id);
+  const running = container.running ?? container.state === "running";
+  tr.append(
+    cell(container.name),
+    cell(container.image || ""),
+    cell(running ? "running" : "stopped", running ? "state-running" : "state-stopped"),
+    cell(container.health || ""),
+    cell((container.ports || []).join(", ")),
+    cell(container.project || ""),
+  );
+  const actions = document.createElement("td");
+  if (running) {
+    actions.append(actionButton("Stop", "stop", container.id), actionButton("Restart", "restart", container.id));
+  } else {
+    actions.append(actionButton("Start", "start", container.id));
+  }
+  tr.append(actions);
+  tr.addEventListener("click", () => selectContainer(container));
+  tr.container = container;
+  return tr;
+}
+
+async function loadContainers() {
+  const all = document.getElementById("all").checked;
+  try {
+    // Docker lists every container unless filtered; containerd only
+    // running ones unless all is set
+    const containers = await api("GET", "/containers" + (all ? "?all=true" : "?status=running"));
+    document.querySelector("#containers tbody").replaceChildren(...containers.map(containerRow));
+    showError(null);
+  } catch (err) {
+    showError(err);
+  }
+}
+
+// applyUpdate changes the one row an update is about, and reloads the list
+// when rows appear or disappear
+function applyUpdate(update) {
+  const tr = document.querySelector(`#containers tbody tr[data-id="${update.id}"]`);
+  const all = document.getElementById("all").checked;
+  if (update.type === "health_status" && tr) {
+    tr.replaceWith(containerRow({ ...tr.container, health: update.health }));
+  } else if ((update.type === "started" || update.type === "died") && tr && all) {
+    tr.replaceWith(containerRow({ ...tr.container, running: update.running }));
+  } else if (update.type !== "health_status") {
+    loadContainers();
+  }
+}
+
+// connectUpdates follows container state changes for the selected host,
+// reconnecting after a pause when the connection drops
+function connectUpdates() {
+  if (state.socket) {
+    state.socket.onclose = null;
+    state.socket.close();
+  }
+  const url = new URL("/api/v1/ws/updates", location.origin);
+  url.protocol = location.protocol === "https:" ? "wss:" : "ws:";
+  if (state.host) {
+    url.searchParams.set("host", state.host);
+  }
+  const socket = new WebSocket(url);
+  socket.onmessage = (message) => applyUpdate(JSON.parse(message.data));
+  socket.onclose = () => {
+    state.socket = null;
+    setTimeout(connectUpdates, 5000);
+  };
+  state.socket = socket;
+}
+
+function selectContainer(container) {
+  state.selected = container.id;
+  state.cpu = [];
+  state.mem = [];
+  state.prevStats = null;
+  document.getElementById("detail").hidden = false;
+  document.getElementById("detail-name").textContent = container.name;
+  for (const tr of document.querySelectorAll("#containers tbody tr")) {
+    tr.classList.remove("selected");
+  }
+  pollDetail();
+  loadContainers();
+}
+
+function closeDetail() {
+  state.selected = null;
+  clearTimeout(state.timer);
+  document.getElementById("detail").hidden = true;
+  loadContainers();
+}
+
+// cpuPercent compares two one-shot samples the way docker stats does
+function cpuPercent(prev, stats) {
+  if (!prev || !stats.cpu_stats || !prev.cpu_stats) {
+    return null;
+  }
+  const cpuDelta = stats.cpu_stats.cpu_usage.total_usage - prev.cpu_stats.cpu_usage.total_usage;
+  const systemDelta = stats.cpu_stats.system_cpu_usage - prev.cpu_stats.system_cpu_usage;
+  const cpus = stats.cpu_stats.online_cpus || 1;
+  if (systemDelta <= 0 || cpuDelta < 0) {
+    return 0;
+  }
+  return (cpuDelta / systemDelta) * cpus * 100;
+}
+
+function formatBytes(bytes) {
+  const units = ["B", "KiB", "MiB", "GiB", "TiB"];
+  let i = 0;
+  while (bytes >= 1024 && i < units.length - 1) {
+    bytes /= 1024;
+    i++;
+  }
+  return bytes.toFixed(1) + " " + units[i];
+}
+
+function drawChart(id, values, max) {
+  const canvas = document.getElementById(id);
+  const ctx = canvas.getContext("2d");
+  ctx.clearRect(0, 0, canvas.width, canvas.height);
+  if (values.length < 2) {
+    return;
+  }
+  const top = Math.max(max || 0, ...values) || 1;
+  const step = canvas.width / (historyLength - 1);
+  ctx.strokeStyle = "#0969da";
+  ctx.lineWidth = 2;
+  ctx.beginPath();
+  values.forEach((value, i) => {
+    const x = (historyLength - values.length + i) * step;
+    const y = canvas.height - (value / top) * (canvas.height - 4) - 2;
+    if (i === 0) {
+      ctx.moveTo(x, y);
+    } else {
+      ctx.lineTo(x, y);
+    }
+  });
+  ctx.stroke();
+}
+
+function pushSample(list, value) {
+  list.push(value);
+  if (list.length > historyLength) {
+    list.shift();
+  }
+}
+
+async function loadStats(id) {
+  const stats = await api("GET", "/containers/" + id + "/stats");
+  const cpu = cpuPercent(state.prevStats, stats);
+  state.prevStats = stats;
+  if (cpu !== null) {
+    pushSample(state.cpu, cpu);
+    document.getElementById("cpu-value").textContent = cpu.toFixed(1) + "%";
+  }
+  const memory = stats.memory_stats || {};
+  if (memory.usage !== undefined) {
+    const used = memory.usage - ((memory.stats && memory.stats.inactive_file) || 0);
+    pushSample(state.mem, used);
+    document.getElementById("mem-value").textContent =
+      formatBytes(used) + (memory.limit ? " / " + formatBytes(memory.limit) : "");
+    drawChart("mem", state.mem, memory.limit);
+  }
+  drawChart("cpu", state.cpu, 100);
+}
+
+async function loadLogs(id) {
+  const lines = document.getElementById("lines").value || 200;
+  // The agent escapes the output and turns colours into ansi-* spans
+  const logs = await api("GET", "/containers/" + id + "/logs?ansi=html&lines=" + lines);
+  const pre = document.getElementById("logs");
+  const atBottom = pre.scrollTop + pre.clientHeight >= pre.scrollHeight - 4;
+  pre.innerHTML = logs;
+  if (atBottom) {
+    pre.scrollTop = pre.scrollHeight;
+  }
+}
+
+async function pollDetail() {
+  clearTimeout(state.timer);
+  const id = state.selected;
+  if (!id) {
+    return;
+  }
+  try {
+    await Promise.all([loadStats(id), loadLogs(id)]);
+    showError(null);
+  } catch (err) {
+    showError(err);
+  }
+  if (state.selected === id && document.getElementById("follow").checked) {
+    state.timer = setTimeout(pollDetail, pollInterval);
+  }
+}
+
+document.getElementById("refresh").addEventListener("click", loadContainers);
+document.getElementById("all").addEventListener("change", loadContainers);
+document.getElementById("close").addEventListener("click", closeDetail);
+document.getElementById("follow").addEventListener("change", pollDetail);
+document.getElementById("lines").addEventListener("change", pollDetail);
+document.getElementById("host").addEventListener("change", (event) => {
+  state.host = event.target.value;
+  closeDetail();
+  connectUpdates();
+});
+
+loadHosts().then(() => {
+  loadContainers();
+  connectUpdates();
+});
+// Poll only while updates are not being pushed
+setInterval(() => {
+  if (!state.socket || state.socket.readyState !== WebSocket.OPEN) {
+    loadContainers();
+  }
+}, 10000);
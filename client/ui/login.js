@@ -0,0 +1,29 @@
+// ContainerScope sign-in form for directory (LDAP) accounts
+
+// Where to go once signed in; only paths on this server are followed
+const params = new URLSearchParams(location.search);
+let redirect = params.get("redirect") || "/";
+if (!redirect.startsWith("/") || redirect.startsWith("//")) {
+  redirect = "/";
+}
+document.getElementById("sso-link").search = "?redirect=" + encodeURIComponent(redirect);
+
+document.getElementById("login").addEventListener("submit", async (event) => {
+  event.preventDefault();
+  const form = event.target;
+  const error = document.getElementById("error");
+  error.hidden = true;
+  const response = await fetch("/auth/ldap/login", {
+    method: "POST",
+    headers: { "Content-Type": "application/json" },
+    body: JSON.stringify({ username: form.username.value, password: form.password.value }),
+  });
+  const envelope = await response.json();
+  if (envelope.error) {
+    error.textContent = envelope.error.message;
+    error.hidden = false;
+    form.password.value = "";
+    return;
+  }
+  location.href = redirect;
+});
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/gin-gonic/gin"
+)
+
+// autoUpdateLabel opts a container into automatic updates when set to "true"
+const autoUpdateLabel = "containerscope.autoupdate"
+
+// updatePolicyBucket holds API-configured policies keyed by container name,
+// since IDs change every time a container is recreated
+const updatePolicyBucket = "update_policies"
+
+// updateResult records what happened when a container was checked
+type updateResult struct {
+	Container string    `json:"container"`
+	Image     string    `json:"image"`
+	Updated   bool      `json:"updated"`
+	NewID     string    `json:"new_id,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	At        time.Time `json:"at"`
+}
+
+// updater is the state of the background update loop
+var updater struct {
+	sync.Mutex
+	interval time.Duration
+	lastRun  time.Time
+	results  []updateResult
+}
+
+// startUpdater runs the update loop every CONTAINERSCOPE_AUTO_UPDATE_INTERVAL
+// until ctx is done; automatic updates are off when it is unset
+func startUpdater(ctx context.Context) {
+	interval := envDuration("CONTAINERSCOPE_AUTO_UPDATE_INTERVAL", 0)
+	if interval <= 0 {
+		return
+	}
+	updater.interval = interval
+	logger.Info("automatic updates enabled", "interval", interval.String())
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+			results := runUpdates(ctx)
+			updater.Lock()
+			updater.lastRun = time.Now()
+			updater.results = results
+			updater.Unlock()
+		}
+	}()
+}
+
+// runUpdates updates every running container that has opted in, by policy
+// or by label, with a policy taking precedence over the label. Once ctx is
+// done it updates no more containers, but finishes the one under way.
+func runUpdates(ctx context.Context) []updateResult {
+	results := []updateResult{}
+
+	policies, err := loadPolicies(updatePolicyBucket)
+	if err != nil {
+		logger.Error("loading update policies", "error", err)
+		return results
+	}
+	containers, err := docker(ctx).ContainerList(ctx, container.ListOptions{
+		Filters: filters.NewArgs(filters.Arg("status", "running")),
+	})
+	if err != nil {
+		logger.Error("listing containers for update", "error", err)
+		return results
+	}
+
+	for _, cont := range containers {
+		name := strings.TrimPrefix(cont.Names[0], "/")
+		enabled := cont.Labels[autoUpdateLabel] == "true"
+		if policy, ok := policies[name]; ok {
+			enabled = policy.Enabled
+		}
+		if !enabled {
+			continue
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		result, err := updateContainer(context.WithoutCancel(ctx), cont.ID, false)
+		if err != nil {
+			result.Error = err.Error()
+			logger.Error("automatic update failed", "container", name, "error", err)
+		} else if result.Updated {
+			logger.Info("container updated", "container", name, "image", result.Image, "new_id", result.NewID)
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// updateContainer pulls the container's image reference and recreates the
+// container when the pull produced a different image, or always with force
+func updateContainer(ctx context.Context, containerID string, force bool) (updateResult, error) {
+	inspection, err := docker(ctx).ContainerInspect(ctx, containerID)
+	if err != nil {
+		return updateResult{Container: containerID, At: time.Now()}, err
+	}
+
+	ref := inspection.Config.Image
+	result := updateResult{Container: strings.TrimPrefix(inspection.Name, "/"), Image: ref, At: time.Now()}
+	if strings.Contains(ref, "@") || strings.HasPrefix(ref, "sha256:") {
+		return result, errors.New("container image is pinned to a digest or ID and cannot be updated")
+	}
+
+	if err := pullImage(ctx, ref); err != nil {
+		return result, err
+	}
+	pulled, _, err := docker(ctx).ImageInspectWithRaw(ctx, ref)
+	if err != nil {
+		return result, err
+	}
+	if pulled.ID == inspection.Image && !force {
+		return result, nil
+	}
+
+	newID, err := recreateContainer(ctx, inspection.ID, ref)
+	if err != nil {
+		return result, err
+	}
+	result.Updated = true
+	result.NewID = newID
+	return result, nil
+}
+
+// redeployContainer pulls the container's image and recreates it if the
+// image changed, or unconditionally with ?force=true
+func redeployContainer(c *gin.Context) {
+	ctx := hostContext(c)
+	result, err := updateContainer(ctx, c.Param("container_id"), c.Query("force") == "true")
+	if err != nil {
+		dockerError(c, "Error redeploying container", err)
+		return
+	}
+
+	respond(c, http.StatusOK, result)
+}
+
+// updateStatus reports the update loop's configuration and last run
+func updateStatus(c *gin.Context) {
+	policies, err := loadPolicies(updatePolicyBucket)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, codeInternal, err.Error())
+		return
+	}
+	policyList := []containerPolicy{}
+	for _, policy := range policies {
+		policyList = append(policyList, policy)
+	}
+
+	updater.Lock()
+	defer updater.Unlock()
+	var lastRun *time.Time
+	if !updater.lastRun.IsZero() {
+		lastRun = &updater.lastRun
+	}
+	results := updater.results
+	if results == nil {
+		results = []updateResult{}
+	}
+	respond(c, http.StatusOK, gin.H{
+		"enabled":          updater.interval > 0,
+		"interval_seconds": updater.interval.Seconds(),
+		"label":            autoUpdateLabel,
+		"last_run":         lastRun,
+		"last_results":     results,
+		"policies":         policyList,
+	})
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/docker/docker/api/types"
+	"github.com/gin-gonic/gin"
+)
+
+// updateCheck compares a local image with its tag in the registry
+type updateCheck struct {
+	Image           string   `json:"image"`
+	LocalDigests    []string `json:"local_digests"`
+	RemoteDigest    string   `json:"remote_digest"`
+	UpdateAvailable bool     `json:"update_available"`
+	// Status is up_to_date, update_available, or unknown for images with
+	// no registry digest (built or loaded locally)
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// checkImageUpdate resolves the registry digest of the image's tag through
+// the daemon and compares it with the digests the local image was pulled as
+func checkImageUpdate(ctx context.Context, imageRef string) (updateCheck, error) {
+	inspection, _, err := docker(ctx).ImageInspectWithRaw(ctx, imageRef)
+	if err != nil {
+		return updateCheck{Image: imageRef}, err
+	}
+
+	// Accept an image ID by checking its first tag
+	ref := imageRef
+	if !contains(inspection.RepoTags, imageRef) {
+		if len(inspection.RepoTags) == 0 {
+			return updateCheck{Image: imageRef}, fmt.Errorf("image %s has no tag to check", imageRef)
+		}
+		ref = inspection.RepoTags[0]
+	}
+
+	check := updateCheck{Image: ref, LocalDigests: []string{}, Status: "unknown"}
+	for _, repoDigest := range inspection.RepoDigests {
+		if _, digest, ok := strings.Cut(repoDigest, "@"); ok {
+			check.LocalDigests = append(check.LocalDigests, digest)
+		}
+	}
+
+	distribution, err := docker(ctx).DistributionInspect(ctx, ref, encodedRegistryAuth(ref))
+	if err != nil {
+		return check, err
+	}
+	check.RemoteDigest = distribution.Descriptor.Digest.String()
+
+	if len(check.LocalDigests) == 0 {
+		return check, nil
+	}
+	check.UpdateAvailable = !contains(check.LocalDigests, check.RemoteDigest)
+	check.Status = "up_to_date"
+	if check.UpdateAvailable {
+		check.Status = "update_available"
+	}
+	return check, nil
+}
+
+// contains reports whether list contains s
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// imageUpdateCheck checks a single image against its registry
+func imageUpdateCheck(c *gin.Context) {
+	ctx := hostContext(c)
+	check, err := checkImageUpdate(ctx, c.Param("image_id"))
+	if err != nil {
+		dockerError(c, "Error checking for image update", err)
+		return
+	}
+
+	respond(c, http.StatusOK, check)
+}
+
+// imagesUpdateCheck checks every tagged image concurrently, reporting
+// failures per image
+func imagesUpdateCheck(c *gin.Context) {
+	ctx := hostContext(c)
+	images, err := docker(ctx).ImageList(ctx, types.ImageListOptions{})
+	if err != nil {
+		dockerError(c, "Error listing images", err)
+		return
+	}
+
+	refs := []string{}
+	for _, image := range images {
+		for _, tag := range image.RepoTags {
+			if tag != "<none>:<none>" {
+				refs = append(refs, tag)
+			}
+		}
+	}
+
+	checks := make([]updateCheck, len(refs))
+	sem := make(chan struct{}, bulkConcurrency)
+	var wg sync.WaitGroup
+	for i, ref := range refs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, ref string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			check, err := checkImageUpdate(ctx, ref)
+			if err != nil {
+				check.Error = err.Error()
+			}
+			checks[i] = check
+		}(i, ref)
+	}
+	wg.Wait()
+
+	available := 0
+	for _, check := range checks {
+		if check.UpdateAvailable {
+			available++
+		}
+	}
+	respond(c, http.StatusOK, gin.H{"images": checks, "updates_available": available})
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Build information, set at link time with
+// -ldflags "-X main.version=... -X main.commit=... -X main.buildDate=..."
+var (
+	version   = "dev"
+	commit    = ""
+	buildDate = ""
+)
+
+// agentStartedAt is when the agent process started
+var agentStartedAt = time.Now()
+
+func init() {
+	// go build records the commit itself when built from a checkout
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				if commit == "" {
+					commit = setting.Value
+				}
+			case "vcs.time":
+				if buildDate == "" {
+					buildDate = setting.Value
+				}
+			}
+		}
+	}
+}
+
+// healthz reports that the agent itself is up and serving. It does not
+// depend on the daemon, so an orchestrator does not restart the agent
+// while dockerd is down; /readyz covers that.
+func healthz(c *gin.Context) {
+	respond(c, http.StatusOK, gin.H{
+		"status":         "ok",
+		"uptime_seconds": int64(time.Since(agentStartedAt).Seconds()),
+	})
+}
+
+// agentVersion reports the agent build and the Docker API version each
+// host's client negotiated
+func agentVersion(c *gin.Context) {
+	apiVersions := make(map[string]string, len(dockerHosts))
+	for name, host := range dockerHosts {
+		cli := host.Client()
+		// Negotiating against a missing daemon would pin the oldest version
+		if host.Health().Reachable {
+			cli.NegotiateAPIVersion(c.Request.Context())
+		}
+		apiVersions[name] = cli.ClientVersion()
+	}
+	respond(c, http.StatusOK, gin.H{
+		"version":             version,
+		"commit":              commit,
+		"build_date":          buildDate,
+		"go_version":          runtime.Version(),
+		"runtime":             runtimeName,
+		"node":                hostname,
+		"docker_api_version":  apiVersions[defaultHostName],
+		"docker_api_versions": apiVersions,
+	})
+}
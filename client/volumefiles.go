@@ -0,0 +1,486 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/errdefs"
+	"github.com/gin-gonic/gin"
+)
+
+// volumeDirect lets the agent read volumes straight from their mountpoints
+// on the local daemon's host instead of through a helper container. It
+// needs root, and HOST_ROOT when the agent runs in a container.
+var volumeDirect = os.Getenv("CONTAINERSCOPE_VOLUME_DIRECT") == "true"
+
+// volumeWrite allows uploads into volumes, which are read-only otherwise
+var volumeWrite = os.Getenv("CONTAINERSCOPE_VOLUME_WRITE") == "true"
+
+// defaultPreviewBytes and maxPreviewBytes bound how much of a file a
+// preview returns
+const (
+	defaultPreviewBytes = 64 << 10
+	maxPreviewBytes     = 1 << 20
+)
+
+// volumeFiles reads the files of one volume. Paths are absolute within
+// the volume.
+type volumeFiles interface {
+	stat(p string) (types.ContainerPathStat, error)
+	// list returns the direct children of a directory
+	list(dir string) ([]interface{}, error)
+	// open returns the contents of a regular file
+	open(p string) (io.ReadCloser, error)
+	// archive returns a tar of a file or directory rooted at its name
+	archive(p string) (io.ReadCloser, error)
+	close()
+}
+
+// helperFiles reads a volume through a helper container that mounts it
+type helperFiles struct {
+	ctx context.Context
+	id  string
+}
+
+func (h *helperFiles) path(p string) string {
+	return path.Join(volumeMountPoint, p)
+}
+
+func (h *helperFiles) stat(p string) (types.ContainerPathStat, error) {
+	return docker(h.ctx).ContainerStatPath(h.ctx, h.id, h.path(p))
+}
+
+func (h *helperFiles) list(dir string) ([]interface{}, error) {
+	reader, err := h.archive(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return archiveEntries(reader)
+}
+
+func (h *helperFiles) open(p string) (io.ReadCloser, error) {
+	reader, err := h.archive(p)
+	if err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(reader)
+	header, err := tr.Next()
+	if err == nil && header.Typeflag != tar.TypeReg {
+		err = errdefs.InvalidParameter(fmt.Errorf("%s is not a regular file", p))
+	}
+	if err != nil {
+		reader.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{tr, reader}, nil
+}
+
+func (h *helperFiles) archive(p string) (io.ReadCloser, error) {
+	reader, _, err := docker(h.ctx).CopyFromContainer(h.ctx, h.id, h.path(p))
+	return reader, err
+}
+
+func (h *helperFiles) close() {
+	removeHelper(context.WithoutCancel(h.ctx), h.id)
+}
+
+// directFiles reads a volume from its mountpoint on the agent's filesystem
+type directFiles struct {
+	root string
+}
+
+// resolve maps a volume path to the file it leads to, following symlinks,
+// and refuses those leading out of the volume: their targets are meant to
+// be resolved inside a container, not on the host
+func (d *directFiles) resolve(p string) (string, error) {
+	resolved, err := filepath.EvalSymlinks(filepath.Join(d.root, filepath.FromSlash(p)))
+	if err != nil {
+		return "", volumeFileError(p, err)
+	}
+	if resolved != d.root && !strings.HasPrefix(resolved, d.root+string(filepath.Separator)) {
+		return "", errdefs.Forbidden(fmt.Errorf("%s leads outside the volume", p))
+	}
+	return resolved, nil
+}
+
+func (d *directFiles) stat(p string) (types.ContainerPathStat, error) {
+	resolved, err := d.resolve(p)
+	if err != nil {
+		return types.ContainerPathStat{}, err
+	}
+	info, err := os.Stat(resolved)
+	if err != nil {
+		return types.ContainerPathStat{}, volumeFileError(p, err)
+	}
+	return types.ContainerPathStat{Name: path.Base(p), Size: info.Size(), Mode: info.Mode(), Mtime: info.ModTime()}, nil
+}
+
+func (d *directFiles) list(dir string) ([]interface{}, error) {
+	resolved, err := d.resolve(dir)
+	if err != nil {
+		return nil, err
+	}
+	children, err := os.ReadDir(resolved)
+	if err != nil {
+		return nil, volumeFileError(dir, err)
+	}
+	entries := make([]interface{}, 0, len(children))
+	for _, child := range children {
+		info, err := child.Info()
+		if err != nil {
+			// Removed since the directory was read
+			continue
+		}
+		linkTarget := ""
+		if info.Mode()&fs.ModeSymlink != 0 {
+			linkTarget, _ = os.Readlink(filepath.Join(resolved, child.Name()))
+		}
+		entries = append(entries, fileEntry(child.Name(), info.Size(), int64(info.Mode().Perm()), info.ModTime(), info.IsDir(), linkTarget))
+	}
+	return entries, nil
+}
+
+func (d *directFiles) open(p string) (io.ReadCloser, error) {
+	resolved, err := d.resolve(p)
+	if err != nil {
+		return nil, err
+	}
+	if info, err := os.Stat(resolved); err != nil {
+		return nil, volumeFileError(p, err)
+	} else if !info.Mode().IsRegular() {
+		return nil, errdefs.InvalidParameter(fmt.Errorf("%s is not a regular file", p))
+	}
+	f, err := os.Open(resolved)
+	if err != nil {
+		return nil, volumeFileError(p, err)
+	}
+	return f, nil
+}
+
+// archive packs the tree the way CopyFromContainer does, with symlinks
+// below the root kept as links
+func (d *directFiles) archive(p string) (io.ReadCloser, error) {
+	resolved, err := d.resolve(p)
+	if err != nil {
+		return nil, err
+	}
+	base := path.Base(p)
+	if p == "/" {
+		base = path.Base(volumeMountPoint)
+	}
+	if _, err := os.Stat(resolved); err != nil {
+		return nil, volumeFileError(p, err)
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		tw := tar.NewWriter(pw)
+		err := filepath.WalkDir(resolved, func(file string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			info, err := entry.Info()
+			if err != nil {
+				return err
+			}
+			linkTarget := ""
+			if info.Mode()&fs.ModeSymlink != 0 {
+				if linkTarget, err = os.Readlink(file); err != nil {
+					return err
+				}
+			}
+			header, err := tar.FileInfoHeader(info, linkTarget)
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(resolved, file)
+			if err != nil {
+				return err
+			}
+			header.Name = path.Join(base, filepath.ToSlash(rel))
+			if info.IsDir() {
+				header.Name += "/"
+			}
+			if err := tw.WriteHeader(header); err != nil {
+				return err
+			}
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+			f, err := os.Open(file)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			_, err = io.Copy(tw, f)
+			return err
+		})
+		if err == nil {
+			err = tw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr, nil
+}
+
+func (d *directFiles) close() {}
+
+// volumeFileError gives filesystem errors the errdefs class dockerError
+// maps to a status, without the host path of the mountpoint
+func volumeFileError(p string, err error) error {
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) {
+		err = fmt.Errorf("%s: %w", p, pathErr.Err)
+	}
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return errdefs.NotFound(err)
+	case errors.Is(err, fs.ErrPermission):
+		return errdefs.Forbidden(err)
+	}
+	return err
+}
+
+// openVolumeFiles gives access to a volume's files: straight from its
+// mountpoint with CONTAINERSCOPE_VOLUME_DIRECT on the default host when
+// it is reached over its unix socket and the mountpoint is visible, and
+// through a read-only helper container otherwise
+func openVolumeFiles(ctx context.Context, name string) (volumeFiles, error) {
+	vol, err := docker(ctx).VolumeInspect(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	host := hostFrom(ctx)
+	if volumeDirect && host.Name == defaultHostName && strings.HasPrefix(host.Endpoint, "unix://") && vol.Mountpoint != "" {
+		root, err := filepath.EvalSymlinks(filepath.Join(hostRoot, vol.Mountpoint))
+		if err == nil {
+			return &directFiles{root: root}, nil
+		}
+		logger.Debug("volume mountpoint not accessible, using a helper container", "volume", name, "error", err)
+	}
+	helper, err := volumeHelper(ctx, name, "volume-files", true)
+	if err != nil {
+		return nil, fmt.Errorf("creating helper container: %w", err)
+	}
+	return &helperFiles{ctx: ctx, id: helper}, nil
+}
+
+// volumePath reads and cleans the ?path= parameter, an absolute path
+// within the volume that defaults to its root
+func volumePath(c *gin.Context) (string, bool) {
+	p := c.DefaultQuery("path", "/")
+	if !strings.HasPrefix(p, "/") {
+		badRequest(c, "path must be an absolute path inside the volume")
+		return "", false
+	}
+	return path.Clean(p), true
+}
+
+// listVolumeFiles lists the direct children of a directory in a volume,
+// or the file itself when path names one
+func listVolumeFiles(c *gin.Context) {
+	ctx := hostContext(c)
+	dir, ok := volumePath(c)
+	if !ok {
+		return
+	}
+	files, err := openVolumeFiles(ctx, c.Param("name"))
+	if err != nil {
+		dockerError(c, "Error opening volume", err)
+		return
+	}
+	defer files.close()
+
+	stat, err := files.stat(dir)
+	if err != nil {
+		dockerError(c, "Error reading volume path", err)
+		return
+	}
+	if !stat.Mode.IsDir() {
+		respond(c, http.StatusOK, gin.H{
+			"path":    dir,
+			"entries": []interface{}{fileEntry(stat.Name, stat.Size, int64(stat.Mode.Perm()), stat.Mtime, false, stat.LinkTarget)},
+		})
+		return
+	}
+	entries, err := files.list(dir)
+	if err != nil {
+		dockerError(c, "Error reading volume path", err)
+		return
+	}
+	respond(c, http.StatusOK, gin.H{"path": dir, "entries": entries})
+}
+
+// previewVolumeFile returns the start of a file in a volume as text, up to
+// ?max_bytes= (64 KiB by default, 1 MiB at most). Binary files are
+// reported without their content; download them instead.
+func previewVolumeFile(c *gin.Context) {
+	ctx := hostContext(c)
+	file, ok := volumePath(c)
+	if !ok {
+		return
+	}
+	limit := defaultPreviewBytes
+	if v := c.Query("max_bytes"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > maxPreviewBytes {
+			badRequest(c, fmt.Sprintf("max_bytes must be between 1 and %d", maxPreviewBytes))
+			return
+		}
+		limit = n
+	}
+	files, err := openVolumeFiles(ctx, c.Param("name"))
+	if err != nil {
+		dockerError(c, "Error opening volume", err)
+		return
+	}
+	defer files.close()
+
+	stat, err := files.stat(file)
+	if err != nil {
+		dockerError(c, "Error reading volume path", err)
+		return
+	}
+	reader, err := files.open(file)
+	if err != nil {
+		dockerError(c, "Error reading file", err)
+		return
+	}
+	defer reader.Close()
+	// Read one byte past the limit to tell whether there is more
+	content, err := io.ReadAll(io.LimitReader(reader, int64(limit)+1))
+	if err != nil {
+		dockerError(c, "Error reading file", err)
+		return
+	}
+	truncated := len(content) > limit
+	if truncated {
+		content = content[:limit]
+	}
+
+	// A cut can split the last character, which is not a sign of binary
+	valid := content
+	if truncated {
+		for i := 0; i < utf8.UTFMax-1 && len(valid) > 0 && !utf8.Valid(valid); i++ {
+			valid = valid[:len(valid)-1]
+		}
+	}
+	binary := bytes.IndexByte(content, 0) >= 0 || !utf8.Valid(valid)
+	result := gin.H{"path": file, "size": stat.Size, "modified": stat.Mtime, "truncated": truncated, "binary": binary}
+	if !binary {
+		result["content"] = string(valid)
+	}
+	respond(c, http.StatusOK, result)
+}
+
+// downloadVolumeFiles streams a file in a volume as is, or a directory as
+// a tar archive
+func downloadVolumeFiles(c *gin.Context) {
+	ctx := hostContext(c)
+	name := c.Param("name")
+	src, ok := volumePath(c)
+	if !ok {
+		return
+	}
+	files, err := openVolumeFiles(ctx, name)
+	if err != nil {
+		dockerError(c, "Error opening volume", err)
+		return
+	}
+	defer files.close()
+
+	stat, err := files.stat(src)
+	if err != nil {
+		dockerError(c, "Error reading volume path", err)
+		return
+	}
+	if !stat.Mode.IsDir() {
+		reader, err := files.open(src)
+		if err != nil {
+			dockerError(c, "Error reading file", err)
+			return
+		}
+		defer reader.Close()
+		c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%s", path.Base(src)))
+		c.DataFromReader(http.StatusOK, stat.Size, "application/octet-stream", reader, nil)
+		return
+	}
+
+	reader, err := files.archive(src)
+	if err != nil {
+		dockerError(c, "Error reading volume path", err)
+		return
+	}
+	defer reader.Close()
+	base := path.Base(src)
+	if src == "/" {
+		base = "root"
+	}
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=volume_%s_%s.tar", name, base))
+	c.DataFromReader(http.StatusOK, -1, "application/x-tar", reader, nil)
+}
+
+// uploadVolumeFiles copies multipart "file" uploads into a directory in a
+// volume through a helper container. Volumes are read-only unless
+// CONTAINERSCOPE_VOLUME_WRITE is set.
+func uploadVolumeFiles(c *gin.Context) {
+	if !volumeWrite {
+		respondError(c, http.StatusForbidden, codeForbidden, "Writing to volumes is disabled; set CONTAINERSCOPE_VOLUME_WRITE=true to allow it")
+		return
+	}
+	ctx := hostContext(c)
+	name := c.Param("name")
+	dst, ok := volumePath(c)
+	if !ok {
+		return
+	}
+	form, err := c.MultipartForm()
+	if err != nil {
+		badRequest(c, "Expected a multipart form with one or more file fields")
+		return
+	}
+	uploads := form.File["file"]
+	if len(uploads) == 0 {
+		badRequest(c, "No files uploaded")
+		return
+	}
+	if _, err := docker(ctx).VolumeInspect(ctx, name); err != nil {
+		dockerError(c, "Error inspecting volume", err)
+		return
+	}
+
+	helper, err := volumeHelper(ctx, name, "volume-files", false)
+	if err != nil {
+		dockerError(c, "Error creating helper container", err)
+		return
+	}
+	defer removeHelper(context.WithoutCancel(ctx), helper)
+	if err := copyUploads(ctx, helper, path.Join(volumeMountPoint, dst), uploads); err != nil {
+		dockerError(c, "Error writing volume", err)
+		return
+	}
+
+	names := []string{}
+	for _, fh := range uploads {
+		names = append(names, path.Join(dst, path.Base(fh.Filename)))
+	}
+	logger.Info("uploaded files to volume", "volume", name, "path", dst, "files", len(names), "host", hostFrom(ctx).Name)
+	respond(c, http.StatusOK, gin.H{"message": "Files uploaded successfully", "files": names})
+}
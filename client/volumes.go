@@ -0,0 +1,387 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/api/types/volume"
+	"github.com/docker/docker/errdefs"
+	"github.com/gin-gonic/gin"
+)
+
+// helperImage is the image of the short-lived containers that mount a
+// volume so its contents can be read or written
+var helperImage = envOr("CONTAINERSCOPE_HELPER_IMAGE", "busybox:latest")
+
+// helperLabel marks helper containers with what they are for, so a
+// leftover one can be recognised and removed
+const helperLabel = "containerscope.helper"
+
+// volumeMountPoint is where helper containers mount the volume
+const volumeMountPoint = "/volume"
+
+// ensureHelperImage pulls the helper image unless the host has it
+func ensureHelperImage(ctx context.Context) error {
+	if _, _, err := docker(ctx).ImageInspectWithRaw(ctx, helperImage); errdefs.IsNotFound(err) {
+		if err := pullImage(ctx, helperImage); err != nil {
+			return fmt.Errorf("pulling helper image %s: %w", helperImage, err)
+		}
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+// volumeHelper creates a container that mounts a volume at
+// volumeMountPoint and returns its ID. The container is never started;
+// the archive endpoints reach mounted volumes of created containers too.
+// The caller removes it.
+func volumeHelper(ctx context.Context, name, purpose string, readOnly bool) (string, error) {
+	if err := ensureHelperImage(ctx); err != nil {
+		return "", err
+	}
+	created, err := docker(ctx).ContainerCreate(ctx,
+		&container.Config{
+			Image:  helperImage,
+			Cmd:    []string{"true"},
+			Labels: map[string]string{helperLabel: purpose},
+		},
+		&container.HostConfig{
+			NetworkMode: "none",
+			Mounts:      []mount.Mount{{Type: mount.TypeVolume, Source: name, Target: volumeMountPoint, ReadOnly: readOnly}},
+		},
+		nil, nil, "")
+	if err != nil {
+		return "", err
+	}
+	return created.ID, nil
+}
+
+// removeHelper removes a helper container, logging rather than failing
+func removeHelper(ctx context.Context, containerID string) {
+	if err := docker(ctx).ContainerRemove(ctx, containerID, container.RemoveOptions{Force: true}); err != nil {
+		logger.Warn("could not remove helper container", "container", containerID[:12], "error", err)
+	}
+}
+
+// volumeUsers lists the running containers that mount a volume
+func volumeUsers(ctx context.Context, name string) ([]string, error) {
+	list, err := docker(ctx).ContainerList(ctx, container.ListOptions{
+		Filters: filters.NewArgs(filters.Arg("volume", name), filters.Arg("status", "running")),
+	})
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(list))
+	for _, cont := range list {
+		if len(cont.Names) > 0 {
+			names = append(names, strings.TrimPrefix(cont.Names[0], "/"))
+		}
+	}
+	return names, nil
+}
+
+// anonymousVolumeLabel is set by the daemon on volumes it creates for
+// containers without a name
+const anonymousVolumeLabel = "com.docker.volume.anonymous"
+
+// volumeSummary is a volume with the space it takes and the containers,
+// running or not, that reference it
+type volumeSummary struct {
+	Name       string            `json:"name"`
+	Driver     string            `json:"driver"`
+	Mountpoint string            `json:"mountpoint"`
+	Scope      string            `json:"scope"`
+	Created    string            `json:"created"`
+	Labels     map[string]string `json:"labels"`
+	Anonymous  bool              `json:"anonymous"`
+	// Size is in bytes, or -1 when the volume's driver does not report it
+	Size       int64    `json:"size"`
+	Containers []string `json:"containers"`
+}
+
+// volumeSummaries lists the volumes of a host with their disk usage. The
+// daemon only measures volumes of the local driver, and walks them to do
+// it, so this is as slow as `docker system df -v`.
+func volumeSummaries(ctx context.Context) ([]volumeSummary, error) {
+	usage, err := docker(ctx).DiskUsage(ctx, types.DiskUsageOptions{Types: []types.DiskUsageObject{types.VolumeObject}})
+	if err != nil {
+		return nil, err
+	}
+	// All containers count, not just those in scope: a volume is only an
+	// orphan if nothing at all uses it
+	list, err := docker(ctx).ContainerList(ctx, container.ListOptions{All: true})
+	if err != nil {
+		return nil, err
+	}
+	users := map[string][]string{}
+	for _, cont := range list {
+		if len(cont.Names) == 0 {
+			continue
+		}
+		for _, mnt := range cont.Mounts {
+			if mnt.Type == mount.TypeVolume {
+				users[mnt.Name] = append(users[mnt.Name], strings.TrimPrefix(cont.Names[0], "/"))
+			}
+		}
+	}
+
+	summaries := make([]volumeSummary, 0, len(usage.Volumes))
+	for _, vol := range usage.Volumes {
+		summary := volumeSummary{
+			Name:       vol.Name,
+			Driver:     vol.Driver,
+			Mountpoint: vol.Mountpoint,
+			Scope:      vol.Scope,
+			Created:    vol.CreatedAt,
+			Labels:     vol.Labels,
+			Size:       -1,
+			Containers: users[vol.Name],
+		}
+		_, summary.Anonymous = vol.Labels[anonymousVolumeLabel]
+		if !summary.Anonymous && len(vol.Name) == 64 {
+			_, err := hex.DecodeString(vol.Name)
+			summary.Anonymous = err == nil
+		}
+		if vol.UsageData != nil && vol.UsageData.Size >= 0 {
+			summary.Size = vol.UsageData.Size
+		}
+		if summary.Labels == nil {
+			summary.Labels = map[string]string{}
+		}
+		if summary.Containers == nil {
+			summary.Containers = []string{}
+		}
+		sort.Strings(summary.Containers)
+		summaries = append(summaries, summary)
+	}
+	return summaries, nil
+}
+
+// sortVolumes sorts volume summaries by the ?sort= key
+func sortVolumes(params listParams, summaries []volumeSummary) {
+	switch params.sort {
+	case "name":
+		sortBy(params, summaries, func(a, b volumeSummary) bool { return a.Name < b.Name })
+	case "created":
+		sortBy(params, summaries, func(a, b volumeSummary) bool { return a.Created < b.Created })
+	case "size":
+		sortBy(params, summaries, func(a, b volumeSummary) bool { return a.Size < b.Size })
+	}
+}
+
+// listVolumes lists the volumes of the selected host with their size and
+// the containers referencing them, sortable by name, created or size
+func listVolumes(c *gin.Context) {
+	ctx := hostContext(c)
+	params, err := parseListParams(c, "name", "created", "size")
+	if err != nil {
+		badRequest(c, err.Error())
+		return
+	}
+	summaries, err := volumeSummaries(ctx)
+	if err != nil {
+		dockerError(c, "Error listing volumes", err)
+		return
+	}
+	sortVolumes(params, summaries)
+	respondETag(c, paginate(c, params, summaries))
+}
+
+// listOrphanVolumes lists the volumes no container references, running or
+// stopped, largest first unless ?sort= says otherwise, with the space
+// removing them all would free
+func listOrphanVolumes(c *gin.Context) {
+	ctx := hostContext(c)
+	params, err := parseListParams(c, "name", "created", "size")
+	if err != nil {
+		badRequest(c, err.Error())
+		return
+	}
+	if params.sort == "" {
+		params.sort = "size"
+		params.desc = c.Query("order") != "asc"
+	}
+	summaries, err := volumeSummaries(ctx)
+	if err != nil {
+		dockerError(c, "Error listing volumes", err)
+		return
+	}
+	orphans := []volumeSummary{}
+	var reclaimable int64
+	for _, summary := range summaries {
+		if len(summary.Containers) > 0 {
+			continue
+		}
+		orphans = append(orphans, summary)
+		reclaimable += max(summary.Size, 0)
+	}
+	sortVolumes(params, orphans)
+	count := len(orphans)
+	respond(c, http.StatusOK, gin.H{
+		"volumes":     paginate(c, params, orphans),
+		"count":       count,
+		"reclaimable": reclaimable,
+	})
+}
+
+// rebaseVolumeArchive copies the archive CopyFromContainer returns for the
+// mount point to w with the mount point's directory taken off every path,
+// so the backup holds the volume's contents as a plain tar of its root
+func rebaseVolumeArchive(w io.Writer, r io.Reader) error {
+	prefix := strings.TrimPrefix(volumeMountPoint, "/") + "/"
+	tr := tar.NewReader(r)
+	tw := tar.NewWriter(w)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		name := strings.TrimPrefix(header.Name, prefix)
+		if name == "" || name == header.Name {
+			continue
+		}
+		header.Name = name
+		if header.Typeflag == tar.TypeLink {
+			header.Linkname = strings.TrimPrefix(header.Linkname, prefix)
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// backupVolume streams the contents of a volume as a tar archive, gzipped
+// with ?compress=true, read through a helper container that mounts it
+// read-only. Volumes in use by running containers are backed up as they
+// are at the time, so stop writers first for a consistent copy.
+func backupVolume(c *gin.Context) {
+	ctx := hostContext(c)
+	name := c.Param("name")
+	compress := c.Query("compress") == "true"
+	if _, err := docker(ctx).VolumeInspect(ctx, name); err != nil {
+		dockerError(c, "Error inspecting volume", err)
+		return
+	}
+
+	helper, err := volumeHelper(ctx, name, "volume-backup", true)
+	if err != nil {
+		dockerError(c, "Error creating helper container", err)
+		return
+	}
+	defer removeHelper(context.WithoutCancel(ctx), helper)
+	reader, _, err := docker(ctx).CopyFromContainer(ctx, helper, volumeMountPoint)
+	if err != nil {
+		dockerError(c, "Error reading volume", err)
+		return
+	}
+	defer reader.Close()
+
+	filename := fmt.Sprintf("volume_%s_%s.tar", name, time.Now().UTC().Format("20060102T150405Z"))
+	contentType := "application/x-tar"
+	if compress {
+		filename += ".gz"
+		contentType = "application/gzip"
+	}
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%s", filename))
+	c.Header("Content-Type", contentType)
+	c.Status(http.StatusOK)
+
+	var w io.Writer = c.Writer
+	var gz *gzip.Writer
+	if compress {
+		gz = gzip.NewWriter(c.Writer)
+		w = gz
+	}
+	err = rebaseVolumeArchive(w, reader)
+	if err == nil && gz != nil {
+		err = gz.Close()
+	}
+	if err != nil {
+		// The status has been sent, so the archive is just cut short
+		c.Error(err)
+		logger.Warn("volume backup failed", "volume", name, "error", err)
+	}
+}
+
+// restoreVolume unpacks a tar archive, plain or gzipped, into a volume
+// through a helper container, creating the volume if it does not exist.
+// Files in the archive replace those in the volume; other files are kept.
+// A volume mounted by running containers is only restored with
+// ?force=true, since they would see it change under them.
+func restoreVolume(c *gin.Context) {
+	ctx := hostContext(c)
+	name := c.Param("name")
+	created := false
+	if _, err := docker(ctx).VolumeInspect(ctx, name); errdefs.IsNotFound(err) {
+		if _, err := docker(ctx).VolumeCreate(ctx, volume.CreateOptions{Name: name}); err != nil {
+			dockerError(c, "Error creating volume", err)
+			return
+		}
+		created = true
+	} else if err != nil {
+		dockerError(c, "Error inspecting volume", err)
+		return
+	} else if c.Query("force") != "true" {
+		users, err := volumeUsers(ctx, name)
+		if err != nil {
+			dockerError(c, "Error listing containers", err)
+			return
+		}
+		if len(users) > 0 {
+			respondError(c, http.StatusConflict, codeConflict,
+				fmt.Sprintf("Volume %s is in use by %s; stop them or pass force=true", name, strings.Join(users, ", ")))
+			return
+		}
+	}
+
+	archive, err := uploadedArchive(c)
+	if err != nil {
+		badRequest(c, "Expected a tar archive as the request body or a multipart file field")
+		return
+	}
+	defer archive.Close()
+	buffered := bufio.NewReader(archive)
+	var content io.Reader = buffered
+	if magic, _ := buffered.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(buffered)
+		if err != nil {
+			badRequest(c, "Invalid gzip archive")
+			return
+		}
+		defer gz.Close()
+		content = gz
+	}
+
+	helper, err := volumeHelper(ctx, name, "volume-restore", false)
+	if err != nil {
+		dockerError(c, "Error creating helper container", err)
+		return
+	}
+	defer removeHelper(context.WithoutCancel(ctx), helper)
+	if err := docker(ctx).CopyToContainer(ctx, helper, volumeMountPoint, content, types.CopyToContainerOptions{}); err != nil {
+		dockerError(c, "Error writing volume", err)
+		return
+	}
+	logger.Info("volume restored", "volume", name, "host", hostFrom(ctx).Name)
+	respond(c, http.StatusOK, gin.H{"message": "Volume restored successfully", "volume": name, "created": created})
+}
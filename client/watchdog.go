@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// watchdogInterval is how often every daemon is pinged; after
+// watchdogFailures misses in a row the host's client is rebuilt
+var watchdogInterval = envDuration("CONTAINERSCOPE_HEALTH_INTERVAL", 10*time.Second)
+
+const watchdogFailures = 3
+
+// watchdogPingTimeout bounds a single ping
+const watchdogPingTimeout = 5 * time.Second
+
+// hostHealth is the watchdog's latest view of a daemon
+type hostHealth struct {
+	Reachable  bool      `json:"reachable"`
+	APIVersion string    `json:"api_version,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	CheckedAt  time.Time `json:"checked_at"`
+	Failures   int       `json:"consecutive_failures"`
+	Reconnects int       `json:"reconnects"`
+}
+
+// Health returns the result of the watchdog's last ping
+func (h *dockerHost) Health() hostHealth {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.health
+}
+
+// startWatchdog pings every configured daemon in the background
+func startWatchdog() {
+	for _, host := range dockerHosts {
+		go watchHost(host)
+	}
+}
+
+// watchHost checks host now and then every watchdogInterval
+func watchHost(host *dockerHost) {
+	checkHost(host)
+	ticker := time.NewTicker(watchdogInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		checkHost(host)
+	}
+}
+
+// checkHost pings host once and rebuilds its client when the daemon has
+// been unreachable for watchdogFailures checks, or has just come back. A
+// client that negotiated its API version while the daemon was down keeps
+// the oldest version forever, so it must not outlive the outage.
+func checkHost(host *dockerHost) {
+	ctx, cancel := context.WithTimeout(context.Background(), watchdogPingTimeout)
+	ping, err := host.Client().Ping(ctx)
+	cancel()
+
+	host.mu.Lock()
+	prev := host.health
+	health := hostHealth{CheckedAt: time.Now(), Reconnects: prev.Reconnects}
+	if err != nil {
+		health.Error = err.Error()
+		health.Failures = prev.Failures + 1
+	} else {
+		health.Reachable = true
+		health.APIVersion = ping.APIVersion
+	}
+	host.health = health
+	host.mu.Unlock()
+
+	reconnect := false
+	switch {
+	case err != nil && health.Failures == 1:
+		logger.Warn("docker daemon unreachable", "host", host.Name, "error", err)
+	case err != nil && health.Failures%watchdogFailures == 0:
+		logger.Warn("docker daemon still unreachable, reconnecting", "host", host.Name, "failures", health.Failures, "error", err)
+		reconnect = true
+	case err == nil && prev.Failures > 0:
+		logger.Info("docker daemon reachable again", "host", host.Name, "api_version", ping.APIVersion)
+		reconnect = true
+	}
+	if !reconnect {
+		return
+	}
+	if err := host.connect(); err != nil {
+		logger.Error("reconnecting to docker daemon", "host", host.Name, "error", err)
+		return
+	}
+	host.mu.Lock()
+	host.health.Reconnects++
+	host.mu.Unlock()
+}
+
+// readyz reports whether the default daemon answered the watchdog's last
+// ping, along with the state of every host, so load balancers only send
+// traffic to agents that can reach their daemon
+func readyz(c *gin.Context) {
+	switch runtimeName {
+	case runtimeContainerd:
+		containerdReadyz(c)
+		return
+	case runtimeKubernetes:
+		kubeReadyz(c)
+		return
+	}
+	hosts := make(map[string]hostHealth, len(dockerHosts))
+	for name, host := range dockerHosts {
+		hosts[name] = host.Health()
+	}
+	status, code := "ok", http.StatusOK
+	if !hosts[defaultHostName].Reachable {
+		status, code = "unavailable", http.StatusServiceUnavailable
+	}
+	respond(c, code, gin.H{"status": status, "hosts": hosts})
+}
+
+// containerdReadyz reports whether containerd answers a version request
+func containerdReadyz(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), watchdogPingTimeout)
+	defer cancel()
+	client, err := containerdConn()
+	if err == nil {
+		_, err = client.Version(ctx)
+	}
+	if err != nil {
+		respond(c, http.StatusServiceUnavailable, gin.H{"status": "unavailable", "error": err.Error()})
+		return
+	}
+	respond(c, http.StatusOK, gin.H{"status": "ok"})
+}
+
+// kubeReadyz reports whether the Kubernetes API server answers a version
+// request
+func kubeReadyz(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), watchdogPingTimeout)
+	defer cancel()
+	k, err := kubeConn()
+	if err == nil {
+		var version map[string]interface{}
+		err = k.getJSON(ctx, "/version", nil, &version)
+	}
+	if err != nil {
+		respond(c, http.StatusServiceUnavailable, gin.H{"status": "unavailable", "error": err.Error()})
+		return
+	}
+	respond(c, http.StatusOK, gin.H{"status": "ok"})
+}
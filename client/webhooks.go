@@ -0,0 +1,447 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types/events"
+	"github.com/gin-gonic/gin"
+)
+
+// webhookBucket holds webhook subscriptions keyed by ID
+const webhookBucket = "webhooks"
+
+// A delivery is attempted webhookMaxAttempts times, waiting a second and
+// doubling between attempts; maxWebhookDeliveries are kept per webhook
+const (
+	webhookMaxAttempts   = 5
+	maxWebhookDeliveries = 20
+)
+
+// webhookEvents are the events a webhook can subscribe to. Container and
+// image events are Docker's, named type.action; autoheal events report
+// what the agent did to an unhealthy container.
+var webhookEvents = []string{
+	"container.create", "container.start", "container.restart", "container.stop",
+	"container.kill", "container.die", "container.oom", "container.destroy",
+	"container.pause", "container.unpause", "container.health_status",
+	"image.pull", "image.push", "image.tag", "image.untag", "image.delete",
+	"autoheal.restarted", "autoheal.failed", "autoheal.gave_up",
+}
+
+// webhook is a URL that is sent the events it subscribes to. Events may
+// use wildcards such as container.* or *.
+type webhook struct {
+	ID      string    `json:"id"`
+	URL     string    `json:"url"`
+	Events  []string  `json:"events"`
+	Secret  string    `json:"secret,omitempty"`
+	Enabled bool      `json:"enabled"`
+	Created time.Time `json:"created"`
+}
+
+// wants reports whether the webhook subscribes to event
+func (w webhook) wants(event string) bool {
+	for _, pattern := range w.Events {
+		prefix, wildcard := strings.CutSuffix(pattern, "*")
+		if pattern == event || wildcard && strings.HasPrefix(event, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// webhookRequest is the body accepted when creating or replacing a webhook
+type webhookRequest struct {
+	URL     string   `json:"url" binding:"required"`
+	Events  []string `json:"events" binding:"required"`
+	Secret  string   `json:"secret"`
+	Enabled *bool    `json:"enabled"`
+}
+
+// validate checks the URL and event filters
+func (req webhookRequest) validate() error {
+	u, err := url.Parse(req.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("url must be an http or https URL")
+	}
+	if len(req.Events) == 0 {
+		return fmt.Errorf("events must name at least one event")
+	}
+	for _, pattern := range req.Events {
+		if !(webhook{Events: []string{pattern}}).wantsAny() {
+			return fmt.Errorf("unknown event %q", pattern)
+		}
+	}
+	return nil
+}
+
+// wantsAny reports whether the webhook's filters match any known event
+func (w webhook) wantsAny() bool {
+	for _, event := range webhookEvents {
+		if w.wants(event) {
+			return true
+		}
+	}
+	return false
+}
+
+// webhookEvent is the JSON payload sent to a webhook
+type webhookEvent struct {
+	Delivery string    `json:"delivery"`
+	Event    string    `json:"event"`
+	Time     time.Time `json:"time"`
+	Host     string    `json:"host"`
+	// ID is the container ID, or the image reference for image events
+	ID       string `json:"id"`
+	Name     string `json:"name,omitempty"`
+	Image    string `json:"image,omitempty"`
+	ExitCode string `json:"exit_code,omitempty"`
+	Signal   string `json:"signal,omitempty"`
+	Health   string `json:"health,omitempty"`
+	Message  string `json:"message,omitempty"`
+}
+
+// webhookDelivery records the outcome of sending one event
+type webhookDelivery struct {
+	ID         string    `json:"id"`
+	Event      string    `json:"event"`
+	Time       time.Time `json:"time"`
+	Attempts   int       `json:"attempts"`
+	StatusCode int       `json:"status_code,omitempty"`
+	Success    bool      `json:"success"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// webhooks caches the stored subscriptions for event matching, and keeps
+// each one's recent deliveries
+var webhooks struct {
+	sync.Mutex
+	list       []webhook
+	deliveries map[string][]webhookDelivery
+}
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// startWebhooks sends every host's events to the webhooks subscribed to
+// them, until ctx is done
+func startWebhooks(ctx context.Context) {
+	if err := reloadWebhooks(); err != nil {
+		logger.Warn("loading webhooks", "error", err)
+	}
+	for name, host := range dockerHosts {
+		go watchWebhookEvents(ctx, host.Name, eventBuses[name])
+	}
+	// Other replicas sharing the store change webhooks without telling
+	// this one
+	if storeShared {
+		go func() {
+			for pause(ctx, 30*time.Second) {
+				if err := reloadWebhooks(); err != nil {
+					logger.Warn("loading webhooks", "error", err)
+				}
+			}
+		}()
+	}
+}
+
+// watchWebhookEvents converts one host's Docker events for webhooks
+func watchWebhookEvents(ctx context.Context, host string, bus *eventBus) {
+	evs := bus.subscribeUntil(ctx)
+	for ev := range evs {
+		if ev.Resync || (ev.Type != events.ContainerEventType && ev.Type != events.ImageEventType) {
+			continue
+		}
+		event := webhookEvent{
+			Event:    string(ev.Type) + "." + string(ev.Action),
+			Time:     time.Unix(0, ev.TimeNano),
+			Host:     host,
+			ID:       ev.Actor.ID,
+			Name:     ev.Actor.Attributes["name"],
+			Image:    ev.Actor.Attributes["image"],
+			ExitCode: ev.Actor.Attributes["exitCode"],
+			Signal:   ev.Actor.Attributes["signal"],
+		}
+		if ev.TimeNano == 0 {
+			event.Time = time.Unix(ev.Time, 0)
+		}
+		if status, ok := strings.CutPrefix(string(ev.Action), string(events.ActionHealthStatus)+": "); ok {
+			event.Event, event.Health = "container.health_status", status
+		}
+		notifyWebhooks(event)
+	}
+}
+
+// notifyWebhooks sends event to every enabled webhook subscribed to it
+func notifyWebhooks(event webhookEvent) {
+	webhooks.Lock()
+	var targets []webhook
+	for _, w := range webhooks.list {
+		if w.Enabled && w.wants(event.Event) {
+			targets = append(targets, w)
+		}
+	}
+	webhooks.Unlock()
+	for _, w := range targets {
+		go deliverWebhook(w, event, webhookMaxAttempts)
+	}
+}
+
+// deliverWebhook posts a signed event, retrying with backoff, and records
+// the delivery
+func deliverWebhook(w webhook, event webhookEvent, attempts int) webhookDelivery {
+	event.Delivery = newRequestID()
+	delivery := webhookDelivery{ID: event.Delivery, Event: event.Event, Time: time.Now()}
+	body, err := json.Marshal(event)
+	if err != nil {
+		delivery.Error = err.Error()
+		return recordDelivery(w, delivery)
+	}
+
+	backoff := time.Second
+	for delivery.Attempts < attempts {
+		delivery.Attempts++
+		delivery.StatusCode, err = postWebhook(w, event, body)
+		if err == nil {
+			delivery.Success, delivery.Error = true, ""
+			break
+		}
+		delivery.Error = err.Error()
+		if delivery.Attempts < attempts {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+	if !delivery.Success {
+		logger.Warn("webhook delivery failed", "webhook", w.ID, "url", w.URL, "event", event.Event, "attempts", delivery.Attempts, "error", delivery.Error)
+	}
+	return recordDelivery(w, delivery)
+}
+
+// postWebhook makes one delivery attempt. The body is signed with the
+// webhook's secret as X-ContainerScope-Signature: sha256=<hex HMAC>.
+func postWebhook(w webhook, event webhookEvent, body []byte) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), webhookClient.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	mac := hmac.New(sha256.New, []byte(w.Secret))
+	mac.Write(body)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "containerscope/"+version)
+	req.Header.Set("X-ContainerScope-Event", event.Event)
+	req.Header.Set("X-ContainerScope-Delivery", event.Delivery)
+	req.Header.Set("X-ContainerScope-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		return resp.StatusCode, fmt.Errorf("%s answered %s", w.URL, resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// recordDelivery keeps a webhook's recent deliveries and counts them
+func recordDelivery(w webhook, delivery webhookDelivery) webhookDelivery {
+	result := "failed"
+	if delivery.Success {
+		result = "success"
+	}
+	webhookDeliveries.WithLabelValues(result).Inc()
+
+	webhooks.Lock()
+	defer webhooks.Unlock()
+	if webhooks.deliveries == nil {
+		webhooks.deliveries = map[string][]webhookDelivery{}
+	}
+	list := append(webhooks.deliveries[w.ID], delivery)
+	if len(list) > maxWebhookDeliveries {
+		list = list[1:]
+	}
+	webhooks.deliveries[w.ID] = list
+	return delivery
+}
+
+// reloadWebhooks refreshes the cached subscriptions from the store
+func reloadWebhooks() error {
+	list, err := loadWebhooks()
+	if err != nil {
+		return err
+	}
+	webhooks.Lock()
+	webhooks.list = list
+	webhooks.Unlock()
+	return nil
+}
+
+// loadWebhooks returns every stored webhook, oldest first
+func loadWebhooks() ([]webhook, error) {
+	list := []webhook{}
+	err := storeEach(webhookBucket, func(_ string, value []byte) error {
+		var w webhook
+		if err := json.Unmarshal(value, &w); err != nil {
+			return err
+		}
+		list = append(list, w)
+		return nil
+	})
+	sort.Slice(list, func(i, j int) bool { return list[i].Created.Before(list[j].Created) })
+	return list, err
+}
+
+// newWebhookSecret returns a random signing secret
+func newWebhookSecret() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// findWebhook loads the webhook named by the id parameter, replying 404
+// when there is none
+func findWebhook(c *gin.Context) (webhook, bool) {
+	var w webhook
+	found, err := storeGet(webhookBucket, c.Param("id"), &w)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, codeInternal, "Error reading webhook")
+		return w, false
+	}
+	if !found {
+		respondError(c, http.StatusNotFound, codeNotFound, "Webhook not found")
+		return w, false
+	}
+	return w, true
+}
+
+// withoutSecret hides a webhook's secret, which is only shown when it is
+// created
+func withoutSecret(w webhook) webhook {
+	w.Secret = ""
+	return w
+}
+
+// listWebhooks returns every webhook
+func listWebhooks(c *gin.Context) {
+	list, err := loadWebhooks()
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, codeInternal, "Error reading webhooks")
+		return
+	}
+	for i := range list {
+		list[i] = withoutSecret(list[i])
+	}
+	respond(c, http.StatusOK, list)
+}
+
+// getWebhook returns one webhook
+func getWebhook(c *gin.Context) {
+	if w, ok := findWebhook(c); ok {
+		respond(c, http.StatusOK, withoutSecret(w))
+	}
+}
+
+// saveWebhook validates the request body and stores it as w. The secret
+// is kept unless the body sets a new one.
+func saveWebhook(c *gin.Context, w webhook, status int) {
+	var req webhookRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		badRequest(c, "url and events are required")
+		return
+	}
+	if err := req.validate(); err != nil {
+		badRequest(c, err.Error())
+		return
+	}
+	w.URL, w.Events = req.URL, req.Events
+	w.Enabled = req.Enabled == nil || *req.Enabled
+	if req.Secret != "" {
+		w.Secret = req.Secret
+	}
+	if err := storePut(webhookBucket, w.ID, w); err != nil {
+		respondError(c, http.StatusInternalServerError, codeInternal, "Error saving webhook")
+		return
+	}
+	if err := reloadWebhooks(); err != nil {
+		logger.Warn("loading webhooks", "error", err)
+	}
+	if status != http.StatusCreated {
+		w = withoutSecret(w)
+	}
+	respond(c, status, w)
+}
+
+// createWebhook adds a webhook, generating a secret unless one is given;
+// the response is the only time the secret is returned
+func createWebhook(c *gin.Context) {
+	w := webhook{ID: newRequestID(), Secret: newWebhookSecret(), Created: time.Now()}
+	saveWebhook(c, w, http.StatusCreated)
+}
+
+// updateWebhook replaces a webhook's settings
+func updateWebhook(c *gin.Context) {
+	if w, ok := findWebhook(c); ok {
+		saveWebhook(c, w, http.StatusOK)
+	}
+}
+
+// deleteWebhook removes a webhook
+func deleteWebhook(c *gin.Context) {
+	w, ok := findWebhook(c)
+	if !ok {
+		return
+	}
+	if err := storeDelete(webhookBucket, w.ID); err != nil {
+		respondError(c, http.StatusInternalServerError, codeInternal, "Error deleting webhook")
+		return
+	}
+	if err := reloadWebhooks(); err != nil {
+		logger.Warn("loading webhooks", "error", err)
+	}
+	webhooks.Lock()
+	delete(webhooks.deliveries, w.ID)
+	webhooks.Unlock()
+	respondMessage(c, "Webhook deleted successfully")
+}
+
+// listWebhookDeliveries returns a webhook's recent deliveries, newest first
+func listWebhookDeliveries(c *gin.Context) {
+	w, ok := findWebhook(c)
+	if !ok {
+		return
+	}
+	webhooks.Lock()
+	list := webhooks.deliveries[w.ID]
+	deliveries := make([]webhookDelivery, len(list))
+	for i, delivery := range list {
+		deliveries[len(list)-1-i] = delivery
+	}
+	webhooks.Unlock()
+	respond(c, http.StatusOK, deliveries)
+}
+
+// testWebhook sends a ping event once, whatever the webhook subscribes
+// to, and returns the delivery
+func testWebhook(c *gin.Context) {
+	w, ok := findWebhook(c)
+	if !ok {
+		return
+	}
+	event := webhookEvent{Event: "ping", Time: time.Now(), Host: hostFrom(hostContext(c)).Name, Message: "Test delivery from ContainerScope"}
+	respond(c, http.StatusOK, deliverWebhook(w, event, 1))
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/events"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// wsPingInterval keeps idle connections open through proxies and finds
+// clients that went away without closing
+const wsPingInterval = 30 * time.Second
+
+// corsOrigins are the origins, besides the agent's own, that browsers may
+// use the API from: CONTAINERSCOPE_CORS_ORIGINS, comma separated. CORS
+// admits any origin when it is unset, but WebSockets only the agent's own.
+var corsOrigins = splitList(os.Getenv("CONTAINERSCOPE_CORS_ORIGINS"))
+
+// wsUpgrader accepts upgrades that checkOrigin allows
+var wsUpgrader = websocket.Upgrader{CheckOrigin: checkOrigin}
+
+// checkOrigin accepts a WebSocket upgrade from the agent's own origin or
+// one of corsOrigins. CORS does not cover WebSockets, and browsers send
+// the session cookie with upgrades started by any page on the same site,
+// so anything else could open a socket as the signed-in user. Clients
+// other than browsers send no Origin and authenticate with a token; an
+// upgrade without Origin that carries the session cookie is refused.
+func checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		_, err := r.Cookie(sessionCookie)
+		return err != nil
+	}
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	for _, allowed := range corsOrigins {
+		if strings.EqualFold(origin, allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// containerUpdateTypes maps the container events the UI cares about to
+// the update types pushed to it
+var containerUpdateTypes = map[events.Action]string{
+	events.ActionCreate:  "created",
+	events.ActionStart:   "started",
+	events.ActionDie:     "died",
+	events.ActionDestroy: "removed",
+}
+
+// containerUpdate is one state change pushed over /ws/updates. Type
+// resync means changes may have been missed and the list should be
+// fetched again.
+type containerUpdate struct {
+	Type     string `json:"type"`
+	ID       string `json:"id,omitempty"`
+	FullID   string `json:"full_id,omitempty"`
+	Name     string `json:"name,omitempty"`
+	Image    string `json:"image,omitempty"`
+	Host     string `json:"host"`
+	Running  *bool  `json:"running,omitempty"`
+	Health   string `json:"health,omitempty"`
+	ExitCode string `json:"exit_code,omitempty"`
+	Time     int64  `json:"time,omitempty"`
+}
+
+// toContainerUpdate converts an event into an update, and false for
+// events the UI does not need
+func toContainerUpdate(host string, ev hostEvent) (containerUpdate, bool) {
+	if ev.Resync {
+		return containerUpdate{Type: "resync", Host: host}, true
+	}
+	if ev.Type != events.ContainerEventType {
+		return containerUpdate{}, false
+	}
+	update := containerUpdate{
+		ID:     ev.Actor.ID,
+		FullID: ev.Actor.ID,
+		Name:   ev.Actor.Attributes["name"],
+		Image:  ev.Actor.Attributes["image"],
+		Host:   host,
+		Time:   ev.Time,
+	}
+	if len(update.ID) > 10 {
+		update.ID = update.ID[:10]
+	}
+	// Health events carry the status in the action, as in
+	// "health_status: healthy"
+	if status, ok := strings.CutPrefix(string(ev.Action), string(events.ActionHealthStatus)+": "); ok {
+		update.Type = "health_status"
+		update.Health = status
+		return update, true
+	}
+	updateType, ok := containerUpdateTypes[ev.Action]
+	if !ok {
+		return containerUpdate{}, false
+	}
+	update.Type = updateType
+	switch ev.Action {
+	case events.ActionStart:
+		running := true
+		update.Running = &running
+	case events.ActionDie:
+		running := false
+		update.Running = &running
+		update.ExitCode = ev.Actor.Attributes["exitCode"]
+	}
+	return update, true
+}
+
+// containerUpdates pushes container state changes over a WebSocket as
+// JSON messages, so the UI can update single rows instead of fetching
+// the whole list
+func containerUpdates(c *gin.Context) {
+	ctx := hostContext(c)
+	bus := eventBusFor(ctx)
+	if bus == nil {
+		respondError(c, http.StatusNotImplemented, codeNotSupported, "Updates are not available for this host")
+		return
+	}
+	conn, err := wsUpgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		// The upgrader has already replied
+		c.Error(err)
+		return
+	}
+	defer conn.Close()
+
+	evs, unsubscribe := bus.subscribe()
+	defer unsubscribe()
+
+	// Reading is only needed to notice the client closing
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	host := hostFrom(ctx).Name
+	ping := time.NewTicker(wsPingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case ev := <-evs:
+			update, ok := toContainerUpdate(host, ev)
+			if !ok {
+				continue
+			}
+			if err := conn.WriteJSON(update); err != nil {
+				return
+			}
+		case <-ping.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(10*time.Second)); err != nil {
+				return
+			}
+		case <-closed:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
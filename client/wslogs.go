@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// hostLogMessage is one message of /ws/logs. Type line carries a line of
+// output; attach and detach say a container's log is now followed or has
+// ended, and error reports a host that could not be reached.
+type hostLogMessage struct {
+	Type      string `json:"type"`
+	Host      string `json:"host"`
+	Container string `json:"container,omitempty"`
+	ID        string `json:"id,omitempty"`
+	Time      string `json:"time,omitempty"`
+	Line      string `json:"line,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// logOrigin is the host and container a merged log source reads
+type logOrigin struct {
+	host    *dockerHost
+	id      string
+	name    string
+	running bool
+}
+
+// hostLogTail follows the logs of the containers matching a selection on
+// several hosts, attaching to matching containers as they start
+type hostLogTail struct {
+	ctx     context.Context
+	args    filters.Args
+	options container.LogsOptions
+	out     chan hostLogMessage
+
+	mu       sync.Mutex
+	followed map[string]bool
+}
+
+// send queues a message for the client, giving up once the tail ends
+func (t *hostLogTail) send(msg hostLogMessage) bool {
+	select {
+	case t.out <- msg:
+		return true
+	case <-t.ctx.Done():
+		return false
+	}
+}
+
+// lineMessage turns a log entry from an origin into a line message
+func lineMessage(origin logOrigin, entry logEntry) hostLogMessage {
+	msg := hostLogMessage{Type: "line", Host: origin.host.Name, Container: origin.name, ID: origin.id[:10], Line: entry.line}
+	if !entry.time.IsZero() {
+		msg.Time = entry.time.Format(time.RFC3339Nano)
+	}
+	return msg
+}
+
+// follow streams a container's log from options until it ends, usually
+// because the container stopped, and then forgets it so a restart can
+// attach again. It returns false if the container's log is still being
+// followed.
+func (t *hostLogTail) follow(origin logOrigin, options container.LogsOptions) bool {
+	key := origin.host.Name + "/" + origin.id
+	t.mu.Lock()
+	if t.followed[key] {
+		t.mu.Unlock()
+		return false
+	}
+	t.followed[key] = true
+	t.mu.Unlock()
+	forget := func() {
+		t.mu.Lock()
+		delete(t.followed, key)
+		t.mu.Unlock()
+	}
+
+	go func() {
+		ctx := withHost(t.ctx, origin.host)
+		out, err := openLogs(ctx, origin.id, options)
+		if err != nil {
+			forget()
+			t.send(hostLogMessage{Type: "error", Host: origin.host.Name, Container: origin.name, ID: origin.id[:10], Error: err.Error()})
+			return
+		}
+		defer out.Close()
+		if !t.send(hostLogMessage{Type: "attach", Host: origin.host.Name, Container: origin.name, ID: origin.id[:10]}) {
+			return
+		}
+		scanner := bufio.NewScanner(out)
+		scanner.Buffer(make([]byte, 64*1024), maxLogLine)
+		for scanner.Scan() {
+			if !t.send(lineMessage(origin, parseLogEntry(origin.name, scanner.Text()))) {
+				return
+			}
+		}
+		forget()
+		t.send(hostLogMessage{Type: "detach", Host: origin.host.Name, Container: origin.name, ID: origin.id[:10]})
+	}()
+	return true
+}
+
+// watch attaches to containers on a host that start after the tail began
+// and match its selection
+func (t *hostLogTail) watch(host *dockerHost) {
+	bus := eventBuses[host.Name]
+	if bus == nil {
+		return
+	}
+	evs, unsubscribe := bus.subscribe()
+	go func() {
+		defer unsubscribe()
+		ctx := withHost(t.ctx, host)
+		for {
+			var ev hostEvent
+			select {
+			case ev = <-evs:
+			case <-t.ctx.Done():
+				return
+			}
+			if ev.Resync || ev.Type != events.ContainerEventType || ev.Action != events.ActionStart {
+				continue
+			}
+			args := t.args.Clone()
+			args.Add("id", ev.Actor.ID)
+			list, err := docker(ctx).ContainerList(ctx, container.ListOptions{All: true, Filters: args})
+			if err != nil || len(list) == 0 {
+				continue
+			}
+			live := t.options
+			live.Since, live.Tail = fmt.Sprintf("%d", ev.Time), "all"
+			origin := logOrigin{host: host, id: ev.Actor.ID, name: ev.Actor.Attributes["name"], running: true}
+			// On a restart the previous run's log may not have ended yet
+			for attempt := 0; !t.follow(origin, live) && attempt < 10; attempt++ {
+				time.Sleep(100 * time.Millisecond)
+			}
+		}
+	}()
+}
+
+// followHostLogs tails the logs of the containers matching the list
+// filters or a compose project on every host the node_label parameters
+// select, over one WebSocket. Each JSON message names the host and
+// container a line came from. The recent history of every container is
+// merged by time first, then new lines are sent as they are written, and
+// containers that start later and match are picked up, so a service can
+// be tailed across hosts and restarts.
+func followHostLogs(c *gin.Context) {
+	hosts, err := selectedHosts(c)
+	if err != nil {
+		badRequest(c, err.Error())
+		return
+	}
+	args, err := containerFilters(c)
+	if err != nil {
+		badRequest(c, err.Error())
+		return
+	}
+	if project := c.Query("project"); project != "" {
+		args.Add("label", composeProjectLabel+"="+project)
+	}
+	if args.Len() == 0 {
+		badRequest(c, "Select containers with label, project, name, image or status")
+		return
+	}
+	q, err := parseLogQuery(c)
+	if err != nil {
+		badRequest(c, err.Error())
+		return
+	}
+	options := q.options
+	if c.Query("lines") == "" && options.Since == "" {
+		options.Tail = aggregateDefaultLines
+	}
+	options.Timestamps, options.Follow = true, false
+
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	defer cancel()
+	var mu sync.Mutex
+	origins := map[string]logOrigin{}
+	errs := forEachHost(ctx, hosts, func(ctx context.Context, host *dockerHost) error {
+		list, err := docker(ctx).ContainerList(ctx, container.ListOptions{All: true, Filters: args})
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		for _, cont := range list {
+			name := cont.ID[:10]
+			if len(cont.Names) > 0 {
+				name = strings.TrimPrefix(cont.Names[0], "/")
+			}
+			origins[host.Name+"/"+name] = logOrigin{host: host, id: cont.ID, name: name, running: cont.State == "running"}
+		}
+		return nil
+	})
+	if len(origins) == 0 && len(errs) == len(hosts) && len(hosts) > 0 {
+		respondError(c, http.StatusServiceUnavailable, codeDockerUnavailable, "No selected host could be reached")
+		return
+	}
+
+	conn, err := wsUpgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		// The upgrader has already replied
+		c.Error(err)
+		return
+	}
+	defer conn.Close()
+
+	// Reading is only needed to notice the client closing
+	go func() {
+		defer cancel()
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	write := func(msg hostLogMessage) error {
+		if msg.Type == "line" {
+			if q.grep != nil && !q.grep.MatchString(stripANSI(msg.Line)) {
+				return nil
+			}
+			msg.Line = q.render(msg.Line)
+		}
+		return conn.WriteJSON(msg)
+	}
+	for name, err := range errs {
+		if write(hostLogMessage{Type: "error", Host: name, Error: err}) != nil {
+			return
+		}
+	}
+
+	// History is merged by time across hosts up to now; following then
+	// picks up from the same instant so no line appears twice
+	start := time.Now()
+	now := fmt.Sprintf("%d.%09d", start.Unix(), start.Nanosecond())
+	history := options
+	history.Until = now
+	var sources []*logSource
+	for key, origin := range origins {
+		sources = append(sources, openLogSources(withHost(ctx, origin.host), map[string]string{origin.id: key}, history)...)
+	}
+	err = mergeLogs(sources, func(entry logEntry) error {
+		return write(lineMessage(origins[entry.name], entry))
+	})
+	closeLogSources(sources)
+	if err != nil {
+		return
+	}
+
+	tail := &hostLogTail{ctx: ctx, args: args, options: options, out: make(chan hostLogMessage, 256), followed: map[string]bool{}}
+	tail.options.Follow = true
+	for _, host := range hosts {
+		tail.watch(host)
+	}
+	live := tail.options
+	live.Since, live.Tail = now, "all"
+	for _, origin := range origins {
+		if origin.running {
+			tail.follow(origin, live)
+		}
+	}
+
+	ping := time.NewTicker(wsPingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case msg := <-tail.out:
+			if err := write(msg); err != nil {
+				return
+			}
+		case <-ping.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(10*time.Second)); err != nil {
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Anmol012/containerscope/pkg/client"
+	"github.com/spf13/cobra"
+)
+
+func psCommand() *cobra.Command {
+	opts := client.ListContainersOptions{Sort: "name"}
+	cmd := &cobra.Command{
+		Use:   "ps",
+		Short: "List containers",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			containers, err := agent().ListContainers(cmd.Context(), &opts)
+			if err != nil {
+				return err
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "ID\tNAME\tIMAGE\tSTATE\tHEALTH\tPORTS")
+			for _, c := range containers {
+				state := "stopped"
+				if c.Running {
+					state = "running"
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", c.ID, c.Name, c.Image, state, c.Health, strings.Join(c.Ports, ", "))
+			}
+			return w.Flush()
+		},
+	}
+	cmd.Flags().BoolVarP(&opts.All, "all", "a", false, "include stopped containers")
+	cmd.Flags().StringArrayVarP(&opts.Label, "label", "l", nil, "filter by label key or key=value")
+	return cmd
+}
+
+func logsCommand() *cobra.Command {
+	var lines int
+	var follow bool
+	cmd := &cobra.Command{
+		Use:   "logs CONTAINER",
+		Short: "Print a container's logs",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if !follow {
+				logs, err := agent().Logs(cmd.Context(), args[0], lines)
+				for _, line := range logs {
+					fmt.Println(line)
+				}
+				return err
+			}
+
+			ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt)
+			defer stop()
+			err := agent().StreamLogs(ctx, args[0], lines, func(line string) error {
+				_, err := fmt.Println(line)
+				return err
+			})
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		},
+	}
+	cmd.Flags().IntVarP(&lines, "tail", "n", 100, "number of lines to show")
+	cmd.Flags().BoolVarP(&follow, "follow", "f", false, "keep printing new output")
+	return cmd
+}
+
+func actionCommand(action string) *cobra.Command {
+	var timeout int
+	cmd := &cobra.Command{
+		Use:   action + " CONTAINER...",
+		Short: strings.ToUpper(action[:1]) + action[1:] + " one or more containers",
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			opts := &client.ActionOptions{}
+			if cmd.Flags().Changed("time") {
+				opts.TimeoutSeconds = &timeout
+			}
+
+			var result *client.BulkResult
+			var err error
+			switch action {
+			case "start":
+				result, err = agent().StartContainers(cmd.Context(), args...)
+			case "stop":
+				result, err = agent().StopContainers(cmd.Context(), opts, args...)
+			case "restart":
+				result, err = agent().RestartContainers(cmd.Context(), opts, args...)
+			}
+			if err != nil {
+				return err
+			}
+
+			for _, r := range result.Results {
+				if r.Success {
+					fmt.Println(r.ContainerID)
+				} else {
+					fmt.Fprintf(os.Stderr, "%s: %s\n", r.ContainerID, r.Error)
+				}
+			}
+			if result.Failed > 0 {
+				return fmt.Errorf("%d of %d containers failed to %s", result.Failed, len(result.Results), action)
+			}
+			return nil
+		},
+	}
+	if action != "start" {
+		cmd.Flags().IntVarP(&timeout, "time", "t", 0, "seconds to wait before killing the container")
+	}
+	return cmd
+}
+
+func statsCommand() *cobra.Command {
+	var interval time.Duration
+	cmd := &cobra.Command{
+		Use:   "stats CONTAINER...",
+		Short: "Show CPU and memory usage",
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			api := agent()
+			first := map[string]*client.Stats{}
+			for _, id := range args {
+				stats, err := api.Stats(ctx, id)
+				if err != nil {
+					return fmt.Errorf("%s: %w", id, err)
+				}
+				first[id] = stats
+			}
+			// CPU usage is a rate, so it needs a second sample
+			time.Sleep(interval)
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "CONTAINER\tCPU %\tMEM USAGE / LIMIT\tMEM %")
+			for _, id := range args {
+				stats, err := api.Stats(ctx, id)
+				if err != nil {
+					return fmt.Errorf("%s: %w", id, err)
+				}
+				mem := stats.MemoryUsed()
+				memPercent := 0.0
+				if stats.MemoryStats.Limit > 0 {
+					memPercent = float64(mem) / float64(stats.MemoryStats.Limit) * 100
+				}
+				fmt.Fprintf(w, "%s\t%.2f%%\t%s / %s\t%.2f%%\n", id, stats.CPUPercent(first[id]), formatBytes(mem), formatBytes(stats.MemoryStats.Limit), memPercent)
+			}
+			return w.Flush()
+		},
+	}
+	cmd.Flags().DurationVar(&interval, "interval", time.Second, "time between the two samples used for CPU usage")
+	return cmd
+}
+
+func formatBytes(n uint64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	value := float64(n)
+	i := 0
+	for value >= 1024 && i < len(units)-1 {
+		value /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f%s", value, units[i])
+}
+
+func hostsCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "hosts",
+		Short: "List the Docker hosts the agent manages",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			hosts, err := agent().ListHosts(cmd.Context())
+			if err != nil {
+				return err
+			}
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "NAME\tENDPOINT\tDEFAULT\tREACHABLE")
+			for _, h := range hosts {
+				fmt.Fprintf(w, "%s\t%s\t%t\t%t\n", h.Name, h.Endpoint, h.Default, h.Reachable)
+			}
+			return w.Flush()
+		},
+	}
+}
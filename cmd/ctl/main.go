@@ -0,0 +1,53 @@
+// Command csctl is a command line client for the ContainerScope agent API.
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/Anmol012/containerscope/pkg/client"
+	"github.com/spf13/cobra"
+)
+
+// Connection settings shared by every command
+var (
+	serverURL string
+	token     string
+	node      string
+)
+
+// agent returns an API client for the selected agent and node
+func agent() *client.Client {
+	return client.New(serverURL, client.WithToken(token), client.WithHost(node))
+}
+
+func main() {
+	root := &cobra.Command{
+		Use:           "csctl",
+		Short:         "Manage containers through a ContainerScope agent",
+		SilenceUsage:  true,
+		SilenceErrors: true,
+	}
+	root.PersistentFlags().StringVar(&serverURL, "server", envOr("CONTAINERSCOPE_URL", "http://localhost:5050"), "agent URL (CONTAINERSCOPE_URL)")
+	root.PersistentFlags().StringVar(&token, "token", os.Getenv("CONTAINERSCOPE_TOKEN"), "API token sent as a bearer token (CONTAINERSCOPE_TOKEN)")
+	root.PersistentFlags().StringVar(&node, "node", os.Getenv("CONTAINERSCOPE_NODE"), "Docker host to target, as configured on the agent (CONTAINERSCOPE_NODE)")
+
+	root.AddCommand(psCommand(), logsCommand(), statsCommand(), hostsCommand())
+	for _, action := range []string{"start", "stop", "restart"} {
+		root.AddCommand(actionCommand(action))
+	}
+
+	if err := root.ExecuteContext(context.Background()); err != nil {
+		fmt.Fprintln(os.Stderr, "csctl:", err)
+		os.Exit(1)
+	}
+}
+
+// envOr returns the environment variable name, or def when it is unset
+func envOr(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
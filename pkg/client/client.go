@@ -0,0 +1,177 @@
+// Package client is a Go client for the ContainerScope agent API.
+//
+// A Client wraps the /api/v1 endpoints with typed methods and response
+// structs:
+//
+//	c := client.New("http://agent-host:5050", client.WithToken(token))
+//	containers, err := c.ListContainers(ctx, &client.ListContainersOptions{All: true})
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Client talks to one ContainerScope agent. It is safe for concurrent use.
+type Client struct {
+	baseURL    string
+	token      string
+	host       string
+	httpClient *http.Client
+}
+
+// Option configures a Client
+type Option func(*Client)
+
+// WithToken sends token as a bearer token on every request
+func WithToken(token string) Option {
+	return func(c *Client) { c.token = token }
+}
+
+// WithHost targets one of the Docker hosts configured on the agent instead
+// of its default host
+func WithHost(host string) Option {
+	return func(c *Client) { c.host = host }
+}
+
+// WithHTTPClient replaces the default HTTP client, which times out after a
+// minute
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) { c.httpClient = httpClient }
+}
+
+// New returns a client for the agent at baseURL, e.g. http://localhost:5050
+func New(baseURL string, opts ...Option) *Client {
+	c := &Client{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		httpClient: &http.Client{Timeout: time.Minute},
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Host returns a copy of the client that targets another configured host
+func (c *Client) Host(host string) *Client {
+	copy := *c
+	copy.host = host
+	return &copy
+}
+
+// Error is an error reported by the agent
+type Error struct {
+	StatusCode int    `json:"-"`
+	Code       string `json:"code"`
+	Message    string `json:"message"`
+	RequestID  string `json:"request_id"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s (request %s)", e.Code, e.Message, e.RequestID)
+}
+
+// IsNotFound reports whether err is a 404 from the agent
+func IsNotFound(err error) bool {
+	apiErr, ok := err.(*Error)
+	return ok && apiErr.StatusCode == http.StatusNotFound
+}
+
+// newRequest builds a request for an /api/v1 path
+func (c *Client) newRequest(ctx context.Context, method, path string, query url.Values, body interface{}) (*http.Request, error) {
+	u, err := url.Parse(c.baseURL + "/api/v1" + path)
+	if err != nil {
+		return nil, err
+	}
+	if query == nil {
+		query = url.Values{}
+	}
+	if c.host != "" {
+		query.Set("host", c.host)
+	}
+	u.RawQuery = query.Encode()
+
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	return req, nil
+}
+
+// do sends a request and decodes the envelope's data into out, which may
+// be nil
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, body, out interface{}) error {
+	req, err := c.newRequest(ctx, method, path, query, body)
+	if err != nil {
+		return err
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var envelope struct {
+		Data  json.RawMessage `json:"data"`
+		Error *Error          `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&envelope); err != nil {
+		return fmt.Errorf("%s %s: unexpected response (HTTP %d): %w", method, path, resp.StatusCode, err)
+	}
+	if envelope.Error != nil {
+		envelope.Error.StatusCode = resp.StatusCode
+		return envelope.Error
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(envelope.Data, out)
+}
+
+// stream sends a request whose response is read as it arrives, without
+// the HTTP client's overall timeout, and returns it when it succeeded
+func (c *Client) stream(ctx context.Context, method, path string, query url.Values) (*http.Response, error) {
+	req, err := c.newRequest(ctx, method, path, query, nil)
+	if err != nil {
+		return nil, err
+	}
+	httpClient := *c.httpClient
+	httpClient.Timeout = 0
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusOK {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	var envelope struct {
+		Error *Error `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&envelope); err != nil || envelope.Error == nil {
+		return nil, fmt.Errorf("%s %s: unexpected response (HTTP %d)", method, path, resp.StatusCode)
+	}
+	envelope.Error.StatusCode = resp.StatusCode
+	return nil, envelope.Error
+}
@@ -0,0 +1,328 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Container is a row of the container list. The fields after Host are
+// only set when ListContainersOptions.Detail is true.
+type Container struct {
+	ID      string   `json:"id"`
+	Name    string   `json:"name"`
+	Image   string   `json:"image"`
+	Running bool     `json:"running"`
+	Health  string   `json:"health"`
+	Ports   []string `json:"ports"`
+	Project string   `json:"project"`
+	Service string   `json:"service"`
+	Node    string   `json:"node"`
+	Host    string   `json:"host"`
+
+	FullID       string            `json:"full_id,omitempty"`
+	Created      string            `json:"created,omitempty"`
+	StartedAt    string            `json:"started_at,omitempty"`
+	Uptime       string            `json:"uptime,omitempty"`
+	State        string            `json:"state,omitempty"`
+	Status       string            `json:"status,omitempty"`
+	RestartCount int               `json:"restart_count,omitempty"`
+	ExitCode     int               `json:"exit_code,omitempty"`
+	Labels       map[string]string `json:"labels,omitempty"`
+	Mounts       []Mount           `json:"mounts,omitempty"`
+	Networks     map[string]string `json:"networks,omitempty"`
+	Command      string            `json:"command,omitempty"`
+}
+
+// Mount is a volume or bind mount of a container
+type Mount struct {
+	Type        string `json:"type"`
+	Name        string `json:"name"`
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+	RW          bool   `json:"rw"`
+}
+
+// ListContainersOptions filters and orders the container list
+type ListContainersOptions struct {
+	// All includes stopped containers
+	All bool
+	// Status, Name, Image and Label filter as in docker ps
+	Status []string
+	Name   []string
+	Image  []string
+	Label  []string
+	// Detail adds the fields that need an inspect per container
+	Detail bool
+	// Sort is name, created or size; Desc reverses it
+	Sort string
+	Desc bool
+	// Page and PerPage paginate when PerPage is set
+	Page    int
+	PerPage int
+}
+
+func (opts *ListContainersOptions) query() url.Values {
+	query := url.Values{}
+	if opts == nil {
+		query.Set("status", "running")
+		return query
+	}
+	query["status"] = opts.Status
+	if !opts.All && len(opts.Status) == 0 {
+		query.Set("status", "running")
+	}
+	query["name"] = opts.Name
+	query["image"] = opts.Image
+	query["label"] = opts.Label
+	if opts.Detail {
+		query.Set("detail", "true")
+	}
+	if opts.Sort != "" {
+		query.Set("sort", opts.Sort)
+	}
+	if opts.Desc {
+		query.Set("order", "desc")
+	}
+	if opts.PerPage > 0 {
+		query.Set("page", strconv.Itoa(max(opts.Page, 1)))
+		query.Set("per_page", strconv.Itoa(opts.PerPage))
+	}
+	return query
+}
+
+// ListContainers lists containers; nil options lists running containers
+func (c *Client) ListContainers(ctx context.Context, opts *ListContainersOptions) ([]Container, error) {
+	var containers []Container
+	err := c.do(ctx, "GET", "/containers", opts.query(), nil, &containers)
+	return containers, err
+}
+
+// InspectContainer returns Docker's inspect output for a container
+func (c *Client) InspectContainer(ctx context.Context, id string) (json.RawMessage, error) {
+	var inspection json.RawMessage
+	err := c.do(ctx, "GET", "/containers/"+url.PathEscape(id)+"/inspect", nil, nil, &inspection)
+	return inspection, err
+}
+
+// InspectResult is one container's inspect output from InspectContainers,
+// or why it could not be inspected
+type InspectResult struct {
+	ContainerID string          `json:"container_id"`
+	Inspect     json.RawMessage `json:"inspect,omitempty"`
+	Error       string          `json:"error,omitempty"`
+	Code        string          `json:"code,omitempty"`
+}
+
+// InspectContainers inspects several containers in one request, returning
+// the results in the order of ids
+func (c *Client) InspectContainers(ctx context.Context, ids ...string) ([]InspectResult, error) {
+	body := struct {
+		ContainerIDs []string `json:"container_ids"`
+	}{ids}
+	var result struct {
+		Results []InspectResult `json:"results"`
+	}
+	err := c.do(ctx, "POST", "/containers/inspect", nil, body, &result)
+	return result.Results, err
+}
+
+// logLinePrefix is the line number the agent puts before each log line
+var logLinePrefix = regexp.MustCompile(`^\d+: `)
+
+// Logs returns the last lines of a container's output, one entry per line
+func (c *Client) Logs(ctx context.Context, id string, lines int) ([]string, error) {
+	var text string
+	query := url.Values{"lines": {strconv.Itoa(lines)}}
+	if err := c.do(ctx, "GET", "/containers/"+url.PathEscape(id)+"/logs", query, nil, &text); err != nil {
+		return nil, err
+	}
+	out := []string{}
+	for _, line := range strings.Split(text, "\n") {
+		if line != "" {
+			out = append(out, logLinePrefix.ReplaceAllString(line, ""))
+		}
+	}
+	return out, nil
+}
+
+// StreamLogs calls fn with the last lines of a container's output and then
+// with each new line as it is written, until ctx is cancelled, the
+// container stops or fn returns an error
+func (c *Client) StreamLogs(ctx context.Context, id string, lines int, fn func(line string) error) error {
+	query := url.Values{"lines": {strconv.Itoa(lines)}, "follow": {"true"}}
+	resp, err := c.stream(ctx, "GET", "/containers/"+url.PathEscape(id)+"/logs/download", query)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	for scanner.Scan() {
+		// Lines are separated by blank lines
+		if line := scanner.Text(); line != "" {
+			if err := fn(logLinePrefix.ReplaceAllString(line, "")); err != nil {
+				return err
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+// Stats is the part of Docker's stats payload most callers need
+type Stats struct {
+	Read     time.Time `json:"read"`
+	CPUStats struct {
+		CPUUsage struct {
+			TotalUsage uint64 `json:"total_usage"`
+		} `json:"cpu_usage"`
+		SystemUsage uint64 `json:"system_cpu_usage"`
+		OnlineCPUs  uint32 `json:"online_cpus"`
+	} `json:"cpu_stats"`
+	MemoryStats struct {
+		Usage uint64            `json:"usage"`
+		Limit uint64            `json:"limit"`
+		Stats map[string]uint64 `json:"stats"`
+	} `json:"memory_stats"`
+	Networks map[string]struct {
+		RxBytes uint64 `json:"rx_bytes"`
+		TxBytes uint64 `json:"tx_bytes"`
+	} `json:"networks"`
+}
+
+// MemoryUsed is memory usage minus the page cache, as docker stats shows it
+func (s *Stats) MemoryUsed() uint64 {
+	return s.MemoryStats.Usage - min(s.MemoryStats.Stats["inactive_file"], s.MemoryStats.Usage)
+}
+
+// CPUPercent computes CPU usage between an earlier sample and this one,
+// where 100 is one fully used CPU
+func (s *Stats) CPUPercent(prev *Stats) float64 {
+	cpuDelta := float64(s.CPUStats.CPUUsage.TotalUsage) - float64(prev.CPUStats.CPUUsage.TotalUsage)
+	systemDelta := float64(s.CPUStats.SystemUsage) - float64(prev.CPUStats.SystemUsage)
+	if systemDelta <= 0 || cpuDelta <= 0 {
+		return 0
+	}
+	return cpuDelta / systemDelta * float64(max(s.CPUStats.OnlineCPUs, 1)) * 100
+}
+
+// Stats samples a container's resource usage once
+func (c *Client) Stats(ctx context.Context, id string) (*Stats, error) {
+	var stats Stats
+	err := c.do(ctx, "GET", "/containers/"+url.PathEscape(id)+"/stats", nil, nil, &stats)
+	return &stats, err
+}
+
+// ActionOptions tunes stop, restart and delete
+type ActionOptions struct {
+	// TimeoutSeconds is how long to wait before killing; nil uses the
+	// container's stop timeout
+	TimeoutSeconds *int `json:"timeout_seconds,omitempty"`
+	// Force and RemoveVolumes apply to DeleteContainers
+	Force         *bool `json:"force,omitempty"`
+	RemoveVolumes bool  `json:"remove_volumes,omitempty"`
+	// Quarantine makes DeleteContainers keep the containers, stopped and
+	// renamed, until the agent's retention runs out; nil uses its default
+	Quarantine *bool `json:"quarantine,omitempty"`
+	// ConfirmationToken is the token from PreviewDelete, which the agent
+	// requires for DeleteContainers unless confirmation is turned off
+	ConfirmationToken string `json:"confirmation_token,omitempty"`
+}
+
+// ActionResult is the outcome of an action on one container
+type ActionResult struct {
+	ContainerID string `json:"container_id"`
+	Success     bool   `json:"success"`
+	Warning     string `json:"warning,omitempty"`
+	Error       string `json:"error,omitempty"`
+	Code        string `json:"code,omitempty"`
+}
+
+// BulkResult reports a bulk action
+type BulkResult struct {
+	Results   []ActionResult `json:"results"`
+	Succeeded int            `json:"succeeded"`
+	Failed    int            `json:"failed"`
+}
+
+func (c *Client) containerAction(ctx context.Context, method, action string, ids []string, opts *ActionOptions) (*BulkResult, error) {
+	body := struct {
+		ContainerIDs []string `json:"container_ids"`
+		ActionOptions
+	}{ContainerIDs: ids}
+	if opts != nil {
+		body.ActionOptions = *opts
+	}
+	var result BulkResult
+	err := c.do(ctx, method, "/containers/"+action, nil, body, &result)
+	return &result, err
+}
+
+// StartContainers starts containers, reporting the outcome for each
+func (c *Client) StartContainers(ctx context.Context, ids ...string) (*BulkResult, error) {
+	return c.containerAction(ctx, "POST", "start", ids, nil)
+}
+
+// StopContainers stops containers; opts may be nil
+func (c *Client) StopContainers(ctx context.Context, opts *ActionOptions, ids ...string) (*BulkResult, error) {
+	return c.containerAction(ctx, "POST", "stop", ids, opts)
+}
+
+// RestartContainers restarts containers; opts may be nil
+func (c *Client) RestartContainers(ctx context.Context, opts *ActionOptions, ids ...string) (*BulkResult, error) {
+	return c.containerAction(ctx, "POST", "restart", ids, opts)
+}
+
+// DeleteContainers removes containers; running ones are killed unless
+// opts.Force is false
+func (c *Client) DeleteContainers(ctx context.Context, opts *ActionOptions, ids ...string) (*BulkResult, error) {
+	return c.containerAction(ctx, "DELETE", "delete", ids, opts)
+}
+
+// DeletePreview lists what a delete would destroy, with the token that
+// allows it
+type DeletePreview struct {
+	Token          string    `json:"token"`
+	ExpiresAt      time.Time `json:"expires_at"`
+	VolumesRemoved int       `json:"volumes_removed"`
+	Containers     []struct {
+		ID      string `json:"id"`
+		FullID  string `json:"full_id"`
+		Name    string `json:"name"`
+		Image   string `json:"image"`
+		State   string `json:"state"`
+		Running bool   `json:"running"`
+		Volumes []struct {
+			Mount
+			// Removed is true for anonymous volumes deleted with the
+			// container
+			Removed bool `json:"removed"`
+		} `json:"volumes"`
+	} `json:"containers"`
+}
+
+// PreviewDelete shows what DeleteContainers with the same opts and ids
+// would remove; pass its Token in opts.ConfirmationToken to go ahead
+func (c *Client) PreviewDelete(ctx context.Context, opts *ActionOptions, ids ...string) (*DeletePreview, error) {
+	query := url.Values{"container_ids": {strings.Join(ids, ",")}}
+	if opts != nil {
+		if opts.Force != nil {
+			query.Set("force", strconv.FormatBool(*opts.Force))
+		}
+		if opts.RemoveVolumes {
+			query.Set("remove_volumes", "true")
+		}
+		if opts.Quarantine != nil {
+			query.Set("quarantine", strconv.FormatBool(*opts.Quarantine))
+		}
+	}
+	var preview DeletePreview
+	err := c.do(ctx, "GET", "/containers/delete/preview", query, nil, &preview)
+	return &preview, err
+}
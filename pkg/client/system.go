@@ -0,0 +1,80 @@
+package client
+
+import "context"
+
+// Image is a row of the image list
+type Image struct {
+	ID         string   `json:"id"`
+	Name       string   `json:"name"`
+	Repository string   `json:"repository"`
+	Tag        string   `json:"tag"`
+	Created    string   `json:"created"`
+	Size       string   `json:"size"`
+	InUse      bool     `json:"in_use"`
+	Containers []string `json:"containers"`
+	Node       string   `json:"node"`
+}
+
+// ListImages lists tagged images
+func (c *Client) ListImages(ctx context.Context) ([]Image, error) {
+	var images []Image
+	err := c.do(ctx, "GET", "/images", nil, nil, &images)
+	return images, err
+}
+
+// Host is a Docker daemon configured on the agent
+type Host struct {
+	Name       string            `json:"name"`
+	Endpoint   string            `json:"endpoint"`
+	TLS        bool              `json:"tls"`
+	Labels     map[string]string `json:"labels"`
+	Default    bool              `json:"default"`
+	Reachable  bool              `json:"reachable"`
+	APIVersion string            `json:"api_version"`
+	Error      string            `json:"error"`
+}
+
+// ListHosts lists the Docker hosts the agent manages and whether each
+// responds
+func (c *Client) ListHosts(ctx context.Context) ([]Host, error) {
+	var hosts []Host
+	err := c.do(ctx, "GET", "/hosts", nil, nil, &hosts)
+	return hosts, err
+}
+
+// NodeStats is the host's CPU, memory, filesystem and uptime figures
+type NodeStats struct {
+	Node          string  `json:"node"`
+	UptimeSeconds float64 `json:"uptime_seconds"`
+	CPU           struct {
+		Cores   int        `json:"cores"`
+		Load    [3]float64 `json:"load"`
+		Percent float64    `json:"percent"`
+	} `json:"cpu"`
+	Memory struct {
+		Total     uint64 `json:"total"`
+		Available uint64 `json:"available"`
+		Used      uint64 `json:"used"`
+		SwapTotal uint64 `json:"swap_total"`
+		SwapFree  uint64 `json:"swap_free"`
+	} `json:"memory"`
+	Filesystems []Filesystem `json:"filesystems"`
+}
+
+// Filesystem is one mounted filesystem on the host
+type Filesystem struct {
+	Device      string  `json:"device"`
+	MountPoint  string  `json:"mount_point"`
+	Type        string  `json:"type"`
+	Total       uint64  `json:"total"`
+	Used        uint64  `json:"used"`
+	Free        uint64  `json:"free"`
+	UsedPercent float64 `json:"used_percent"`
+}
+
+// NodeStats returns the agent host's resource usage
+func (c *Client) NodeStats(ctx context.Context) (*NodeStats, error) {
+	var stats NodeStats
+	err := c.do(ctx, "GET", "/node/stats", nil, nil, &stats)
+	return &stats, err
+}